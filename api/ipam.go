@@ -1,8 +1,10 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/url"
 )
 
 func (client *Client) ipamOp(ID string, op string) (*net.IPNet, error) {
@@ -18,6 +20,42 @@ func (client *Client) AllocateIP(ID string) (*net.IPNet, error) {
 	return client.ipamOp(ID, "POST")
 }
 
+// returns an IP for the ID given in the named pool, allocating a
+// fresh one if necessary.  If subnet is not nil, it says which of
+// the pool's subnets to allocate in.
+func (client *Client) AllocateIPInPool(ID string, pool string, subnet *net.IPNet) (*net.IPNet, error) {
+	path := fmt.Sprintf("/ip/%s", ID)
+	if subnet != nil {
+		path = fmt.Sprintf("/ip/%s/%s", ID, subnet)
+	}
+	ip, err := client.httpVerb("POST", path+"?pool="+url.QueryEscape(pool), nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseIP(ip)
+}
+
+// returns the subnets of the named pool
+func (client *Client) PoolSubnets(pool string) ([]*net.IPNet, error) {
+	body, err := client.httpVerb("GET", fmt.Sprintf("/pools/%s", url.QueryEscape(pool)), nil)
+	if err != nil {
+		return nil, err
+	}
+	var info struct{ Subnets []string }
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		return nil, err
+	}
+	var subnets []*net.IPNet
+	for _, s := range info.Subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
 // returns an IP for the ID given, or nil if one has not been
 // allocated
 func (client *Client) LookupIP(ID string) (*net.IPNet, error) {
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 
@@ -17,8 +19,29 @@ type ContainerObserver interface {
 	ContainerDestroyed(ident string)
 }
 
+// Bounds on how long to wait between attempts to reconnect to Docker,
+// or to list its containers after reconnecting
+var (
+	initialReconnectDelay = time.Second
+	maxReconnectDelay     = time.Minute
+)
+
+// The parts of the Docker API we watch containers through
+type eventSource interface {
+	Ping() error
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+}
+
 type Client struct {
 	*docker.Client
+	sync.Mutex
+	source     eventSource
+	observers  []ContainerObserver
+	onResync   []func()
+	containers map[string]bool // ID -> running, as of the last event we saw
+	watching   bool
+	status     Status
 }
 
 // NewClient creates a new Docker client and checks we can talk to Docker
@@ -30,7 +53,7 @@ func NewClient(apiPath string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	client := &Client{dc}
+	client := &Client{Client: dc, source: dc}
 
 	return client, client.checkWorking()
 }
@@ -43,7 +66,7 @@ func NewVersionedClient(apiPath string, apiVersionString string) (*Client, error
 	if err != nil {
 		return nil, err
 	}
-	client := &Client{dc}
+	client := &Client{Client: dc, source: dc}
 
 	return client, client.checkWorking()
 }
@@ -53,13 +76,16 @@ func NewVersionedClientFromEnv(apiVersionString string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	client := &Client{dc}
+	client := &Client{Client: dc, source: dc}
 
 	return client, client.checkWorking()
 }
 
 func (c *Client) checkWorking() error {
 	_, err := c.Version()
+	if err == nil {
+		c.status.Connected, c.status.Since = true, time.Now()
+	}
 	return err
 }
 
@@ -71,27 +97,192 @@ func (c *Client) Info() string {
 	return fmt.Sprintf("Docker API on %s: %v", c.Endpoint(), env)
 }
 
-// AddObserver adds an observer for docker events
+// AddObserver adds an observer for docker events.  If the connection
+// to Docker is lost we keep trying to get it back, and when we do
+// we tell the observers about whatever they missed.
 func (c *Client) AddObserver(ob ContainerObserver) error {
-	events := make(chan *docker.APIEvents)
-	if err := c.AddEventListener(events); err != nil {
-		Log.Errorf("[docker] Unable to add listener to Docker API: %s", err)
-		return err
+	c.Lock()
+	defer c.Unlock()
+	if !c.watching {
+		events := make(chan *docker.APIEvents)
+		if err := c.source.AddEventListener(events); err != nil {
+			Log.Errorf("[docker] Unable to add listener to Docker API: %s", err)
+			return err
+		}
+		containers, err := c.ContainerStates()
+		if err != nil {
+			Log.Warningf("[docker] Unable to list containers: %s", err)
+			containers = make(map[string]bool)
+		}
+		c.containers = containers
+		c.watching = true
+		go c.watch(events)
 	}
+	c.observers = append(c.observers, ob)
+	return nil
+}
+
+// OnResync adds a function to be called after we have reconnected
+// to Docker and told the observers what they missed
+func (c *Client) OnResync(f func()) {
+	c.Lock()
+	c.onResync = append(c.onResync, f)
+	c.Unlock()
+}
 
-	go func() {
+func (c *Client) watch(events chan *docker.APIEvents) {
+	for {
 		for event := range events {
-			switch event.Status {
-			case "start":
-				ob.ContainerStarted(event.ID)
-			case "die":
-				ob.ContainerDied(event.ID)
-			case "destroy":
-				ob.ContainerDestroyed(event.ID)
-			}
+			c.dispatch(event)
 		}
-	}()
-	return nil
+		// The event stream only ends if the connection to Docker
+		// was lost; we miss any events until we get it back
+		Log.Warningf("[docker] Lost connection to Docker events; reconnecting")
+		c.setDisconnected(errors.New("event stream closed"))
+		disconnected := time.Now()
+		events = c.reconnect()
+		Log.Infof("[docker] Reconnected to Docker events after %s; resynchronising", time.Since(disconnected))
+		c.resync()
+	}
+}
+
+func (c *Client) dispatch(event *docker.APIEvents) {
+	c.Lock()
+	switch event.Status {
+	case "start":
+		c.containers[event.ID] = true
+	case "die":
+		c.containers[event.ID] = false
+	case "destroy":
+		delete(c.containers, event.ID)
+	}
+	observers := c.observers
+	c.Unlock()
+	for _, ob := range observers {
+		switch event.Status {
+		case "start":
+			ob.ContainerStarted(event.ID)
+		case "die":
+			ob.ContainerDied(event.ID)
+		case "destroy":
+			ob.ContainerDestroyed(event.ID)
+		}
+	}
+}
+
+// Keep trying to listen to events again, backing off exponentially
+func (c *Client) reconnect() chan *docker.APIEvents {
+	for delay := initialReconnectDelay; ; {
+		time.Sleep(delay)
+		events := make(chan *docker.APIEvents)
+		err := c.source.Ping()
+		if err == nil {
+			err = c.source.AddEventListener(events)
+		}
+		if err == nil {
+			c.Lock()
+			c.status.Connected, c.status.Since, c.status.LastError = true, time.Now(), ""
+			c.status.Reconnects++
+			c.Unlock()
+			return events
+		}
+		Log.Debugf("[docker] Unable to reconnect to Docker: %s", err)
+		c.setDisconnected(err)
+		delay = backOff(delay)
+	}
+}
+
+func backOff(delay time.Duration) time.Duration {
+	if delay *= 2; delay > maxReconnectDelay {
+		delay = maxReconnectDelay
+	}
+	return delay
+}
+
+func (c *Client) setDisconnected(err error) {
+	c.Lock()
+	if c.status.Connected {
+		c.status.Connected, c.status.Since = false, time.Now()
+	}
+	c.status.LastError = err.Error()
+	c.Unlock()
+}
+
+// Compare the containers Docker has now with what we last knew, and
+// make up the events we must have missed.  Until we can list the
+// containers, we keep trying, backing off exponentially.
+func (c *Client) resync() {
+	var containers map[string]bool
+	for delay := initialReconnectDelay; ; delay = backOff(delay) {
+		var err error
+		if containers, err = c.ContainerStates(); err == nil {
+			break
+		}
+		Log.Errorf("[docker] Unable to list containers to resynchronise: %s; retrying in %s", err, delay)
+		time.Sleep(delay)
+	}
+	c.Lock()
+	previous, onResync := c.containers, c.onResync
+	c.Unlock()
+
+	var events []*docker.APIEvents
+	for id, wasRunning := range previous {
+		running, exists := containers[id]
+		if wasRunning && !running {
+			Log.Infof("[docker] Container %s stopped while we were disconnected", id)
+			events = append(events, &docker.APIEvents{Status: "die", ID: id})
+		}
+		if !exists {
+			Log.Infof("[docker] Container %s was removed while we were disconnected", id)
+			events = append(events, &docker.APIEvents{Status: "destroy", ID: id})
+		}
+	}
+	for id, running := range containers {
+		if running && !previous[id] {
+			Log.Infof("[docker] Container %s started while we were disconnected", id)
+			events = append(events, &docker.APIEvents{Status: "start", ID: id})
+		}
+	}
+	for _, event := range events {
+		c.dispatch(event)
+	}
+	// Only this goroutine updates containers once we are watching
+	c.Lock()
+	c.containers = containers
+	c.Unlock()
+	for _, f := range onResync {
+		f()
+	}
+}
+
+// ContainerStates returns the IDs of all containers, mapped to
+// whether they are running
+func (c *Client) ContainerStates() (map[string]bool, error) {
+	containers, err := c.source.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		// Docker describes running (and paused) containers as "Up ..."
+		states[container.ID] = strings.HasPrefix(container.Status, "Up")
+	}
+	return states, nil
+}
+
+// IsContainerID returns true if s looks like a full container ID, as
+// opposed to the other identifiers (e.g. "weave:expose") that
+// addresses and names can be registered under
+func IsContainerID(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
 }
 
 // IsContainerNotRunning returns true if we have checked with Docker that the ID is not running
@@ -107,6 +298,23 @@ func (c *Client) IsContainerNotRunning(idStr string) bool {
 	return false
 }
 
+// StableName returns a name for the container that stays the same
+// when it is recreated: the value of the given label if that is not
+// empty, otherwise the container's name.
+func (c *Client) StableName(idStr string, label string) (string, error) {
+	container, err := c.InspectContainer(idStr)
+	if err != nil {
+		return "", err
+	}
+	if label != "" {
+		if container.Config == nil {
+			return "", nil
+		}
+		return container.Config.Labels[label], nil
+	}
+	return strings.TrimPrefix(container.Name, "/"), nil
+}
+
 // This is intended to find an IP address that we can reach the container on;
 // if it is on the Docker bridge network then that address; if on the host network
 // then localhost
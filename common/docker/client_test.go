@@ -0,0 +1,174 @@
+package docker
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/require"
+)
+
+// Stands in for Docker: holds the containers, and the event stream,
+// which can be dropped
+type fakeEventSource struct {
+	sync.Mutex
+	containers map[string]bool // ID -> running
+	listener   chan<- *docker.APIEvents
+	listens    int
+	listFails  int // how many more times listing containers should fail
+}
+
+func (src *fakeEventSource) Ping() error { return nil }
+
+func (src *fakeEventSource) AddEventListener(listener chan<- *docker.APIEvents) error {
+	src.Lock()
+	defer src.Unlock()
+	src.listener = listener
+	src.listens++
+	return nil
+}
+
+func (src *fakeEventSource) ListContainers(docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	src.Lock()
+	defer src.Unlock()
+	if src.listFails > 0 {
+		src.listFails--
+		return nil, errors.New("Docker is not ready")
+	}
+	var containers []docker.APIContainers
+	for id, running := range src.containers {
+		status := "Exited (0) 1 second ago"
+		if running {
+			status = "Up 1 second"
+		}
+		containers = append(containers, docker.APIContainers{ID: id, Status: status})
+	}
+	return containers, nil
+}
+
+func (src *fakeEventSource) send(status, id string) {
+	src.Lock()
+	listener := src.listener
+	src.Unlock()
+	listener <- &docker.APIEvents{Status: status, ID: id}
+}
+
+// Simulate losing the connection to Docker
+func (src *fakeEventSource) drop() {
+	src.Lock()
+	close(src.listener)
+	src.listener = nil
+	src.Unlock()
+}
+
+func (src *fakeEventSource) set(id string, running bool) {
+	src.Lock()
+	src.containers[id] = running
+	src.Unlock()
+}
+
+func (src *fakeEventSource) remove(id string) {
+	src.Lock()
+	delete(src.containers, id)
+	src.Unlock()
+}
+
+type recordingObserver struct {
+	sync.Mutex
+	events []string
+}
+
+func (ob *recordingObserver) record(event string) {
+	ob.Lock()
+	ob.events = append(ob.events, event)
+	ob.Unlock()
+}
+
+func (ob *recordingObserver) ContainerStarted(ident string)   { ob.record("start " + ident) }
+func (ob *recordingObserver) ContainerDied(ident string)      { ob.record("die " + ident) }
+func (ob *recordingObserver) ContainerDestroyed(ident string) { ob.record("destroy " + ident) }
+
+// The events seen since the last call, in a predictable order
+func (ob *recordingObserver) take() []string {
+	ob.Lock()
+	defer ob.Unlock()
+	events := ob.events
+	ob.events = nil
+	sort.Strings(events)
+	return events
+}
+
+func newWatchingClient(t *testing.T, src *fakeEventSource) (*Client, *recordingObserver, chan struct{}) {
+	initialReconnectDelay = time.Millisecond
+	maxReconnectDelay = 10 * time.Millisecond
+	client := &Client{source: src}
+	ob := &recordingObserver{}
+	require.NoError(t, client.AddObserver(ob))
+	resynced := make(chan struct{}, 1)
+	client.OnResync(func() { resynced <- struct{}{} })
+	return client, ob, resynced
+}
+
+func waitForResync(t *testing.T, resynced chan struct{}) {
+	select {
+	case <-resynced:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for resync")
+	}
+}
+
+func TestResyncAfterReconnect(t *testing.T) {
+	src := &fakeEventSource{containers: map[string]bool{"a": true, "b": true, "c": false, "d": false}}
+	client, ob, resynced := newWatchingClient(t, src)
+
+	src.send("start", "d")
+	src.send("die", "d")
+	src.send("destroy", "d")
+	src.remove("d")
+
+	// Then, without our seeing the events, a stops, b is removed,
+	// c is started and e comes and goes, before we are disconnected
+	src.set("a", false)
+	src.remove("b")
+	src.set("c", true)
+	src.set("e", true)
+	src.remove("e")
+	src.drop()
+	waitForResync(t, resynced)
+	require.Equal(t, []string{"destroy b", "destroy d", "die a", "die b", "die d", "start c", "start d"}, ob.take())
+	require.Equal(t, 2, src.listens)
+	client.Lock()
+	status := client.status
+	client.Unlock()
+	require.True(t, status.Connected)
+	require.Equal(t, 1, status.Reconnects)
+
+	// Events on the new stream are passed on, and we compare with
+	// them when next resynchronising
+	src.send("die", "c")
+	src.set("c", false)
+	src.set("f", true)
+	src.drop()
+	waitForResync(t, resynced)
+	require.Equal(t, []string{"die c", "start f"}, ob.take())
+}
+
+func TestResyncRetriesListing(t *testing.T) {
+	src := &fakeEventSource{containers: map[string]bool{"a": true}}
+	_, ob, resynced := newWatchingClient(t, src)
+
+	src.Lock()
+	src.listFails = 3
+	src.Unlock()
+	src.remove("a")
+	src.set("b", true)
+	src.drop()
+	waitForResync(t, resynced)
+	require.Equal(t, []string{"destroy a", "die a", "start b"}, ob.take())
+	src.Lock()
+	require.Equal(t, 0, src.listFails)
+	src.Unlock()
+}
@@ -0,0 +1,24 @@
+package docker
+
+import (
+	"time"
+)
+
+type Status struct {
+	Endpoint   string
+	Connected  bool
+	Since      time.Time // when we last connected or lost the connection
+	LastError  string    `json:",omitempty"`
+	Reconnects int
+}
+
+func NewStatus(c *Client) *Status {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	status := c.status
+	status.Endpoint = c.Endpoint()
+	return &status
+}
@@ -7,14 +7,18 @@ import (
 )
 
 type allocateResult struct {
-	addr address.Address
-	err  error
+	addr   address.Address
+	subnet address.CIDR // for allocations in a pool
+	err    error
 }
 
 type allocate struct {
 	resultChan       chan<- allocateResult
 	ident            string
+	sticky           string        // stable key, if any
 	r                address.Range // Range we are trying to allocate within
+	pool             string        // or pool
+	poolSubnet       address.CIDR  // restricting which of the pool's subnets to use; zero for any
 	hasBeenCancelled func() bool
 }
 
@@ -25,48 +29,134 @@ func (g *allocate) Try(alloc *Allocator) bool {
 		return true
 	}
 
+	if g.pool != "" {
+		return g.tryPool(alloc)
+	}
+
 	if addr, found := alloc.lookupOwned(g.ident, g.r); found {
 		// If we had heard that this container died, resurrect it
 		delete(alloc.dead, g.ident) // delete is no-op if key not in map
-		g.resultChan <- allocateResult{addr, nil}
+		g.resultChan <- allocateResult{addr: addr}
 		return true
 	}
 
 	if !alloc.universe.Overlaps(g.r) {
-		g.resultChan <- allocateResult{0, fmt.Errorf("range %s out of bounds: %s", g.r, alloc.universe)}
+		g.resultChan <- allocateResult{err: fmt.Errorf("range %s out of bounds: %s", g.r, alloc.universe)}
+		return true
+	}
+
+	ranges, quotaErr := alloc.rangesWithinQuotas(g.r)
+	if len(ranges) == 0 {
+		g.resultChan <- allocateResult{err: quotaErr}
 		return true
 	}
 
 	alloc.establishRing()
 
-	if ok, addr := alloc.space.Allocate(g.r); ok {
-		// If caller hasn't supplied a unique ID, file it under the IP address
-		// which lets the caller then release the address using DELETE /ip/address
-		if g.ident == "_" {
-			g.ident = addr.String()
+	for _, r := range ranges {
+		if g.allocateIn(alloc, g.r, r, address.CIDR{}) {
+			return true
 		}
-		alloc.debugln("Allocated", addr, "for", g.ident, "in", g.r)
-		alloc.addOwned(g.ident, addr)
-		g.resultChan <- allocateResult{addr, nil}
-		return true
 	}
 
 	// out of space
-	donors := alloc.ring.ChoosePeersToAskForSpace(g.r.Start, g.r.End)
+	for _, r := range ranges {
+		if g.askForSpace(alloc, r) {
+			break
+		}
+	}
+	return false
+}
+
+// Allocate from a named pool, in whichever of its subnets has space
+func (g *allocate) tryPool(alloc *Allocator) bool {
+	pool := alloc.pools.find(g.pool)
+	if pool == nil {
+		g.resultChan <- allocateResult{err: fmt.Errorf("unknown pool %s", g.pool)}
+		return true
+	}
+	var subnets []address.CIDR
+	for _, subnet := range pool.subnets {
+		if g.poolSubnet == (address.CIDR{}) || g.poolSubnet == subnet {
+			subnets = append(subnets, subnet)
+		}
+	}
+	if len(subnets) == 0 {
+		g.resultChan <- allocateResult{err: fmt.Errorf("subnet %s is not in pool %s", g.poolSubnet, g.pool)}
+		return true
+	}
+
+	for _, subnet := range subnets {
+		if addr, found := alloc.lookupOwned(g.ident, subnet.HostRange()); found {
+			delete(alloc.dead, g.ident)
+			g.resultChan <- allocateResult{addr, subnet, nil}
+			return true
+		}
+	}
+
+	if err := alloc.checkPoolQuota(pool); err != nil {
+		g.resultChan <- allocateResult{err: err}
+		return true
+	}
+
+	alloc.establishRing()
+
+	for _, subnet := range subnets {
+		// other pools may share the subnet
+		ranges, _ := alloc.rangesWithinQuotas(subnet.HostRange())
+		for _, r := range ranges {
+			if g.allocateIn(alloc, subnet.HostRange(), r, subnet) {
+				return true
+			}
+		}
+	}
+
+	// out of space; ask for some in the first subnet that anyone has
+	// space in
+	for _, subnet := range subnets {
+		if g.askForSpace(alloc, subnet.HostRange()) {
+			break
+		}
+	}
+	return false
+}
+
+// Allocate an address in the part within of r if we have one free,
+// returning true if so
+func (g *allocate) allocateIn(alloc *Allocator, r, within address.Range, subnet address.CIDR) bool {
+	addr, ok := alloc.takeHeld(g.sticky, within)
+	if ok {
+		alloc.debugln("Returning held address", addr, "for", g.sticky, "to", g.ident)
+	} else if ok, addr = alloc.space.Allocate(within); !ok {
+		return false
+	}
+	// If caller hasn't supplied a unique ID, file it under the IP address
+	// which lets the caller then release the address using DELETE /ip/address
+	if g.ident == "_" {
+		g.ident = addr.String()
+	}
+	alloc.debugln("Allocated", addr, "for", g.ident, "in", r)
+	alloc.addOwned(g.ident, addr, r, g.sticky)
+	g.resultChan <- allocateResult{addr, subnet, nil}
+	return true
+}
+
+// Ask a peer with space in r for some, returning true if we did
+func (g *allocate) askForSpace(alloc *Allocator, r address.Range) bool {
+	donors := alloc.ring.ChoosePeersToAskForSpace(r.Start, r.End)
 	for _, donor := range donors {
-		if err := alloc.sendSpaceRequest(donor, g.r); err != nil {
+		if err := alloc.sendSpaceRequest(donor, r); err != nil {
 			alloc.debugln("Problem asking peer", donor, "for space:", err)
 		} else {
-			alloc.debugln("Decided to ask peer", donor, "for space in range", g.r)
-			break
+			alloc.debugln("Decided to ask peer", donor, "for space in range", r)
+			return true
 		}
 	}
-
 	return false
 }
 
 func (g *allocate) Cancel() {
-	g.resultChan <- allocateResult{0, &errorCancelled{"Allocate", g.ident}}
+	g.resultChan <- allocateResult{err: &errorCancelled{"Allocate", g.ident}}
 }
 
 func (g *allocate) ForContainer(ident string) bool {
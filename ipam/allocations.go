@@ -0,0 +1,141 @@
+package ipam
+
+import (
+	"sort"
+	"time"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Listing the addresses allocated to containers, on this peer or
+// across the cluster.  For the latter we query the other peers for
+// theirs.
+
+// Allocation is an address allocated to a container
+type Allocation struct {
+	ContainerID string
+	Address     address.Address
+	Subnet      string    `json:",omitempty"` // where known
+	Allocated   time.Time `json:",omitempty"`
+	Peer        string    // name(nickname) of the peer that allocated it
+}
+
+// Details of an address that are not held in owned
+type allocationInfo struct {
+	time   time.Time
+	r      address.Range // the range the address was allocated in, if any
+	sticky string        // the stable key it was allocated for, if any
+}
+
+// AllocationFilter selects allocations; zero fields match anything
+type AllocationFilter struct {
+	ContainerID string
+	Subnet      address.Range
+	Address     address.Address
+}
+
+func (filter AllocationFilter) matches(ident string, addr address.Address) bool {
+	return (filter.ContainerID == "" || filter.ContainerID == ident) &&
+		(filter.Subnet.Size() == 0 || filter.Subnet.Contains(addr)) &&
+		(filter.Address == 0 || filter.Address == addr)
+}
+
+type allocationsByAddress []Allocation
+
+func (a allocationsByAddress) Len() int           { return len(a) }
+func (a allocationsByAddress) Less(i, j int) bool { return a[i].Address < a[j].Address }
+func (a allocationsByAddress) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func (alloc *Allocator) peerDescription(name mesh.PeerName) string {
+	return alloc.annotatePeernames([]mesh.PeerName{name})[0]
+}
+
+func (alloc *Allocator) allocations(filter AllocationFilter) []Allocation {
+	result := []Allocation{}
+	us := alloc.peerDescription(alloc.ourName)
+	for ident, addrs := range alloc.owned {
+		for _, addr := range addrs {
+			if !filter.matches(ident, addr) {
+				continue
+			}
+			info := alloc.allocationInfo[addr]
+			allocation := Allocation{ContainerID: ident, Address: addr, Allocated: info.time, Peer: us}
+			if info.r.Size() > 0 {
+				// Allocations are made in the host range of a
+				// subnet, which excludes its first and last
+				// addresses
+				allocation.Subnet = address.Range{Start: info.r.Start - 1, End: info.r.End + 1}.AsCIDRString()
+			}
+			result = append(result, allocation)
+		}
+	}
+	sort.Sort(allocationsByAddress(result))
+	return result
+}
+
+// Allocations (Sync) - the addresses allocated by this peer
+func (alloc *Allocator) Allocations(filter AllocationFilter) []Allocation {
+	resultChan := make(chan []Allocation)
+	alloc.actionChan <- func() {
+		resultChan <- alloc.allocations(filter)
+	}
+	return <-resultChan
+}
+
+// ClusterAllocations (Sync) - the addresses allocated by all peers,
+// as far as they answer within a timeout.  Also returns the peers
+// which did not answer, or could not be asked.
+func (alloc *Allocator) ClusterAllocations(filter AllocationFilter) ([]Allocation, []string) {
+	var result []Allocation
+	responses, missing := alloc.queryPeers(msgAllocationsRequest, filter, func() []mesh.PeerName {
+		result = alloc.allocations(filter)
+		var peers []mesh.PeerName
+		if filter.Address != 0 && alloc.ring.Contains(filter.Address) {
+			// Only the owner of the address can have allocated it
+			if owner := alloc.ring.Owner(filter.Address); owner != alloc.ourName && owner != mesh.UnknownPeerName {
+				peers = append(peers, owner)
+			}
+		} else {
+			for peer := range alloc.ring.PeerNames() {
+				if peer != alloc.ourName {
+					peers = append(peers, peer)
+				}
+			}
+		}
+		return peers
+	})
+
+	for peer, body := range responses {
+		var allocations []Allocation
+		if err := gobDecode(body, &allocations); err != nil {
+			alloc.debugln("Unable to decode allocations from", peer, ":", err)
+			missing = append(missing, peer)
+			continue
+		}
+		result = append(result, allocations...)
+	}
+
+	missingChan := make(chan []string)
+	alloc.actionChan <- func() {
+		var descriptions []string
+		for _, peer := range missing {
+			descriptions = append(descriptions, alloc.peerDescription(peer))
+		}
+		sort.Strings(descriptions)
+		missingChan <- descriptions
+	}
+	sort.Sort(allocationsByAddress(result))
+	return result, <-missingChan
+}
+
+// Another peer wants to know about our allocations
+func (alloc *Allocator) answerAllocationsRequest(sender mesh.PeerName, msg []byte) error {
+	return alloc.answerQuery(sender, msg, msgAllocationsResponse, func(request []byte) (interface{}, error) {
+		var filter AllocationFilter
+		if err := gobDecode(request, &filter); err != nil {
+			return nil, err
+		}
+		return alloc.allocations(filter), nil
+	})
+}
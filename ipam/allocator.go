@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"reflect"
 	"sort"
 	"time"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/docker"
 	"github.com/weaveworks/weave/ipam/paxos"
 	"github.com/weaveworks/weave/ipam/ring"
 	"github.com/weaveworks/weave/ipam/space"
@@ -20,6 +22,10 @@ const (
 	msgSpaceRequest = iota
 	msgRingUpdate
 	msgSpaceRequestDenied
+	msgAllocationsRequest
+	msgAllocationsResponse
+	msgCheckRequest
+	msgCheckResponse
 
 	tickInterval         = time.Second * 5
 	MinSubnetSize        = 4 // first and last addresses are excluded, so 2 would be too small
@@ -43,37 +49,61 @@ type operation interface {
 // necessary plumbing.  Runs as a single-threaded Actor, so no locks
 // are used around data structures.
 type Allocator struct {
-	actionChan       chan<- func()
-	ourName          mesh.PeerName
-	universe         address.Range                // superset of all ranges
-	ring             *ring.Ring                   // information on ranges owned by all peers
-	space            space.Space                  // more detail on ranges owned by us
-	owned            map[string][]address.Address // who owns what addresses, indexed by container-ID
-	nicknames        map[mesh.PeerName]string     // so we can map nicknames for rmpeer
-	pendingAllocates []operation                  // held until we get some free space
-	pendingClaims    []operation                  // held until we know who owns the space
-	dead             map[string]time.Time         // containers we heard were dead, and when
-	gossip           mesh.Gossip                  // our link to the outside world for sending messages
-	paxos            *paxos.Node
-	paxosActive      bool
-	ticker           *time.Ticker
-	shuttingDown     bool // to avoid doing any requests while trying to shut down
-	isKnownPeer      func(mesh.PeerName) bool
-	now              func() time.Time
+	actionChan         chan<- func()
+	ourName            mesh.PeerName
+	universe           address.Range                      // superset of all ranges
+	ring               *ring.Ring                         // information on ranges owned by all peers
+	space              space.Space                        // more detail on ranges owned by us
+	owned              map[string][]address.Address       // who owns what addresses, indexed by container-ID
+	allocationInfo     map[address.Address]allocationInfo // when and where owned addresses were allocated
+	nicknames          map[mesh.PeerName]string           // so we can map nicknames for rmpeer
+	pendingAllocates   []operation                        // held until we get some free space
+	pendingClaims      []operation                        // held until we know who owns the space
+	dead               map[string]time.Time               // containers we heard were dead, and when
+	gossip             mesh.Gossip                        // our link to the outside world for sending messages
+	paxos              *paxos.Node
+	paxosActive        bool
+	ticker             *time.Ticker
+	shuttingDown       bool // to avoid doing any requests while trying to shut down
+	isKnownPeer        func(mesh.PeerName) bool
+	now                func() time.Time
+	ringObservers      []func([]ring.RangeInfo) // told about changes in range ownership
+	lastRangeInfo      []ring.RangeInfo         // as last told to ringObservers
+	ownedObservers     []func(map[address.Address]string)
+	ownedChanged       bool                   // since ownedObservers were last told
+	queryable          map[mesh.PeerName]bool // peers that answer queries
+	queries            map[uint64]*query
+	lastQueryID        uint64
+	reserved           reservations // addresses not to be allocated, cluster-wide
+	pools              pools
+	poolUsage          map[mesh.PeerName]poolUsage // addresses each peer has in each pool
+	sticky             StickyConfig
+	held               map[string][]heldAddress // addresses released by containers, held for their stable keys
+	rebalance          RebalanceConfig
+	lastRebalance      time.Time
+	lastFree           map[mesh.PeerName]address.Offset // free space of each peer when we last considered rebalancing
+	rebalanceTransfers int
+	lastHeard          map[mesh.PeerName]time.Time // when each peer last sent us gossip directly
 }
 
 // NewAllocator creates and initialises a new Allocator
 func NewAllocator(ourName mesh.PeerName, ourUID mesh.PeerUID, ourNickname string, universe address.Range, quorum uint, isKnownPeer func(name mesh.PeerName) bool) *Allocator {
 	return &Allocator{
-		ourName:     ourName,
-		universe:    universe,
-		ring:        ring.New(universe.Start, universe.End, ourName),
-		owned:       make(map[string][]address.Address),
-		paxos:       paxos.NewNode(ourName, ourUID, quorum),
-		nicknames:   map[mesh.PeerName]string{ourName: ourNickname},
-		isKnownPeer: isKnownPeer,
-		dead:        make(map[string]time.Time),
-		now:         time.Now,
+		ourName:        ourName,
+		universe:       universe,
+		ring:           ring.New(universe.Start, universe.End, ourName),
+		owned:          make(map[string][]address.Address),
+		allocationInfo: make(map[address.Address]allocationInfo),
+		paxos:          paxos.NewNode(ourName, ourUID, quorum),
+		nicknames:      map[mesh.PeerName]string{ourName: ourNickname},
+		isKnownPeer:    isKnownPeer,
+		dead:           make(map[string]time.Time),
+		now:            time.Now,
+		queryable:      map[mesh.PeerName]bool{ourName: true},
+		queries:        make(map[uint64]*query),
+		poolUsage:      make(map[mesh.PeerName]poolUsage),
+		held:           make(map[string][]heldAddress),
+		lastHeard:      make(map[mesh.PeerName]time.Time),
 	}
 }
 
@@ -204,6 +234,31 @@ func (alloc *Allocator) Allocate(ident string, r address.Range, hasBeenCancelled
 	return result.addr, result.err
 }
 
+// AllocateSticky (Sync) - like Allocate, but for a stable key as well
+// as the container, so that the address can be held for the key when
+// the container goes away, and handed back when it is recreated
+func (alloc *Allocator) AllocateSticky(ident string, key string, r address.Range, hasBeenCancelled func() bool) (address.Address, error) {
+	resultChan := make(chan allocateResult)
+	op := &allocate{resultChan: resultChan, ident: ident, sticky: key, r: r, hasBeenCancelled: hasBeenCancelled}
+	alloc.doOperation(op, &alloc.pendingAllocates)
+	result := <-resultChan
+	return result.addr, result.err
+}
+
+// AllocateInPool (Sync) - get new IP address for container with given
+// name in the named pool, and the subnet it is in.  If subnet is
+// non-zero, only that one of the pool's subnets is used.  Fails if
+// the pool's quota has been reached, otherwise blocks until there is
+// space.  key, if not empty, makes the address sticky, as for
+// AllocateSticky.
+func (alloc *Allocator) AllocateInPool(ident string, key string, pool string, subnet address.CIDR, hasBeenCancelled func() bool) (address.Address, address.CIDR, error) {
+	resultChan := make(chan allocateResult)
+	op := &allocate{resultChan: resultChan, ident: ident, sticky: key, pool: pool, poolSubnet: subnet, hasBeenCancelled: hasBeenCancelled}
+	alloc.doOperation(op, &alloc.pendingAllocates)
+	result := <-resultChan
+	return result.addr, result.subnet, result.err
+}
+
 // Lookup (Sync) - get existing IP address for container with given name in range
 func (alloc *Allocator) Lookup(ident string, r address.Range) (address.Address, error) {
 	resultChan := make(chan allocateResult)
@@ -218,10 +273,11 @@ func (alloc *Allocator) Lookup(ident string, r address.Range) (address.Address,
 	return result.addr, result.err
 }
 
-// Claim an address that we think we should own (Sync)
-func (alloc *Allocator) Claim(ident string, addr address.Address, noErrorOnUnknown bool) error {
+// Claim an address that we think we should own (Sync).  Reserved
+// addresses are refused unless allowReserved is set.
+func (alloc *Allocator) Claim(ident string, addr address.Address, noErrorOnUnknown bool, allowReserved bool) error {
 	resultChan := make(chan error)
-	op := &claim{resultChan: resultChan, ident: ident, addr: addr, noErrorOnUnknown: noErrorOnUnknown}
+	op := &claim{resultChan: resultChan, ident: ident, addr: addr, noErrorOnUnknown: noErrorOnUnknown, allowReserved: allowReserved}
 	alloc.doOperation(op, &alloc.pendingClaims)
 	return <-resultChan
 }
@@ -264,6 +320,48 @@ func (alloc *Allocator) removeDeadContainers() {
 
 func (alloc *Allocator) ContainerStarted(ident string) {}
 
+// Reconcile (Sync) - catch up with container events we may have
+// missed: free the addresses of containers that no longer exist, treat
+// those that have stopped as having died, and keep the addresses of
+// those that are running even if we thought they had died.
+// Identifiers that are not container IDs are left alone, as are
+// containers given addresses after the time the list of containers
+// was taken, since it may have been taken before they existed.
+func (alloc *Allocator) Reconcile(containers map[string]bool, since time.Time) {
+	done := make(chan struct{})
+	alloc.actionChan <- func() {
+		for ident, addrs := range alloc.owned {
+			if !docker.IsContainerID(ident) || alloc.allocatedSince(addrs, since) {
+				continue
+			}
+			_, dead := alloc.dead[ident]
+			switch running, exists := containers[ident]; {
+			case !exists:
+				alloc.infof("Container %s no longer exists; freeing addresses %v", ident, addrs)
+				alloc.delete(ident)
+				delete(alloc.dead, ident)
+			case !running && !dead:
+				alloc.infof("Container %s is not running; noting to remove addresses %v later", ident, addrs)
+				alloc.dead[ident] = alloc.now()
+			case running && dead:
+				alloc.infof("Container %s is running again; keeping addresses %v", ident, addrs)
+				delete(alloc.dead, ident)
+			}
+		}
+		close(done)
+	}
+	<-done
+}
+
+func (alloc *Allocator) allocatedSince(addrs []address.Address, since time.Time) bool {
+	for _, addr := range addrs {
+		if alloc.allocationInfo[addr].time.After(since) {
+			return true
+		}
+	}
+	return false
+}
+
 // Delete (Sync) - release all IP addresses for container with given name
 func (alloc *Allocator) Delete(ident string) error {
 	errChan := make(chan error)
@@ -276,9 +374,13 @@ func (alloc *Allocator) Delete(ident string) error {
 func (alloc *Allocator) delete(ident string) error {
 	addrs, found := alloc.owned[ident]
 	for _, addr := range addrs {
-		alloc.space.Free(addr)
+		if !alloc.hold(addr) {
+			alloc.space.Free(addr)
+		}
+		delete(alloc.allocationInfo, addr)
 	}
 	delete(alloc.owned, ident)
+	alloc.ownedChanged = true
 
 	if !found {
 		return fmt.Errorf("Delete: no addresses for %s", ident)
@@ -299,7 +401,9 @@ func (alloc *Allocator) Free(ident string, addrToFree address.Address) error {
 				} else {
 					alloc.owned[ident] = append(addrs[:i], addrs[i+1:]...)
 				}
+				alloc.ownedChanged = true
 				alloc.space.Free(addrToFree)
+				delete(alloc.allocationInfo, addrToFree)
 				errChan <- nil
 				return
 			}
@@ -356,9 +460,61 @@ func (alloc *Allocator) Shutdown() {
 	<-doneChan
 }
 
+// TakeoverPreview describes what taking over a peer's ranges would do
+type TakeoverPreview struct {
+	Peer      string         // name(nickname)
+	Alive     bool           // whether the peer appears to be connected to the network
+	LastHeard *time.Time     `json:",omitempty"` // when the peer last sent us gossip directly, if ever
+	Ranges    []string       // the ranges that would move to us
+	Size      address.Offset // the number of addresses in those ranges
+	Free      address.Offset // of which the peer last reported as free
+}
+
+func (alloc *Allocator) takeoverPreview(peername mesh.PeerName) *TakeoverPreview {
+	preview := &TakeoverPreview{
+		Peer:   alloc.peerDescription(peername),
+		Alive:  alloc.isKnownPeer(peername),
+		Ranges: []string{},
+	}
+	if t, found := alloc.lastHeard[peername]; found {
+		preview.LastHeard = &t
+	}
+	for _, r := range alloc.ring.AllRangeInfo() {
+		if r.Peer == peername {
+			preview.Ranges = append(preview.Ranges, r.Range.String())
+		}
+	}
+	if s, found := alloc.ring.SpaceByPeer()[peername]; found {
+		preview.Size, preview.Free = s.Size, s.Free
+	}
+	return preview
+}
+
+// PreviewTakeoverRanges (Sync) - report what AdminTakeoverRanges would
+// do for a given peer, without doing it
+func (alloc *Allocator) PreviewTakeoverRanges(peerNameOrNickname string) (*TakeoverPreview, error) {
+	type result struct {
+		preview *TakeoverPreview
+		err     error
+	}
+	resultChan := make(chan result)
+	alloc.actionChan <- func() {
+		peername, err := alloc.lookupPeername(peerNameOrNickname)
+		if err != nil {
+			resultChan <- result{err: fmt.Errorf("Cannot find peer '%s'", peerNameOrNickname)}
+			return
+		}
+		resultChan <- result{preview: alloc.takeoverPreview(peername)}
+	}
+	r := <-resultChan
+	return r.preview, r.err
+}
+
 // AdminTakeoverRanges (Sync) - take over the ranges owned by a given peer.
-// Only done on adminstrator command.
-func (alloc *Allocator) AdminTakeoverRanges(peerNameOrNickname string) error {
+// Only done on adminstrator command.  Refused if the peer appears to
+// be alive, unless forced, since if it is it will carry on allocating
+// from those ranges and the same addresses will be allocated twice.
+func (alloc *Allocator) AdminTakeoverRanges(peerNameOrNickname string, force bool) error {
 	resultChan := make(chan error)
 	alloc.actionChan <- func() {
 		peername, err := alloc.lookupPeername(peerNameOrNickname)
@@ -372,7 +528,13 @@ func (alloc *Allocator) AdminTakeoverRanges(peerNameOrNickname string) error {
 			resultChan <- fmt.Errorf("Cannot take over ranges from yourself!")
 			return
 		}
+		if alloc.isKnownPeer(peername) && !force {
+			resultChan <- fmt.Errorf("Peer %s appears to be connected; taking over its ranges while it is running will lead to duplicate IP addresses. Stop it first, or force the takeover", alloc.peerDescription(peername))
+			return
+		}
 
+		preview := alloc.takeoverPreview(peername)
+		alloc.infof("Taking over %v (%d addresses, %d free) from %s", preview.Ranges, preview.Size, preview.Free, preview.Peer)
 		newRanges, err := alloc.ring.Transfer(peername, alloc.ourName)
 		alloc.space.AddRanges(newRanges)
 		resultChan <- err
@@ -426,6 +588,7 @@ func (alloc *Allocator) OnGossipUnicast(sender mesh.PeerName, msg []byte) error
 	alloc.debugln("OnGossipUnicast from", sender, ": ", len(msg), "bytes")
 	resultChan := make(chan error)
 	alloc.actionChan <- func() {
+		alloc.lastHeard[sender] = alloc.now()
 		switch msg[0] {
 		case msgSpaceRequest:
 			// some other peer asked us for space
@@ -442,6 +605,15 @@ func (alloc *Allocator) OnGossipUnicast(sender mesh.PeerName, msg []byte) error
 			resultChan <- err
 		case msgRingUpdate:
 			resultChan <- alloc.update(sender, msg[1:])
+		case msgAllocationsRequest:
+			resultChan <- alloc.answerAllocationsRequest(sender, msg[1:])
+		case msgAllocationsResponse, msgCheckResponse:
+			resultChan <- alloc.queryResponse(sender, msg[1:])
+		case msgCheckRequest:
+			resultChan <- alloc.answerCheckRequest(sender, msg[1:])
+		default:
+			alloc.infof("Ignoring unknown message type %d from %s", msg[0], sender)
+			resultChan <- nil
 		}
 	}
 	return <-resultChan
@@ -452,6 +624,7 @@ func (alloc *Allocator) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mes
 	alloc.debugln("OnGossipBroadcast from", sender, ":", len(msg), "bytes")
 	resultChan := make(chan error)
 	alloc.actionChan <- func() {
+		alloc.lastHeard[sender] = alloc.now()
 		resultChan <- alloc.update(sender, msg)
 	}
 	return alloc.Gossip(), <-resultChan
@@ -462,15 +635,24 @@ type gossipState struct {
 	// gossipped in order to detect skewed clocks
 	Now       int64
 	Nicknames map[mesh.PeerName]string
+	Queryable map[mesh.PeerName]bool // peers that answer queries
+	Reserved  reservations
+	Pools     pools
+	PoolUsage map[mesh.PeerName]poolUsage
 
 	Paxos paxos.GossipState
 	Ring  *ring.Ring
 }
 
 func (alloc *Allocator) encode() []byte {
+	alloc.updatePoolUsage()
 	data := gossipState{
 		Now:       alloc.now().Unix(),
 		Nicknames: alloc.nicknames,
+		Queryable: alloc.queryable,
+		Reserved:  alloc.reserved,
+		Pools:     alloc.pools,
+		PoolUsage: alloc.poolUsage,
 	}
 
 	// We're only interested in Paxos until we have a Ring.
@@ -526,6 +708,26 @@ func (alloc *Allocator) Gossip() mesh.GossipData {
 	return &ipamGossipData{alloc}
 }
 
+// OnRingUpdate registers a function to be called, from the
+// allocator's goroutine, with the ownership of every range in the
+// ring, both now and whenever that changes.
+func (alloc *Allocator) OnRingUpdate(observer func([]ring.RangeInfo)) {
+	alloc.actionChan <- func() {
+		alloc.ringObservers = append(alloc.ringObservers, observer)
+		observer(alloc.ring.AllRangeInfo())
+	}
+}
+
+// OnOwnedUpdate registers a function to be called, from the
+// allocator's goroutine, with the container that each locally
+// allocated address belongs to, both now and whenever that changes.
+func (alloc *Allocator) OnOwnedUpdate(observer func(map[address.Address]string)) {
+	alloc.actionChan <- func() {
+		alloc.ownedObservers = append(alloc.ownedObservers, observer)
+		observer(alloc.ownedByAddress())
+	}
+}
+
 // SetInterfaces gives the allocator two interfaces for talking to the outside world
 func (alloc *Allocator) SetInterfaces(gossip mesh.Gossip) {
 	alloc.gossip = gossip
@@ -546,11 +748,15 @@ func (alloc *Allocator) actorLoop(actionChan <-chan func()) {
 				alloc.propose()
 			}
 			alloc.removeDeadContainers()
+			alloc.releaseExpiredHolds()
 			alloc.tryPendingOps()
+			alloc.considerRebalancing()
 		}
 
 		alloc.assertInvariants()
 		alloc.reportFreeSpace()
+		alloc.notifyRingObservers()
+		alloc.notifyOwnedObservers()
 	}
 }
 
@@ -668,6 +874,17 @@ func (alloc *Allocator) update(sender mesh.PeerName, msg []byte) error {
 	for peer, nickname := range data.Nicknames {
 		alloc.nicknames[peer] = nickname
 	}
+	for peer := range data.Queryable {
+		alloc.queryable[peer] = true
+	}
+	if alloc.updateReservations(data.Reserved) {
+		alloc.debugln("Reservations updated to", alloc.reserved.Ranges)
+	}
+	if data.Pools.supersedes(alloc.pools) {
+		alloc.debugln("Pools updated to", data.Pools.Pools)
+		alloc.setPools(data.Pools)
+	}
+	alloc.mergePoolUsage(data.PoolUsage)
 
 	// only one of Ring and Paxos should be present.  And we
 	// shouldn't get updates for a empty Ring. But tolerate
@@ -683,6 +900,7 @@ func (alloc *Allocator) update(sender mesh.PeerName, msg []byte) error {
 		default:
 			if err == nil && !alloc.ring.Empty() {
 				alloc.pruneNicknames()
+				alloc.prunePoolUsage()
 				alloc.ringUpdated()
 			}
 			return err
@@ -765,11 +983,49 @@ func (alloc *Allocator) reportFreeSpace() {
 	alloc.ring.ReportFree(freespace)
 }
 
+func (alloc *Allocator) notifyRingObservers() {
+	if len(alloc.ringObservers) == 0 {
+		return
+	}
+	rangeInfo := alloc.ring.AllRangeInfo()
+	if reflect.DeepEqual(rangeInfo, alloc.lastRangeInfo) {
+		return
+	}
+	alloc.lastRangeInfo = rangeInfo
+	for _, observer := range alloc.ringObservers {
+		observer(rangeInfo)
+	}
+}
+
+func (alloc *Allocator) notifyOwnedObservers() {
+	if !alloc.ownedChanged || len(alloc.ownedObservers) == 0 {
+		return
+	}
+	alloc.ownedChanged = false
+	owned := alloc.ownedByAddress()
+	for _, observer := range alloc.ownedObservers {
+		observer(owned)
+	}
+}
+
 // Owned addresses
 
-// NB: addr must not be owned by ident already
-func (alloc *Allocator) addOwned(ident string, addr address.Address) {
+// NB: addr must not be owned by ident already.  r is the range it
+// was allocated in, and sticky the key it was allocated for, if any.
+func (alloc *Allocator) addOwned(ident string, addr address.Address, r address.Range, sticky string) {
 	alloc.owned[ident] = append(alloc.owned[ident], addr)
+	alloc.allocationInfo[addr] = allocationInfo{alloc.now(), r, sticky}
+	alloc.ownedChanged = true
+}
+
+func (alloc *Allocator) ownedByAddress() map[address.Address]string {
+	owned := make(map[address.Address]string)
+	for ident, addrs := range alloc.owned {
+		for _, addr := range addrs {
+			owned[addr] = ident
+		}
+	}
+	return owned
 }
 
 func (alloc *Allocator) lookupOwned(ident string, r address.Range) (address.Address, bool) {
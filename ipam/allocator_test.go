@@ -3,6 +3,7 @@ package ipam
 import (
 	"fmt"
 	"math/rand"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -10,6 +11,8 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/net/address"
 	"github.com/weaveworks/weave/testing/gossip"
 )
@@ -155,7 +158,7 @@ func TestAllocatorClaim(t *testing.T) {
 	addr1, _ := address.ParseIP(testAddr1)
 
 	// First claim should trigger "dunno, I'm going to wait"
-	err := alloc.Claim(container3, addr1, true)
+	err := alloc.Claim(container3, addr1, true, false)
 	require.NoError(t, err)
 
 	// Do one allocate to ensure paxos is all done
@@ -164,23 +167,23 @@ func TestAllocatorClaim(t *testing.T) {
 	addrx, err := allocs[0].Allocate(container1, subnet, returnFalse)
 
 	// Now try the claim again
-	err = alloc.Claim(container3, addr1, true)
+	err = alloc.Claim(container3, addr1, true, false)
 	require.NoError(t, err)
 	// Check we get this address back if we try an allocate
 	addr3, _ := alloc.Allocate(container3, subnet, returnFalse)
 	require.Equal(t, testAddr1, addr3.String(), "address")
 	// one more claim should still work
-	err = alloc.Claim(container3, addr1, true)
+	err = alloc.Claim(container3, addr1, true, false)
 	require.NoError(t, err)
 	// claim for a different container should fail
-	err = alloc.Claim(container1, addr1, true)
+	err = alloc.Claim(container1, addr1, true, false)
 	require.Error(t, err)
 	// claiming the address allocated on the other peer should fail
-	err = alloc.Claim(container1, addrx, true)
+	err = alloc.Claim(container1, addrx, true, false)
 	require.Error(t, err, "claiming address allocated on other peer should fail")
 	// Check an address outside of our universe
 	addr2, _ := address.ParseIP(testAddr2)
-	err = alloc.Claim(container1, addr2, true)
+	err = alloc.Claim(container1, addr2, true, false)
 	require.NoError(t, err)
 }
 
@@ -337,8 +340,8 @@ func TestTransfer(t *testing.T) {
 	alloc2.Stop()
 	alloc3.Stop()
 	router.Flush()
-	require.NoError(t, alloc1.AdminTakeoverRanges(alloc2.ourName.String()))
-	require.NoError(t, alloc1.AdminTakeoverRanges(alloc3.ourName.String()))
+	require.NoError(t, alloc1.AdminTakeoverRanges(alloc2.ourName.String(), true))
+	require.NoError(t, alloc1.AdminTakeoverRanges(alloc3.ourName.String(), true))
 	router.Flush()
 
 	require.Equal(t, address.Offset(1022), alloc1.NumFreeAddresses(subnet))
@@ -348,6 +351,102 @@ func TestTransfer(t *testing.T) {
 	alloc1.Stop()
 }
 
+func TestTakeoverPreview(t *testing.T) {
+	const (
+		cidr = "10.0.1.7/22"
+	)
+	allocs, router, subnet := makeNetworkOfAllocators(2, cidr)
+	defer stopNetworkOfAllocators(allocs)
+	alloc1 := allocs[0]
+	alloc2 := allocs[1]
+
+	_, err := alloc2.Allocate("foo", subnet, returnFalse)
+	require.NoError(t, err)
+	alloc2.gossip.GossipBroadcast(alloc2.Gossip())
+	router.Flush()
+
+	preview, err := alloc1.PreviewTakeoverRanges(alloc2.ourName.String())
+	require.NoError(t, err)
+	require.True(t, preview.Alive)
+	require.NotNil(t, preview.LastHeard)
+	require.NotEmpty(t, preview.Ranges)
+	require.True(t, preview.Size > 0)
+	require.True(t, preview.Free < preview.Size, "alloc2 has allocated an address")
+
+	// Refused while the peer is alive, unless forced
+	require.Error(t, alloc1.AdminTakeoverRanges(alloc2.ourName.String(), false))
+	_, err = alloc1.PreviewTakeoverRanges("no-such-peer")
+	require.Error(t, err)
+
+	done := make(chan struct{})
+	alloc1.actionChan <- func() {
+		alloc1.isKnownPeer = func(mesh.PeerName) bool { return false }
+		close(done)
+	}
+	<-done
+	preview, err = alloc1.PreviewTakeoverRanges(alloc2.ourName.String())
+	require.NoError(t, err)
+	require.False(t, preview.Alive)
+	require.NoError(t, alloc1.AdminTakeoverRanges(alloc2.ourName.String(), false))
+
+	preview, err = alloc1.PreviewTakeoverRanges(alloc2.ourName.String())
+	require.NoError(t, err)
+	require.Empty(t, preview.Ranges)
+	require.Equal(t, address.Offset(0), preview.Size)
+}
+
+func TestOnRingUpdate(t *testing.T) {
+	const (
+		cidr = "10.0.1.7/22"
+	)
+	allocs, router, subnet := makeNetworkOfAllocators(2, cidr)
+	defer stopNetworkOfAllocators(allocs)
+	alloc1 := allocs[0]
+	alloc2 := allocs[1]
+
+	updates := make(chan []ring.RangeInfo, 10)
+	alloc1.OnRingUpdate(func(ranges []ring.RangeInfo) { updates <- ranges })
+	require.Empty(t, <-updates, "ring should not be established yet")
+
+	_, err := alloc2.Allocate("foo", subnet, returnFalse)
+	require.NoError(t, err)
+	router.Flush()
+
+	var ranges []ring.RangeInfo
+	select {
+	case ranges = <-updates:
+	case <-time.After(time.Second):
+		require.FailNow(t, "no ring update received")
+	}
+	owners := make(map[mesh.PeerName]struct{})
+	for _, r := range ranges {
+		owners[r.Peer] = struct{}{}
+	}
+	require.Contains(t, owners, alloc2.ourName)
+}
+
+func TestOnOwnedUpdate(t *testing.T) {
+	const (
+		container1 = "abcdef"
+		universe   = "10.0.3.0/26"
+	)
+
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", universe, 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	updates := make(chan map[address.Address]string, 10)
+	alloc.OnOwnedUpdate(func(owned map[address.Address]string) { updates <- owned })
+	require.Empty(t, <-updates)
+
+	addr, err := alloc.Allocate(container1, subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, map[address.Address]string{addr: container1}, <-updates)
+
+	require.NoError(t, alloc.Free(container1, addr))
+	require.Empty(t, <-updates)
+}
+
 func TestFakeRouterSimple(t *testing.T) {
 	const (
 		cidr = "10.0.1.7/22"
@@ -517,7 +616,7 @@ func TestAllocatorFuzz(t *testing.T) {
 		addressIndex := rand.Int31n(int32(subnet.Size()))
 		alloc := allocs[allocIndex]
 		addr := address.Add(subnet.Start, address.Offset(addressIndex))
-		err := alloc.Claim(name, addr, true)
+		err := alloc.Claim(name, addr, true, false)
 		if err == nil {
 			noteAllocation(allocIndex, name, addr)
 		}
@@ -584,3 +683,343 @@ func TestGossipSkew(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestClusterAllocations(t *testing.T) {
+	const (
+		cidr = "10.0.1.7/22"
+	)
+	allocs, router, subnet := makeNetworkOfAllocators(3, cidr)
+	defer stopNetworkOfAllocators(allocs)
+
+	addr1, err := allocs[1].Allocate("container1", subnet, returnFalse)
+	require.NoError(t, err)
+	addr2, err := allocs[2].Allocate("container2", subnet, returnFalse)
+	require.NoError(t, err)
+	for _, alloc := range allocs {
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+	}
+	router.Flush()
+
+	local := allocs[1].Allocations(AllocationFilter{})
+	require.Len(t, local, 1)
+	require.Equal(t, "container1", local[0].ContainerID)
+	require.Equal(t, addr1, local[0].Address)
+
+	all, missing := allocs[0].ClusterAllocations(AllocationFilter{})
+	require.Empty(t, missing)
+	require.Len(t, all, 2)
+
+	found, missing := allocs[0].ClusterAllocations(AllocationFilter{Address: addr2})
+	require.Empty(t, missing)
+	require.Len(t, found, 1)
+	require.Equal(t, "container2", found[0].ContainerID)
+
+	none, _ := allocs[0].ClusterAllocations(AllocationFilter{ContainerID: "container3"})
+	require.Empty(t, none)
+}
+
+func TestReservations(t *testing.T) {
+	const (
+		cidr = "10.0.1.0/22"
+	)
+	allocs, router, subnet := makeNetworkOfAllocators(2, cidr)
+	defer stopNetworkOfAllocators(allocs)
+
+	reserved, _ := ParseReservation("10.0.1.1-10.0.1.8")
+	err := allocs[0].SetReservations([]address.Range{reserved})
+	require.NoError(t, err)
+	router.Flush()
+	require.Equal(t, []address.Range{reserved}, allocs[1].Reservations())
+
+	outside, _ := ParseReservation("10.0.9.0/24")
+	require.Error(t, allocs[1].SetReservations([]address.Range{outside}), "reservation outside universe")
+
+	for i := 0; i < 16; i++ {
+		addr, err := allocs[i%2].Allocate(fmt.Sprintf("container%d", i), subnet, returnFalse)
+		require.NoError(t, err)
+		require.False(t, reserved.Contains(addr), "allocated reserved address %s", addr)
+	}
+
+	// Claiming a reserved address needs an override
+	addr, _ := address.ParseIP("10.0.1.2")
+	require.Error(t, allocs[1].Claim("claimer", addr, false, false))
+	require.NoError(t, allocs[1].Claim("claimer", addr, false, true))
+
+	// A later change, made elsewhere, supersedes the earlier one
+	require.NoError(t, allocs[1].SetReservations(nil))
+	router.Flush()
+	require.Empty(t, allocs[0].Reservations())
+}
+
+func TestLaunchReservations(t *testing.T) {
+	const (
+		cidr = "10.0.1.0/22"
+	)
+	allocs, router, _ := makeNetworkOfAllocators(2, cidr)
+	defer stopNetworkOfAllocators(allocs)
+
+	// Reservations given at launch on different peers are combined
+	reserved0, _ := ParseReservation("10.0.1.1-10.0.1.8")
+	reserved1, _ := ParseReservation("10.0.1.5-10.0.1.10")
+	require.NoError(t, allocs[0].SetLaunchReservations([]address.Range{reserved0}))
+	require.NoError(t, allocs[1].SetLaunchReservations([]address.Range{reserved1}))
+	require.Equal(t, []address.Range{reserved0}, allocs[0].Reservations())
+	require.Equal(t, []address.Range{reserved1}, allocs[1].Reservations())
+	for _, alloc := range allocs {
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+	}
+	router.Flush()
+	combined, _ := ParseReservation("10.0.1.1-10.0.1.10")
+	for _, alloc := range allocs {
+		require.Equal(t, []address.Range{combined}, alloc.Reservations())
+	}
+
+	// A change made since supersedes them
+	require.NoError(t, allocs[0].SetReservations(nil))
+	router.Flush()
+	require.Empty(t, allocs[1].Reservations())
+}
+
+func TestPools(t *testing.T) {
+	const (
+		cidr = "10.0.0.0/22"
+	)
+	allocs, router, _ := makeNetworkOfAllocators(2, cidr)
+	defer stopNetworkOfAllocators(allocs)
+
+	pool, err := ParsePool("frontend:10.0.1.0/28,10.0.2.0/28:quota=5:peer-quota=3")
+	require.NoError(t, err)
+	require.NoError(t, allocs[0].SetPool(pool))
+	router.Flush()
+	status, found := allocs[1].PoolByName("frontend")
+	require.True(t, found, "pool gossiped")
+	require.Equal(t, []string{"10.0.1.0/28", "10.0.2.0/28"}, status.Subnets)
+
+	bad, _ := ParsePool("outside:10.1.0.0/24")
+	require.Error(t, allocs[0].SetPool(bad), "pool outside universe")
+	_, _, err = allocs[0].AllocateInPool("c", "", "backend", address.CIDR{}, returnFalse)
+	require.Error(t, err, "unknown pool")
+
+	allocate := func(alloc *Allocator, ident string) error {
+		addr, subnet, err := alloc.AllocateInPool(ident, "", "frontend", address.CIDR{}, returnFalse)
+		if err == nil {
+			require.True(t, subnet.Range().Contains(addr), "address %s in subnet %s", addr, subnet)
+			require.Equal(t, 28, subnet.PrefixLen)
+		}
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, allocate(allocs[0], fmt.Sprintf("a%d", i)))
+	}
+	require.Error(t, allocate(allocs[0], "a3"), "peer quota")
+	// Asking again for an existing allocation is fine
+	require.NoError(t, allocate(allocs[0], "a0"))
+
+	// The quota applies however addresses in the pool are asked for
+	_, poolSubnet, _ := address.ParseCIDR("10.0.1.0/28")
+	_, err = allocs[0].Allocate("x0", poolSubnet.HostRange(), returnFalse)
+	require.Error(t, err, "peer quota for plain allocation")
+	require.Error(t, allocs[0].Claim("x1", poolSubnet.Start+10, false, false), "peer quota for claim")
+	_, universe, _ := address.ParseCIDR(cidr)
+	for i := 0; i < 20; i++ {
+		addr, err := allocs[0].Allocate(fmt.Sprintf("x%d", i), universe.HostRange(), returnFalse)
+		require.NoError(t, err)
+		require.False(t, status.Pool.contains(addr), "address %s outside pool", addr)
+	}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, allocs[0].Delete(fmt.Sprintf("x%d", i)))
+	}
+
+	for _, alloc := range allocs {
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+	}
+	router.Flush()
+	require.NoError(t, allocate(allocs[1], "b0"))
+	require.NoError(t, allocate(allocs[1], "b1"))
+	require.Error(t, allocate(allocs[1], "b2"), "cluster quota")
+
+	addr, _, err := allocs[1].LookupInPool("b1", "frontend")
+	require.NoError(t, err)
+	require.True(t, status.Pool.contains(addr), "address %s in pool", addr)
+
+	require.NoError(t, allocs[1].DeletePool("frontend"))
+	router.Flush()
+	require.Empty(t, allocs[0].Pools())
+}
+
+func TestStickyAddresses(t *testing.T) {
+	const (
+		holdTime = time.Minute
+	)
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/26", 1)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.SetStickyConfig(StickyConfig{HoldTime: holdTime})
+	alloc.Start()
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	addr1, err := alloc.AllocateSticky("container1", "web", subnet, returnFalse)
+	require.NoError(t, err)
+	require.NoError(t, alloc.Delete("container1"))
+
+	// While held, the address isn't given to anyone else...
+	addr2, err := alloc.Allocate("container2", subnet, returnFalse)
+	require.NoError(t, err)
+	require.NotEqual(t, addr1, addr2, "held address allocated to another container")
+	require.Error(t, alloc.Claim("container2", addr1, false, false), "claim of held address")
+
+	// ...but is given back to a container with the same key
+	addr3, err := alloc.AllocateSticky("container3", "web", subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr1, addr3, "sticky address")
+
+	// Once the hold expires, the address is freed
+	alloc.ContainerDestroyed("container3")
+	alloc.actionChan <- func() { alloc.now = func() time.Time { return time.Now().Add(holdTime * 2) } }
+	alloc.actionChan <- func() { alloc.releaseExpiredHolds() }
+	addr4, err := alloc.Allocate("container4", subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr1, addr4, "address freed after hold expired")
+}
+
+func TestReconcile(t *testing.T) {
+	var (
+		gone    = strings.Repeat("1", 64)
+		stopped = strings.Repeat("2", 64)
+		revived = strings.Repeat("3", 64)
+		late    = strings.Repeat("4", 64)
+	)
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/26", 1)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.Start()
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	for _, ident := range []string{gone, stopped, revived, "weave:expose"} {
+		_, err := alloc.Allocate(ident, subnet, returnFalse)
+		require.NoError(t, err)
+	}
+	alloc.ContainerDied(revived)
+
+	// A container attached after the list was taken isn't in it
+	since := time.Now()
+	_, err := alloc.Allocate(late, subnet, returnFalse)
+	require.NoError(t, err)
+
+	alloc.Reconcile(map[string]bool{stopped: false, revived: true}, since)
+	require.Len(t, alloc.Allocations(AllocationFilter{ContainerID: gone}), 0, "addresses of vanished container")
+	require.Len(t, alloc.Allocations(AllocationFilter{ContainerID: "weave:expose"}), 1, "addresses of non-container")
+	require.Len(t, alloc.Allocations(AllocationFilter{ContainerID: late}), 1, "addresses of container attached since")
+
+	// The stopped container's addresses go after the usual delay,
+	// and the running one's stay
+	alloc.actionChan <- func() { alloc.now = func() time.Time { return time.Now().Add(containerDiedTimeout * 2) } }
+	alloc.actionChan <- func() { alloc.removeDeadContainers() }
+	require.Len(t, alloc.Allocations(AllocationFilter{ContainerID: stopped}), 0, "addresses of stopped container")
+	require.Len(t, alloc.Allocations(AllocationFilter{ContainerID: revived}), 1, "addresses of running container")
+}
+
+func TestRebalance(t *testing.T) {
+	const (
+		cidr = "10.0.1.0/24"
+	)
+	allocs, router, subnet := makeNetworkOfAllocators(2, cidr)
+	defer stopNetworkOfAllocators(allocs)
+	rich, poor := allocs[0], allocs[1]
+	rebalance := func(alloc *Allocator) {
+		done := make(chan struct{})
+		alloc.actionChan <- func() {
+			alloc.lastRebalance = time.Time{}
+			alloc.considerRebalancing()
+			close(done)
+		}
+		<-done
+		router.Flush()
+	}
+	for _, alloc := range allocs {
+		alloc := alloc
+		alloc.actionChan <- func() { alloc.rebalance = RebalanceConfig{Interval: time.Second, LowWater: 0.1, HighWater: 0.5} }
+	}
+
+	// Use up nearly all the poor peer's space
+	for i := 0; i < 120; i++ {
+		_, err := poor.Allocate(fmt.Sprintf("container%d", i), subnet, returnFalse)
+		require.NoError(t, err)
+	}
+	poor.gossip.GossipBroadcast(poor.Gossip())
+	router.Flush()
+	before := poor.NumFreeAddresses(subnet)
+	require.True(t, before < 12, "poor peer should be nearly out of space")
+
+	// The poor peer has nothing to give
+	rebalance(poor)
+	require.Equal(t, before, poor.NumFreeAddresses(subnet))
+
+	rebalance(rich)
+	require.Equal(t, before+64, poor.NumFreeAddresses(subnet), "space given to poor peer")
+	require.Equal(t, 1, NewStatus(rich, address.CIDR{}).Rebalance.Transfers)
+
+	// Once topped up, the poor peer needs no more
+	poor.gossip.GossipBroadcast(poor.Gossip())
+	router.Flush()
+	rebalance(rich)
+	require.Equal(t, before+64, poor.NumFreeAddresses(subnet))
+}
+
+func TestCheckConsistency(t *testing.T) {
+	const (
+		cidr = "10.0.1.0/24"
+	)
+	allocs, router, subnet := makeNetworkOfAllocators(3, cidr)
+	defer stopNetworkOfAllocators(allocs)
+
+	_, err := allocs[0].CheckConsistency()
+	require.Error(t, err, "check before ring established")
+
+	for _, alloc := range allocs {
+		_, err := alloc.Allocate("container", subnet, returnFalse)
+		require.NoError(t, err)
+	}
+	for _, alloc := range allocs {
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+	}
+	router.Flush()
+
+	report, err := allocs[0].CheckConsistency()
+	require.NoError(t, err)
+	require.Len(t, report.Peers, 3)
+	require.Empty(t, report.Problems)
+}
+
+func TestAnalyseConsistency(t *testing.T) {
+	ip := func(s string) address.Address {
+		addr, _ := address.ParseIP(s)
+		return addr
+	}
+	var (
+		peer1, _ = mesh.PeerNameFromString("01:00:00:01:00:00")
+		peer2, _ = mesh.PeerNameFromString("02:00:00:01:00:00")
+		peer3, _ = mesh.PeerNameFromString("03:00:00:01:00:00")
+		peer4, _ = mesh.PeerNameFromString("04:00:00:01:00:00")
+		r1       = address.NewRange(ip("10.0.0.0"), 64)
+		r2       = address.NewRange(ip("10.0.0.32"), 64)
+		r3       = address.NewRange(ip("10.0.0.128"), 64)
+		r4       = address.NewRange(ip("10.0.0.192"), 64)
+	)
+	responses := map[mesh.PeerName]checkResponse{
+		peer1: {RingHash: 1, Owned: []address.Range{r1}},
+		peer2: {RingHash: 2, Owned: []address.Range{r2}, Outside: []address.Address{ip("10.0.0.200")}},
+	}
+	ringInfo := []ring.RangeInfo{{Peer: peer1, Range: r1}, {Peer: peer3, Range: r3}, {Peer: peer4, Range: r4}}
+	known := map[mesh.PeerName]bool{peer1: true, peer2: true, peer3: true}
+
+	report := analyseConsistency(peer1, responses, []mesh.PeerName{peer3, peer4}, ringInfo, known,
+		func(peer mesh.PeerName) string { return peer.String() })
+	require.Len(t, report.Peers, 2)
+	var kinds []string
+	for _, problem := range report.Problems {
+		kinds = append(kinds, problem.Kind)
+	}
+	require.Equal(t, []string{ProblemDivergent, ProblemOutside, ProblemOverlap, ProblemOrphan, ProblemNoAnswer}, kinds)
+	require.Contains(t, report.Problems[2].Description, "10.0.0.32-10.0.0.63")
+}
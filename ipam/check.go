@@ -0,0 +1,218 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Checking that the peers agree about who owns what.  We query every
+// peer in the ring for its view of the ring and the space it
+// allocates from, and look for disagreements.
+
+// Kinds of problem a consistency check can find
+const (
+	ProblemOverlap   = "overlap"   // two peers allocate from the same addresses
+	ProblemOrphan    = "orphan"    // a range is owned by a peer we don't know
+	ProblemDivergent = "divergent" // a peer's ring differs from ours
+	ProblemOutside   = "outside"   // a peer has allocated an address it doesn't own
+	ProblemNoAnswer  = "no-answer" // a peer could not be checked
+)
+
+// PeerCheck is what a peer told us about itself
+type PeerCheck struct {
+	Peer        string // name(nickname)
+	RingHash    string // of who owns what, as far as the peer knows
+	RingVersion uint64
+	Owned       []string // the ranges the peer allocates from
+	Outside     []string `json:",omitempty"` // addresses allocated outside those
+}
+
+// Problem is something wrong found by a consistency check, and what
+// to do about it
+type Problem struct {
+	Kind        string
+	Description string
+	Remedy      string
+}
+
+// ConsistencyReport is the result of a consistency check
+type ConsistencyReport struct {
+	Peers    []PeerCheck
+	Problems []Problem
+}
+
+type checkResponse struct {
+	RingHash    uint64
+	RingVersion uint64
+	Owned       []address.Range
+	Outside     []address.Address
+}
+
+func (alloc *Allocator) checkSelf() checkResponse {
+	hash, version := alloc.ring.Fingerprint()
+	owned := alloc.space.OwnedRanges()
+	response := checkResponse{RingHash: hash, RingVersion: version, Owned: owned}
+	for _, addrs := range alloc.owned {
+	nextAddr:
+		for _, addr := range addrs {
+			for _, r := range owned {
+				if r.Contains(addr) {
+					continue nextAddr
+				}
+			}
+			response.Outside = append(response.Outside, addr)
+		}
+	}
+	return response
+}
+
+// CheckConsistency (Sync) - ask all the peers in the ring for their
+// view of it, and report any disagreements
+func (alloc *Allocator) CheckConsistency() (*ConsistencyReport, error) {
+	var (
+		local    checkResponse
+		ringInfo []ring.RangeInfo
+		known    = make(map[mesh.PeerName]bool)
+		err      error
+	)
+	bodies, missing := alloc.queryPeers(msgCheckRequest, nil, func() []mesh.PeerName {
+		if alloc.ring.Empty() {
+			err = fmt.Errorf("IP allocation has not been initialised")
+			return nil
+		}
+		local = alloc.checkSelf()
+		ringInfo = alloc.ring.AllRangeInfo()
+		var peers []mesh.PeerName
+		for peer := range alloc.ring.PeerNames() {
+			known[peer] = peer == alloc.ourName || alloc.isKnownPeer(peer)
+			if peer != alloc.ourName {
+				peers = append(peers, peer)
+			}
+		}
+		return peers
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	responses := map[mesh.PeerName]checkResponse{alloc.ourName: local}
+	for peer, body := range bodies {
+		var response checkResponse
+		if err := gobDecode(body, &response); err != nil {
+			alloc.debugln("Unable to decode consistency check from", peer, ":", err)
+			missing = append(missing, peer)
+			continue
+		}
+		responses[peer] = response
+	}
+
+	reportChan := make(chan *ConsistencyReport)
+	alloc.actionChan <- func() {
+		reportChan <- analyseConsistency(alloc.ourName, responses, missing, ringInfo, known, alloc.peerDescription)
+	}
+	return <-reportChan, nil
+}
+
+// Another peer wants to check consistency
+func (alloc *Allocator) answerCheckRequest(sender mesh.PeerName, msg []byte) error {
+	return alloc.answerQuery(sender, msg, msgCheckResponse, func([]byte) (interface{}, error) {
+		return alloc.checkSelf(), nil
+	})
+}
+
+type ownedRange struct {
+	peer mesh.PeerName
+	address.Range
+}
+
+type ownedRanges []ownedRange
+
+func (o ownedRanges) Len() int           { return len(o) }
+func (o ownedRanges) Less(i, j int) bool { return o[i].Start < o[j].Start }
+func (o ownedRanges) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+
+// Work out what is wrong, given what each peer told us (including
+// ourselves), which peers didn't answer, and the ring and which of
+// the peers in it are known, as we see them
+func analyseConsistency(ourName mesh.PeerName, responses map[mesh.PeerName]checkResponse, missing []mesh.PeerName,
+	ringInfo []ring.RangeInfo, known map[mesh.PeerName]bool, describe func(mesh.PeerName) string) *ConsistencyReport {
+	report := &ConsistencyReport{Peers: []PeerCheck{}, Problems: []Problem{}}
+	problem := func(kind, remedy, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, Problem{Kind: kind, Description: fmt.Sprintf(format, args...), Remedy: remedy})
+	}
+
+	var peers []mesh.PeerName
+	for peer := range responses {
+		peers = append(peers, peer)
+	}
+	sort.Sort(peerNames(peers))
+
+	ours := responses[ourName]
+	var owned ownedRanges
+	for _, peer := range peers {
+		response := responses[peer]
+		check := PeerCheck{
+			Peer:        describe(peer),
+			RingHash:    fmt.Sprintf("%016x", response.RingHash),
+			RingVersion: response.RingVersion,
+			Owned:       []string{},
+		}
+		for _, r := range response.Owned {
+			check.Owned = append(check.Owned, r.String())
+			owned = append(owned, ownedRange{peer, r})
+		}
+		for _, addr := range response.Outside {
+			check.Outside = append(check.Outside, addr.String())
+		}
+		report.Peers = append(report.Peers, check)
+
+		if response.RingHash != ours.RingHash {
+			problem(ProblemDivergent,
+				"This is normal for a short while after ranges change hands. If it persists, check that "+describe(peer)+" is connected to the rest of the network.",
+				"%s disagrees with %s about who owns what (ring version %d, ours %d)", describe(peer), describe(ourName), response.RingVersion, ours.RingVersion)
+		}
+		if len(response.Outside) > 0 {
+			problem(ProblemOutside,
+				"Detach and re-attach the containers using these addresses so they get addresses from the peer's own space; they may clash with addresses allocated elsewhere.",
+				"%s has allocated %v outside the space it owns", describe(peer), check.Outside)
+		}
+	}
+
+	sort.Sort(owned)
+	for i := range owned {
+		for j := i + 1; j < len(owned) && owned[j].Start < owned[i].End; j++ {
+			if owned[j].peer == owned[i].peer {
+				continue
+			}
+			overlap := address.Range{Start: owned[j].Start, End: owned[j].End}
+			if owned[i].End < overlap.End {
+				overlap.End = owned[i].End
+			}
+			problem(ProblemOverlap,
+				"The same address may be allocated twice. Usually one of the peers was removed with 'rmpeer' while still running; run 'weave reset' on it and launch it again.",
+				"%s and %s both own %s", describe(owned[i].peer), describe(owned[j].peer), overlap)
+		}
+	}
+
+	for _, r := range ringInfo {
+		if !known[r.Peer] {
+			problem(ProblemOrphan,
+				"If "+describe(r.Peer)+" is gone for good, run 'weave rmpeer' for it on one (and only one) of the other peers.",
+				"%s is owned by %s, which is not connected", r.Range, describe(r.Peer))
+		}
+	}
+
+	sort.Sort(peerNames(missing))
+	for _, peer := range missing {
+		if known[peer] {
+			problem(ProblemNoAnswer,
+				"The peer may be running an older version of weave, or be overloaded; check it by hand.",
+				"%s could not be checked", describe(peer))
+		}
+	}
+	return report
+}
@@ -13,6 +13,7 @@ type claim struct {
 	ident            string
 	addr             address.Address
 	noErrorOnUnknown bool
+	allowReserved    bool
 }
 
 // Send an error (or nil for success) back to caller listening on resultChan
@@ -38,6 +39,11 @@ func (c *claim) Try(alloc *Allocator) bool {
 		return true
 	}
 
+	if alloc.reserved.contains(c.addr) && !c.allowReserved {
+		c.sendResult(fmt.Errorf("address %s is reserved", c.addr))
+		return true
+	}
+
 	alloc.establishRing()
 
 	// If we had heard that this container died, resurrect it
@@ -72,9 +78,21 @@ func (c *claim) Try(alloc *Allocator) bool {
 	// We are the owner, check we haven't given it to another container
 	switch existingIdent := alloc.findOwner(c.addr); existingIdent {
 	case "":
-		if err := alloc.space.Claim(c.addr); err == nil {
+		if key := alloc.heldFor(c.addr); key != "" {
+			c.sendResult(fmt.Errorf("address %s is being held for %s", c.addr, key))
+			break
+		}
+		if err := alloc.checkPoolQuotas(c.addr); err != nil {
+			c.sendResult(err)
+			break
+		}
+		spaceClaim := alloc.space.Claim
+		if c.allowReserved {
+			spaceClaim = alloc.space.ClaimReserved
+		}
+		if err := spaceClaim(c.addr); err == nil {
 			alloc.debugln("Claimed", c.addr, "for", c.ident)
-			alloc.addOwned(c.ident, c.addr)
+			alloc.addOwned(c.ident, c.addr, address.Range{}, "")
 			c.sendResult(nil)
 		} else {
 			c.sendResult(err)
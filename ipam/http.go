@@ -1,8 +1,11 @@
 package ipam
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -29,19 +32,89 @@ func parseCIDR(w http.ResponseWriter, cidrStr string) (address.CIDR, bool) {
 	return cidr, true
 }
 
-func (alloc *Allocator) handleHTTPAllocate(dockerCli *docker.Client, w http.ResponseWriter, ident string, checkAlive bool, subnet address.CIDR) {
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// The stable key to allocate for: as given in the request or, if
+// sticky addresses are enabled, the container's name or label
+func (alloc *Allocator) stickyKey(dockerCli *docker.Client, r *http.Request, ident string) string {
+	if key := r.FormValue("sticky"); key != "" {
+		return key
+	}
+	if alloc.sticky.HoldTime <= 0 || dockerCli == nil || ident == "_" {
+		return ""
+	}
+	key, err := dockerCli.StableName(ident, alloc.sticky.Label)
+	if err != nil {
+		common.Log.Debugln("[allocator]: unable to find stable name of", ident, ":", err)
+		return ""
+	}
+	return key
+}
+
+func printConsistencyReport(w http.ResponseWriter, report *ConsistencyReport) {
+	for _, peer := range report.Peers {
+		fmt.Fprintf(w, "%s: ring %s (version %d), owns %s\n", peer.Peer, peer.RingHash, peer.RingVersion, strings.Join(peer.Owned, ", "))
+	}
+	if len(report.Problems) == 0 {
+		fmt.Fprintln(w, "\nNo problems found.")
+		return
+	}
+	fmt.Fprintf(w, "\n%d problems found:\n", len(report.Problems))
+	for _, problem := range report.Problems {
+		fmt.Fprintf(w, "\n[%s] %s\n    %s\n", problem.Kind, problem.Description, problem.Remedy)
+	}
+}
+
+func printTakeoverPreview(w http.ResponseWriter, preview *TakeoverPreview) {
+	state := "not connected"
+	if preview.Alive {
+		state = "CONNECTED - removing it while it is running will lead to duplicate IP addresses"
+	}
+	fmt.Fprintf(w, "Peer %s is %s\n", preview.Peer, state)
+	if preview.LastHeard != nil {
+		fmt.Fprintf(w, "Last heard from at %s\n", preview.LastHeard.Format(time.RFC3339))
+	} else {
+		fmt.Fprintln(w, "Not heard from since this peer started")
+	}
+	if len(preview.Ranges) == 0 {
+		fmt.Fprintln(w, "It owns no ranges; nothing would move")
+		return
+	}
+	fmt.Fprintf(w, "Would take over %d addresses (%d in use) in %s\n",
+		preview.Size, preview.Size-preview.Free, strings.Join(preview.Ranges, ", "))
+}
+
+// Allocate in the subnet or, if pool is given, in the pool (restricted
+// to the subnet if that is non-zero)
+func (alloc *Allocator) handleHTTPAllocate(dockerCli *docker.Client, w http.ResponseWriter, ident string, sticky string, checkAlive bool, subnet address.CIDR, pool string) {
 	closedChan := w.(http.CloseNotifier).CloseNotify()
-	addr, err := alloc.Allocate(ident, subnet.HostRange(),
-		func() bool {
-			select {
-			case <-closedChan:
-				return true
-			default:
-				res := checkAlive && dockerCli != nil && dockerCli.IsContainerNotRunning(ident)
-				checkAlive = false // we check only once; if the container dies later we learn about that through events
-				return res
-			}
-		})
+	hasBeenCancelled := func() bool {
+		select {
+		case <-closedChan:
+			return true
+		default:
+			res := checkAlive && dockerCli != nil && dockerCli.IsContainerNotRunning(ident)
+			checkAlive = false // we check only once; if the container dies later we learn about that through events
+			return res
+		}
+	}
+	var (
+		addr address.Address
+		err  error
+	)
+	if pool != "" {
+		addr, subnet, err = alloc.AllocateInPool(ident, sticky, pool, subnet, hasBeenCancelled)
+	} else {
+		addr, err = alloc.AllocateSticky(ident, sticky, subnet.HostRange(), hasBeenCancelled)
+	}
 	if err != nil {
 		if _, ok := err.(*errorCancelled); ok { // cancellation is not really an error
 			common.Log.Infoln("[allocator]:", err.Error())
@@ -61,15 +134,125 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 		fmt.Fprintf(w, "%s", defaultSubnet)
 	})
 
+	router.Methods("GET").Path("/ip").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var filter AllocationFilter
+		filter.ContainerID = r.FormValue("container")
+		if subnetStr := r.FormValue("subnet"); subnetStr != "" {
+			subnet, ok := parseCIDR(w, subnetStr)
+			if !ok {
+				return
+			}
+			filter.Subnet = subnet.Range()
+		}
+		if addrStr := r.FormValue("address"); addrStr != "" {
+			addr, err := address.ParseIP(addrStr)
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			filter.Address = addr
+		}
+
+		var result struct {
+			Allocations []Allocation
+			Missing     []string `json:",omitempty"` // peers that didn't answer
+		}
+		if r.FormValue("cluster") == "true" {
+			result.Allocations, result.Missing = alloc.ClusterAllocations(filter)
+		} else {
+			result.Allocations = alloc.Allocations(filter)
+		}
+		writeJSON(w, result)
+	})
+
+	router.Methods("GET").Path("/consistency").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, err := alloc.CheckConsistency()
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		if r.Header.Get("Accept") == "application/json" {
+			writeJSON(w, report)
+			return
+		}
+		printConsistencyReport(w, report)
+	})
+
+	router.Methods("GET").Path("/reserved").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reserved := []string{}
+		for _, rr := range alloc.Reservations() {
+			reserved = append(reserved, formatReservation(rr))
+		}
+		writeJSON(w, reserved)
+	})
+
+	router.Methods("PUT").Path("/reserved").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reserved []string
+		if err := json.NewDecoder(r.Body).Decode(&reserved); err != nil {
+			badRequest(w, fmt.Errorf("Unable to parse reservations: %s", err))
+			return
+		}
+		var ranges []address.Range
+		for _, s := range reserved {
+			rr, err := ParseReservation(s)
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			ranges = append(ranges, rr)
+		}
+		if err := alloc.SetReservations(ranges); err != nil {
+			badRequest(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	router.Methods("GET").Path("/pools").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, alloc.Pools())
+	})
+
+	router.Methods("GET").Path("/pools/{name}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, found := alloc.PoolByName(mux.Vars(r)["name"])
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, status)
+	})
+
+	router.Methods("PUT").Path("/pools/{name}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pool Pool
+		if err := json.NewDecoder(r.Body).Decode(&pool); err != nil {
+			badRequest(w, fmt.Errorf("Unable to parse pool: %s", err))
+			return
+		}
+		pool.Name = mux.Vars(r)["name"]
+		if err := alloc.SetPool(pool); err != nil {
+			badRequest(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	router.Methods("DELETE").Path("/pools/{name}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := alloc.DeletePool(mux.Vars(r)["name"]); err != nil {
+			badRequest(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
 	router.Methods("PUT").Path("/ip/{id}/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		ident := vars["id"]
 		ipStr := vars["ip"]
 		noErrorOnUnknown := r.FormValue("noErrorOnUnknown") == "true"
+		allowReserved := r.FormValue("allowReserved") == "true"
 		if ip, err := address.ParseIP(ipStr); err != nil {
 			badRequest(w, err)
 			return
-		} else if err := alloc.Claim(ident, ip, noErrorOnUnknown); err != nil {
+		} else if err := alloc.Claim(ident, ip, noErrorOnUnknown, allowReserved); err != nil {
 			badRequest(w, fmt.Errorf("Unable to claim: %s", err))
 			return
 		}
@@ -90,6 +273,15 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 	})
 
 	router.Methods("GET").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pool := r.FormValue("pool"); pool != "" {
+			addr, subnet, err := alloc.LookupInPool(mux.Vars(r)["id"], pool)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, "%s/%d", addr, subnet.PrefixLen)
+			return
+		}
 		addr, err := alloc.Lookup(mux.Vars(r)["id"], defaultSubnet.HostRange())
 		if err != nil {
 			http.NotFound(w, r)
@@ -101,13 +293,17 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 	router.Methods("POST").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		if subnet, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"]); ok {
-			alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", subnet)
+			alloc.handleHTTPAllocate(dockerCli, w, vars["id"], alloc.stickyKey(dockerCli, r, vars["id"]), r.FormValue("check-alive") == "true", subnet, r.FormValue("pool"))
 		}
 	})
 
 	router.Methods("POST").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", defaultSubnet)
+		subnet, pool := defaultSubnet, r.FormValue("pool")
+		if pool != "" {
+			subnet = address.CIDR{} // any of the pool's subnets
+		}
+		alloc.handleHTTPAllocate(dockerCli, w, vars["id"], alloc.stickyKey(dockerCli, r, vars["id"]), r.FormValue("check-alive") == "true", subnet, pool)
 	})
 
 	router.Methods("DELETE").Path("/ip/{id}/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -140,9 +336,22 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 		w.WriteHeader(204)
 	})
 
+	router.Methods("GET").Path("/peer/{id}/rmpeer-preview").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		preview, err := alloc.PreviewTakeoverRanges(mux.Vars(r)["id"])
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		if r.Header.Get("Accept") == "application/json" {
+			writeJSON(w, preview)
+			return
+		}
+		printTakeoverPreview(w, preview)
+	})
+
 	router.Methods("DELETE").Path("/peer/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ident := mux.Vars(r)["id"]
-		if err := alloc.AdminTakeoverRanges(ident); err != nil {
+		if err := alloc.AdminTakeoverRanges(ident, r.FormValue("force") == "true"); err != nil {
 			badRequest(w, err)
 			return
 		}
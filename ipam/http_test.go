@@ -171,3 +171,32 @@ func TestHTTPCancel(t *testing.T) {
 		require.FailNow(t, "Error: Allocate returned non-nil", string(body))
 	}
 }
+
+func TestHTTPRmpeerPreview(t *testing.T) {
+	const cidr = "10.0.1.7/22"
+	allocs, router, subnet := makeNetworkOfAllocators(2, cidr)
+	defer stopNetworkOfAllocators(allocs)
+	alloc1, alloc2 := allocs[0], allocs[1]
+	_, err := alloc2.Allocate("foo", subnet, returnFalse)
+	require.NoError(t, err)
+	alloc2.gossip.GossipBroadcast(alloc2.Gossip())
+	router.Flush()
+	_, universe, _ := address.ParseCIDR(cidr)
+	port := listenHTTP(alloc1, universe)
+	peerURL := fmt.Sprintf("http://localhost:%d/peer/%s", port, alloc2.ourName)
+
+	preview := HTTPGet(t, peerURL+"/rmpeer-preview")
+	require.Contains(t, preview, "CONNECTED")
+	require.Contains(t, preview, "Would take over")
+
+	// Refused, because the peer is connected; the ranges stay put
+	resp, err := doHTTP("DELETE", peerURL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, preview, HTTPGet(t, peerURL+"/rmpeer-preview"))
+
+	resp, err = doHTTP("DELETE", peerURL+"?force=true")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Contains(t, HTTPGet(t, peerURL+"/rmpeer-preview"), "nothing would move")
+}
@@ -0,0 +1,397 @@
+package ipam
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A Pool is a named set of subnets within the universe, which
+// addresses can be allocated from by name, optionally limited in how
+// many may be allocated.  Like reservations, the set of pools is
+// gossiped and replaced as a whole.
+//
+// An address counts against a pool if it is in any of the pool's
+// subnets, however it came to be allocated, and the quotas apply to
+// allocating or claiming it however that is asked for.  The
+// cluster-wide quota
+// is enforced using the counts each peer gossips for its own
+// addresses, so it can be overshot briefly when several peers
+// allocate from the same pool at once.
+type Pool struct {
+	Name      string
+	Subnets   []string
+	Quota     int `json:",omitempty"` // addresses across the cluster; 0 for no limit
+	PeerQuota int `json:",omitempty"` // addresses on any one peer; 0 for no limit
+
+	subnets []address.CIDR
+}
+
+type pools struct {
+	Version uint64
+	Peer    mesh.PeerName // who made this version, to break ties
+	Pools   []Pool
+}
+
+// How many addresses a peer has in each pool
+type poolUsage struct {
+	Version uint64
+	Counts  map[string]int
+}
+
+// PoolStatus is a pool along with how many of its addresses are in use
+type PoolStatus struct {
+	Pool
+	Local   int // on this peer
+	Cluster int // on all peers, as far as we know
+}
+
+func (p pools) supersedes(other pools) bool {
+	return p.Version > other.Version || (p.Version == other.Version && p.Peer > other.Peer)
+}
+
+func (p pools) find(name string) *Pool {
+	for i := range p.Pools {
+		if p.Pools[i].Name == name {
+			return &p.Pools[i]
+		}
+	}
+	return nil
+}
+
+// ParsePool parses a pool given as name:cidr[,cidr...][:quota=N][:peer-quota=N]
+func ParsePool(s string) (Pool, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 {
+		return Pool{}, fmt.Errorf("invalid pool %q; expected name:cidr[,cidr...][:quota=N][:peer-quota=N]", s)
+	}
+	pool := Pool{Name: parts[0], Subnets: strings.Split(parts[1], ",")}
+	for _, option := range parts[2:] {
+		i := strings.Index(option, "=")
+		if i < 0 {
+			return Pool{}, fmt.Errorf("invalid pool option %q; expected key=value", option)
+		}
+		n, err := strconv.Atoi(option[i+1:])
+		if err != nil || n < 0 {
+			return Pool{}, fmt.Errorf("invalid value for pool option %q", option)
+		}
+		switch option[:i] {
+		case "quota":
+			pool.Quota = n
+		case "peer-quota":
+			pool.PeerQuota = n
+		default:
+			return Pool{}, fmt.Errorf("unknown pool option %q", option[:i])
+		}
+	}
+	return pool, nil
+}
+
+// Check a pool definition, and parse its subnets
+func (pool *Pool) parse(universe address.Range) error {
+	if pool.Name == "" || strings.ContainsAny(pool.Name, ":,/?&") {
+		return fmt.Errorf("invalid pool name %q", pool.Name)
+	}
+	if len(pool.Subnets) == 0 {
+		return fmt.Errorf("pool %s has no subnets", pool.Name)
+	}
+	if pool.Quota < 0 || pool.PeerQuota < 0 {
+		return fmt.Errorf("pool %s has a negative quota", pool.Name)
+	}
+	pool.subnets = nil
+	for _, s := range pool.Subnets {
+		subnetAddr, cidr, err := address.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		if cidr.Start != subnetAddr {
+			return fmt.Errorf("invalid subnet %s in pool %s - bits after network prefix are not all zero", s, pool.Name)
+		}
+		if cidr.Size() < MinSubnetSize {
+			return fmt.Errorf("subnet %s in pool %s is smaller than minimum size %d", s, pool.Name, MinSubnetSize)
+		}
+		if r := cidr.Range(); r.Start < universe.Start || r.End > universe.End {
+			return fmt.Errorf("subnet %s in pool %s is not within the allocation range %s", s, pool.Name, universe.AsCIDRString())
+		}
+		pool.subnets = append(pool.subnets, cidr)
+	}
+	return nil
+}
+
+func (pool *Pool) contains(addr address.Address) bool {
+	for _, subnet := range pool.subnets {
+		if subnet.Range().Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (alloc *Allocator) checkPools(ps []Pool) error {
+	names := make(map[string]struct{})
+	for i := range ps {
+		if err := ps[i].parse(alloc.universe); err != nil {
+			return err
+		}
+		if _, found := names[ps[i].Name]; found {
+			return fmt.Errorf("duplicate pool %s", ps[i].Name)
+		}
+		names[ps[i].Name] = struct{}{}
+	}
+	return nil
+}
+
+func (alloc *Allocator) setPools(p pools) {
+	// Gossip doesn't carry the parsed subnets
+	if err := alloc.checkPools(p.Pools); err != nil {
+		alloc.infof("Ignoring invalid pools: %s", err)
+		return
+	}
+	alloc.pools = p
+}
+
+// Number of our addresses in the pool
+func (alloc *Allocator) localPoolCount(pool *Pool) int {
+	count := 0
+	for _, addrs := range alloc.owned {
+		for _, addr := range addrs {
+			if pool.contains(addr) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func (alloc *Allocator) clusterPoolCount(pool *Pool) int {
+	count := alloc.localPoolCount(pool)
+	for peer, usage := range alloc.poolUsage {
+		if peer != alloc.ourName {
+			count += usage.Counts[pool.Name]
+		}
+	}
+	return count
+}
+
+func (alloc *Allocator) checkPoolQuota(pool *Pool) error {
+	if pool.PeerQuota > 0 && alloc.localPoolCount(pool) >= pool.PeerQuota {
+		return fmt.Errorf("pool %s is limited to %d addresses per peer", pool.Name, pool.PeerQuota)
+	}
+	if pool.Quota > 0 && alloc.clusterPoolCount(pool) >= pool.Quota {
+		return fmt.Errorf("pool %s is limited to %d addresses", pool.Name, pool.Quota)
+	}
+	return nil
+}
+
+// Check the quotas of all the pools addr is in
+func (alloc *Allocator) checkPoolQuotas(addr address.Address) error {
+	for i := range alloc.pools.Pools {
+		if pool := &alloc.pools.Pools[i]; pool.contains(addr) {
+			if err := alloc.checkPoolQuota(pool); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The parts of r outside the subnets of pools that have reached
+// their quotas, along with the error for a pool that has, if r
+// overlaps any
+func (alloc *Allocator) rangesWithinQuotas(r address.Range) ([]address.Range, error) {
+	ranges := []address.Range{r}
+	var quotaErr error
+	for i := range alloc.pools.Pools {
+		pool := &alloc.pools.Pools[i]
+		err := alloc.checkPoolQuota(pool)
+		if err == nil {
+			continue
+		}
+		for _, subnet := range pool.subnets {
+			if subnet.Range().Overlaps(r) {
+				quotaErr = err
+				ranges = excludeRange(ranges, subnet.Range())
+			}
+		}
+	}
+	return ranges, quotaErr
+}
+
+func excludeRange(ranges []address.Range, x address.Range) []address.Range {
+	var result []address.Range
+	for _, r := range ranges {
+		if !r.Overlaps(x) {
+			result = append(result, r)
+			continue
+		}
+		if r.Start < x.Start {
+			result = append(result, address.Range{Start: r.Start, End: x.Start})
+		}
+		if x.End < r.End {
+			result = append(result, address.Range{Start: x.End, End: r.End})
+		}
+	}
+	return result
+}
+
+// Bring our own entry in poolUsage up to date, for gossiping
+func (alloc *Allocator) updatePoolUsage() {
+	counts := make(map[string]int)
+	for i := range alloc.pools.Pools {
+		pool := &alloc.pools.Pools[i]
+		if count := alloc.localPoolCount(pool); count > 0 {
+			counts[pool.Name] = count
+		}
+	}
+	ours := alloc.poolUsage[alloc.ourName]
+	if !equalCounts(counts, ours.Counts) {
+		alloc.poolUsage[alloc.ourName] = poolUsage{Version: ours.Version + 1, Counts: counts}
+	}
+}
+
+func equalCounts(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, count := range a {
+		if b[name] != count {
+			return false
+		}
+	}
+	return true
+}
+
+func (alloc *Allocator) mergePoolUsage(usage map[mesh.PeerName]poolUsage) {
+	for peer, u := range usage {
+		if peer != alloc.ourName && u.Version > alloc.poolUsage[peer].Version {
+			alloc.poolUsage[peer] = u
+		}
+	}
+}
+
+// Forget the usage of peers which have gone
+func (alloc *Allocator) prunePoolUsage() {
+	ringPeers := alloc.ring.PeerNames()
+	for peer := range alloc.poolUsage {
+		if _, ok := ringPeers[peer]; !ok && peer != alloc.ourName && !alloc.isKnownPeer(peer) {
+			delete(alloc.poolUsage, peer)
+		}
+	}
+}
+
+// SetLaunchPools (Async) - the pools given on the command line.  These
+// are superseded by any defined since, elsewhere in the cluster or on
+// this peer.
+func (alloc *Allocator) SetLaunchPools(ps []Pool) error {
+	if err := alloc.checkPools(ps); err != nil {
+		return err
+	}
+	alloc.actionChan <- func() {
+		p := pools{Version: launchConfigVersion, Peer: alloc.ourName, Pools: ps}
+		if p.supersedes(alloc.pools) {
+			alloc.pools = p
+		}
+	}
+	return nil
+}
+
+// SetPool (Sync) - define or redefine a pool across the cluster
+func (alloc *Allocator) SetPool(pool Pool) error {
+	return alloc.changePools(func(ps []Pool) []Pool {
+		for i := range ps {
+			if ps[i].Name == pool.Name {
+				ps[i] = pool
+				return ps
+			}
+		}
+		return append(ps, pool)
+	})
+}
+
+// DeletePool (Sync) - remove a pool across the cluster.  Addresses
+// already allocated from it are unaffected.
+func (alloc *Allocator) DeletePool(name string) error {
+	return alloc.changePools(func(ps []Pool) []Pool {
+		for i := range ps {
+			if ps[i].Name == name {
+				return append(ps[:i], ps[i+1:]...)
+			}
+		}
+		return ps
+	})
+}
+
+func (alloc *Allocator) changePools(change func([]Pool) []Pool) error {
+	resultChan := make(chan error)
+	alloc.actionChan <- func() {
+		ps := change(append([]Pool(nil), alloc.pools.Pools...))
+		if err := alloc.checkPools(ps); err != nil {
+			resultChan <- err
+			return
+		}
+		alloc.pools = pools{Version: alloc.pools.Version + 1, Peer: alloc.ourName, Pools: ps}
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+		resultChan <- nil
+	}
+	return <-resultChan
+}
+
+func (alloc *Allocator) poolStatus(pool *Pool) PoolStatus {
+	return PoolStatus{Pool: *pool, Local: alloc.localPoolCount(pool), Cluster: alloc.clusterPoolCount(pool)}
+}
+
+// Pools (Sync) - all the pools, with their usage
+func (alloc *Allocator) Pools() []PoolStatus {
+	resultChan := make(chan []PoolStatus)
+	alloc.actionChan <- func() {
+		result := []PoolStatus{}
+		for i := range alloc.pools.Pools {
+			result = append(result, alloc.poolStatus(&alloc.pools.Pools[i]))
+		}
+		resultChan <- result
+	}
+	return <-resultChan
+}
+
+// PoolByName (Sync)
+func (alloc *Allocator) PoolByName(name string) (PoolStatus, bool) {
+	type result struct {
+		status PoolStatus
+		found  bool
+	}
+	resultChan := make(chan result)
+	alloc.actionChan <- func() {
+		if pool := alloc.pools.find(name); pool != nil {
+			resultChan <- result{alloc.poolStatus(pool), true}
+			return
+		}
+		resultChan <- result{}
+	}
+	r := <-resultChan
+	return r.status, r.found
+}
+
+// LookupInPool (Sync) - get the existing address for a container in
+// any of the pool's subnets
+func (alloc *Allocator) LookupInPool(ident string, name string) (address.Address, address.CIDR, error) {
+	resultChan := make(chan allocateResult)
+	alloc.actionChan <- func() {
+		pool := alloc.pools.find(name)
+		if pool == nil {
+			resultChan <- allocateResult{err: fmt.Errorf("unknown pool %s", name)}
+			return
+		}
+		for _, subnet := range pool.subnets {
+			if addr, found := alloc.lookupOwned(ident, subnet.HostRange()); found {
+				resultChan <- allocateResult{addr: addr, subnet: subnet}
+				return
+			}
+		}
+		resultChan <- allocateResult{err: fmt.Errorf("lookup: no address found for %s in pool %s", ident, name)}
+	}
+	result := <-resultChan
+	return result.addr, result.subnet, result.err
+}
@@ -0,0 +1,150 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// Asking other peers something and gathering up their answers, for
+// cluster-wide listings and checks.  The request goes to each peer
+// in a unicast message, and each answers with a unicast message
+// carrying the same query ID.  Only peers that have said (in their
+// gossip) that they understand these messages get asked, since older
+// peers would choke on them.
+
+const clusterQueryTimeout = 3 * time.Second
+
+// The body of query requests and responses
+type queryMessage struct {
+	ID   uint64
+	Body []byte // the gob-encoded request or response
+}
+
+type queryResponse struct {
+	peer mesh.PeerName
+	body []byte
+}
+
+// A query awaiting responses
+type query struct {
+	responses chan queryResponse
+	pending   map[mesh.PeerName]struct{} // peers yet to answer
+}
+
+// queryPeers (Sync) - send the request, if any, to the peers returned
+// by choosePeers, which is called in the actor, and gather the bodies
+// of their responses, as far as they answer within a timeout.  Also
+// returns the peers which did not answer, or could not be asked.
+func (alloc *Allocator) queryPeers(requestType byte, request interface{}, choosePeers func() []mesh.PeerName) (map[mesh.PeerName][]byte, []mesh.PeerName) {
+	type started struct {
+		id     uint64
+		query  *query
+		asked  int
+		unable []mesh.PeerName
+	}
+	startedChan := make(chan started)
+	alloc.actionChan <- func() {
+		peers := choosePeers()
+		alloc.lastQueryID++
+		s := started{id: alloc.lastQueryID}
+		s.query = &query{
+			responses: make(chan queryResponse, len(peers)),
+			pending:   make(map[mesh.PeerName]struct{}),
+		}
+		var body []byte
+		if request != nil {
+			body = gobEncode(request)
+		}
+		msg := append([]byte{requestType}, gobEncode(queryMessage{s.id, body})...)
+		for _, peer := range peers {
+			if !alloc.queryable[peer] {
+				s.unable = append(s.unable, peer)
+				continue
+			}
+			if err := alloc.gossip.GossipUnicast(peer, msg); err != nil {
+				alloc.debugln("Unable to send query", s.id, "to", peer, ":", err)
+				s.unable = append(s.unable, peer)
+				continue
+			}
+			s.query.pending[peer] = struct{}{}
+			s.asked++
+		}
+		alloc.queries[s.id] = s.query
+		startedChan <- s
+	}
+	s := <-startedChan
+
+	responses := make(map[mesh.PeerName][]byte)
+	timeout := time.After(clusterQueryTimeout)
+loop:
+	for i := 0; i < s.asked; i++ {
+		select {
+		case response := <-s.query.responses:
+			responses[response.peer] = response.body
+		case <-timeout:
+			break loop
+		}
+	}
+
+	missingChan := make(chan []mesh.PeerName)
+	alloc.actionChan <- func() {
+		delete(alloc.queries, s.id)
+		missing := s.unable
+		for peer := range s.query.pending {
+			missing = append(missing, peer)
+		}
+		missingChan <- missing
+	}
+	return responses, <-missingChan
+}
+
+// Another peer has sent us a query; reply with a message of the given
+// type, holding what answer makes of the request body
+func (alloc *Allocator) answerQuery(sender mesh.PeerName, msg []byte, responseType byte, answer func(request []byte) (interface{}, error)) error {
+	var request queryMessage
+	if err := gobDecode(msg, &request); err != nil {
+		return err
+	}
+	response, err := answer(request.Body)
+	if err != nil {
+		return err
+	}
+	reply := append([]byte{responseType}, gobEncode(queryMessage{request.ID, gobEncode(response)})...)
+	return alloc.gossip.GossipUnicast(sender, reply)
+}
+
+func (alloc *Allocator) queryResponse(sender mesh.PeerName, msg []byte) error {
+	var response queryMessage
+	if err := gobDecode(msg, &response); err != nil {
+		return err
+	}
+	// Late or unexpected responses are not worth breaking the
+	// connection over
+	query, found := alloc.queries[response.ID]
+	if !found {
+		alloc.debugln("Ignoring response from", sender, "to expired query", response.ID)
+		return nil
+	}
+	if _, pending := query.pending[sender]; !pending {
+		alloc.debugln("Ignoring unexpected response from", sender, "to query", response.ID)
+		return nil
+	}
+	delete(query.pending, sender)
+	query.responses <- queryResponse{sender, response.Body}
+	return nil
+}
+
+func gobDecode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func gobEncode(data interface{}) []byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(data); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
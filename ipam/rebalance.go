@@ -0,0 +1,166 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Rebalancing: rather than waiting for a peer to run out of space and
+// ask for more, peers with plenty of free space periodically give
+// some to peers that are running low, judging by the free space each
+// peer reports in the ring.  To avoid several peers giving to the same
+// one at once, only the peer with the most free space gives, and only
+// one range at a time; the recipient's newly reported free space then
+// shows whether it needs more.
+
+// How many intervals ahead we look when deciding whether a peer's
+// free space is running out
+const exhaustionHorizon = 3
+
+// RebalanceConfig controls rebalancing
+type RebalanceConfig struct {
+	Interval  time.Duration // how often to consider rebalancing; 0 disables it
+	LowWater  float64       // fraction of its space below which a peer is given more
+	HighWater float64       // fraction of its space above which a peer gives some away
+}
+
+// RebalanceStatus describes how evenly free space is spread
+type RebalanceStatus struct {
+	Imbalance float64  // percentage points between the peers with the most and least of their space free
+	Needy     []string // peers running low on space
+	Transfers int      // ranges this peer has given away to rebalance
+}
+
+// SetRebalanceConfig must be called before Start
+func (alloc *Allocator) SetRebalanceConfig(config RebalanceConfig) {
+	alloc.rebalance = config
+}
+
+func freeFraction(s ring.PeerSpace) float64 {
+	if s.Size == 0 {
+		return 0
+	}
+	return float64(s.Free) / float64(s.Size)
+}
+
+// Is the peer low on space, or heading that way given how much its
+// free space fell since we last looked?
+func (alloc *Allocator) isNeedy(peer mesh.PeerName, s ring.PeerSpace) bool {
+	if freeFraction(s) < alloc.rebalance.LowWater {
+		return true
+	}
+	previous, found := alloc.lastFree[peer]
+	return found && s.Free < previous && s.Free < (previous-s.Free)*exhaustionHorizon
+}
+
+// The peers that could use more space, neediest first
+func (alloc *Allocator) needyPeers(spaces map[mesh.PeerName]ring.PeerSpace) []mesh.PeerName {
+	var needy []mesh.PeerName
+	for peer, s := range spaces {
+		if (peer == alloc.ourName || alloc.isKnownPeer(peer)) && alloc.isNeedy(peer, s) {
+			needy = append(needy, peer)
+		}
+	}
+	sort.Sort(byFreeFraction{needy, spaces})
+	return needy
+}
+
+type byFreeFraction struct {
+	peers  []mesh.PeerName
+	spaces map[mesh.PeerName]ring.PeerSpace
+}
+
+func (b byFreeFraction) Len() int      { return len(b.peers) }
+func (b byFreeFraction) Swap(i, j int) { b.peers[i], b.peers[j] = b.peers[j], b.peers[i] }
+func (b byFreeFraction) Less(i, j int) bool {
+	fi, fj := freeFraction(b.spaces[b.peers[i]]), freeFraction(b.spaces[b.peers[j]])
+	return fi < fj || (fi == fj && b.peers[i] < b.peers[j])
+}
+
+// The peer which should give space away, if any: the one with the
+// most free space, provided that is enough of its own space
+func (alloc *Allocator) richestPeer(spaces map[mesh.PeerName]ring.PeerSpace) mesh.PeerName {
+	richest := mesh.UnknownPeerName
+	for peer, s := range spaces {
+		if freeFraction(s) <= alloc.rebalance.HighWater || (peer != alloc.ourName && !alloc.isKnownPeer(peer)) {
+			continue
+		}
+		if r, found := spaces[richest]; !found || s.Free > r.Free || (s.Free == r.Free && peer > richest) {
+			richest = peer
+		}
+	}
+	return richest
+}
+
+func (alloc *Allocator) considerRebalancing() {
+	if alloc.rebalance.Interval <= 0 || alloc.ring.Empty() || alloc.shuttingDown {
+		return
+	}
+	now := alloc.now()
+	if now.Sub(alloc.lastRebalance) < alloc.rebalance.Interval {
+		return
+	}
+	alloc.lastRebalance = now
+
+	spaces := alloc.ring.SpaceByPeer()
+	defer func() {
+		alloc.lastFree = make(map[mesh.PeerName]address.Offset)
+		for peer, s := range spaces {
+			alloc.lastFree[peer] = s.Free
+		}
+	}()
+
+	if alloc.richestPeer(spaces) != alloc.ourName {
+		return
+	}
+	for _, to := range alloc.needyPeers(spaces) {
+		if to == alloc.ourName {
+			continue
+		}
+		chunk, ok := alloc.space.Donate(alloc.universe)
+		if !ok {
+			return
+		}
+		ours, theirs := spaces[alloc.ourName], spaces[to]
+		alloc.infof("Rebalancing: giving %s to %s, which has %d of %d addresses free (we have %d of %d)",
+			chunk, alloc.peerDescription(to), theirs.Free, theirs.Size, ours.Free, ours.Size)
+		alloc.ring.GrantRangeToHost(chunk.Start, chunk.End, to)
+		alloc.rebalanceTransfers++
+		alloc.sendRingUpdate(to)
+		return
+	}
+}
+
+func (alloc *Allocator) rebalanceStatus() *RebalanceStatus {
+	if alloc.rebalance.Interval <= 0 || alloc.ring.Empty() {
+		return nil
+	}
+	spaces := alloc.ring.SpaceByPeer()
+	status := &RebalanceStatus{Needy: []string{}, Transfers: alloc.rebalanceTransfers}
+	if len(spaces) > 0 {
+		least, most := 1.0, 0.0
+		for _, s := range spaces {
+			f := freeFraction(s)
+			if f < least {
+				least = f
+			}
+			if f > most {
+				most = f
+			}
+		}
+		status.Imbalance = (most - least) * 100
+	}
+	for _, peer := range alloc.needyPeers(spaces) {
+		status.Needy = append(status.Needy, alloc.peerDescription(peer))
+	}
+	return status
+}
+
+func (s *RebalanceStatus) String() string {
+	return fmt.Sprintf("%.1f%% imbalance, %d needy peers, %d transfers", s.Imbalance, len(s.Needy), s.Transfers)
+}
@@ -0,0 +1,195 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Reserved addresses are ones within the universe that must not be
+// allocated, typically because something outside weave (a gateway,
+// an appliance) uses them.  Every peer needs to honour the same set,
+// so it is gossiped along with the ring.  The set is replaced as a
+// whole; each replacement bumps the version, and peers adopt any
+// version later than their own.  The exception is the reservations
+// given at launch: each peer may have been given different ones, and
+// none should win over the others, so they are combined.
+
+// The version used for configuration given at launch (reservations
+// and pools), so that any change made subsequently supersedes it
+const launchConfigVersion = 1
+
+type reservations struct {
+	Version uint64
+	Peer    mesh.PeerName // who made this version, to break ties
+	Ranges  []address.Range
+}
+
+func (r reservations) supersedes(other reservations) bool {
+	return r.Version > other.Version || (r.Version == other.Version && r.Peer > other.Peer)
+}
+
+// Combine launch reservations, from whichever peers
+func (r reservations) merge(other reservations) reservations {
+	all := append(append([]address.Range{}, r.Ranges...), other.Ranges...)
+	sort.Sort(rangesByStart(all))
+	var merged []address.Range
+	for _, rr := range all {
+		if n := len(merged); n > 0 && rr.Start <= merged[n-1].End {
+			if rr.End > merged[n-1].End {
+				merged[n-1].End = rr.End
+			}
+			continue
+		}
+		merged = append(merged, rr)
+	}
+	result := reservations{Version: launchConfigVersion, Peer: r.Peer, Ranges: merged}
+	if other.Peer > result.Peer {
+		result.Peer = other.Peer
+	}
+	return result
+}
+
+func (r reservations) equal(other reservations) bool {
+	if r.Version != other.Version || r.Peer != other.Peer || len(r.Ranges) != len(other.Ranges) {
+		return false
+	}
+	for i := range r.Ranges {
+		if r.Ranges[i] != other.Ranges[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type rangesByStart []address.Range
+
+func (p rangesByStart) Len() int           { return len(p) }
+func (p rangesByStart) Less(i, j int) bool { return p[i].Start < p[j].Start }
+func (p rangesByStart) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func (r reservations) contains(addr address.Address) bool {
+	for _, rr := range r.Ranges {
+		if rr.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseReservation parses an address, a CIDR, or a range given as
+// start-end (inclusive)
+func ParseReservation(s string) (address.Range, error) {
+	if strings.Contains(s, "/") {
+		_, cidr, err := address.ParseCIDR(s)
+		if err != nil {
+			return address.Range{}, err
+		}
+		return cidr.Range(), nil
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		start, err := address.ParseIP(s[:i])
+		if err != nil {
+			return address.Range{}, err
+		}
+		end, err := address.ParseIP(s[i+1:])
+		if err != nil {
+			return address.Range{}, err
+		}
+		if end < start {
+			return address.Range{}, fmt.Errorf("invalid range %s: end before start", s)
+		}
+		return address.Range{Start: start, End: end + 1}, nil
+	}
+	addr, err := address.ParseIP(s)
+	if err != nil {
+		return address.Range{}, err
+	}
+	return address.NewRange(addr, 1), nil
+}
+
+func formatReservation(r address.Range) string {
+	if r.Size() == 1 {
+		return r.Start.String()
+	}
+	return r.String()
+}
+
+func (alloc *Allocator) checkReservations(ranges []address.Range) error {
+	for _, r := range ranges {
+		if !alloc.universe.Overlaps(r) {
+			return fmt.Errorf("reserved range %s is outside the allocation range %s", r, alloc.universe.AsCIDRString())
+		}
+	}
+	return nil
+}
+
+func (alloc *Allocator) setReservations(r reservations) {
+	alloc.reserved = r
+	alloc.space.SetReserved(r.Ranges)
+	for ident, addrs := range alloc.owned {
+		for _, addr := range addrs {
+			if r.contains(addr) {
+				alloc.infof("Address %s of %s is now reserved; it will not be reallocated once freed", addr, ident)
+			}
+		}
+	}
+	// Lifting a reservation might have freed up space
+	alloc.tryPendingOps()
+}
+
+// Adopt reservations made here or elsewhere, if they supersede ours
+// or are launch reservations to combine with ours.  Returns true if
+// ours changed.
+func (alloc *Allocator) updateReservations(r reservations) bool {
+	if r.Version == launchConfigVersion && alloc.reserved.Version == launchConfigVersion {
+		r = alloc.reserved.merge(r)
+		if r.equal(alloc.reserved) {
+			return false
+		}
+	} else if !r.supersedes(alloc.reserved) {
+		return false
+	}
+	alloc.setReservations(r)
+	return true
+}
+
+// SetLaunchReservations (Async) - the reservations given on the command
+// line.  These are superseded by any made since, elsewhere in the
+// cluster or on this peer.
+func (alloc *Allocator) SetLaunchReservations(ranges []address.Range) error {
+	if err := alloc.checkReservations(ranges); err != nil {
+		return err
+	}
+	alloc.actionChan <- func() {
+		alloc.updateReservations(reservations{Version: launchConfigVersion, Peer: alloc.ourName, Ranges: ranges})
+	}
+	return nil
+}
+
+// SetReservations (Sync) - replace the reservations across the cluster
+func (alloc *Allocator) SetReservations(ranges []address.Range) error {
+	if err := alloc.checkReservations(ranges); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	alloc.actionChan <- func() {
+		alloc.setReservations(reservations{Version: alloc.reserved.Version + 1, Peer: alloc.ourName, Ranges: ranges})
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+		close(done)
+	}
+	<-done
+	return nil
+}
+
+// Reservations (Sync)
+func (alloc *Allocator) Reservations() []address.Range {
+	resultChan := make(chan []address.Range)
+	alloc.actionChan <- func() {
+		resultChan <- alloc.reserved.Ranges
+	}
+	return <-resultChan
+}
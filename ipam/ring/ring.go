@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math/rand"
 	"sort"
@@ -424,7 +425,7 @@ func (r *Ring) ReportFree(freespace map[address.Address]address.Offset) {
 		common.Assert(free <= maxSize)
 
 		if entries[i].Free == free {
-			return
+			continue
 		}
 
 		entries[i].Free = free
@@ -432,6 +433,36 @@ func (r *Ring) ReportFree(freespace map[address.Address]address.Offset) {
 	}
 }
 
+// PeerSpace is how many addresses a peer owns, and how many of those
+// it last reported as free
+type PeerSpace struct {
+	Size, Free address.Offset
+}
+
+// SpaceByPeer totals up the space of each peer in the ring
+func (r *Ring) SpaceByPeer() map[mesh.PeerName]PeerSpace {
+	result := make(map[mesh.PeerName]PeerSpace)
+	for i, entry := range r.Entries {
+		s := result[entry.Peer]
+		s.Size += r.distance(entry.Token, r.Entries.entry(i+1).Token)
+		s.Free += entry.Free
+		result[entry.Peer] = s
+	}
+	return result
+}
+
+// Fingerprint returns a hash of which peer owns each range, so that
+// peers can tell whether they agree on that, and the total of the
+// entries' versions, which only ever goes up.
+func (r *Ring) Fingerprint() (hash uint64, version uint64) {
+	h := fnv.New64a()
+	for _, entry := range r.Entries {
+		fmt.Fprintf(h, "%d %d\n", entry.Token, entry.Peer)
+		version += uint64(entry.Version)
+	}
+	return h.Sum64(), version
+}
+
 type weightedPeer struct {
 	weight   float64
 	peername mesh.PeerName
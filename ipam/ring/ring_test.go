@@ -744,3 +744,30 @@ func (es entries) String() string {
 	fmt.Fprintf(&buffer, "]")
 	return buffer.String()
 }
+
+func TestReportFreeUnchanged(t *testing.T) {
+	ring1 := New(start, end, peer1name)
+	ring1.ClaimItAll()
+	ring1.GrantRangeToHost(dot10, middle, peer2name)
+
+	// A range whose free space hasn't changed mustn't stop the
+	// others being updated, whichever order they are looked at in
+	for i := address.Offset(1); i <= 10; i++ {
+		ring1.ReportFree(map[address.Address]address.Offset{start: 10, middle: i})
+		entry, found := ring1.Entries.get(middle)
+		require.True(t, found)
+		require.Equal(t, i, entry.Free)
+	}
+}
+
+func TestSpaceByPeer(t *testing.T) {
+	ring1 := New(start, end, peer1name)
+	ring1.ClaimItAll()
+	ring1.GrantRangeToHost(dot10, middle, peer2name)
+
+	ring1.ReportFree(map[address.Address]address.Offset{start: 10, middle: 100})
+	require.Equal(t, map[mesh.PeerName]PeerSpace{
+		peer1name: {Size: 10 + address.Offset(end-middle), Free: 10 + 100},
+		peer2name: {Size: address.Offset(middle - dot10), Free: address.Offset(middle - dot10)},
+	}, ring1.SpaceByPeer())
+}
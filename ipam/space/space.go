@@ -19,6 +19,15 @@ type Space struct {
 	// repetition.
 	ours []address.Address
 	free []address.Address
+
+	// Addresses which must not be allocated, though they may be
+	// claimed with an override.  Same representation as above.
+	reserved []address.Address
+
+	// The free addresses which are not reserved.  Allocation walks
+	// this on every request, so it is kept up to date alongside
+	// free rather than worked out each time.
+	available []address.Address
 }
 
 func New() *Space {
@@ -26,23 +35,56 @@ func New() *Space {
 }
 
 func (s *Space) Add(start address.Address, size address.Offset) {
-	s.free = add(s.free, start, address.Add(start, size))
+	s.addFree(start, address.Add(start, size))
 }
 
 // Clear removes all spaces from this space set.  Used during node shutdown.
 func (s *Space) Clear() {
 	s.free = s.free[:0]
 	s.ours = s.ours[:0]
+	s.available = s.available[:0]
+}
+
+func (s *Space) addFree(start, end address.Address) {
+	s.free = add(s.free, start, end)
+	s.available = add(s.available, start, end)
+	for i := 0; i < len(s.reserved); i += 2 {
+		if s.reserved[i] < end && s.reserved[i+1] > start {
+			s.available = subtract(s.available, s.reserved[i], s.reserved[i+1])
+		}
+	}
+}
+
+func (s *Space) subtractFree(start, end address.Address) {
+	s.free = subtract(s.free, start, end)
+	s.available = subtract(s.available, start, end)
+}
+
+func (s *Space) updateAvailable() {
+	s.available = s.computeAvailable()
 }
 
-// Walk down the free list calling f() on the in-range portions, until
-// f() returns true or we run out of free space.  Return true iff f() returned true
+func (s *Space) computeAvailable() []address.Address {
+	available := s.free
+	for i := 0; i < len(s.reserved); i += 2 {
+		available = subtract(available, s.reserved[i], s.reserved[i+1])
+	}
+	return available
+}
+
+// Walk down the free list, skipping reserved addresses, calling f()
+// on the in-range portions, until f() returns true or we run out of
+// free space.  Return true iff f() returned true
 func (s *Space) walkFree(r address.Range, f func(address.Range) bool) bool {
+	return walkRanges(s.available, r, f)
+}
+
+func walkRanges(free []address.Address, r address.Range, f func(address.Range) bool) bool {
 	if r.Start >= r.End { // degenerate case
 		return false
 	}
-	for i := 0; i < len(s.free); i += 2 {
-		chunk := address.Range{Start: s.free[i], End: s.free[i+1]}
+	for i := 0; i < len(free); i += 2 {
+		chunk := address.Range{Start: free[i], End: free[i+1]}
 		if chunk.End <= r.Start { // this chunk comes before the range
 			continue
 		}
@@ -73,21 +115,44 @@ func (s *Space) Allocate(r address.Range) (bool, address.Address) {
 	return s.walkFree(r, func(chunk address.Range) bool {
 		result = chunk.Start
 		s.ours = add(s.ours, result, result+1)
-		s.free = subtract(s.free, result, result+1)
+		s.subtractFree(result, result+1)
 		return true
 	}), result
 }
 
 func (s *Space) Claim(addr address.Address) error {
+	if contains(s.reserved, addr) {
+		return fmt.Errorf("Address %v is reserved", addr)
+	}
+	return s.ClaimReserved(addr)
+}
+
+// ClaimReserved is like Claim, but may also claim a reserved address
+func (s *Space) ClaimReserved(addr address.Address) error {
 	if !contains(s.free, addr) {
 		return fmt.Errorf("Address %v is not free to claim", addr)
 	}
 
 	s.ours = add(s.ours, addr, addr+1)
-	s.free = subtract(s.free, addr, addr+1)
+	s.subtractFree(addr, addr+1)
 	return nil
 }
 
+// SetReserved replaces the set of reserved addresses.  They need
+// not be within the space; addresses that are already allocated are
+// unaffected.
+func (s *Space) SetReserved(ranges []address.Range) {
+	s.reserved = s.reserved[:0]
+	for _, r := range ranges {
+		s.reserved = add(s.reserved, r.Start, r.End)
+	}
+	s.updateAvailable()
+}
+
+func (s *Space) IsReserved(addr address.Address) bool {
+	return contains(s.reserved, addr)
+}
+
 func (s *Space) NumFreeAddressesInRange(r address.Range) address.Offset {
 	res := address.Offset(0)
 	s.walkFree(r, func(chunk address.Range) bool {
@@ -106,13 +171,17 @@ func (s *Space) Free(addr address.Address) error {
 	}
 
 	s.ours = subtract(s.ours, addr, addr+1)
-	s.free = add(s.free, addr, addr+1)
+	s.addFree(addr, addr+1)
 	return nil
 }
 
-func (s *Space) biggestFreeRange(r address.Range) (biggest address.Range) {
+func (s *Space) biggestFreeRange(r address.Range) address.Range {
+	return biggestRange(s.available, r)
+}
+
+func biggestRange(free []address.Address, r address.Range) (biggest address.Range) {
 	biggestSize := address.Offset(0)
-	s.walkFree(r, func(chunk address.Range) bool {
+	walkRanges(free, r, func(chunk address.Range) bool {
 		if size := chunk.Size(); size >= biggestSize {
 			biggest = chunk
 			biggestSize = size
@@ -124,6 +193,12 @@ func (s *Space) biggestFreeRange(r address.Range) (biggest address.Range) {
 
 func (s *Space) Donate(r address.Range) (address.Range, bool) {
 	biggest := s.biggestFreeRange(r)
+	if biggest.Size() == 0 {
+		// Reserved addresses are only given away when nothing
+		// else is free, since the peer asking may want to claim
+		// one of them
+		biggest = biggestRange(s.free, r)
+	}
 
 	if biggest.Size() == 0 {
 		return address.Range{}, false
@@ -134,7 +209,7 @@ func (s *Space) Donate(r address.Range) (address.Range, bool) {
 	biggest.Start = address.Add(biggest.Start, biggest.Size()/2)
 
 	s.ours = subtract(s.ours, biggest.Start, biggest.End)
-	s.free = subtract(s.free, biggest.Start, biggest.End)
+	s.subtractFree(biggest.Start, biggest.End)
 	return biggest, true
 }
 
@@ -200,6 +275,12 @@ func (s *Space) String() string {
 	if len(s.ours) == 0 && len(s.free) == 0 {
 		fmt.Fprintf(&buf, "No address ranges owned")
 	}
+	if len(s.reserved) > 0 {
+		fmt.Fprintf(&buf, " reserved:")
+		for i := 0; i < len(s.reserved); i += 2 {
+			fmt.Fprintf(&buf, " %s+%d ", s.reserved[i], s.reserved[i+1]-s.reserved[i])
+		}
+	}
 	return buf.String()
 }
 
@@ -212,6 +293,20 @@ func (p addressSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 func (s *Space) assertInvariants() {
 	common.Assert(sort.IsSorted(addressSlice(s.ours)))
 	common.Assert(sort.IsSorted(addressSlice(s.free)))
+	common.Assert(sort.IsSorted(addressSlice(s.reserved)))
+	common.Assert(addressSlice(s.available).equal(s.computeAvailable()))
+}
+
+func (p addressSlice) equal(q addressSlice) bool {
+	if len(p) != len(q) {
+		return false
+	}
+	for i := range p {
+		if p[i] != q[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // Return a slice representing everything we own, whether it is free or not
@@ -238,7 +333,7 @@ func (s *Space) OwnedRanges() []address.Range {
 // Create a Space that has free space in all the supplied Ranges.
 func (s *Space) AddRanges(ranges []address.Range) {
 	for _, r := range ranges {
-		s.free = add(s.free, r.Start, r.End)
+		s.addFree(r.Start, r.End)
 	}
 }
 
@@ -253,6 +348,6 @@ func (s *Space) UpdateRanges(ranges []address.Range) {
 		new = subtract(new, current[i], current[i+1])
 	}
 	for i := 0; i < len(new); i += 2 {
-		s.free = add(s.free, new[i], new[i+1])
+		s.addFree(new[i], new[i+1])
 	}
 }
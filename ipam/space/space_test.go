@@ -132,6 +132,46 @@ func TestSpaceAllocate(t *testing.T) {
 	space1.assertInvariants()
 }
 
+func TestSpaceReserved(t *testing.T) {
+	start := ip("10.0.3.0")
+	space1 := makeSpace(start, 8)
+	space1.SetReserved([]address.Range{address.NewRange(start, 2), address.NewRange(ip("10.0.3.4"), 1)})
+	space1.assertInvariants()
+
+	require.Equal(t, address.Offset(5), space1.NumFreeAddressesInRange(address.NewRange(start, 8)))
+	var got []string
+	for {
+		ok, addr := space1.Allocate(address.NewRange(start, 8))
+		if !ok {
+			break
+		}
+		got = append(got, addr.String())
+	}
+	require.Equal(t, []string{"10.0.3.2", "10.0.3.3", "10.0.3.5", "10.0.3.6", "10.0.3.7"}, got)
+
+	// Reserved addresses are only donated when nothing else is free
+	r, ok := space1.Donate(address.NewRange(start, 8))
+	require.True(t, ok && r.Start == ip("10.0.3.1") && r.Size() == 1, "donate of reserved addresses")
+	space1.Add(r.Start, r.Size()) // put it back
+
+	wt.AssertErrorInterface(t, (*error)(nil), space1.Claim(start), "claim of reserved address")
+	require.True(t, space1.IsReserved(start))
+	require.NoError(t, space1.ClaimReserved(start))
+	space1.assertInvariants()
+
+	// Freeing a reserved address doesn't make it available
+	require.NoError(t, space1.Free(start))
+	space1.assertInvariants()
+	ok, _ = space1.Allocate(address.NewRange(start, 2))
+	require.False(t, ok, "allocate of freed reserved address")
+	require.NoError(t, space1.ClaimReserved(start))
+
+	// Lifting the reservation makes the rest available again
+	space1.SetReserved(nil)
+	ok, addr := space1.Allocate(address.NewRange(start, 8))
+	require.True(t, ok && addr.String() == "10.0.3.1", "allocate after reservation lifted")
+}
+
 func TestSpaceFree(t *testing.T) {
 	const (
 		testAddr1   = "10.0.3.4"
@@ -14,6 +14,8 @@ type Status struct {
 	Entries          []EntryStatus
 	PendingClaims    []ClaimStatus
 	PendingAllocates []string
+	Reserved         []string
+	Rebalance        *RebalanceStatus `json:",omitempty"`
 }
 
 type EntryStatus struct {
@@ -49,7 +51,9 @@ func NewStatus(allocator *Allocator, defaultSubnet address.CIDR) *Status {
 			defaultSubnet.String(),
 			newEntryStatusSlice(allocator),
 			newClaimStatusSlice(allocator),
-			newAllocateIdentSlice(allocator)}
+			newAllocateIdentSlice(allocator),
+			newReservedSlice(allocator),
+			allocator.rebalanceStatus()}
 	}
 
 	return <-resultChan
@@ -89,7 +93,19 @@ func newAllocateIdentSlice(allocator *Allocator) []string {
 	var slice []string
 	for _, op := range allocator.pendingAllocates {
 		allocate := op.(*allocate)
+		if allocate.pool != "" {
+			slice = append(slice, fmt.Sprintf("%s pool:%s", allocate.ident, allocate.pool))
+			continue
+		}
 		slice = append(slice, fmt.Sprintf("%s %s", allocate.ident, allocate.r.String()))
 	}
 	return slice
 }
+
+func newReservedSlice(allocator *Allocator) []string {
+	var slice []string
+	for _, r := range allocator.reserved.Ranges {
+		slice = append(slice, formatReservation(r))
+	}
+	return slice
+}
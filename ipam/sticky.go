@@ -0,0 +1,89 @@
+package ipam
+
+import (
+	"time"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Sticky addresses: an allocation can be made for a stable key, such
+// as the container's name, as well as for the container ID.  When the
+// container goes away its addresses are held for that key for a
+// while, rather than being freed, so that a container recreated with
+// the same key (and so with a new ID) gets the same addresses back.
+// Holds are local to the peer, and are lost when it restarts.
+
+// StickyConfig controls sticky addresses
+type StickyConfig struct {
+	HoldTime time.Duration // how long to hold addresses; 0 disables holding
+	Label    string        // key containers by this label, rather than by name
+}
+
+type heldAddress struct {
+	addr  address.Address
+	until time.Time
+}
+
+// SetStickyConfig must be called before Start
+func (alloc *Allocator) SetStickyConfig(config StickyConfig) {
+	alloc.sticky = config
+}
+
+// Hold an address being released, if it was allocated for a key.
+// Returns false if the address should be freed instead.
+func (alloc *Allocator) hold(addr address.Address) bool {
+	key := alloc.allocationInfo[addr].sticky
+	if key == "" || alloc.sticky.HoldTime <= 0 {
+		return false
+	}
+	alloc.debugln("Holding", addr, "for", key, "for", alloc.sticky.HoldTime)
+	alloc.held[key] = append(alloc.held[key], heldAddress{addr, alloc.now().Add(alloc.sticky.HoldTime)})
+	return true
+}
+
+// Take back an address held for the key, in range r
+func (alloc *Allocator) takeHeld(key string, r address.Range) (address.Address, bool) {
+	held := alloc.held[key]
+	for i, h := range held {
+		if r.Contains(h.addr) {
+			if len(held) == 1 {
+				delete(alloc.held, key)
+			} else {
+				alloc.held[key] = append(held[:i], held[i+1:]...)
+			}
+			return h.addr, true
+		}
+	}
+	return 0, false
+}
+
+func (alloc *Allocator) heldFor(addr address.Address) string {
+	for key, held := range alloc.held {
+		for _, h := range held {
+			if h.addr == addr {
+				return key
+			}
+		}
+	}
+	return ""
+}
+
+func (alloc *Allocator) releaseExpiredHolds() {
+	now := alloc.now()
+	for key, held := range alloc.held {
+		remaining := held[:0]
+		for _, h := range held {
+			if now.Before(h.until) {
+				remaining = append(remaining, h)
+				continue
+			}
+			alloc.debugln("Hold on", h.addr, "for", key, "expired")
+			alloc.space.Free(h.addr)
+		}
+		if len(remaining) == 0 {
+			delete(alloc.held, key)
+		} else {
+			alloc.held[key] = remaining
+		}
+	}
+}
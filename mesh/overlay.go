@@ -82,6 +82,12 @@ type OverlayConnection interface {
 	DisplayName() string
 }
 
+// An OverlayConnection may also implement this, to add details of its
+// state to the status of the connection.
+type OverlayConnectionAttrs interface {
+	Attrs() map[string]interface{}
+}
+
 type NullOverlay struct{}
 
 func (NullOverlay) AddFeaturesTo(map[string]string) {
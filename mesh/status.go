@@ -54,6 +54,7 @@ type LocalConnectionStatus struct {
 	Outbound bool
 	State    string
 	Info     string
+	Attrs    map[string]interface{}
 }
 
 func NewStatus(router *Router) *Status {
@@ -157,11 +158,15 @@ func NewLocalConnectionStatusSlice(cm *ConnectionMaker) []LocalConnectionStatus
 					info = fmt.Sprintf("%-11v %v", "unencrypted", info)
 				}
 			}
-			slice = append(slice, LocalConnectionStatus{conn.RemoteTCPAddr(), conn.Outbound(), state, info})
+			var attrs map[string]interface{}
+			if overlayAttrs, ok := lc.OverlayConn.(OverlayConnectionAttrs); ok {
+				attrs = overlayAttrs.Attrs()
+			}
+			slice = append(slice, LocalConnectionStatus{conn.RemoteTCPAddr(), conn.Outbound(), state, info, attrs})
 		}
 		for address, target := range cm.targets {
 			add := func(state, info string) {
-				slice = append(slice, LocalConnectionStatus{address, true, state, info})
+				slice = append(slice, LocalConnectionStatus{address, true, state, info, nil})
 			}
 			switch target.state {
 			case TargetWaiting:
@@ -36,6 +36,22 @@ func (tb *TokenBucket) Wait() {
 	tb.earliestUnspentToken = tb.earliestUnspentToken.Add(tb.tokenInterval)
 }
 
+// Like Wait, but rather than sleeping until a token becomes
+// available, return false if the bucket is currently empty.
+func (tb *TokenBucket) TryTake() bool {
+	if tb.earliestUnspentToken.After(time.Now()) {
+		return false
+	}
+
+	capacityToken := tb.capacityToken()
+	if tb.earliestUnspentToken.Before(capacityToken) {
+		tb.earliestUnspentToken = capacityToken
+	}
+
+	tb.earliestUnspentToken = tb.earliestUnspentToken.Add(tb.tokenInterval)
+	return true
+}
+
 // Determine the historic token timestamp representing a full bucket
 func (tb *TokenBucket) capacityToken() time.Time {
 	return time.Now().Add(-tb.refillDuration).Truncate(tb.tokenInterval)
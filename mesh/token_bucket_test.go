@@ -0,0 +1,26 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucketTryTake(t *testing.T) {
+	// The initial fill is rounded to a whole token interval, so
+	// the bucket may start with one token more than its capacity.
+	tb := NewTokenBucket(3, time.Hour)
+	taken := 0
+	for taken < 10 && tb.TryTake() {
+		taken++
+	}
+	require.True(t, taken >= 3 && taken <= 4, "took %d tokens", taken)
+	require.False(t, tb.TryTake(), "bucket should be empty")
+
+	tb = NewTokenBucket(1, time.Millisecond)
+	for tb.TryTake() {
+	}
+	time.Sleep(5 * time.Millisecond)
+	require.True(t, tb.TryTake(), "bucket should have been refilled")
+}
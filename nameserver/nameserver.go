@@ -8,6 +8,7 @@ import (
 	"github.com/miekg/dns"
 
 	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/docker"
 	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/net/address"
 )
@@ -39,6 +40,7 @@ type Nameserver struct {
 	gossip      mesh.Gossip
 	entries     Entries
 	isKnownPeer func(mesh.PeerName) bool
+	added       map[string]time.Time // when we last added entries for each container
 	quit        chan struct{}
 }
 
@@ -47,6 +49,7 @@ func New(ourName mesh.PeerName, domain string, isKnownPeer func(mesh.PeerName) b
 		ourName:     ourName,
 		domain:      dns.Fqdn(domain),
 		isKnownPeer: isKnownPeer,
+		added:       make(map[string]time.Time),
 		quit:        make(chan struct{}),
 	}
 }
@@ -87,6 +90,7 @@ func (n *Nameserver) AddEntry(hostname, containerid string, origin mesh.PeerName
 	n.infof("adding entry %s -> %s", hostname, addr.String())
 	n.Lock()
 	entry := n.entries.add(hostname, containerid, origin, addr)
+	n.added[containerid] = time.Now()
 	n.Unlock()
 	return n.broadcastEntries(entry)
 }
@@ -126,6 +130,7 @@ func (n *Nameserver) ContainerDestroyed(ident string) {}
 
 func (n *Nameserver) ContainerDied(ident string) {
 	n.Lock()
+	delete(n.added, ident)
 	entries := n.entries.tombstone(n.ourName, func(e *Entry) bool {
 		if e.ContainerID == ident {
 			n.infof("container %s died; tombstoning entry %s", ident, e.String())
@@ -139,6 +144,53 @@ func (n *Nameserver) ContainerDied(ident string) {
 	}
 }
 
+// Reconcile tombstones our entries for containers which are not
+// running, in case we missed their deaths.  Entries not registered
+// under a container ID are left alone, as are those for containers
+// added to after the time the list of containers was taken.
+func (n *Nameserver) Reconcile(containers map[string]bool, since time.Time) {
+	n.Lock()
+	entries := n.entries.tombstone(n.ourName, func(e *Entry) bool {
+		if e.Tombstone > 0 || !docker.IsContainerID(e.ContainerID) || containers[e.ContainerID] || n.added[e.ContainerID].After(since) {
+			return false
+		}
+		delete(n.added, e.ContainerID)
+		n.infof("container %s is not running; tombstoning entry %s", e.ContainerID, e.String())
+		return true
+	})
+	n.Unlock()
+	if err := n.broadcastEntries(entries...); err != nil {
+		n.errorf("failed to broadcast reconciled entries: %v", err)
+	}
+}
+
+// Reregister adds entries for a running container's addresses under
+// its FQDN, if that is in our domain and we have no entries for the
+// container, live or tombstoned.  This puts back names lost while we
+// were not watching, without undoing deliberate removals.
+func (n *Nameserver) Reregister(ident, fqdn string, addrs []address.Address) {
+	hostname := dns.Fqdn(fqdn)
+	if !dns.IsSubDomain(n.domain, hostname) {
+		return
+	}
+	n.Lock()
+	_, err := n.entries.first(func(e *Entry) bool {
+		return e.Origin == n.ourName && e.ContainerID == ident
+	})
+	var entries Entries
+	if err != nil {
+		for _, addr := range addrs {
+			n.infof("container %s is running but has no entries; adding entry %s -> %s", ident, hostname, addr)
+			entries = append(entries, n.entries.add(hostname, ident, n.ourName, addr))
+		}
+		n.added[ident] = time.Now()
+	}
+	n.Unlock()
+	if err := n.broadcastEntries(entries...); err != nil {
+		n.errorf("failed to broadcast entries for container %s: %v", ident, err)
+	}
+}
+
 func (n *Nameserver) PeerGone(peer mesh.PeerName) {
 	n.infof("peer %s gone", peer.String())
 	n.Lock()
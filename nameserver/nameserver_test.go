@@ -270,3 +270,41 @@ func TestTombstoneDeletion(t *testing.T) {
 	nameserver.deleteTombstones()
 	require.Equal(t, Entries{}, nameserver.entries)
 }
+
+func TestReconcile(t *testing.T) {
+	var (
+		running = strings.Repeat("1", 64)
+		gone    = strings.Repeat("2", 64)
+		removed = strings.Repeat("3", 64)
+		late    = strings.Repeat("4", 64)
+	)
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.Nil(t, err)
+	nameserver := New(peername, "weave.local.", func(mesh.PeerName) bool { return true })
+
+	require.Nil(t, nameserver.AddEntry("running.weave.local.", running, peername, address.Address(1)))
+	require.Nil(t, nameserver.AddEntry("gone.weave.local.", gone, peername, address.Address(2)))
+	require.Nil(t, nameserver.AddEntry("extern.weave.local.", "weave:extern", peername, address.Address(3)))
+	require.Nil(t, nameserver.AddEntry("removed.weave.local.", removed, peername, address.Address(4)))
+	require.Nil(t, nameserver.Delete("removed.weave.local.", removed, "*", address.Address(0)))
+
+	// A container attached after the list was taken isn't in it
+	since := time.Now()
+	require.Nil(t, nameserver.AddEntry("late.weave.local.", late, peername, address.Address(5)))
+
+	containers := map[string]bool{running: true, removed: true}
+	nameserver.Reconcile(containers, since)
+	require.Equal(t, []address.Address{1}, nameserver.Lookup("running.weave.local."))
+	require.Equal(t, []address.Address{}, nameserver.Lookup("gone.weave.local."))
+	require.Equal(t, []address.Address{3}, nameserver.Lookup("extern.weave.local."))
+	require.Equal(t, []address.Address{5}, nameserver.Lookup("late.weave.local."))
+
+	// Names are only put back for containers we have no entries for
+	nameserver.Reregister(removed, "removed.weave.local", []address.Address{4})
+	require.Equal(t, []address.Address{}, nameserver.Lookup("removed.weave.local."))
+	nameserver.PeerGone(peername)
+	nameserver.Reregister(running, "running.example.com", []address.Address{1})
+	nameserver.Reregister(running, "running.weave.local", []address.Address{1})
+	require.Equal(t, []address.Address{1}, nameserver.Lookup("running.weave.local."))
+	require.Equal(t, []address.Address{}, nameserver.Lookup("running.example.com."))
+}
@@ -0,0 +1,63 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// WithNetNS runs f in the network namespace at nsPath, e.g.
+// /proc/<pid>/ns/net, and then returns to ours.
+func WithNetNS(nsPath string, f func() error) error {
+	ns, err := os.Open(nsPath)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	// Namespaces belong to OS threads, so we mustn't be moved to
+	// another while switched
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ours, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		return err
+	}
+	defer ours.Close()
+
+	if err := setns(ns); err != nil {
+		return err
+	}
+	defer func() {
+		if err := setns(ours); err != nil {
+			// Carrying on in the wrong namespace would be worse
+			panic(fmt.Sprintf("unable to return to our network namespace: %s", err))
+		}
+	}()
+	return f()
+}
+
+func setns(ns *os.File) error {
+	if _, _, errno := syscall.RawSyscall(sysSetns, ns.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// InterfaceHardwareAddrInNS returns the MAC of the named interface in
+// the network namespace at nsPath
+func InterfaceHardwareAddrInNS(nsPath, ifaceName string) (net.HardwareAddr, error) {
+	var result net.HardwareAddr
+	err := WithNetNS(nsPath, func() error {
+		iface, err := net.InterfaceByName(ifaceName)
+		if err != nil {
+			return err
+		}
+		result = iface.HardwareAddr
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,4 @@
+package net
+
+// Not defined by package syscall
+const sysSetns = 308
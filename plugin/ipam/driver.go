@@ -1,7 +1,9 @@
 package ipamplugin
 
 import (
+	"fmt"
 	"net"
+	"strings"
 
 	"github.com/docker/libnetwork/ipamapi"
 	"github.com/docker/libnetwork/netlabel"
@@ -12,6 +14,11 @@ import (
 
 const (
 	WeaveContainer = "weave"
+	// Option, given with --ipam-opt, naming the weave IPAM pool to
+	// allocate from
+	PoolOption = "pool"
+
+	defaultPoolID = "weavepool"
 )
 
 type ipam struct {
@@ -31,12 +38,33 @@ func (i *ipam) GetDefaultAddressSpaces() (string, string, error) {
 
 func (i *ipam) RequestPool(addressSpace, pool, subPool string, options map[string]string, v6 bool) (string, *net.IPNet, map[string]string, error) {
 	Log.Debugln("RequestPool", addressSpace, pool, subPool, options)
-	cidr, err := i.weave.DefaultSubnet()
-	Log.Debugln("RequestPool returning ", cidr, err)
+	var (
+		poolID = defaultPoolID
+		cidr   *net.IPNet
+		err    error
+	)
+	if name := options[PoolOption]; name != "" {
+		// A docker network has a single subnet, so we use the first
+		// of the pool's
+		var subnets []*net.IPNet
+		if subnets, err = i.weave.PoolSubnets(name); err == nil {
+			if len(subnets) == 0 {
+				return "", nil, nil, fmt.Errorf("pool %s has no subnets", name)
+			}
+			cidr = subnets[0]
+			poolID = strings.Join([]string{defaultPoolID, name, cidr.String()}, ":")
+		}
+	} else {
+		cidr, err = i.weave.DefaultSubnet()
+	}
+	Log.Debugln("RequestPool returning ", poolID, cidr, err)
+	if err != nil {
+		return "", nil, nil, err
+	}
 	// Pass back a fake "gateway address"; we don't actually use it,
 	// so just give the network address.
 	data := map[string]string{netlabel.Gateway: cidr.String()}
-	return "weavepool", cidr, data, err
+	return poolID, cidr, data, nil
 }
 
 func (i *ipam) ReleasePool(poolID string) error {
@@ -47,7 +75,19 @@ func (i *ipam) ReleasePool(poolID string) error {
 func (i *ipam) RequestAddress(poolID string, address net.IP, options map[string]string) (*net.IPNet, map[string]string, error) {
 	Log.Debugln("RequestAddress", poolID, address, options)
 	// Pass magic string to weave IPAM, which then stores the address under its own string
-	ip, err := i.weave.AllocateIP("_")
+	var (
+		ip  *net.IPNet
+		err error
+	)
+	if parts := strings.SplitN(poolID, ":", 3); len(parts) == 3 {
+		_, subnet, perr := net.ParseCIDR(parts[2])
+		if perr != nil {
+			return nil, nil, perr
+		}
+		ip, err = i.weave.AllocateIPInPool("_", parts[1], subnet)
+	} else {
+		ip, err = i.weave.AllocateIP("_")
+	}
 	Log.Debugln("allocateIP returned", ip, err)
 	return ip, nil, err
 }
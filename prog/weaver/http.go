@@ -10,6 +10,7 @@ import (
 
 	"github.com/gorilla/mux"
 	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/docker"
 	"github.com/weaveworks/weave/ipam"
 	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/nameserver"
@@ -154,7 +155,11 @@ var statusTemplate = defTemplate("status", `\
     Connections: {{len .Router.Connections}}{{with printConnectionCounts .Router.Connections}} ({{.}}){{end}}
           Peers: {{len .Router.Peers}}{{with printPeerConnectionCounts .Router.Peers}} (with {{.}} connections){{end}}
  TrustedSubnets: {{printList .Router.TrustedSubnets}}
-{{if .IPAM}}\
+{{with .Router.StormControl}}   StormControl: {{.DroppedByMAC}} frames dropped by MAC limit, {{.DroppedByPeer}} by peer limit
+{{end}}{{with .Router.Routing}}        Routing: gateway {{.GatewayMAC}}, {{.Routes}} routes, {{.Neighbours}} local addresses
+{{end}}{{with .Router.AntiSpoofing}}   AntiSpoofing: {{.Mode}}, {{.Bindings}} MACs bound, {{.Violations}} violations
+{{end}}{{with .Router.DHCP}}           DHCP: {{if .Address}}serving {{.Subnet}} from {{.Address}}, {{len .Leases}} leases{{else}}awaiting address{{end}}
+{{end}}{{if .IPAM}}\
 
         Service: ipam
 {{if .IPAM.Entries}}\
@@ -172,6 +177,12 @@ var statusTemplate = defTemplate("status", `\
 {{end}}\
           Range: {{.IPAM.Range}}
   DefaultSubnet: {{.IPAM.DefaultSubnet}}
+{{if .IPAM.Reserved}}\
+       Reserved: {{printList .IPAM.Reserved}}
+{{end}}\
+{{with .IPAM.Rebalance}}\
+      Rebalance: {{.}}
+{{end}}\
 {{end}}\
 {{if .DNS}}\
 
@@ -181,6 +192,17 @@ var statusTemplate = defTemplate("status", `\
             TTL: {{.DNS.TTL}}
         Entries: {{countDNSEntries .DNS.Entries}}
 {{end}}\
+{{if .Docker}}\
+
+        Service: docker
+       Endpoint: {{.Docker.Endpoint}}
+{{if .Docker.Connected}}\
+         Status: connected since {{.Docker.Since.Format "2006-01-02 15:04:05"}}
+{{else}}\
+         Status: disconnected since {{.Docker.Since.Format "2006-01-02 15:04:05"}} - retrying{{with .Docker.LastError}} (last error: {{.}}){{end}}
+{{end}}\
+     Reconnects: {{.Docker.Reconnects}}
+{{end}}\
 `)
 
 var targetsTemplate = defTemplate("targetsTemplate", `\
@@ -190,7 +212,8 @@ var targetsTemplate = defTemplate("targetsTemplate", `\
 
 var connectionsTemplate = defTemplate("connectionsTemplate", `\
 {{range .Router.Connections}}\
-{{if .Outbound}}->{{else}}<-{{end}} {{printf "%-21v" .Address}} {{printf "%-11v" .State}} {{.Info}}
+{{if .Outbound}}->{{else}}<-{{end}} {{printf "%-21v" .Address}} {{printf "%-11v" .State}} {{.Info}}\
+{{with .Attrs}}{{with .fallback}} ({{.}}){{end}}{{end}}
 {{end}}\
 `)
 
@@ -222,15 +245,17 @@ type WeaveStatus struct {
 	Router  *weave.NetworkRouterStatus `json:"Router,omitempty"`
 	IPAM    *ipam.Status               `json:"IPAM,omitempty"`
 	DNS     *nameserver.Status         `json:"DNS,omitempty"`
+	Docker  *docker.Status             `json:"Docker,omitempty"`
 }
 
-func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) {
+func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, dockerCli *docker.Client) {
 	status := func() WeaveStatus {
 		return WeaveStatus{
 			version,
 			weave.NewNetworkRouterStatus(router),
 			ipam.NewStatus(allocator, defaultSubnet),
-			nameserver.NewStatus(ns, dnsserver)}
+			nameserver.NewStatus(ns, dnsserver),
+			docker.NewStatus(dockerCli)}
 	}
 	muxRouter.Methods("GET").Path("/report").Headers("Accept", "application/json").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
@@ -17,6 +19,7 @@ import (
 	. "github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/common/docker"
 	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/ipam/ring"
 	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/nameserver"
 	weavenet "github.com/weaveworks/weave/net"
@@ -56,10 +59,17 @@ func main() {
 		logLevel           string
 		prof               string
 		bufSzMB            int
+		capture            string
+		sleeveSockets      int
+		cryptoWorkers      int
 		noDiscovery        bool
 		httpAddr           string
 		iprangeCIDR        string
 		ipsubnetCIDR       string
+		ipReservations     ipReservations
+		ipPools            ipPools
+		stickyConfig       ipam.StickyConfig
+		rebalanceConfig    ipam.RebalanceConfig
 		peerCount          int
 		dockerAPI          string
 		peers              []string
@@ -67,6 +77,15 @@ func main() {
 		dnsConfig          dnsConfig
 		datapathName       string
 		trustedSubnetStr   string
+		networkSpecs       networkSpecs
+		dhcp               bool
+		dhcpSubnetCIDR     string
+		dhcpLeaseTime      time.Duration
+		dhcpRouter         string
+		dhcpDNSServer      string
+		antiSpoofing       string
+		peerLabels         peerLabels
+		overlayPolicyFile  string
 
 		defaultDockerHost = "unix:///var/run/docker.sock"
 	)
@@ -88,9 +107,19 @@ func main() {
 	mflag.IntVar(&config.ConnLimit, []string{"#connlimit", "#-connlimit", "-conn-limit"}, 30, "connection limit (0 for unlimited)")
 	mflag.BoolVar(&noDiscovery, []string{"#nodiscovery", "#-nodiscovery", "-no-discovery"}, false, "disable peer discovery")
 	mflag.IntVar(&bufSzMB, []string{"#bufsz", "-bufsz"}, 8, "capture buffer size in MB")
+	mflag.IntVar(&sleeveSockets, []string{"-sleeve-sockets"}, runtime.NumCPU(), "number of UDP sockets, each with its own goroutine, to spread sleeve traffic across")
+	mflag.IntVar(&cryptoWorkers, []string{"-crypto-workers"}, runtime.NumCPU(), "number of goroutines encrypting and decrypting sleeve traffic (0 or 1 to do it on the connection's own goroutine)")
+	mflag.StringVar(&capture, []string{"-capture"}, "af_packet", "how to capture/inject on --iface and network interfaces: af_packet, or pcap if built with -tags pcap")
 	mflag.StringVar(&httpAddr, []string{"#httpaddr", "#-httpaddr", "-http-addr"}, "", "address to bind HTTP interface to (disabled if blank, absolute path indicates unix domain socket)")
 	mflag.StringVar(&iprangeCIDR, []string{"#iprange", "#-iprange", "-ipalloc-range"}, "", "IP address range reserved for automatic allocation, in CIDR notation")
 	mflag.StringVar(&ipsubnetCIDR, []string{"#ipsubnet", "#-ipsubnet", "-ipalloc-default-subnet"}, "", "subnet to allocate within by default, in CIDR notation")
+	mflag.Var(&ipReservations, []string{"-ipalloc-reserve"}, "address, CIDR or start-end range within --ipalloc-range not to allocate automatically (may be repeated)")
+	mflag.Var(&ipPools, []string{"-ipalloc-pool"}, "named pool to allocate from, as name:cidr[,cidr...][:quota=N][:peer-quota=N] (may be repeated)")
+	mflag.DurationVar(&stickyConfig.HoldTime, []string{"-ipalloc-sticky-hold"}, 0, "how long to hold the addresses of a removed container for another created with the same name (0 to disable)")
+	mflag.StringVar(&stickyConfig.Label, []string{"-ipalloc-sticky-label"}, "", "identify containers for --ipalloc-sticky-hold by this label instead of by name")
+	mflag.DurationVar(&rebalanceConfig.Interval, []string{"-ipalloc-rebalance-interval"}, 0, "how often to consider giving free IP address space to peers running low (0, the default, to disable)")
+	mflag.Float64Var(&rebalanceConfig.LowWater, []string{"-ipalloc-rebalance-low"}, 0.1, "fraction of its IP address space below which a peer is given more")
+	mflag.Float64Var(&rebalanceConfig.HighWater, []string{"-ipalloc-rebalance-high"}, 0.5, "fraction of its IP address space above which a peer may give some away")
 	mflag.IntVar(&peerCount, []string{"#initpeercount", "#-initpeercount", "-init-peer-count"}, 0, "number of peers in network (for IP address allocation)")
 	mflag.StringVar(&dockerAPI, []string{"#api", "#-api", "-docker-api"}, defaultDockerHost, "Docker API endpoint")
 	mflag.BoolVar(&noDNS, []string{"-no-dns"}, false, "disable DNS server")
@@ -100,6 +129,26 @@ func main() {
 	mflag.DurationVar(&dnsConfig.ClientTimeout, []string{"-dns-fallback-timeout"}, nameserver.DefaultClientTimeout, "timeout for fallback DNS requests")
 	mflag.StringVar(&dnsConfig.EffectiveListenAddress, []string{"-dns-effective-listen-address"}, "", "address DNS will actually be listening, after Docker port mapping")
 	mflag.StringVar(&datapathName, []string{"-datapath"}, "", "ODP datapath name")
+	mflag.BoolVar(&networkConfig.ARPProxy, []string{"-arp-proxy"}, false, "answer ARP requests for known remote hosts locally instead of broadcasting them")
+	mflag.BoolVar(&networkConfig.IGMPSnooping, []string{"-igmp-snooping"}, false, "only send multicast traffic to peers with containers that have joined the group")
+	mflag.BoolVar(&networkConfig.Routed, []string{"-routed"}, false, "route IP packets to the peer owning the destination address, instead of bridging ethernet frames")
+	mflag.IntVar(&networkConfig.StormControl.MACRate, []string{"-storm-control-mac-rate"}, 0, "maximum broadcast/multicast/unknown-unicast frames per second from a single MAC (0 for unlimited)")
+	mflag.IntVar(&networkConfig.StormControl.PeerRate, []string{"-storm-control-peer-rate"}, 0, "maximum broadcast/multicast/unknown-unicast frames per second originating from a single peer (0 for unlimited)")
+	mflag.IntVar(&networkConfig.StormControl.Burst, []string{"-storm-control-burst"}, 100, "number of frames allowed in a burst by storm control")
+	mflag.DurationVar(&networkConfig.MacCache.MaxAge, []string{"-mac-cache-max-age"}, 10*time.Minute, "time after which MAC cache entries that haven't been seen expire")
+	mflag.IntVar(&networkConfig.MacCache.MaxEntries, []string{"-mac-cache-max-entries"}, 0, "maximum number of entries in the MAC cache (0 for unlimited)")
+	mflag.IntVar(&networkConfig.MacCache.MaxEntriesPerPeer, []string{"-mac-cache-max-entries-per-peer"}, 0, "maximum number of MAC cache entries for a single peer (0 for unlimited)")
+
+	mflag.StringVar(&antiSpoofing, []string{"-anti-spoofing"}, "off", "check that local containers only send from the addresses allocated to them: off, log or enforce")
+	mflag.BoolVar(&dhcp, []string{"-dhcp"}, false, "answer DHCP requests on the local bridge with addresses from the allocation range")
+	mflag.StringVar(&dhcpSubnetCIDR, []string{"-dhcp-subnet"}, "", "subnet to allocate DHCP addresses within (defaults to --ipalloc-default-subnet)")
+	mflag.DurationVar(&dhcpLeaseTime, []string{"-dhcp-lease-time"}, time.Hour, "duration of DHCP leases")
+	mflag.StringVar(&dhcpRouter, []string{"-dhcp-router"}, "", "default gateway to hand out to DHCP clients")
+	mflag.StringVar(&dhcpDNSServer, []string{"-dhcp-dns-server"}, "", "DNS server to hand out to DHCP clients (defaults to weaveDNS)")
+	mflag.Var(&networkSpecs, []string{"-network"}, "isolated network, as name:id:interface[:ipalloc-range] (may be repeated)")
+
+	mflag.Var(&peerLabels, []string{"-peer-label"}, "label of this peer, as key=value, for matching against other peers' overlay policies (may be repeated)")
+	mflag.StringVar(&overlayPolicyFile, []string{"-overlay-policy"}, "", "file containing the initial overlay policy, as JSON")
 
 	mflag.StringVar(&trustedSubnetStr, []string{"-trusted-subnets"}, "", "Command separated list of trusted subnets in CIDR notation")
 
@@ -137,19 +186,34 @@ func main() {
 	}
 	config.ProtocolMinVersion = byte(protocolMinVersion)
 
+	if sc := networkConfig.StormControl; sc.MACRate < 0 || sc.MACRate > weave.MaxStormControlRate || sc.PeerRate < 0 || sc.PeerRate > weave.MaxStormControlRate {
+		Log.Fatalf("--storm-control-mac-rate and --storm-control-peer-rate must be in range [0,%d]", weave.MaxStormControlRate)
+	}
+	if networkConfig.StormControl.Burst < 1 {
+		Log.Fatal("--storm-control-burst must be at least 1")
+	}
+
 	if pktdebug {
 		networkConfig.PacketLogging = packetLogging{}
 	} else {
 		networkConfig.PacketLogging = nopPacketLogging{}
 	}
 
-	overlay, bridge := createOverlay(datapathName, ifaceName, config.Port, bufSzMB)
+	var err error
+	networkConfig.AntiSpoofing, err = weave.ParseSourceGuardMode(antiSpoofing)
+	checkFatal(err)
+
+	newBridge := bridgeConstructor(capture, bufSzMB)
+	overlay, bridge, fastdp := createOverlay(datapathName, ifaceName, config.Port, sleeveSockets, cryptoWorkers, newBridge)
 	networkConfig.Bridge = bridge
+	overlay.SetLabels(peerLabels)
+	if overlayPolicyFile != "" {
+		checkFatal(loadOverlayPolicy(overlay, overlayPolicyFile))
+	}
 
 	name := peerName(routerName, bridge.Interface())
 
 	if nickName == "" {
-		var err error
 		nickName, err = os.Hostname()
 		checkFatal(err)
 	}
@@ -161,6 +225,11 @@ func main() {
 	router := weave.NewNetworkRouter(config, networkConfig, name, nickName, overlay)
 	Log.Println("Our name is", router.Ourself)
 
+	networks := make([]*network, len(networkSpecs))
+	for i, spec := range networkSpecs {
+		networks[i] = createNetwork(router, spec, newBridge)
+	}
+
 	var dockerCli *docker.Client
 	if dockerAPI != "" {
 		dc, err := docker.NewClient(dockerAPI)
@@ -186,11 +255,60 @@ func main() {
 		allocator     *ipam.Allocator
 		defaultSubnet address.CIDR
 	)
+	if rebalanceConfig.LowWater < 0 || rebalanceConfig.HighWater > 1 || rebalanceConfig.LowWater >= rebalanceConfig.HighWater {
+		Log.Fatal("--ipalloc-rebalance-low and --ipalloc-rebalance-high must be fractions, with low below high")
+	}
 	if iprangeCIDR != "" {
-		allocator, defaultSubnet = createAllocator(router.Router, iprangeCIDR, ipsubnetCIDR, determineQuorum(peerCount, peers), isKnownPeer)
+		allocator, defaultSubnet = createAllocator(router.Router, "IPallocation", iprangeCIDR, ipsubnetCIDR, determineQuorum(peerCount, peers), isKnownPeer, stickyConfig, rebalanceConfig)
 		observeContainers(allocator)
+		if len(ipReservations) > 0 {
+			checkFatal(allocator.SetLaunchReservations(ipReservations))
+		}
+		if len(ipPools) > 0 {
+			checkFatal(allocator.SetLaunchPools(ipPools))
+		}
 	} else if peerCount > 0 {
 		Log.Fatal("--init-peer-count flag specified without --ipalloc-range")
+	} else if len(ipReservations) > 0 {
+		Log.Fatal("--ipalloc-reserve flag specified without --ipalloc-range")
+	} else if len(ipPools) > 0 {
+		Log.Fatal("--ipalloc-pool flag specified without --ipalloc-range")
+	}
+	if router.L3 != nil {
+		if allocator == nil {
+			Log.Fatal("--routed flag specified without --ipalloc-range")
+		}
+		allocator.OnRingUpdate(func(ranges []ring.RangeInfo) {
+			routes := make([]weave.IPRoute, len(ranges))
+			for i, r := range ranges {
+				routes[i] = weave.IPRoute{Range: r.Range, Peer: r.Peer}
+			}
+			router.L3.SetRoutes(routes)
+		})
+	}
+	for _, network := range networks {
+		if network.ipRange != "" {
+			network.allocator, network.subnet = createAllocator(router.Router, "IPallocation-"+network.Name, network.ipRange, "", determineQuorum(peerCount, peers), isKnownPeer, stickyConfig, rebalanceConfig)
+			observeContainers(network.allocator)
+		}
+	}
+
+	if router.SourceGuard != nil {
+		if allocator == nil {
+			Log.Fatal("--anti-spoofing flag specified without --ipalloc-range")
+		}
+		router.SourceGuard.SetMACLookup(sourceMACLookup(dockerCli))
+		allocator.OnOwnedUpdate(router.SourceGuard.SetAllocations)
+	}
+	if dhcp {
+		if allocator == nil {
+			Log.Fatal("--dhcp flag specified without --ipalloc-range")
+		}
+		if router.L3 != nil {
+			Log.Fatal("--dhcp cannot be used with --routed")
+		}
+		router.DHCP = weave.NewDHCPServer(router, allocator,
+			createDHCPConfig(dhcpSubnetCIDR, defaultSubnet, dhcpLeaseTime, dhcpRouter, dhcpDNSServer, noDNS, dnsConfig))
 	}
 
 	var (
@@ -223,12 +341,33 @@ func main() {
 			ns.HandleHTTP(muxRouter, dockerCli)
 		}
 		router.HandleHTTP(muxRouter)
-		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver)
+		handleNetworkHTTP(muxRouter, router, newBridge)
+		overlay.HandleHTTP(muxRouter)
+		if fastdp != nil {
+			fastdp.HandleHTTP(muxRouter)
+		}
+		for _, network := range networks {
+			if network.allocator != nil {
+				network.allocator.HandleHTTP(muxRouter.PathPrefix("/network/"+network.Name).Subrouter(), network.subnet, dockerCli)
+			}
+		}
+		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, dockerCli)
 		http.Handle("/", muxRouter)
 		Log.Println("Listening for HTTP control messages on", httpAddr)
 		go listenAndServeHTTP(httpAddr, muxRouter)
 	}
 
+	// Now that the allocators are running and can reach the other
+	// peers, pick up the containers that are already attached
+	if dockerCli != nil {
+		allocators := []*ipam.Allocator{allocator}
+		for _, network := range networks {
+			allocators = append(allocators, network.allocator)
+		}
+		go reconcileContainers(dockerCli, allocators, ns)
+		dockerCli.OnResync(func() { reconcileContainers(dockerCli, allocators, ns) })
+	}
+
 	SignalHandlerLoop(router)
 }
 
@@ -272,29 +411,111 @@ func (nopPacketLogging) LogPacket(string, weave.PacketKey) {
 func (nopPacketLogging) LogForwardPacket(string, weave.ForwardPacketKey) {
 }
 
-func createOverlay(datapathName string, ifaceName string, port int, bufSzMB int) (weave.NetworkOverlay, weave.Bridge) {
+type bridgeConstructorFunc func(*net.Interface) (weave.Bridge, error)
+
+func bridgeConstructor(capture string, bufSzMB int) bridgeConstructorFunc {
+	bufSz := bufSzMB * 1024 * 1024 // bufsz flag is in MB
+	switch capture {
+	case "pcap":
+		return func(iface *net.Interface) (weave.Bridge, error) { return weave.NewPcap(iface, bufSz) }
+	case "af_packet":
+		return func(iface *net.Interface) (weave.Bridge, error) { return weave.NewAFPacket(iface, bufSz) }
+	}
+	Log.Fatalf("Invalid --capture %q; expected pcap or af_packet", capture)
+	return nil
+}
+
+func createOverlay(datapathName string, ifaceName string, port int, sleeveSockets int, cryptoWorkers int, newBridge bridgeConstructorFunc) (*weave.OverlaySwitch, weave.Bridge, *weave.FastDatapath) {
 	overlay := weave.NewOverlaySwitch()
 	var bridge weave.Bridge
+	var fastdp *weave.FastDatapath
 	switch {
 	case datapathName != "" && ifaceName != "":
 		Log.Fatal("At most one of --datapath and --iface must be specified.")
 	case datapathName != "":
-		fastdp, err := weave.NewFastDatapath(datapathName, port)
+		var err error
+		fastdp, err = weave.NewFastDatapath(datapathName, port)
 		checkFatal(err)
 		bridge = fastdp.Bridge()
 		overlay.Add("fastdp", fastdp.Overlay())
 	case ifaceName != "":
 		iface, err := weavenet.EnsureInterface(ifaceName)
 		checkFatal(err)
-		bridge, err = weave.NewPcap(iface, bufSzMB*1024*1024) // bufsz flag is in MB
+		bridge, err = newBridge(iface)
 		checkFatal(err)
 	default:
 		bridge = weave.NullBridge{}
 	}
-	sleeve := weave.NewSleeveOverlay(port)
+	sleeve := weave.NewSleeveOverlay(port, sleeveSockets, cryptoWorkers)
 	overlay.Add("sleeve", sleeve)
 	overlay.SetCompatOverlay(sleeve)
-	return overlay, bridge
+	// Least preferred; only for when UDP doesn't get through
+	overlay.Add("tcp", weave.NewTCPOverlay())
+	return overlay, bridge, fastdp
+}
+
+type peerLabels []string
+
+func (labels *peerLabels) String() string {
+	return strings.Join(*labels, ",")
+}
+
+func (labels *peerLabels) Set(value string) error {
+	if !strings.Contains(value, "=") || strings.Contains(value, ",") {
+		return fmt.Errorf("invalid label %q; expected key=value", value)
+	}
+	*labels = append(*labels, value)
+	return nil
+}
+
+type ipReservations []address.Range
+
+func (reservations *ipReservations) String() string {
+	var strs []string
+	for _, r := range *reservations {
+		strs = append(strs, r.String())
+	}
+	return strings.Join(strs, ",")
+}
+
+func (reservations *ipReservations) Set(value string) error {
+	r, err := ipam.ParseReservation(value)
+	if err != nil {
+		return err
+	}
+	*reservations = append(*reservations, r)
+	return nil
+}
+
+type ipPools []ipam.Pool
+
+func (pools *ipPools) String() string {
+	var names []string
+	for _, pool := range *pools {
+		names = append(names, pool.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (pools *ipPools) Set(value string) error {
+	pool, err := ipam.ParsePool(value)
+	if err != nil {
+		return err
+	}
+	*pools = append(*pools, pool)
+	return nil
+}
+
+func loadOverlayPolicy(overlay *weave.OverlaySwitch, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var policy weave.OverlayPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return fmt.Errorf("unable to parse overlay policy %s: %s", path, err)
+	}
+	return overlay.SetPolicy(policy)
 }
 
 func parseAndCheckCIDR(cidrStr string) address.CIDR {
@@ -307,7 +528,7 @@ func parseAndCheckCIDR(cidrStr string) address.CIDR {
 	return cidr
 }
 
-func createAllocator(router *mesh.Router, ipRangeStr string, defaultSubnetStr string, quorum uint, isKnownPeer func(mesh.PeerName) bool) (*ipam.Allocator, address.CIDR) {
+func createAllocator(router *mesh.Router, channelName string, ipRangeStr string, defaultSubnetStr string, quorum uint, isKnownPeer func(mesh.PeerName) bool, sticky ipam.StickyConfig, rebalance ipam.RebalanceConfig) (*ipam.Allocator, address.CIDR) {
 	ipRange := parseAndCheckCIDR(ipRangeStr)
 	defaultSubnet := ipRange
 	if defaultSubnetStr != "" {
@@ -318,12 +539,47 @@ func createAllocator(router *mesh.Router, ipRangeStr string, defaultSubnetStr st
 	}
 	allocator := ipam.NewAllocator(router.Ourself.Peer.Name, router.Ourself.Peer.UID, router.Ourself.Peer.NickName, ipRange.Range(), quorum, isKnownPeer)
 
-	allocator.SetInterfaces(router.NewGossip("IPallocation", allocator))
+	allocator.SetInterfaces(router.NewGossip(channelName, allocator))
+	allocator.SetStickyConfig(sticky)
+	allocator.SetRebalanceConfig(rebalance)
 	allocator.Start()
 
 	return allocator, defaultSubnet
 }
 
+func createDHCPConfig(subnetStr string, defaultSubnet address.CIDR, leaseTime time.Duration, routerStr string, dnsServerStr string, noDNS bool, dnsConfig dnsConfig) weave.DHCPConfig {
+	// Leases are given to clients in whole seconds
+	if leaseTime < time.Second {
+		Log.Fatalf("Invalid DHCP lease time %s: must be at least a second", leaseTime)
+	}
+	config := weave.DHCPConfig{Subnet: defaultSubnet, LeaseTime: leaseTime}
+	if subnetStr != "" {
+		config.Subnet = parseAndCheckCIDR(subnetStr)
+	}
+	if routerStr != "" {
+		if config.Router = net.ParseIP(routerStr).To4(); config.Router == nil {
+			Log.Fatalf("Invalid DHCP router address %s", routerStr)
+		}
+	}
+	if dnsServerStr == "" && !noDNS {
+		// weaveDNS, as reachable from outside the router's
+		// container
+		dnsServerStr = dnsConfig.EffectiveListenAddress
+		if host, _, err := net.SplitHostPort(dnsServerStr); err == nil {
+			dnsServerStr = host
+		}
+		config.Domain = strings.TrimSuffix(dnsConfig.Domain, ".")
+	}
+	if dnsServerStr != "" {
+		dnsServer := net.ParseIP(dnsServerStr).To4()
+		if dnsServer == nil {
+			Log.Fatalf("Invalid DHCP DNS server address %s", dnsServerStr)
+		}
+		config.DNSServers = []net.IP{dnsServer}
+	}
+	return config
+}
+
 func createDNSServer(config dnsConfig, router *mesh.Router, isKnownPeer func(mesh.PeerName) bool) (*nameserver.Nameserver, *nameserver.DNSServer) {
 	ns := nameserver.New(router.Ourself.Peer.Name, config.Domain, isKnownPeer)
 	router.Peers.OnGC(func(peer *mesh.Peer) { ns.PeerGone(peer.Name) })
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/ipam"
+	weavenet "github.com/weaveworks/weave/net"
+	"github.com/weaveworks/weave/net/address"
+	weave "github.com/weaveworks/weave/router"
+)
+
+// The --network flag may be given several times
+type networkSpecs []string
+
+func (specs *networkSpecs) String() string {
+	return strings.Join(*specs, ",")
+}
+
+func (specs *networkSpecs) Set(value string) error {
+	if len(strings.SplitN(value, ":", 4)) < 3 {
+		return fmt.Errorf("invalid network %q; expected name:id:interface[:ipalloc-range]", value)
+	}
+	*specs = append(*specs, value)
+	return nil
+}
+
+type network struct {
+	*weave.Network
+	ipRange   string
+	allocator *ipam.Allocator
+	subnet    address.CIDR
+}
+
+func createNetwork(router *weave.NetworkRouter, spec string, newBridge bridgeConstructorFunc) *network {
+	parts := strings.SplitN(spec, ":", 4)
+	name, idStr, ifaceName := parts[0], parts[1], parts[2]
+	id, err := parseNetwork(router, name, idStr)
+	checkFatal(err)
+	iface, err := weavenet.EnsureInterface(ifaceName)
+	checkFatal(err)
+	n, err := addNetwork(router, name, id, iface, newBridge)
+	checkFatal(err)
+	result := &network{Network: n}
+	if len(parts) == 4 {
+		result.ipRange = parts[3]
+	}
+	return result
+}
+
+func parseNetwork(router *weave.NetworkRouter, name string, idStr string) (weave.NetworkID, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return 0, fmt.Errorf("invalid network name %q", name)
+	}
+	id, err := strconv.ParseUint(idStr, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID for network %s: %s", name, idStr)
+	}
+	return weave.NetworkID(id), router.CheckNewNetwork(weave.NetworkID(id), name)
+}
+
+func addNetwork(router *weave.NetworkRouter, name string, id weave.NetworkID, iface *net.Interface, newBridge bridgeConstructorFunc) (*weave.Network, error) {
+	bridge, err := newBridge(iface)
+	if err != nil {
+		return nil, err
+	}
+	n, err := router.AddNetwork(id, name, bridge)
+	if err != nil {
+		if closer, ok := bridge.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+	Log.Println("Added network", n, "on interface", iface.Name)
+	return n, nil
+}
+
+// Networks can also be added while the router is running, though
+// without IP allocation, since allocators have to be created before
+// the router starts.  The interface must already exist.
+func handleNetworkHTTP(muxRouter *mux.Router, router *weave.NetworkRouter, newBridge bridgeConstructorFunc) {
+	muxRouter.Methods("POST").Path("/network/{name}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		id, err := parseNetwork(router, name, r.FormValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		iface, err := net.InterfaceByName(r.FormValue("iface"))
+		if err != nil {
+			http.Error(w, fmt.Sprint("unable to find interface ", r.FormValue("iface"), ": ", err), http.StatusBadRequest)
+			return
+		}
+		if _, err := addNetwork(router, name, id, iface, newBridge); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/nameserver"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Bring IPAM and DNS into line with the containers Docker has, in
+// case we missed events for some of them.  The addresses of running
+// containers are reclaimed by 'weave launch' when we start, so we
+// only need what Docker can tell us here.  The allocators and
+// nameserver may be nil if not in use.
+func reconcileContainers(dockerCli *docker.Client, allocators []*ipam.Allocator, ns *nameserver.Nameserver) {
+	since := time.Now()
+	containers, err := dockerCli.ContainerStates()
+	if err != nil {
+		Log.Errorf("[docker] Unable to list containers for reconciliation: %s", err)
+		return
+	}
+	Log.Infof("[docker] Reconciling with %d containers", len(containers))
+	for _, allocator := range allocators {
+		if allocator != nil {
+			allocator.Reconcile(containers, since)
+		}
+	}
+	if ns == nil {
+		return
+	}
+	ns.Reconcile(containers, since)
+
+	// Give names back to running containers which have weave
+	// addresses, in case we lost them
+	for ident, running := range containers {
+		if !running {
+			continue
+		}
+		var addrs []address.Address
+		for _, allocator := range allocators {
+			if allocator != nil {
+				for _, a := range allocator.Allocations(ipam.AllocationFilter{ContainerID: ident}) {
+					addrs = append(addrs, a.Address)
+				}
+			}
+		}
+		if len(addrs) == 0 {
+			continue
+		}
+		container, err := dockerCli.InspectContainer(ident)
+		if err != nil || container.Config == nil {
+			continue
+		}
+		// As for 'weave attach': only containers with a domain
+		if container.Config.Domainname == "" {
+			continue
+		}
+		ns.Reregister(ident, container.Config.Hostname+"."+container.Config.Domainname, addrs)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/weaveworks/weave/common/docker"
+	weavenet "github.com/weaveworks/weave/net"
+	"github.com/weaveworks/weave/net/address"
+	weave "github.com/weaveworks/weave/router"
+)
+
+const (
+	// The IPAM ident of the address given to the host by 'weave expose'
+	exposeIdent = "weave:expose"
+	// The interface that 'weave attach' gives containers
+	containerIfaceName = "ethwe"
+)
+
+// Anti-spoofing binds each container to the MAC of its weave
+// interface, which we read from the container's network namespace;
+// 'weave launch' gives us the host's /proc for this.  The host's
+// exposed address is on the weave bridge, which we can see directly
+// since we share the host's network namespace.
+func sourceMACLookup(dockerCli *docker.Client) weave.SourceMACLookup {
+	return func(ident string, addr address.Address) (weave.MAC, error) {
+		if ident == exposeIdent {
+			return hostMACWithAddr(addr)
+		}
+		if dockerCli == nil {
+			return weave.MAC{}, fmt.Errorf("no docker client to look up container %s", ident)
+		}
+		container, err := dockerCli.InspectContainer(ident)
+		if err != nil {
+			return weave.MAC{}, err
+		}
+		if container.State.Pid == 0 {
+			return weave.MAC{}, fmt.Errorf("container %s is not running", ident)
+		}
+		hw, err := weavenet.InterfaceHardwareAddrInNS(netNSPath(container.State.Pid), containerIfaceName)
+		if err != nil {
+			return weave.MAC{}, err
+		}
+		return toMAC(hw)
+	}
+}
+
+// The network namespace of a process, as we can see it from inside
+// the router's container
+func netNSPath(pid int) string {
+	procfs := os.Getenv("PROCFS")
+	if procfs == "" {
+		procfs = "/proc"
+	}
+	return filepath.Join(procfs, strconv.Itoa(pid), "ns", "net")
+}
+
+func hostMACWithAddr(addr address.Address) (weave.MAC, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return weave.MAC{}, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && address.FromIP4(ipnet.IP) == addr {
+				return toMAC(iface.HardwareAddr)
+			}
+		}
+	}
+	return weave.MAC{}, fmt.Errorf("no interface has address %s", addr)
+}
+
+func toMAC(hw net.HardwareAddr) (mac weave.MAC, err error) {
+	if len(hw) != len(mac) {
+		return mac, fmt.Errorf("unexpected hardware address %s", hw)
+	}
+	copy(mac[:], hw)
+	return mac, nil
+}
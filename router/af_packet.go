@@ -0,0 +1,281 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// A Bridge which captures frames through a TPACKET_V3 memory-mapped
+// AF_PACKET receive ring, and injects them by writing to an AF_PACKET
+// socket.  Unlike Pcap, it doesn't need cgo or libpcap, and the
+// kernel hands over frames a block at a time rather than one per
+// system call.
+
+const (
+	packetRxRing      = 5  // PACKET_RX_RING
+	packetStatistics  = 6  // PACKET_STATISTICS
+	packetVersion     = 10 // PACKET_VERSION
+	packetAddMember   = 1  // PACKET_ADD_MEMBERSHIP
+	packetMrPromisc   = 1  // PACKET_MR_PROMISC
+	packetOutgoing    = 4  // PACKET_OUTGOING
+	tpacketV3         = 2  // TPACKET_V3
+	tpStatusKernel    = 0
+	tpStatusUser      = 1
+	tpacketFrameSize  = 2048
+	tpacketBlockSize  = 1 << 20
+	tpacketBlockTimeo = 1 // ms before a partially filled block is handed over
+
+	// offsets within struct tpacket_block_desc
+	blockStatusOffset   = 8
+	blockNumPktsOffset  = 12
+	blockFirstPktOffset = 16
+	// offsets within struct tpacket3_hdr
+	pktNextOffset    = 0
+	pktSnapLenOffset = 12
+	pktMacOffset     = 24
+	// struct sockaddr_ll follows the tpacket3_hdr; its sll_pkttype
+	// field tells us which direction the frame was going in.
+	pktTypeOffset = 48 + 10
+)
+
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+type packetMreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	address [8]byte
+}
+
+type tpacketStatsV3 struct {
+	packets    uint32
+	drops      uint32
+	freezeQCnt uint32
+}
+
+type AFPacket struct {
+	NonDiscardingFlowOp
+
+	iface   *net.Interface
+	bufSz   int
+	writeFD int
+
+	mutex    sync.Mutex
+	readFD   int
+	received int
+	dropped  int
+}
+
+func NewAFPacket(iface *net.Interface, bufSz int) (Bridge, error) {
+	// A socket bound with protocol 0 doesn't receive anything
+	fd, err := newPacketSocket(iface, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &AFPacket{iface: iface, bufSz: bufSz, writeFD: fd, readFD: -1}, nil
+}
+
+// Release a bridge that was never started.  Once consuming packets,
+// a bridge stays open for the life of the router.
+func (p *AFPacket) Close() error {
+	return syscall.Close(p.writeFD)
+}
+
+func newPacketSocket(iface *net.Interface, protocol uint16) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(protocol)))
+	if err != nil {
+		return -1, fmt.Errorf("creating AF_PACKET socket: %s", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(protocol), Ifindex: iface.Index}); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("binding AF_PACKET socket to %s: %s", iface.Name, err)
+	}
+	return fd, nil
+}
+
+func (p *AFPacket) StartConsumingPackets(consumer BridgeConsumer) error {
+	fd, err := newPacketSocket(p.iface, syscall.ETH_P_ALL)
+	if err != nil {
+		return err
+	}
+	ring, err := setupRxRing(fd, p.iface, p.bufSz)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.readFD != -1 {
+		panic("already consuming")
+	}
+	p.readFD = fd
+	go p.sniff(fd, ring, consumer)
+	return nil
+}
+
+func setupRxRing(fd int, iface *net.Interface, bufSz int) ([]byte, error) {
+	version := int32(tpacketV3)
+	if err := setsockopt(fd, packetVersion, unsafe.Pointer(&version), unsafe.Sizeof(version)); err != nil {
+		return nil, fmt.Errorf("selecting TPACKET_V3 (requires Linux 3.2 or later): %s", err)
+	}
+	mreq := packetMreq{ifindex: int32(iface.Index), typ: packetMrPromisc}
+	if err := setsockopt(fd, packetAddMember, unsafe.Pointer(&mreq), unsafe.Sizeof(mreq)); err != nil {
+		return nil, fmt.Errorf("enabling promiscuous mode on %s: %s", iface.Name, err)
+	}
+
+	blocks := bufSz / tpacketBlockSize
+	if blocks < 2 {
+		blocks = 2
+	}
+	req := tpacketReq3{
+		blockSize:    tpacketBlockSize,
+		blockNr:      uint32(blocks),
+		frameSize:    tpacketFrameSize,
+		frameNr:      uint32(blocks * tpacketBlockSize / tpacketFrameSize),
+		retireBlkTov: tpacketBlockTimeo}
+	if err := setsockopt(fd, packetRxRing, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return nil, fmt.Errorf("creating receive ring: %s", err)
+	}
+	ring, err := syscall.Mmap(fd, 0, blocks*tpacketBlockSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mapping receive ring: %s", err)
+	}
+	return ring, nil
+}
+
+func setsockopt(fd int, opt int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_PACKET, uintptr(opt), uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (p *AFPacket) Interface() *net.Interface {
+	return p.iface
+}
+
+func (p *AFPacket) String() string {
+	return fmt.Sprint(p.iface.Name, " (via AF_PACKET)")
+}
+
+func (p *AFPacket) InjectPacket(PacketKey) FlowOp {
+	return p
+}
+
+func (p *AFPacket) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	_, err := syscall.Write(p.writeFD, frame)
+	checkWarn(err)
+}
+
+func (p *AFPacket) sniff(fd int, ring []byte, consumer BridgeConsumer) {
+	dec := NewEthernetDecoder()
+	blocks := len(ring) / tpacketBlockSize
+	for block := 0; ; block = (block + 1) % blocks {
+		desc := ring[block*tpacketBlockSize : (block+1)*tpacketBlockSize]
+		status := (*uint32)(unsafe.Pointer(&desc[blockStatusOffset]))
+		for atomic.LoadUint32(status)&tpStatusUser == 0 {
+			checkFatal(waitReadable(fd))
+		}
+
+		forEachBlockFrame(desc, func(pkt []byte) {
+			p.consume(pkt, dec, consumer)
+		})
+		atomic.StoreUint32(status, tpStatusKernel)
+	}
+}
+
+// Call f with each of the frames in a block handed over by the
+// kernel, apart from the ones we injected ourselves
+func forEachBlockFrame(desc []byte, f func([]byte)) {
+	numPkts := hostUint32(desc[blockNumPktsOffset:])
+	offset := hostUint32(desc[blockFirstPktOffset:])
+	for i := uint32(0); i < numPkts; i++ {
+		hdr := desc[offset:]
+		if hdr[pktTypeOffset] != packetOutgoing {
+			mac := uint32(hostUint16(hdr[pktMacOffset:]))
+			f(hdr[mac : mac+hostUint32(hdr[pktSnapLenOffset:])])
+		}
+		offset += hostUint32(hdr[pktNextOffset:])
+	}
+}
+
+func (p *AFPacket) consume(pkt []byte, dec *EthernetDecoder, consumer BridgeConsumer) {
+	dec.DecodeLayers(pkt)
+	if len(dec.decoded) == 0 {
+		return
+	}
+	if fop := consumer(dec.PacketKey()); !fop.Discards() {
+		// The block goes back to the kernel once we are done
+		// with it, so forwarders need a copy of the frame
+		pktCopy := make([]byte, len(pkt))
+		copy(pktCopy, pkt)
+		fop.Process(pktCopy, dec, false)
+	}
+}
+
+func waitReadable(fd int) error {
+	pfd := struct {
+		fd      int32
+		events  int16
+		revents int16
+	}{int32(fd), 0x1 /* POLLIN */, 0}
+	_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, 0, 0, 0, 0)
+	if errno != 0 && errno != syscall.EINTR {
+		return errno
+	}
+	return nil
+}
+
+func (p *AFPacket) Stats() map[string]int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.readFD == -1 {
+		return nil
+	}
+
+	// The kernel resets its counters whenever they are read
+	var stats tpacketStatsV3
+	size := uint32(unsafe.Sizeof(stats))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(p.readFD), syscall.SOL_PACKET, packetStatistics,
+		uintptr(unsafe.Pointer(&stats)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return nil
+	}
+	p.received += int(stats.packets)
+	p.dropped += int(stats.drops)
+	return map[string]int{
+		"PacketsReceived": p.received,
+		"PacketsDropped":  p.dropped,
+	}
+}
+
+// Host to network byte order, whatever the host's
+func htons(n uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], n)
+	return hostUint16(b[:])
+}
+
+// The ring's descriptors are in host byte order
+func hostUint16(b []byte) uint16 {
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+func hostUint32(b []byte) uint32 {
+	return *(*uint32)(unsafe.Pointer(&b[0]))
+}
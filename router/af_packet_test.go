@@ -0,0 +1,78 @@
+package router
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func putHostUint16(b []byte, n uint16) {
+	*(*uint16)(unsafe.Pointer(&b[0])) = n
+}
+
+func putHostUint32(b []byte, n uint32) {
+	*(*uint32)(unsafe.Pointer(&b[0])) = n
+}
+
+type testRingFrame struct {
+	frame    []byte
+	outgoing bool
+}
+
+// Lay out a block as the kernel fills it in a TPACKET_V3 ring
+func makeRingBlock(frames []testRingFrame) []byte {
+	const firstPkt, macOffset = 48, 82
+	desc := make([]byte, 1<<16)
+	putHostUint32(desc[blockNumPktsOffset:], uint32(len(frames)))
+	putHostUint32(desc[blockFirstPktOffset:], firstPkt)
+	offset := uint32(firstPkt)
+	for i, f := range frames {
+		hdr := desc[offset:]
+		putHostUint32(hdr[pktSnapLenOffset:], uint32(len(f.frame)))
+		putHostUint16(hdr[pktMacOffset:], macOffset)
+		if f.outgoing {
+			hdr[pktTypeOffset] = packetOutgoing
+		}
+		copy(hdr[macOffset:], f.frame)
+		// Frames are aligned to 16 bytes, and the last has no
+		// successor
+		next := (macOffset + uint32(len(f.frame)) + 15) &^ 15
+		if i == len(frames)-1 {
+			next = 0
+		}
+		putHostUint32(hdr[pktNextOffset:], next)
+		offset += next
+	}
+	return desc
+}
+
+func TestAFPacketRingParsing(t *testing.T) {
+	mac1 := mustParseMAC(t, "02:00:00:00:00:01")
+	mac2 := mustParseMAC(t, "02:00:00:00:00:02")
+	frame1 := makeUDPFrame(t, mac1, mac2, "10.0.0.1", "10.0.0.2", []byte("first"))
+	frame2 := makeUDPFrame(t, mac2, mac1, "10.0.0.2", "10.0.0.1", []byte("injected by us"))
+	frame3 := makeUDPFrame(t, mac2, mac1, "10.0.0.2", "10.0.0.1", make([]byte, 1000))
+
+	var frames [][]byte
+	collect := func(frame []byte) { frames = append(frames, frame) }
+
+	forEachBlockFrame(makeRingBlock([]testRingFrame{{frame1, false}, {frame2, true}, {frame3, false}}), collect)
+	require.Equal(t, [][]byte{frame1, frame3}, frames, "outgoing frames skipped")
+
+	frames = nil
+	forEachBlockFrame(makeRingBlock(nil), collect)
+	require.Empty(t, frames)
+
+	frames = nil
+	forEachBlockFrame(makeRingBlock([]testRingFrame{{frame2, true}}), collect)
+	require.Empty(t, frames)
+}
+
+func TestHtons(t *testing.T) {
+	n := htons(0x0806)
+	b := (*[2]byte)(unsafe.Pointer(&n))
+	require.Equal(t, uint16(0x0806), binary.BigEndian.Uint16(b[:]), "network byte order in memory")
+	require.Equal(t, uint16(0x0806), htons(htons(0x0806)))
+}
@@ -0,0 +1,349 @@
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// ARP proxying: we learn the IP->MAC bindings of local hosts from the
+// ARP requests, replies and gratuitous ARPs that they send, and gossip
+// those bindings to other peers.  Requests and gratuitous ARPs are
+// broadcast, so we see them all, but replies are unicast, and to see
+// those we have to keep fastdp from taking over a host's unicast
+// traffic until we have learned its binding.  ARP requests for hosts we know about
+// are then answered locally, rather than being broadcast across the
+// whole network.  Only on a miss is the request broadcast as usual.
+
+const (
+	ARPGossipChannel = "arp"
+	arpMaxAge        = macMaxAge
+	// How long to keep inspecting a host's unicast frames for ARP
+	// replies, if we don't learn its binding sooner
+	arpUnicastInspection = 10 * time.Second
+)
+
+type ARPEntry struct {
+	IP        address.Address
+	MAC       MAC
+	Origin    mesh.PeerName
+	Timestamp int64     // set by the origin peer; the newest entry wins
+	lastSeen  time.Time // local, not gossiped
+}
+
+// The progress of inspecting a local host's unicast frames
+type arpInspection struct {
+	started time.Time
+	learned bool
+}
+
+type ARPProxy struct {
+	sync.RWMutex
+	router      *NetworkRouter
+	gossip      mesh.Gossip
+	entries     map[address.Address]*ARPEntry
+	inspections map[MAC]*arpInspection
+}
+
+func NewARPProxy(router *NetworkRouter) *ARPProxy {
+	proxy := &ARPProxy{
+		router:      router,
+		entries:     make(map[address.Address]*ARPEntry),
+		inspections: make(map[MAC]*arpInspection)}
+	proxy.gossip = router.NewGossip(ARPGossipChannel, proxy)
+	router.Peers.OnGC(func(peer *mesh.Peer) { proxy.peerGone(peer.Name) })
+	time.AfterFunc(arpMaxAge/10, proxy.expire)
+	return proxy
+}
+
+func (proxy *ARPProxy) Lookup(ip address.Address) (ARPEntry, bool) {
+	proxy.RLock()
+	defer proxy.RUnlock()
+	entry, found := proxy.entries[ip]
+	if !found {
+		return ARPEntry{}, false
+	}
+	return *entry, true
+}
+
+// Record a binding observed on the local bridge, gossiping it if it
+// is new or due a refresh.
+func (proxy *ARPProxy) learn(ip address.Address, mac MAC) {
+	ourName := proxy.router.Ourself.Name
+	now := time.Now()
+
+	proxy.Lock()
+	if inspection, found := proxy.inspections[mac]; found {
+		inspection.learned = true
+	} else {
+		proxy.inspections[mac] = &arpInspection{started: now, learned: true}
+	}
+	entry, found := proxy.entries[ip]
+	if found && entry.MAC == mac && entry.Origin == ourName && now.Before(entry.lastSeen.Add(arpMaxAge/10)) {
+		proxy.Unlock()
+		return
+	}
+	if !found || entry.MAC != mac {
+		log.Println("Learned ARP binding", ip, "->", mac)
+	}
+	entry = &ARPEntry{IP: ip, MAC: mac, Origin: ourName, Timestamp: now.UnixNano(), lastSeen: now}
+	proxy.entries[ip] = entry
+	update := &ARPGossipData{Entries: []ARPEntry{*entry}}
+	proxy.Unlock()
+
+	checkWarn(proxy.gossip.GossipBroadcast(update))
+}
+
+// Merge entries received from other peers, returning those that were
+// new to us.
+func (proxy *ARPProxy) merge(entries []ARPEntry) []ARPEntry {
+	ourName := proxy.router.Ourself.Name
+	now := time.Now()
+	var newEntries []ARPEntry
+
+	proxy.Lock()
+	defer proxy.Unlock()
+	for _, entry := range entries {
+		// We are authoritative for our own entries, and
+		// ignore those from peers that have already gone.
+		if entry.Origin == ourName || proxy.router.Peers.Fetch(entry.Origin) == nil {
+			continue
+		}
+		if existing, found := proxy.entries[entry.IP]; found && existing.Timestamp >= entry.Timestamp {
+			continue
+		}
+		entry.lastSeen = now
+		e := entry
+		proxy.entries[entry.IP] = &e
+		newEntries = append(newEntries, entry)
+	}
+	return newEntries
+}
+
+func (proxy *ARPProxy) peerGone(name mesh.PeerName) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	for ip, entry := range proxy.entries {
+		if entry.Origin == name {
+			delete(proxy.entries, ip)
+		}
+	}
+}
+
+func (proxy *ARPProxy) expire() {
+	now := time.Now()
+	proxy.Lock()
+	for ip, entry := range proxy.entries {
+		if now.After(entry.lastSeen.Add(arpMaxAge)) {
+			delete(proxy.entries, ip)
+		}
+	}
+	for mac, inspection := range proxy.inspections {
+		if now.After(inspection.started.Add(arpMaxAge)) {
+			delete(proxy.inspections, mac)
+		}
+	}
+	proxy.Unlock()
+	time.AfterFunc(arpMaxAge/10, proxy.expire)
+}
+
+// Wrap the FlowOp for a frame that is about to be broadcast so that
+// ARP traffic gets examined first.
+func (proxy *ARPProxy) broadcastFlowOp(key PacketKey, relayFop FlowOp) FlowOp {
+	return inspectingFlowOp{inspect: func(frame []byte, dec *EthernetDecoder) FlowOp {
+		if !dec.isARP() || !proxy.handleARP(key, dec) {
+			return relayFop
+		}
+		return nil
+	}}
+}
+
+// Wrap the FlowOp for a unicast frame from a local host so that, if
+// it is an ARP reply, we learn from it.  Only done until we learn the
+// host's binding, or give up, so that fastdp flows can be created
+// for the rest of its traffic.
+func (proxy *ARPProxy) unicastFlowOp(key PacketKey, fwdFop FlowOp) FlowOp {
+	if !proxy.inspectUnicast(key.SrcMAC) {
+		return fwdFop
+	}
+	return inspectingFlowOp{inspect: func(frame []byte, dec *EthernetDecoder) FlowOp {
+		if dec.isARP() {
+			proxy.learnFromARP(&dec.ARP)
+		}
+		return fwdFop
+	}}
+}
+
+func (proxy *ARPProxy) inspectUnicast(mac MAC) bool {
+	now := time.Now()
+	proxy.Lock()
+	defer proxy.Unlock()
+	inspection, found := proxy.inspections[mac]
+	if !found {
+		proxy.inspections[mac] = &arpInspection{started: now}
+		return true
+	}
+	return !inspection.learned && now.Before(inspection.started.Add(arpUnicastInspection))
+}
+
+func validARP(arp *layers.ARP) bool {
+	return arp.AddrType == layers.LinkTypeEthernet && arp.Protocol == layers.EthernetTypeIPv4 &&
+		len(arp.SourceHwAddress) == 6 && len(arp.SourceProtAddress) == 4 && len(arp.DstProtAddress) == 4
+}
+
+// Learn from the sender fields, which are present in requests as well
+// as replies.  A sender address of 0.0.0.0 indicates an address probe
+// (RFC 5227), which tells us nothing.
+func (proxy *ARPProxy) learnFromARP(arp *layers.ARP) {
+	if !validARP(arp) {
+		return
+	}
+	if srcIP := address.FromIP4(arp.SourceProtAddress); srcIP != 0 {
+		var srcMAC MAC
+		copy(srcMAC[:], arp.SourceHwAddress)
+		proxy.learn(srcIP, srcMAC)
+	}
+}
+
+// Returns true if the ARP frame has been dealt with and should not be
+// broadcast.
+func (proxy *ARPProxy) handleARP(key PacketKey, dec *EthernetDecoder) bool {
+	arp := &dec.ARP
+	if !validARP(arp) {
+		return false
+	}
+	proxy.learnFromARP(arp)
+
+	if arp.Operation != layers.ARPRequest {
+		return false
+	}
+
+	srcIP := address.FromIP4(arp.SourceProtAddress)
+
+	dstIP := address.FromIP4(arp.DstProtAddress)
+	if dstIP == srcIP {
+		// gratuitous ARP; other hosts may want to see it
+		return false
+	}
+
+	entry, found := proxy.Lookup(dstIP)
+	switch {
+	case !found:
+		return false
+	case entry.Origin == proxy.router.Ourself.Name:
+		// The target is local, so the bridge has already
+		// delivered the request to it.
+		return true
+	}
+
+	reply, err := makeARPReply(entry.MAC, arp)
+	if err != nil {
+		log.Error("Unable to construct ARP reply: ", err)
+		return false
+	}
+	replyKey := PacketKey{SrcMAC: entry.MAC, DstMAC: key.SrcMAC}
+	proxy.router.PacketLogging.LogPacket("Answering ARP", replyKey)
+	if fop := proxy.router.Bridge.InjectPacket(replyKey); fop != nil {
+		replyDec := NewEthernetDecoder()
+		replyDec.DecodeLayers(reply)
+		fop.Process(reply, replyDec, false)
+	}
+	return true
+}
+
+func makeARPReply(mac MAC, req *layers.ARP) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr(mac[:]),
+			DstMAC:       req.SourceHwAddress,
+			EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   net.HardwareAddr(mac[:]),
+			SourceProtAddress: req.DstProtAddress,
+			DstHwAddress:      req.SourceHwAddress,
+			DstProtAddress:    req.SourceProtAddress})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Gossiper methods
+
+func (proxy *ARPProxy) Gossip() mesh.GossipData {
+	proxy.RLock()
+	defer proxy.RUnlock()
+	gossip := &ARPGossipData{Entries: make([]ARPEntry, 0, len(proxy.entries))}
+	for _, entry := range proxy.entries {
+		gossip.Entries = append(gossip.Entries, *entry)
+	}
+	return gossip
+}
+
+func (proxy *ARPProxy) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+func (proxy *ARPProxy) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	_, gossip, err := proxy.receiveGossip(msg)
+	return gossip, err
+}
+
+func (proxy *ARPProxy) OnGossip(msg []byte) (mesh.GossipData, error) {
+	newEntries, _, err := proxy.receiveGossip(msg)
+	return newEntries, err
+}
+
+func (proxy *ARPProxy) receiveGossip(msg []byte) (mesh.GossipData, mesh.GossipData, error) {
+	var gossip ARPGossipData
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&gossip); err != nil {
+		return nil, nil, err
+	}
+	if newEntries := proxy.merge(gossip.Entries); len(newEntries) > 0 {
+		return &ARPGossipData{Entries: newEntries}, &gossip, nil
+	}
+	return nil, &gossip, nil
+}
+
+type ARPGossipData struct {
+	Entries []ARPEntry
+}
+
+func (g *ARPGossipData) Merge(o mesh.GossipData) mesh.GossipData {
+	byIP := make(map[address.Address]ARPEntry)
+	for _, entries := range [][]ARPEntry{g.Entries, o.(*ARPGossipData).Entries} {
+		for _, entry := range entries {
+			if existing, found := byIP[entry.IP]; !found || existing.Timestamp < entry.Timestamp {
+				byIP[entry.IP] = entry
+			}
+		}
+	}
+	merged := &ARPGossipData{Entries: make([]ARPEntry, 0, len(byIP))}
+	for _, entry := range byIP {
+		merged.Entries = append(merged.Entries, entry)
+	}
+	return merged
+}
+
+func (g *ARPGossipData) Encode() [][]byte {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(g); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
@@ -0,0 +1,116 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func ipAddr(t *testing.T, s string) address.Address {
+	addr, err := address.ParseIP(s)
+	require.NoError(t, err)
+	return addr
+}
+
+func TestARPProxyMerge(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{ARPProxy: true})
+	proxy := router.ARP
+	peer := addTestPeer(t, router, "00:00:00:00:00:02")
+	now := time.Now().UnixNano()
+
+	entries := []ARPEntry{
+		{IP: ipAddr(t, "10.0.0.1"), MAC: mustParseMAC(t, "02:00:00:00:00:01"), Origin: peer.Name, Timestamp: now},
+		{IP: ipAddr(t, "10.0.0.2"), MAC: mustParseMAC(t, "02:00:00:00:00:02"), Origin: peer.Name, Timestamp: now},
+		{IP: ipAddr(t, "10.0.0.3"), MAC: mustParseMAC(t, "02:00:00:00:00:03"), Origin: peer.Name, Timestamp: now},
+		// from a peer we don't know, and from ourself
+		{IP: ipAddr(t, "10.0.0.4"), MAC: mustParseMAC(t, "02:00:00:00:00:04"), Origin: peerName(t, "00:00:00:00:00:09"), Timestamp: now},
+		{IP: ipAddr(t, "10.0.0.5"), MAC: mustParseMAC(t, "02:00:00:00:00:05"), Origin: router.Ourself.Name, Timestamp: now},
+	}
+	require.Len(t, proxy.merge(entries), 3)
+	for _, entry := range entries[:3] {
+		found, ok := proxy.Lookup(entry.IP)
+		require.True(t, ok, "entry for %s", entry.IP)
+		require.Equal(t, entry.MAC, found.MAC, "MAC for %s", entry.IP)
+	}
+	for _, entry := range entries[3:] {
+		_, ok := proxy.Lookup(entry.IP)
+		require.False(t, ok, "entry for %s", entry.IP)
+	}
+
+	// Older news is ignored, newer wins
+	stale := entries[0]
+	stale.MAC = mustParseMAC(t, "02:00:00:00:00:99")
+	stale.Timestamp = now - 1
+	require.Empty(t, proxy.merge([]ARPEntry{stale}))
+	fresh := stale
+	fresh.Timestamp = now + 1
+	require.Len(t, proxy.merge([]ARPEntry{fresh}), 1)
+	found, _ := proxy.Lookup(fresh.IP)
+	require.Equal(t, fresh.MAC, found.MAC)
+}
+
+func TestARPProxyRequests(t *testing.T) {
+	router, bridge := newTestRouter(t, NetworkConfig{ARPProxy: true})
+	proxy := router.ARP
+	peer := addTestPeer(t, router, "00:00:00:00:00:02")
+	localMAC := mustParseMAC(t, "02:00:00:00:00:01")
+	remoteMAC := mustParseMAC(t, "02:00:00:00:00:02")
+	proxy.merge([]ARPEntry{{IP: ipAddr(t, "10.0.0.2"), MAC: remoteMAC, Origin: peer.Name, Timestamp: time.Now().UnixNano()}})
+
+	broadcast := func(frame []byte) [][]byte {
+		return passFrame(frame, true, proxy.broadcastFlowOp)
+	}
+
+	// A request for an unknown host is broadcast, but we learn
+	// about the requester
+	relayed := broadcast(makeARPFrame(t, layers.ARPRequest, localMAC, "10.0.0.1", MAC{}, "10.0.0.9"))
+	require.Len(t, relayed, 1)
+	require.Empty(t, bridge.takeInjected())
+	entry, found := proxy.Lookup(ipAddr(t, "10.0.0.1"))
+	require.True(t, found)
+	require.Equal(t, localMAC, entry.MAC)
+	require.Equal(t, router.Ourself.Name, entry.Origin)
+
+	// A request for a known remote host is answered locally
+	relayed = broadcast(makeARPFrame(t, layers.ARPRequest, localMAC, "10.0.0.1", MAC{}, "10.0.0.2"))
+	require.Empty(t, relayed)
+	injected := bridge.takeInjected()
+	require.Len(t, injected, 1)
+	reply := decodeFrame(injected[0])
+	require.True(t, reply.isARP())
+	require.Equal(t, uint16(layers.ARPReply), reply.ARP.Operation)
+	require.Equal(t, remoteMAC[:], []byte(reply.Eth.SrcMAC))
+	require.Equal(t, localMAC[:], []byte(reply.Eth.DstMAC))
+	require.Equal(t, remoteMAC[:], reply.ARP.SourceHwAddress)
+	require.Equal(t, []byte{10, 0, 0, 2}, reply.ARP.SourceProtAddress)
+	require.Equal(t, localMAC[:], reply.ARP.DstHwAddress)
+	require.Equal(t, []byte{10, 0, 0, 1}, reply.ARP.DstProtAddress)
+
+	// Gratuitous ARP is passed on
+	relayed = broadcast(makeARPFrame(t, layers.ARPRequest, localMAC, "10.0.0.1", MAC{}, "10.0.0.1"))
+	require.Len(t, relayed, 1)
+}
+
+func TestARPProxyLearnsFromUnicastReplies(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{ARPProxy: true})
+	proxy := router.ARP
+	localMAC := mustParseMAC(t, "02:00:00:00:00:01")
+	remoteMAC := mustParseMAC(t, "02:00:00:00:00:02")
+	key := PacketKey{SrcMAC: localMAC, DstMAC: remoteMAC}
+
+	require.IsType(t, inspectingFlowOp{}, proxy.unicastFlowOp(key, &recordingFlowOp{}))
+	frame := makeARPFrame(t, layers.ARPReply, localMAC, "10.0.0.1", remoteMAC, "10.0.0.2")
+	require.Len(t, passFrame(frame, false, proxy.unicastFlowOp), 1, "reply forwarded")
+	entry, found := proxy.Lookup(ipAddr(t, "10.0.0.1"))
+	require.True(t, found)
+	require.Equal(t, localMAC, entry.MAC)
+
+	// Once learned, the host's unicast traffic is left alone, so
+	// that fastdp can create flows for it
+	fwd := &recordingFlowOp{}
+	require.Equal(t, FlowOp(fwd), proxy.unicastFlowOp(key, fwd))
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"sync"
+)
+
+// A pool of goroutines for encrypting and decrypting the packets of
+// sleeve connections in parallel, so that a single busy encrypted
+// connection isn't limited to one core.  Only the sealing and
+// opening of packets is farmed out: sequence numbers are still
+// assigned, and checked against the replay window, in order by the
+// goroutine that owns the connection or socket.
+
+type cryptoTask struct {
+	run func(int)
+	i   int
+	wg  *sync.WaitGroup
+}
+
+type cryptoWorkers struct {
+	tasks chan cryptoTask
+}
+
+// Returns nil, which does everything on the calling goroutine, if
+// fewer than two workers are requested.
+func newCryptoWorkers(workers int) *cryptoWorkers {
+	if workers < 2 {
+		return nil
+	}
+	pool := &cryptoWorkers{tasks: make(chan cryptoTask, workers*sleeveBatchSize)}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// Stop the workers.  The pool must not be used afterwards.
+func (pool *cryptoWorkers) stop() {
+	if pool != nil {
+		close(pool.tasks)
+	}
+}
+
+func (pool *cryptoWorkers) work() {
+	for task := range pool.tasks {
+		task.run(task.i)
+		task.wg.Done()
+	}
+}
+
+// Call run(i) for each i in [0, n), returning once all have
+// completed.  The calling goroutine does its share of the work, and
+// takes on any that the workers have no room for.
+func (pool *cryptoWorkers) parallel(n int, run func(int)) {
+	if pool == nil || n < 2 {
+		for i := 0; i < n; i++ {
+			run(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		select {
+		case pool.tasks <- cryptoTask{run, i, &wg}:
+		default:
+			run(i)
+			wg.Done()
+		}
+	}
+	run(0)
+	wg.Wait()
+}
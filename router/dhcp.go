@@ -0,0 +1,515 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// DHCP server: hosts attached to the local bridge which cannot be
+// configured with 'weave attach', such as VMs, can obtain an address
+// by DHCP.  Addresses are allocated by IPAM, keyed by the client's
+// MAC, and freed when the lease expires.  Only local clients are
+// served; DHCP requests are not broadcast to other peers, whose
+// servers would otherwise answer them too.
+//
+// The server needs an address of its own, to identify itself to
+// clients, which it allocates from IPAM as well.
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpBootRequest = 1
+	dhcpBootReply   = 2
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpDecline  = 4
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+
+	dhcpOptPad           = 0
+	dhcpOptSubnetMask    = 1
+	dhcpOptRouter        = 3
+	dhcpOptDNSServer     = 6
+	dhcpOptDomainName    = 15
+	dhcpOptRequestedIP   = 50
+	dhcpOptLeaseTime     = 51
+	dhcpOptMessageType   = 53
+	dhcpOptServerID      = 54
+	dhcpOptRenewalTime   = 58
+	dhcpOptRebindingTime = 59
+	dhcpOptEnd           = 255
+
+	dhcpHeaderSize     = 236
+	dhcpMinMessageSize = 300 // as required by BOOTP relays
+	dhcpOfferHoldTime  = time.Minute
+	dhcpMinExpiryCheck = time.Second
+	dhcpServerIdent    = "weave:dhcp"
+	dhcpBroadcastFlag  = 0x8000
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// The subset of ipam.Allocator that the DHCP server uses
+type DHCPAllocator interface {
+	Allocate(ident string, r address.Range, hasBeenCancelled func() bool) (address.Address, error)
+	Free(ident string, addr address.Address) error
+}
+
+type DHCPConfig struct {
+	Subnet     address.CIDR
+	LeaseTime  time.Duration
+	Router     net.IP // optional default gateway
+	DNSServers []net.IP
+	Domain     string
+}
+
+type dhcpLease struct {
+	addr    address.Address
+	expires time.Time
+	bound   bool // false while only offered
+}
+
+type DHCPServer struct {
+	sync.Mutex
+	router    *NetworkRouter
+	allocator DHCPAllocator
+	config    DHCPConfig
+	mac       MAC
+	addr      address.Address // zero until allocated
+	leases    map[MAC]*dhcpLease
+}
+
+func NewDHCPServer(router *NetworkRouter, allocator DHCPAllocator, config DHCPConfig) *DHCPServer {
+	server := &DHCPServer{
+		router:    router,
+		allocator: allocator,
+		config:    config,
+		mac:       makeServiceMAC("dhcp", router.Ourself.Name),
+		leases:    make(map[MAC]*dhcpLease)}
+	// Allocation waits for the IPAM ring to be established, which
+	// may involve other peers, so mustn't hold up startup.
+	go server.allocateAddress()
+	time.AfterFunc(server.expiryInterval(), server.expire)
+	return server
+}
+
+func (server *DHCPServer) allocateAddress() {
+	addr, err := server.allocator.Allocate(dhcpServerIdent, server.config.Subnet.HostRange(), func() bool { return false })
+	if err != nil {
+		log.Error("DHCP server: unable to allocate an address: ", err)
+		return
+	}
+	server.Lock()
+	server.addr = addr
+	server.Unlock()
+	log.Println("DHCP server: listening on", addr, "at", server.mac)
+}
+
+func (server *DHCPServer) expiryInterval() time.Duration {
+	interval := server.config.LeaseTime / 10
+	switch {
+	case interval < dhcpMinExpiryCheck:
+		return dhcpMinExpiryCheck
+	case interval > dhcpOfferHoldTime:
+		return dhcpOfferHoldTime
+	}
+	return interval
+}
+
+func (server *DHCPServer) expire() {
+	server.expireLeases(time.Now())
+	time.AfterFunc(server.expiryInterval(), server.expire)
+}
+
+func (server *DHCPServer) expireLeases(now time.Time) {
+	server.Lock()
+	var expired []MAC
+	for mac, lease := range server.leases {
+		if now.After(lease.expires) {
+			expired = append(expired, mac)
+		}
+	}
+	server.Unlock()
+	for _, mac := range expired {
+		server.release(mac, "expired")
+	}
+}
+
+func (server *DHCPServer) release(mac MAC, reason string) {
+	server.Lock()
+	lease, found := server.leases[mac]
+	delete(server.leases, mac)
+	server.Unlock()
+	if !found {
+		return
+	}
+	if lease.bound {
+		log.Println("DHCP server: lease of", lease.addr, "to", mac, reason)
+	}
+	if err := server.allocator.Free(mac.String(), lease.addr); err != nil {
+		log.Warning("DHCP server: unable to free ", lease.addr, ": ", err)
+	}
+}
+
+// Wrap the FlowOp for a captured frame so that DHCP requests, and ARP
+// requests for the server's address, get answered instead of being
+// passed on.
+func (server *DHCPServer) capturedFlowOp(key PacketKey, fop FlowOp) FlowOp {
+	return inspectingFlowOp{inspect: func(frame []byte, dec *EthernetDecoder) FlowOp {
+		switch {
+		case dec.isARP():
+			if server.handleARP(dec) {
+				return nil
+			}
+		case server.isRequest(dec):
+			if err := server.handleRequest(dec.IP.Payload[8:]); err != nil {
+				log.Warning("DHCP server: ", err)
+			}
+			return nil
+		}
+		return fop
+	}}
+}
+
+// Is the frame a request from a DHCP client?
+func (server *DHCPServer) isRequest(dec *EthernetDecoder) bool {
+	if !dec.isIPv4() || dec.IP.Protocol != layers.IPProtocolUDP {
+		return false
+	}
+	udp := dec.IP.Payload
+	return len(udp) >= 8 && binary.BigEndian.Uint16(udp[0:2]) == dhcpClientPort &&
+		binary.BigEndian.Uint16(udp[2:4]) == dhcpServerPort
+}
+
+func (server *DHCPServer) handleARP(dec *EthernetDecoder) bool {
+	arp := &dec.ARP
+	if arp.Operation != layers.ARPRequest || len(arp.DstProtAddress) != 4 || len(arp.SourceHwAddress) != 6 {
+		return false
+	}
+	server.Lock()
+	serverAddr := server.addr
+	server.Unlock()
+	if serverAddr == 0 || address.FromIP4(arp.DstProtAddress) != serverAddr {
+		return false
+	}
+	reply, err := makeARPReply(server.mac, arp)
+	if err != nil {
+		log.Error("Unable to construct ARP reply: ", err)
+		return false
+	}
+	var dstMAC MAC
+	copy(dstMAC[:], arp.SourceHwAddress)
+	server.inject(PacketKey{SrcMAC: server.mac, DstMAC: dstMAC}, reply)
+	return true
+}
+
+type dhcpMessage struct {
+	op      byte
+	xid     []byte
+	flags   uint16
+	ciaddr  address.Address
+	giaddr  address.Address
+	chaddr  MAC
+	options map[byte][]byte
+}
+
+func parseDHCPMessage(msg []byte) (*dhcpMessage, error) {
+	if len(msg) < dhcpHeaderSize+len(dhcpMagicCookie) {
+		return nil, errors.New("truncated message")
+	}
+	if msg[1] != 1 || msg[2] != 6 {
+		return nil, fmt.Errorf("unsupported hardware address type %d/%d", msg[1], msg[2])
+	}
+	m := &dhcpMessage{
+		op:      msg[0],
+		xid:     msg[4:8],
+		flags:   binary.BigEndian.Uint16(msg[10:12]),
+		ciaddr:  address.FromIP4(msg[12:16]),
+		giaddr:  address.FromIP4(msg[24:28]),
+		options: make(map[byte][]byte)}
+	copy(m.chaddr[:], msg[28:34])
+	options := msg[dhcpHeaderSize:]
+	for i := range dhcpMagicCookie {
+		if options[i] != dhcpMagicCookie[i] {
+			return nil, errors.New("not a DHCP message")
+		}
+	}
+	for options = options[len(dhcpMagicCookie):]; len(options) > 0; {
+		code := options[0]
+		switch code {
+		case dhcpOptEnd:
+			return m, nil
+		case dhcpOptPad:
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return nil, errors.New("truncated options")
+		}
+		m.options[code] = options[2 : 2+options[1]]
+		options = options[2+options[1]:]
+	}
+	return m, nil
+}
+
+func (m *dhcpMessage) messageType() byte {
+	if opt := m.options[dhcpOptMessageType]; len(opt) == 1 {
+		return opt[0]
+	}
+	return 0
+}
+
+func (m *dhcpMessage) addressOption(code byte) address.Address {
+	if opt := m.options[code]; len(opt) == 4 {
+		return address.FromIP4(opt)
+	}
+	return 0
+}
+
+func (server *DHCPServer) handleRequest(msg []byte) error {
+	// The request may be dealt with after the frame buffer has
+	// been reused
+	req, err := parseDHCPMessage(append([]byte(nil), msg...))
+	if err != nil {
+		return err
+	}
+	if req.op != dhcpBootRequest {
+		return nil
+	}
+	if req.giaddr != 0 {
+		return fmt.Errorf("ignoring relayed request from %s", req.chaddr)
+	}
+	server.Lock()
+	serverAddr := server.addr
+	server.Unlock()
+	if serverAddr == 0 {
+		return fmt.Errorf("ignoring request from %s: no server address allocated yet", req.chaddr)
+	}
+
+	switch req.messageType() {
+	case dhcpDiscover:
+		// Allocation may have to wait for other peers to give us
+		// some space, so don't hold up the capturing goroutine.
+		go server.offer(req)
+	case dhcpRequest:
+		if serverID := req.addressOption(dhcpOptServerID); serverID != 0 && serverID != serverAddr {
+			// The client has accepted some other server's offer
+			server.release(req.chaddr, "declined")
+			return nil
+		}
+		go server.acknowledge(req)
+	case dhcpDecline:
+		server.release(req.chaddr, "declined by client")
+	case dhcpRelease:
+		server.release(req.chaddr, "released by client")
+	}
+	return nil
+}
+
+func (server *DHCPServer) allocate(mac MAC) (address.Address, error) {
+	addr, err := server.allocator.Allocate(mac.String(), server.config.Subnet.HostRange(), func() bool { return false })
+	if err != nil {
+		return 0, err
+	}
+	server.Lock()
+	if _, found := server.leases[mac]; !found {
+		server.leases[mac] = &dhcpLease{addr: addr, expires: time.Now().Add(dhcpOfferHoldTime)}
+	}
+	server.Unlock()
+	return addr, nil
+}
+
+func (server *DHCPServer) offer(req *dhcpMessage) {
+	addr, err := server.allocate(req.chaddr)
+	if err != nil {
+		log.Warning("DHCP server: unable to allocate an address for ", req.chaddr, ": ", err)
+		return
+	}
+	server.reply(req, dhcpOffer, addr)
+}
+
+func (server *DHCPServer) acknowledge(req *dhcpMessage) {
+	requested := req.addressOption(dhcpOptRequestedIP)
+	if requested == 0 {
+		requested = req.ciaddr // renewing or rebinding
+	}
+	// After a restart we won't know about the client's lease, in
+	// which case allocation gets it the same address as before if
+	// it is still free.
+	addr, err := server.allocate(req.chaddr)
+	switch {
+	case err != nil:
+		log.Warning("DHCP server: unable to allocate an address for ", req.chaddr, ": ", err)
+		server.reply(req, dhcpNak, 0)
+		return
+	case requested != addr:
+		server.reply(req, dhcpNak, 0)
+		return
+	}
+
+	server.Lock()
+	lease, found := server.leases[req.chaddr]
+	if !found {
+		lease = &dhcpLease{addr: addr}
+		server.leases[req.chaddr] = lease
+	}
+	if !lease.bound {
+		log.Println("DHCP server: leased", addr, "to", req.chaddr)
+	}
+	lease.bound = true
+	lease.expires = time.Now().Add(server.config.LeaseTime)
+	server.Unlock()
+	server.reply(req, dhcpAck, addr)
+}
+
+func (server *DHCPServer) reply(req *dhcpMessage, msgType byte, addr address.Address) {
+	server.Lock()
+	serverAddr := server.addr
+	server.Unlock()
+
+	msg := make([]byte, dhcpHeaderSize, dhcpMinMessageSize)
+	msg[0] = dhcpBootReply
+	msg[1], msg[2] = 1, 6
+	copy(msg[4:8], req.xid)
+	binary.BigEndian.PutUint16(msg[10:12], req.flags)
+	if msgType != dhcpNak {
+		copy(msg[12:16], req.ciaddr.IP4())
+		copy(msg[16:20], addr.IP4())
+		copy(msg[20:24], serverAddr.IP4())
+	}
+	copy(msg[28:34], req.chaddr[:])
+	msg = append(msg, dhcpMagicCookie...)
+
+	option := func(code byte, data ...byte) {
+		msg = append(msg, code, byte(len(data)))
+		msg = append(msg, data...)
+	}
+	seconds := func(d time.Duration) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(d/time.Second))
+		return b
+	}
+	option(dhcpOptMessageType, msgType)
+	option(dhcpOptServerID, serverAddr.IP4()...)
+	if msgType != dhcpNak {
+		config := server.config
+		option(dhcpOptLeaseTime, seconds(config.LeaseTime)...)
+		option(dhcpOptRenewalTime, seconds(config.LeaseTime/2)...)
+		option(dhcpOptRebindingTime, seconds(config.LeaseTime*7/8)...)
+		option(dhcpOptSubnetMask, net.CIDRMask(config.Subnet.PrefixLen, 32)...)
+		if config.Router != nil {
+			option(dhcpOptRouter, config.Router.To4()...)
+		}
+		if len(config.DNSServers) > 0 {
+			var servers []byte
+			for _, ip := range config.DNSServers {
+				servers = append(servers, ip.To4()...)
+			}
+			option(dhcpOptDNSServer, servers...)
+		}
+		if config.Domain != "" {
+			option(dhcpOptDomainName, []byte(config.Domain)...)
+		}
+	}
+	msg = append(msg, dhcpOptEnd)
+	for len(msg) < dhcpMinMessageSize {
+		msg = append(msg, dhcpOptPad)
+	}
+
+	// RFC 2131 section 4.1: reply by broadcast if the client asks
+	// us to, or cannot receive unicast yet
+	dstIP := net.IPv4bcast
+	switch {
+	case msgType == dhcpNak || req.flags&dhcpBroadcastFlag != 0:
+	case req.ciaddr != 0:
+		dstIP = req.ciaddr.IP4()
+	default:
+		dstIP = addr.IP4()
+	}
+	dstMAC := req.chaddr
+	if dstIP.Equal(net.IPv4bcast) {
+		dstMAC = broadcastMAC
+	}
+
+	frame, err := server.makeFrame(dstMAC, serverAddr, dstIP, msg)
+	if err != nil {
+		log.Error("DHCP server: unable to construct reply: ", err)
+		return
+	}
+	server.inject(PacketKey{SrcMAC: server.mac, DstMAC: dstMAC}, frame)
+}
+
+func (server *DHCPServer) makeFrame(dstMAC MAC, srcIP address.Address, dstIP net.IP, msg []byte) ([]byte, error) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    srcIP.IP4(),
+		DstIP:    dstIP}
+	udp := &layers.UDP{SrcPort: dhcpServerPort, DstPort: dhcpClientPort}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr(server.mac[:]),
+			DstMAC:       net.HardwareAddr(dstMAC[:]),
+			EthernetType: layers.EthernetTypeIPv4},
+		ip, udp, gopacket.Payload(msg))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (server *DHCPServer) inject(key PacketKey, frame []byte) {
+	server.router.PacketLogging.LogPacket("DHCP server", key)
+	if fop := server.router.Bridge.InjectPacket(key); fop != nil {
+		dec := NewEthernetDecoder()
+		dec.DecodeLayers(frame)
+		fop.Process(frame, dec, false)
+	}
+}
+
+type DHCPStatus struct {
+	Address string
+	Subnet  string
+	Leases  []DHCPLeaseStatus
+}
+
+type DHCPLeaseStatus struct {
+	MAC     string
+	Address string
+	Expires time.Time
+}
+
+func newDHCPStatus(server *DHCPServer) *DHCPStatus {
+	if server == nil {
+		return nil
+	}
+	server.Lock()
+	defer server.Unlock()
+	status := &DHCPStatus{Subnet: server.config.Subnet.String()}
+	if server.addr != 0 {
+		status.Address = server.addr.String()
+	}
+	for mac, lease := range server.leases {
+		if lease.bound {
+			status.Leases = append(status.Leases, DHCPLeaseStatus{mac.String(), lease.addr.String(), lease.expires})
+		}
+	}
+	return status
+}
@@ -0,0 +1,178 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Hands out addresses in order, as IPAM would from an empty range
+type testDHCPAllocator struct {
+	sync.Mutex
+	next  address.Offset
+	owned map[string]address.Address
+}
+
+func (alloc *testDHCPAllocator) Allocate(ident string, r address.Range, hasBeenCancelled func() bool) (address.Address, error) {
+	alloc.Lock()
+	defer alloc.Unlock()
+	if addr, found := alloc.owned[ident]; found {
+		return addr, nil
+	}
+	addr := address.Add(r.Start, alloc.next)
+	alloc.next++
+	alloc.owned[ident] = addr
+	return addr, nil
+}
+
+func (alloc *testDHCPAllocator) Free(ident string, addr address.Address) error {
+	alloc.Lock()
+	defer alloc.Unlock()
+	delete(alloc.owned, ident)
+	return nil
+}
+
+func (alloc *testDHCPAllocator) owner(addr address.Address) string {
+	alloc.Lock()
+	defer alloc.Unlock()
+	for ident, a := range alloc.owned {
+		if a == addr {
+			return ident
+		}
+	}
+	return ""
+}
+
+func makeDHCPFrame(t *testing.T, mac MAC, msgType byte, ciaddr address.Address, options ...byte) []byte {
+	msg := make([]byte, dhcpHeaderSize)
+	msg[0] = dhcpBootRequest
+	msg[1], msg[2] = 1, 6
+	copy(msg[4:8], []byte{1, 2, 3, 4})
+	copy(msg[12:16], ciaddr.IP4())
+	copy(msg[28:34], mac[:])
+	msg = append(msg, dhcpMagicCookie...)
+	msg = append(msg, dhcpOptMessageType, 1, msgType)
+	msg = append(msg, options...)
+	msg = append(msg, dhcpOptEnd)
+
+	srcIP := net.IPv4zero
+	if ciaddr != 0 {
+		srcIP = ciaddr.IP4()
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP, DstIP: net.IPv4bcast}
+	udp := &layers.UDP{SrcPort: dhcpClientPort, DstPort: dhcpServerPort}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serializeFrame(t,
+		&layers.Ethernet{SrcMAC: mac[:], DstMAC: broadcastMAC[:], EthernetType: layers.EthernetTypeIPv4},
+		ip, udp, gopacket.Payload(msg))
+}
+
+func addressOption(code byte, addr address.Address) []byte {
+	return append([]byte{code, 4}, addr.IP4()...)
+}
+
+// Wait for the server to inject a reply, returning it and the address
+// it offers
+func dhcpReply(t *testing.T, bridge *testBridge) (*dhcpMessage, address.Address) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if injected := bridge.takeInjected(); len(injected) > 0 {
+			require.Len(t, injected, 1)
+			dec := decodeFrame(injected[0])
+			require.True(t, dec.isIPv4() && dec.IP.Protocol == layers.IPProtocolUDP, "reply is UDP")
+			msg := dec.IP.Payload[8:]
+			reply, err := parseDHCPMessage(msg)
+			require.NoError(t, err)
+			require.Equal(t, byte(dhcpBootReply), reply.op)
+			return reply, address.FromIP4(msg[16:20])
+		}
+	}
+	require.FailNow(t, "no reply from DHCP server")
+	return nil, 0
+}
+
+func TestDHCPServer(t *testing.T) {
+	router, bridge := newTestRouter(t, NetworkConfig{})
+	alloc := &testDHCPAllocator{owned: make(map[string]address.Address)}
+	_, subnet, _ := address.ParseCIDR("10.2.0.0/24")
+	server := NewDHCPServer(router, alloc, DHCPConfig{Subnet: subnet, LeaseTime: time.Hour})
+	for deadline := time.Now().Add(time.Second); newDHCPStatus(server).Address == ""; time.Sleep(time.Millisecond) {
+		require.True(t, time.Now().Before(deadline), "server address allocated")
+	}
+	serverAddr, _ := alloc.Allocate(dhcpServerIdent, subnet.HostRange(), nil)
+
+	clientMAC := mustParseMAC(t, "02:00:00:00:00:01")
+	send := func(frame []byte) {
+		require.Empty(t, passFrame(frame, true, server.capturedFlowOp), "request answered, not passed on")
+	}
+
+	send(makeDHCPFrame(t, clientMAC, dhcpDiscover, 0))
+	offer, offered := dhcpReply(t, bridge)
+	require.Equal(t, byte(dhcpOffer), offer.messageType())
+	require.Equal(t, serverAddr, offer.addressOption(dhcpOptServerID))
+	require.True(t, subnet.Range().Contains(offered))
+	require.Equal(t, clientMAC.String(), alloc.owner(offered))
+	require.Empty(t, newDHCPStatus(server).Leases, "offer doesn't bind")
+
+	send(makeDHCPFrame(t, clientMAC, dhcpRequest, 0,
+		append(addressOption(dhcpOptRequestedIP, offered), addressOption(dhcpOptServerID, serverAddr)...)...))
+	ack, acked := dhcpReply(t, bridge)
+	require.Equal(t, byte(dhcpAck), ack.messageType())
+	require.Equal(t, offered, acked)
+	require.Equal(t, []byte{0, 0, 0x0e, 0x10}, ack.options[dhcpOptLeaseTime])
+	leases := newDHCPStatus(server).Leases
+	require.Len(t, leases, 1)
+	require.Equal(t, offered.String(), leases[0].Address)
+
+	// Renewal extends the lease
+	server.Lock()
+	server.leases[clientMAC].expires = time.Now()
+	server.Unlock()
+	send(makeDHCPFrame(t, clientMAC, dhcpRequest, offered))
+	renewed, _ := dhcpReply(t, bridge)
+	require.Equal(t, byte(dhcpAck), renewed.messageType())
+	require.True(t, newDHCPStatus(server).Leases[0].Expires.After(time.Now().Add(time.Hour/2)), "lease extended")
+
+	// Asking for some other address gets a NAK
+	send(makeDHCPFrame(t, clientMAC, dhcpRequest, 0, addressOption(dhcpOptRequestedIP, offered+1)...))
+	nak, _ := dhcpReply(t, bridge)
+	require.Equal(t, byte(dhcpNak), nak.messageType())
+
+	// Once the lease expires, the address is freed
+	server.expireLeases(time.Now().Add(30 * time.Minute))
+	require.Len(t, newDHCPStatus(server).Leases, 1)
+	server.expireLeases(time.Now().Add(2 * time.Hour))
+	require.Empty(t, newDHCPStatus(server).Leases)
+	require.Empty(t, alloc.owner(offered))
+}
+
+func TestDHCPExpiryInterval(t *testing.T) {
+	for _, c := range []struct{ leaseTime, interval time.Duration }{
+		{0, dhcpMinExpiryCheck},
+		{time.Second, dhcpMinExpiryCheck},
+		{time.Minute, 6 * time.Second},
+		{time.Hour, dhcpOfferHoldTime},
+	} {
+		server := &DHCPServer{config: DHCPConfig{LeaseTime: c.leaseTime}}
+		require.Equal(t, c.interval, server.expiryInterval(), "lease time %s", c.leaseTime)
+	}
+}
+
+func TestDHCPMessageParsing(t *testing.T) {
+	frame := makeDHCPFrame(t, mustParseMAC(t, "02:00:00:00:00:01"), dhcpDiscover, 0)
+	msg := decodeFrame(frame).IP.Payload[8:]
+	_, err := parseDHCPMessage(msg[:dhcpHeaderSize])
+	require.Error(t, err, "truncated message")
+	_, err = parseDHCPMessage(append(append([]byte(nil), msg[:len(msg)-1]...), dhcpOptLeaseTime, 4, 0))
+	require.Error(t, err, "truncated options")
+	binary.BigEndian.PutUint32(msg[dhcpHeaderSize:], 0)
+	_, err = parseDHCPMessage(msg)
+	require.Error(t, err, "no magic cookie")
+}
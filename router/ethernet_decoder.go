@@ -2,6 +2,7 @@ package router
 
 import (
 	"bytes"
+	"encoding/binary"
 	"net"
 
 	"github.com/google/gopacket"
@@ -11,13 +12,15 @@ import (
 type EthernetDecoder struct {
 	Eth     layers.Ethernet
 	IP      layers.IPv4
+	IPv6    layers.IPv6
+	ARP     layers.ARP
 	decoded []gopacket.LayerType
 	parser  *gopacket.DecodingLayerParser
 }
 
 func NewEthernetDecoder() *EthernetDecoder {
 	dec := &EthernetDecoder{}
-	dec.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &dec.Eth, &dec.IP)
+	dec.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &dec.Eth, &dec.IP, &dec.IPv6, &dec.ARP)
 	return dec
 }
 
@@ -70,6 +73,59 @@ func (dec *EthernetDecoder) makeICMPFragNeeded(mtu int) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+const (
+	ipv6MinMTU       = 1280
+	ipv6HeaderSize   = 40
+	icmpv6HeaderSize = 8
+)
+
+func (dec *EthernetDecoder) makeICMPv6PacketTooBig(mtu int) ([]byte, error) {
+	// The message carries as much of the offending packet as fits
+	// without exceeding the minimum IPv6 MTU.
+	original := dec.Eth.Payload
+	if maxLen := ipv6MinMTU - ipv6HeaderSize - icmpv6HeaderSize; len(original) > maxLen {
+		original = original[:maxLen]
+	}
+	// The layer only covers the type, code and checksum; the MTU
+	// goes at the start of the payload
+	body := make([]byte, 4+len(original))
+	binary.BigEndian.PutUint32(body, uint32(mtu))
+	copy(body[4:], original)
+	payload := gopacket.Payload(body)
+
+	ip := &layers.IPv6{
+		Version:      6,
+		TrafficClass: dec.IPv6.TrafficClass,
+		NextHeader:   layers.IPProtocolICMPv6,
+		HopLimit:     64,
+		SrcIP:        dec.IPv6.DstIP,
+		DstIP:        dec.IPv6.SrcIP}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0)}
+	if err := icmp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       dec.Eth.DstMAC,
+			DstMAC:       dec.Eth.SrcMAC,
+			EthernetType: dec.Eth.EthernetType},
+		ip,
+		icmp,
+		&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Sending ICMPv6 Packet Too Big (%v -> %v): PMTU=%v", ip.SrcIP, ip.DstIP, mtu)
+	return buf.Bytes(), nil
+}
+
 var (
 	zeroMAC, _ = net.ParseMAC("00:00:00:00:00:00")
 )
@@ -80,5 +136,17 @@ func (dec *EthernetDecoder) IsSpecial() bool {
 }
 
 func (dec *EthernetDecoder) DF() bool {
-	return len(dec.decoded) == 2 && (dec.IP.Flags&layers.IPv4DontFragment != 0)
+	return dec.isIPv4() && (dec.IP.Flags&layers.IPv4DontFragment != 0)
+}
+
+func (dec *EthernetDecoder) isIPv4() bool {
+	return len(dec.decoded) == 2 && dec.decoded[1] == layers.LayerTypeIPv4
+}
+
+func (dec *EthernetDecoder) isIPv6() bool {
+	return len(dec.decoded) == 2 && dec.decoded[1] == layers.LayerTypeIPv6
+}
+
+func (dec *EthernetDecoder) isARP() bool {
+	return len(dec.decoded) == 2 && dec.decoded[1] == layers.LayerTypeARP
 }
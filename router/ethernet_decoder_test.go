@@ -0,0 +1,69 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+// Sum of the ICMPv6 pseudo-header and message, which comes to 0xffff
+// when the checksum in the message is correct
+func icmpv6Sum(srcIP, dstIP net.IP, msg []byte) uint16 {
+	var sum uint32
+	add := func(data []byte) {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(data[i])<<8 | uint32(data[i+1])
+		}
+		if len(data)%2 == 1 {
+			sum += uint32(data[len(data)-1]) << 8
+		}
+	}
+	add(srcIP.To16())
+	add(dstIP.To16())
+	sum += uint32(len(msg))
+	sum += uint32(layers.IPProtocolICMPv6)
+	add(msg)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+func TestICMPv6PacketTooBig(t *testing.T) {
+	srcMAC := mustParseMAC(t, "02:00:00:00:00:01")
+	dstMAC := mustParseMAC(t, "02:00:00:00:00:02")
+
+	for _, size := range []int{100, 2000} {
+		frame := makeUDPFrame(t, srcMAC, dstMAC, "fd00::1", "fd00::2", make([]byte, size))
+		dec := decodeFrame(frame)
+		require.True(t, dec.isIPv6())
+
+		reply, err := dec.makeICMPv6PacketTooBig(1400)
+		require.NoError(t, err)
+		packet := gopacket.NewPacket(reply, layers.LayerTypeEthernet, gopacket.Default)
+		eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		require.Equal(t, net.HardwareAddr(srcMAC[:]), eth.DstMAC)
+		require.Equal(t, net.HardwareAddr(dstMAC[:]), eth.SrcMAC)
+		ip := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		require.Equal(t, "fd00::2", ip.SrcIP.String())
+		require.Equal(t, "fd00::1", ip.DstIP.String())
+		require.Equal(t, layers.IPProtocolICMPv6, ip.NextHeader)
+		require.Equal(t, int(ip.Length), len(ip.Payload))
+		icmp := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+		require.Equal(t, layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0), icmp.TypeCode)
+		require.Equal(t, uint16(0xffff), icmpv6Sum(ip.SrcIP, ip.DstIP, ip.Payload), "checksum")
+
+		body := icmp.Payload
+		require.Equal(t, uint32(1400), binary.BigEndian.Uint32(body))
+		original := frame[14:]
+		if len(original) > ipv6MinMTU-ipv6HeaderSize-icmpv6HeaderSize {
+			original = original[:ipv6MinMTU-ipv6HeaderSize-icmpv6HeaderSize]
+			require.Equal(t, ipv6MinMTU+14, len(reply), "reply fits the minimum MTU")
+		}
+		require.Equal(t, original, body[4:])
+	}
+}
@@ -35,6 +35,7 @@ type FastDatapath struct {
 	iface            *net.Interface
 	deleteFlowsCount uint64
 	missCount        uint64
+	flowCount        int // as of the last enumeration, plus those created since
 	missHandlers     map[odp.VportID]missHandler
 	localPeer        *mesh.Peer
 	peers            *mesh.Peers
@@ -50,8 +51,12 @@ type FastDatapath struct {
 	seenMACs map[MAC]struct{}
 
 	// vxlan vports associated with the given UDP ports
-	vxlanVportIDs    map[int]odp.VportID
-	mainVxlanVportID odp.VportID
+	vxlanVportIDs       map[int]odp.VportID
+	mainVxlanVportID    odp.VportID
+	networkVxlanVportID odp.VportID
+
+	// vxlan vports for frames on networks other than the default
+	networkVxlanVports map[odp.VportID]struct{}
 
 	// A singleton pool for the occasions when we need to decode
 	// the packet.
@@ -85,16 +90,17 @@ func NewFastDatapath(dpName string, port int) (*FastDatapath, error) {
 	}
 
 	fastdp := &FastDatapath{
-		dpname:        dpName,
-		dpif:          dpif,
-		dp:            dp,
-		iface:         iface,
-		missHandlers:  make(map[odp.VportID]missHandler),
-		sendToPort:    nil,
-		sendToMAC:     make(map[MAC]bridgeSender),
-		seenMACs:      make(map[MAC]struct{}),
-		vxlanVportIDs: make(map[int]odp.VportID),
-		forwarders:    make(map[mesh.PeerName]*fastDatapathForwarder),
+		dpname:             dpName,
+		dpif:               dpif,
+		dp:                 dp,
+		iface:              iface,
+		missHandlers:       make(map[odp.VportID]missHandler),
+		sendToPort:         nil,
+		sendToMAC:          make(map[MAC]bridgeSender),
+		seenMACs:           make(map[MAC]struct{}),
+		vxlanVportIDs:      make(map[int]odp.VportID),
+		networkVxlanVports: make(map[odp.VportID]struct{}),
+		forwarders:         make(map[mesh.PeerName]*fastDatapathForwarder),
 	}
 
 	// This delete happens asynchronously in the kernel, meaning that
@@ -117,7 +123,14 @@ func NewFastDatapath(dpName string, port int) (*FastDatapath, error) {
 	// numbers to be independent, but working out how to specify
 	// them on the connecting side.  So we can wait to find out if
 	// anyone wants that.
-	fastdp.mainVxlanVportID, err = fastdp.getVxlanVportIDHarder(port+1, 5, time.Millisecond*10)
+	fastdp.mainVxlanVportID, err = fastdp.getVxlanVportIDHarder(port+1, false, 5, time.Millisecond*10)
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames on networks other than the default go to the port
+	// after that.  See networkTunnelIDFor.
+	fastdp.networkVxlanVportID, err = fastdp.getVxlanVportIDHarder(port+2, true, 5, time.Millisecond*10)
 	if err != nil {
 		return nil, err
 	}
@@ -371,19 +384,15 @@ func (fastdp fastDatapathOverlay) Diagnostics() interface{} {
 		vportStatuses = append(vportStatuses, VportStatus(vport))
 	}
 
-	flows, err := fastdp.dp.EnumerateFlows()
-	checkWarn(err)
-	flowStatuses := make([]FlowStatus, 0, len(flows))
-	for _, flow := range flows {
-		flowStatuses = append(flowStatuses, FlowStatus(flow))
-	}
-
+	// The flows themselves can be queried through /fastdp/flows;
+	// enumerating them here just to count them would be costly on
+	// a busy host.
 	return struct {
-		Vports []VportStatus
-		Flows  []FlowStatus
+		Vports    []VportStatus
+		FlowCount int
 	}{
 		vportStatuses,
-		flowStatuses,
+		fastdp.flowCount,
 	}
 }
 
@@ -401,11 +410,11 @@ func (fastdp fastDatapathOverlay) StartConsumingPackets(localPeer *mesh.Peer, pe
 	return nil
 }
 
-func (fastdp *FastDatapath) getVxlanVportIDHarder(udpPort int, retries int, duration time.Duration) (odp.VportID, error) {
+func (fastdp *FastDatapath) getVxlanVportIDHarder(udpPort int, networks bool, retries int, duration time.Duration) (odp.VportID, error) {
 	var vxlanVportID odp.VportID
 	var err error
 	for try := 0; try < retries; try++ {
-		vxlanVportID, err = fastdp.getVxlanVportID(udpPort)
+		vxlanVportID, err = fastdp.getVxlanVportID(udpPort, networks)
 		if err == nil || err != odp.NetlinkError(syscall.EADDRINUSE) {
 			return vxlanVportID, err
 		}
@@ -415,11 +424,17 @@ func (fastdp *FastDatapath) getVxlanVportIDHarder(udpPort int, retries int, dura
 	return 0, err
 }
 
-func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
+// Get the vxlan vport for the given UDP port, creating it if
+// necessary.  networks says whether the vport is for frames on
+// networks other than the default.
+func (fastdp *FastDatapath) getVxlanVportID(udpPort int, networks bool) (odp.VportID, error) {
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
 
 	if vxlanVportID, present := fastdp.vxlanVportIDs[udpPort]; present {
+		if _, isNetworks := fastdp.networkVxlanVports[vxlanVportID]; isNetworks != networks {
+			return 0, fmt.Errorf("vxlan port %d is already used for other traffic", udpPort)
+		}
 		return vxlanVportID, nil
 	}
 
@@ -430,6 +445,9 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 	}
 
 	fastdp.vxlanVportIDs[udpPort] = vxlanVportID
+	if networks {
+		fastdp.networkVxlanVports[vxlanVportID] = struct{}{}
+	}
 	fastdp.missHandlers[vxlanVportID] = func(fks odp.FlowKeys, lock *fastDatapathLock) FlowOp {
 		tunnel := fks[odp.OVS_KEY_ATTR_TUNNEL].(odp.TunnelFlowKey)
 		tunKey := tunnel.Key()
@@ -440,7 +458,17 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 			return vetoFlowCreationFlowOp{}
 		}
 
-		srcPeer, dstPeer := fastdp.extractPeers(tunKey.TunnelId)
+		var srcPeer, dstPeer *mesh.Peer
+		network := DefaultNetwork
+		if networks {
+			srcPeer, network = fastdp.extractNetworkPeer(tunKey.TunnelId)
+			dstPeer = fastdp.localPeer
+			if network == DefaultNetwork {
+				return vetoFlowCreationFlowOp{}
+			}
+		} else {
+			srcPeer, dstPeer = fastdp.extractPeers(tunKey.TunnelId)
+		}
 		if srcPeer == nil || dstPeer == nil {
 			return vetoFlowCreationFlowOp{}
 		}
@@ -448,7 +476,7 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 		lock.unlock()
 		pk := flowKeysToPacketKey(fks)
 		var zeroMAC MAC
-		if pk.SrcMAC == zeroMAC && pk.DstMAC == zeroMAC {
+		if !networks && pk.SrcMAC == zeroMAC && pk.DstMAC == zeroMAC {
 			return vxlanSpecialPacketFlowOp{
 				fastdp:  fastdp,
 				srcPeer: srcPeer,
@@ -462,6 +490,7 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 		key := ForwardPacketKey{
 			SrcPeer:   srcPeer,
 			DstPeer:   dstPeer,
+			Network:   network,
 			PacketKey: pk,
 		}
 
@@ -483,6 +512,12 @@ func (fastdp *FastDatapath) extractPeers(tunnelID [8]byte) (*mesh.Peer, *mesh.Pe
 	return srcPeer, dstPeer
 }
 
+func (fastdp *FastDatapath) extractNetworkPeer(tunnelID [8]byte) (*mesh.Peer, NetworkID) {
+	vni := binary.BigEndian.Uint64(tunnelID[:])
+	srcPeer := fastdp.peers.FetchByShortID(mesh.PeerShortID(vni & 0xfff))
+	return srcPeer, NetworkID((vni >> 12) & 0xfff)
+}
+
 type vxlanSpecialPacketFlowOp struct {
 	NonDiscardingFlowOp
 	fastdp  *FastDatapath
@@ -508,6 +543,11 @@ type fastDatapathForwarder struct {
 	connUID        uint64
 	vxlanVportID   odp.VportID
 
+	// Frames on networks other than the default go to
+	// networkVxlanVportID, if the remote peer supports networks
+	networks            bool
+	networkVxlanVportID odp.VportID
+
 	lock              sync.RWMutex
 	confirmed         bool
 	remoteAddr        *net.UDPAddr
@@ -529,6 +569,8 @@ func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectio
 	}
 
 	vxlanVportID := fastdp.mainVxlanVportID
+	networkVxlanVportID := fastdp.networkVxlanVportID
+	networks := supportsNetworks(params.Features)
 	var remoteAddr *net.UDPAddr
 
 	if params.Outbound {
@@ -540,10 +582,16 @@ func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectio
 		vxlanRemoteAddr.Port++
 		remoteAddr = &vxlanRemoteAddr
 		var err error
-		vxlanVportID, err = fastdp.getVxlanVportID(remoteAddr.Port)
+		vxlanVportID, err = fastdp.getVxlanVportID(remoteAddr.Port, false)
 		if err != nil {
 			return nil, err
 		}
+		if networks {
+			networkVxlanVportID, err = fastdp.getVxlanVportID(remoteAddr.Port+1, true)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	localIP, err := ipv4Bytes(params.LocalAddr.IP)
@@ -559,6 +607,9 @@ func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectio
 		connUID:        params.ConnUID,
 		vxlanVportID:   vxlanVportID,
 
+		networks:            networks,
+		networkVxlanVportID: networkVxlanVportID,
+
 		remoteAddr:        remoteAddr,
 		heartbeatInterval: FastHeartbeat,
 		stopChan:          make(chan struct{}),
@@ -761,6 +812,18 @@ func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 		return nil
 	}
 
+	vxlanVportID, tunnelID := fwd.vxlanVportID, tunnelIDFor(key)
+	if key.Network != DefaultNetwork {
+		// The network ID takes the place of the destination
+		// peer in the VNI, so only frames for the remote peer
+		// itself, which includes broadcasts, can be sent this
+		// way.  Leave the rest to another overlay.
+		if !fwd.networks || key.DstPeer != fwd.remotePeer {
+			return nil
+		}
+		vxlanVportID, tunnelID = fwd.networkVxlanVportID, networkTunnelIDFor(key)
+	}
+
 	fwd.lock.RLock()
 	defer fwd.lock.RUnlock()
 
@@ -779,14 +842,14 @@ func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 	}
 
 	var sta odp.SetTunnelAction
-	sta.SetTunnelId(tunnelIDFor(key))
+	sta.SetTunnelId(tunnelID)
 	sta.SetIpv4Src(fwd.localIP)
 	sta.SetIpv4Dst(remoteIP)
 	sta.SetTos(0)
 	sta.SetTtl(64)
 	sta.SetDf(true)
 	sta.SetCsum(false)
-	return fwd.fastdp.odpActions(sta, odp.NewOutputAction(fwd.vxlanVportID))
+	return fwd.fastdp.odpActions(sta, odp.NewOutputAction(vxlanVportID))
 }
 
 func tunnelIDFor(key ForwardPacketKey) (tunnelID [8]byte) {
@@ -796,6 +859,16 @@ func tunnelIDFor(key ForwardPacketKey) (tunnelID [8]byte) {
 	return
 }
 
+// There is no room in the VNI for a network ID as well as both peer
+// short IDs.  So frames on other networks go to a separate vxlan
+// port, and the network ID takes the place of the destination peer,
+// which is always the receiving one.
+func networkTunnelIDFor(key ForwardPacketKey) (tunnelID [8]byte) {
+	src := uint64(key.SrcPeer.ShortID)
+	binary.BigEndian.PutUint64(tunnelID[:], src|uint64(key.Network)<<12)
+	return
+}
+
 func (fwd *fastDatapathForwarder) Stop() {
 	// Might be nice to delete all the relevant flows here, but we
 	// can just let them expire.
@@ -844,6 +917,7 @@ func (fastdp *FastDatapath) deleteFlows() error {
 		}
 	}
 
+	fastdp.flowCount = 0
 	return nil
 }
 
@@ -902,10 +976,14 @@ func (fastdp *FastDatapath) expireFlows() {
 	flows, err := fastdp.dp.EnumerateFlows()
 	checkWarn(err)
 
+	fastdp.flowCount = len(flows)
 	for _, flow := range flows {
 		if flow.Used == 0 {
 			log.Debug("Expiring flow ", flow.FlowSpec)
 			err = fastdp.dp.DeleteFlow(flow.FlowKeys)
+			if err == nil {
+				fastdp.flowCount--
+			}
 		} else {
 			fastdp.touchFlow(flow.FlowKeys, &lock)
 			err = fastdp.dp.ClearFlow(flow.FlowSpec)
@@ -1119,7 +1197,11 @@ func (fastdp *FastDatapath) send(fops FlowOp, frame []byte, lock *fastDatapathLo
 		// to introduce a stale flow.
 		if lock.deleteFlowsCount == fastdp.deleteFlowsCount {
 			log.Debug("Creating ODP flow ", flow)
-			checkWarn(fastdp.dp.CreateFlow(flow))
+			err := fastdp.dp.CreateFlow(flow)
+			if err == nil {
+				fastdp.flowCount++
+			}
+			checkWarn(err)
 		}
 	}
 }
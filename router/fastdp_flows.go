@@ -0,0 +1,323 @@
+package router
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/weaveworks/go-odp/odp"
+	"github.com/weaveworks/weave/mesh"
+)
+
+// The ODP flow table can be large on a busy host, so rather than
+// being dumped into the report, it is available to query through its
+// own endpoint, with filtering, sorting and pagination.
+
+const defaultFlowsLimit = 100
+
+// Criteria for selecting flows; zero values match everything
+type flowFilter struct {
+	mac      *MAC
+	peer     string
+	vport    *odp.VportID
+	tunnelID *uint64
+}
+
+func parseFlowFilter(r *http.Request) (filter flowFilter, err error) {
+	if s := r.FormValue("mac"); s != "" {
+		hwAddr, err := net.ParseMAC(s)
+		if err != nil {
+			return filter, err
+		}
+		var mac MAC
+		copy(mac[:], hwAddr)
+		filter.mac = &mac
+	}
+	filter.peer = r.FormValue("peer")
+	if s := r.FormValue("vport"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return filter, fmt.Errorf("invalid vport %q", s)
+		}
+		vport := odp.VportID(id)
+		filter.vport = &vport
+	}
+	if s := r.FormValue("tunnel"); s != "" {
+		id, err := strconv.ParseUint(s, 0, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid tunnel ID %q", s)
+		}
+		filter.tunnelID = &id
+	}
+	return filter, nil
+}
+
+func (filter flowFilter) empty() bool {
+	return filter.mac == nil && filter.peer == "" && filter.vport == nil && filter.tunnelID == nil
+}
+
+// Must be called with the fastdp lock held
+func (fastdp *FastDatapath) flowMatches(flow odp.FlowInfo, filter flowFilter) bool {
+	var macs []MAC
+	var vports []odp.VportID
+	var tunnelIDs [][8]byte
+
+	for _, fk := range flow.FlowKeys {
+		switch fk := fk.(type) {
+		case odp.EthernetFlowKey:
+			eth := fk.Key()
+			macs = append(macs, eth.EthSrc, eth.EthDst)
+		case odp.InPortFlowKey:
+			vports = append(vports, fk.VportID())
+		case odp.TunnelFlowKey:
+			tunnelIDs = append(tunnelIDs, fk.Key().TunnelId)
+		}
+	}
+	for _, action := range flow.Actions {
+		switch action := action.(type) {
+		case odp.OutputAction:
+			vports = append(vports, action.VportID())
+		case odp.SetTunnelAction:
+			tunnelIDs = append(tunnelIDs, action.TunnelId)
+		}
+	}
+
+	if filter.mac != nil && !containsMAC(macs, *filter.mac) {
+		return false
+	}
+	if filter.vport != nil && !containsVport(vports, *filter.vport) {
+		return false
+	}
+	if filter.tunnelID != nil {
+		found := false
+		for _, id := range tunnelIDs {
+			found = found || binary.BigEndian.Uint64(id[:]) == *filter.tunnelID
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.peer != "" {
+		networks := false
+		for _, vport := range vports {
+			_, isNetworks := fastdp.networkVxlanVports[vport]
+			networks = networks || isNetworks
+		}
+		found := false
+		for _, id := range tunnelIDs {
+			found = found || fastdp.tunnelInvolvesPeer(id, networks, filter.peer)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// The tunnel IDs of flows for networks other than the default only
+// identify the originating peer.
+func (fastdp *FastDatapath) tunnelInvolvesPeer(tunnelID [8]byte, networks bool, nameOrNickName string) bool {
+	if fastdp.peers == nil {
+		return false
+	}
+	var srcPeer, dstPeer *mesh.Peer
+	if networks {
+		srcPeer, _ = fastdp.extractNetworkPeer(tunnelID)
+	} else {
+		srcPeer, dstPeer = fastdp.extractPeers(tunnelID)
+	}
+	for _, peer := range []*mesh.Peer{srcPeer, dstPeer} {
+		if peer != nil && (peer.Name.String() == nameOrNickName || peer.NickName == nameOrNickName) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMAC(macs []MAC, mac MAC) bool {
+	for _, m := range macs {
+		if m == mac {
+			return true
+		}
+	}
+	return false
+}
+
+func containsVport(vports []odp.VportID, vport odp.VportID) bool {
+	for _, v := range vports {
+		if v == vport {
+			return true
+		}
+	}
+	return false
+}
+
+func (fastdp *FastDatapath) selectFlows(filter flowFilter) ([]odp.FlowInfo, error) {
+	lock := fastdp.startLock()
+	defer lock.unlock()
+
+	flows, err := fastdp.dp.EnumerateFlows()
+	if err != nil {
+		return nil, err
+	}
+	fastdp.flowCount = len(flows)
+	selected := flows[:0]
+	for _, flow := range flows {
+		if fastdp.flowMatches(flow, filter) {
+			selected = append(selected, flow)
+		}
+	}
+	return selected, nil
+}
+
+// Delete the flows matching the filter, returning how many there were
+func (fastdp *FastDatapath) deleteSelectedFlows(filter flowFilter) (int, error) {
+	lock := fastdp.startLock()
+	defer lock.unlock()
+
+	flows, err := fastdp.dp.EnumerateFlows()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, flow := range flows {
+		if !fastdp.flowMatches(flow, filter) {
+			continue
+		}
+		if err := fastdp.dp.DeleteFlow(flow.FlowKeys); err != nil && !odp.IsNoSuchFlowError(err) {
+			return deleted, err
+		}
+		deleted++
+	}
+	fastdp.flowCount = len(flows) - deleted
+	return deleted, nil
+}
+
+type flowsByField struct {
+	flows []odp.FlowInfo
+	field func(*odp.FlowInfo) uint64
+}
+
+func (s flowsByField) Len() int      { return len(s.flows) }
+func (s flowsByField) Swap(i, j int) { s.flows[i], s.flows[j] = s.flows[j], s.flows[i] }
+
+// Largest first
+func (s flowsByField) Less(i, j int) bool {
+	return s.field(&s.flows[i]) > s.field(&s.flows[j])
+}
+
+func sortFlows(flows []odp.FlowInfo, by string) error {
+	var field func(*odp.FlowInfo) uint64
+	switch by {
+	case "":
+		return nil
+	case "packets":
+		field = func(flow *odp.FlowInfo) uint64 { return flow.Packets }
+	case "bytes":
+		field = func(flow *odp.FlowInfo) uint64 { return flow.Bytes }
+	case "used":
+		field = func(flow *odp.FlowInfo) uint64 { return flow.Used }
+	default:
+		return fmt.Errorf("cannot sort by %q; expected packets, bytes or used", by)
+	}
+	sort.Stable(flowsByField{flows, field})
+	return nil
+}
+
+// Returns the page of flows starting at offset, and the offset
+// actually used
+func paginate(flows []odp.FlowInfo, offset, limit int) ([]odp.FlowInfo, int) {
+	if offset > len(flows) {
+		offset = len(flows)
+	}
+	flows = flows[offset:]
+	if limit < len(flows) {
+		flows = flows[:limit]
+	}
+	return flows, offset
+}
+
+func formInt(r *http.Request, name string, def int) (int, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return i, nil
+}
+
+func (fastdp *FastDatapath) HandleHTTP(muxRouter *mux.Router) {
+	muxRouter.Methods("GET").Path("/fastdp/flows").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseFlowFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offset, err := formInt(r, "offset", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, err := formInt(r, "limit", defaultFlowsLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		flows, err := fastdp.selectFlows(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := sortFlows(flows, r.FormValue("sort")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		total := len(flows)
+		flows, offset = paginate(flows, offset, limit)
+		flowStatuses := make([]*FlowStatus, len(flows))
+		for i := range flows {
+			flowStatuses[i] = (*FlowStatus)(&flows[i])
+		}
+
+		json, err := json.MarshalIndent(struct {
+			Total  int
+			Offset int
+			Flows  []*FlowStatus
+		}{total, offset, flowStatuses}, "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	})
+
+	muxRouter.Methods("DELETE").Path("/fastdp/flows").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseFlowFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.empty() && r.FormValue("all") != "true" {
+			http.Error(w, "refusing to delete all flows without all=true", http.StatusBadRequest)
+			return
+		}
+		deleted, err := fastdp.deleteSelectedFlows(filter)
+		log.Println("Deleted", deleted, "fastdp flows")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, deleted)
+	})
+}
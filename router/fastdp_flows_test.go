@@ -0,0 +1,146 @@
+package router
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/go-odp/odp"
+)
+
+func makeTestFlow(srcMAC, dstMAC MAC, inPort, outPort odp.VportID, tunnelID uint64, packets uint64) odp.FlowInfo {
+	flow := odp.FlowInfo{FlowSpec: odp.NewFlowSpec(), Packets: packets}
+	ethernetFlowKey := odp.NewEthernetFlowKey()
+	ethernetFlowKey.SetEthSrc(srcMAC)
+	ethernetFlowKey.SetEthDst(dstMAC)
+	flow.AddKey(ethernetFlowKey)
+	flow.AddKey(odp.NewInPortFlowKey(inPort))
+	if tunnelID != 0 {
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], tunnelID)
+		var setTunnel odp.SetTunnelAction
+		setTunnel.SetTunnelId(id)
+		flow.AddAction(setTunnel)
+	}
+	flow.AddAction(odp.NewOutputAction(outPort))
+	return flow
+}
+
+func formRequest(values url.Values) *http.Request {
+	return &http.Request{Method: "GET", URL: &url.URL{RawQuery: values.Encode()}}
+}
+
+func TestFlowMatches(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{})
+	fastdp := &FastDatapath{peers: router.Peers}
+	mac1 := mustParseMAC(t, "02:00:00:00:00:01")
+	mac2 := mustParseMAC(t, "02:00:00:00:00:02")
+	mac3 := mustParseMAC(t, "02:00:00:00:00:03")
+	// Traffic from the local peer to short ID 5
+	tunnelID := uint64(5)<<12 | uint64(router.Ourself.ShortID)
+	local := makeTestFlow(mac1, mac2, 1, 2, 0, 0)
+	tunnelled := makeTestFlow(mac2, mac3, 1, 3, tunnelID, 0)
+
+	filter := func(values url.Values) flowFilter {
+		filter, err := parseFlowFilter(formRequest(values))
+		require.NoError(t, err)
+		return filter
+	}
+	matching := func(values url.Values) []bool {
+		f := filter(values)
+		return []bool{fastdp.flowMatches(local, f), fastdp.flowMatches(tunnelled, f)}
+	}
+
+	require.True(t, filter(nil).empty())
+	require.Equal(t, []bool{true, true}, matching(nil))
+	require.Equal(t, []bool{true, false}, matching(url.Values{"mac": {"02:00:00:00:00:01"}}))
+	require.Equal(t, []bool{true, true}, matching(url.Values{"mac": {"02:00:00:00:00:02"}}))
+	require.Equal(t, []bool{true, true}, matching(url.Values{"vport": {"1"}}))
+	require.Equal(t, []bool{false, true}, matching(url.Values{"vport": {"3"}}))
+	require.Equal(t, []bool{false, true}, matching(url.Values{"tunnel": {strconv.FormatUint(tunnelID, 10)}}))
+	require.Equal(t, []bool{false, false}, matching(url.Values{"tunnel": {"42"}}))
+	require.Equal(t, []bool{false, true}, matching(url.Values{"peer": {router.Ourself.Name.String()}}))
+	require.Equal(t, []bool{false, true}, matching(url.Values{"peer": {router.Ourself.NickName}}))
+	require.Equal(t, []bool{false, false}, matching(url.Values{"peer": {"nosuchpeer"}}))
+	require.Equal(t, []bool{false, true}, matching(url.Values{"mac": {"02:00:00:00:00:02"}, "vport": {"3"}}))
+	require.False(t, filter(url.Values{"vport": {"3"}}).empty())
+
+	for _, values := range []url.Values{{"mac": {"nonsense"}}, {"vport": {"-1"}}, {"tunnel": {"x"}}} {
+		_, err := parseFlowFilter(formRequest(values))
+		require.Error(t, err, "%v", values)
+	}
+}
+
+func TestSortFlows(t *testing.T) {
+	flows := []odp.FlowInfo{
+		{Packets: 1, Bytes: 300, Used: 2},
+		{Packets: 3, Bytes: 100, Used: 2},
+		{Packets: 2, Bytes: 200, Used: 1},
+	}
+	packets := func() []uint64 {
+		var result []uint64
+		for _, flow := range flows {
+			result = append(result, flow.Packets)
+		}
+		return result
+	}
+
+	require.NoError(t, sortFlows(flows, ""))
+	require.Equal(t, []uint64{1, 3, 2}, packets(), "unsorted")
+	require.NoError(t, sortFlows(flows, "packets"))
+	require.Equal(t, []uint64{3, 2, 1}, packets())
+	require.NoError(t, sortFlows(flows, "bytes"))
+	require.Equal(t, []uint64{1, 2, 3}, packets())
+	require.NoError(t, sortFlows(flows, "used"))
+	require.Equal(t, []uint64{1, 3, 2}, packets(), "stable for equal values")
+	require.Error(t, sortFlows(flows, "nonsense"))
+}
+
+func TestFormInt(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected int
+		ok       bool
+	}{
+		{"", 7, true},
+		{"0", 0, true},
+		{"42", 42, true},
+		{"-1", 0, false},
+		{"ten", 0, false},
+	} {
+		i, err := formInt(formRequest(url.Values{"n": {test.value}}), "n", 7)
+		if !test.ok {
+			require.Error(t, err, test.value)
+			continue
+		}
+		require.NoError(t, err, test.value)
+		require.Equal(t, test.expected, i, test.value)
+	}
+}
+
+func TestPaginateFlows(t *testing.T) {
+	flows := make([]odp.FlowInfo, 5)
+	for i := range flows {
+		flows[i].Packets = uint64(i)
+	}
+	check := func(offset, limit int, expectedOffset int, expected ...uint64) {
+		page, actualOffset := paginate(flows, offset, limit)
+		require.Equal(t, expectedOffset, actualOffset)
+		var packets []uint64
+		for _, flow := range page {
+			packets = append(packets, flow.Packets)
+		}
+		require.Equal(t, expected, packets, "offset %d limit %d", offset, limit)
+	}
+
+	check(0, 100, 0, 0, 1, 2, 3, 4)
+	check(0, 2, 0, 0, 1)
+	check(2, 2, 2, 2, 3)
+	check(4, 2, 4, 4)
+	check(5, 2, 5)
+	check(10, 2, 5)
+	check(1, 0, 1)
+}
@@ -22,6 +22,7 @@ type PacketKey struct {
 type ForwardPacketKey struct {
 	SrcPeer *mesh.Peer
 	DstPeer *mesh.Peer
+	Network NetworkID
 	PacketKey
 }
 
@@ -84,6 +85,20 @@ func (mfop *MultiFlowOp) Discards() bool {
 	return true
 }
 
+// An inspectingFlowOp examines the frame before deciding which FlowOp
+// (if any) should then process it.  Being opaque, it prevents the
+// creation of fastdp flows for the frames it sees.
+type inspectingFlowOp struct {
+	NonDiscardingFlowOp
+	inspect func(frame []byte, dec *EthernetDecoder) FlowOp
+}
+
+func (fop inspectingFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	if next := fop.inspect(frame, dec); next != nil {
+		next.Process(frame, dec, broadcast)
+	}
+}
+
 func FlattenFlowOp(fop FlowOp) []FlowOp {
 	return collectFlowOps(nil, fop)
 }
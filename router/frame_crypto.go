@@ -97,6 +97,14 @@ func (ne *NaClEncryptor) Bytes() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	header := ne.nextHeader(ne.buf, &ne.nonce)
+	// Seal *appends* to ciphertext
+	return secretbox.Seal(header, plaintext, &ne.nonce, ne.sessionKey), nil
+}
+
+// Write the unencrypted header of the next packet into buf, and set
+// up its nonce.
+func (ne *NaClEncryptor) nextHeader(buf []byte, nonce *[24]byte) []byte {
 	// We carry the DF flag in the (unencrypted portion of the)
 	// payload, rather than just extracting it from the packet headers
 	// at the receiving end, since we do not trust routers not to mess
@@ -107,13 +115,44 @@ func (ne *NaClEncryptor) Bytes() ([]byte, error) {
 	if ne.df {
 		seqNoAndDF |= (1 << 63)
 	}
-	ciphertext := ne.buf
-	binary.BigEndian.PutUint64(ciphertext[ne.prefixLen:], seqNoAndDF)
-	binary.BigEndian.PutUint64(ne.nonce[16:24], seqNoAndDF)
-	// Seal *appends* to ciphertext
-	ciphertext = secretbox.Seal(ciphertext[:ne.prefixLen+8], plaintext, &ne.nonce, ne.sessionKey)
+	copy(buf, ne.buf[:ne.prefixLen])
+	binary.BigEndian.PutUint64(buf[ne.prefixLen:], seqNoAndDF)
+	*nonce = ne.nonce
+	binary.BigEndian.PutUint64(nonce[16:24], seqNoAndDF)
 	ne.seqNo++
-	return ciphertext, nil
+	return buf[:ne.prefixLen+8]
+}
+
+// A packet whose encryption has been put off, so that it can be done
+// on another goroutine.  Its sequence number, and hence its nonce, is
+// fixed when it is created, so packets keep their order however the
+// sealing is scheduled.
+type deferredSeal struct {
+	msg        []byte // the header, to which seal appends the ciphertext
+	plaintext  []byte
+	nonce      [24]byte
+	sessionKey *[32]byte
+}
+
+// As Bytes, but leaving the encryption to be done by seal.  ds's
+// buffers are reused.
+func (ne *NaClEncryptor) BytesDeferred(ds *deferredSeal) error {
+	plaintext, err := ne.NonEncryptor.Bytes()
+	if err != nil {
+		return err
+	}
+	if cap(ds.msg) < ne.prefixLen+8 {
+		ds.msg = make([]byte, ne.prefixLen+8, MaxUDPPacketSize)
+	}
+	ds.msg = ne.nextHeader(ds.msg[:ne.prefixLen+8], &ds.nonce)
+	ds.plaintext = append(ds.plaintext[:0], plaintext...)
+	ds.sessionKey = ne.sessionKey
+	return nil
+}
+
+func (ds *deferredSeal) seal() []byte {
+	ds.msg = secretbox.Seal(ds.msg, ds.plaintext, &ds.nonce, ds.sessionKey)
+	return ds.msg
 }
 
 func (ne *NaClEncryptor) PacketOverhead() int {
@@ -199,31 +238,57 @@ func NewNaClDecryptor(sessionKey *[32]byte, outbound bool) *NaClDecryptor {
 }
 
 func (nd *NaClDecryptor) IterateFrames(packet []byte, consumer FrameConsumer) error {
+	return nd.iterateOpened(nd.open(packet), consumer)
+}
+
+// Decryption is split in two, so that the expensive part can be done
+// for several packets in parallel.  open only depends on the packet,
+// and may be called concurrently.  iterateOpened checks the sequence
+// number against the replay window, which is only advanced for
+// packets that decrypted successfully; it must be called for packets
+// in the order they were received, and not concurrently.
+type openedPacket struct {
+	plaintext  []byte
+	seqNoAndDF uint64
+	err        error
+}
+
+func (nd *NaClDecryptor) open(packet []byte) openedPacket {
 	if len(packet) < 8 {
-		return PacketDecodingError{Desc: fmt.Sprintf("encrypted UDP packet too short; expected length >= 8, got %d", len(packet))}
+		return openedPacket{err: PacketDecodingError{Desc: fmt.Sprintf("encrypted UDP packet too short; expected length >= 8, got %d", len(packet))}}
 	}
-	buf, success := nd.decrypt(packet)
+	seqNoAndDF := binary.BigEndian.Uint64(packet[:8])
+	nonce := nd.instanceFor(seqNoAndDF).nonce
+	binary.BigEndian.PutUint64(nonce[16:24], seqNoAndDF)
+	result, success := secretbox.Open(nil, packet[8:], &nonce, nd.sessionKey)
 	if !success {
-		return PacketDecodingError{Desc: fmt.Sprint("UDP packet decryption failed")}
+		return openedPacket{err: PacketDecodingError{Desc: fmt.Sprint("UDP packet decryption failed")}}
 	}
-	return nd.NonDecryptor.IterateFrames(buf, consumer)
+	return openedPacket{plaintext: result, seqNoAndDF: seqNoAndDF}
 }
 
-func (nd *NaClDecryptor) decrypt(buf []byte) ([]byte, bool) {
-	seqNoAndDF := binary.BigEndian.Uint64(buf[:8])
-	df := (seqNoAndDF & (1 << 63)) != 0
-	seqNo := seqNoAndDF & ((1 << 63) - 1)
-	var di *NaClDecryptorInstance
-	if df {
-		di = nd.instanceDF
-	} else {
-		di = nd.instance
+func (nd *NaClDecryptor) iterateOpened(opened openedPacket, consumer FrameConsumer) error {
+	if opened.err != nil {
+		return opened.err
 	}
-	binary.BigEndian.PutUint64(di.nonce[16:24], seqNoAndDF)
-	result, success := secretbox.Open(nil, buf[8:], &di.nonce, nd.sessionKey)
-	if !success {
-		return nil, false
+	if !nd.accept(opened.seqNoAndDF) {
+		return nil
+	}
+	return nd.NonDecryptor.IterateFrames(opened.plaintext, consumer)
+}
+
+func (nd *NaClDecryptor) instanceFor(seqNoAndDF uint64) *NaClDecryptorInstance {
+	if (seqNoAndDF & (1 << 63)) != 0 {
+		return nd.instanceDF
 	}
+	return nd.instance
+}
+
+// Record the sequence number of a successfully decrypted packet,
+// returning false if the packet should be dropped as a duplicate.
+func (nd *NaClDecryptor) accept(seqNoAndDF uint64) bool {
+	di := nd.instanceFor(seqNoAndDF)
+	seqNo := seqNoAndDF & ((1 << 63) - 1)
 	// Drop duplicates. We do this *after* decryption since we must
 	// not advance our state unless decryption succeeded. Doing so
 	// would open an easy attack vector where an adversary could
@@ -235,10 +300,10 @@ func (nd *NaClDecryptor) decrypt(buf []byte) ([]byte, bool) {
 		// possible we may have just received a very old packet, or
 		// duplication may have occurred in the network. So let's just
 		// drop the packet silently.
-		return nil, true
+		return false
 	}
 	usedOffsets.Add(offset)
-	return result, success
+	return true
 }
 
 // We record seen message sequence numbers in a sliding window of
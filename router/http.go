@@ -1,11 +1,14 @@
 package router
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/mesh"
 )
 
 func (router *NetworkRouter) HandleHTTP(muxRouter *mux.Router) {
@@ -26,4 +29,107 @@ func (router *NetworkRouter) HandleHTTP(muxRouter *mux.Router) {
 		router.ConnectionMaker.ForgetConnections(r.Form["peer"])
 	})
 
+	muxRouter.Methods("GET").Path("/network/{name}/iface").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		network := router.LookupNetwork(mux.Vars(r)["name"])
+		if network == nil {
+			http.NotFound(w, r)
+			return
+		}
+		iface := network.Bridge.Interface()
+		if iface == nil {
+			http.Error(w, fmt.Sprint("network ", network.Name, " has no interface"), http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, iface.Name)
+	})
+
+	// The MAC endpoints operate on the default network unless
+	// another is named with the "network" parameter.
+	lookupMacs := func(w http.ResponseWriter, r *http.Request) *MacCache {
+		name := r.FormValue("network")
+		if name == "" {
+			return router.Macs
+		}
+		if network := router.LookupNetwork(name); network != nil {
+			return network.Macs
+		}
+		http.Error(w, fmt.Sprint("unknown network ", name), http.StatusNotFound)
+		return nil
+	}
+
+	muxRouter.Methods("GET").Path("/status/macs").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		macs := lookupMacs(w, r)
+		if macs == nil {
+			return
+		}
+		var peer *mesh.Peer
+		if peerName := r.FormValue("peer"); peerName != "" {
+			if peer = router.lookupPeer(peerName); peer == nil {
+				http.Error(w, fmt.Sprint("unknown peer ", peerName), http.StatusNotFound)
+				return
+			}
+		}
+		json, err := json.MarshalIndent(newMACStatusSliceForPeer(macs, peer), "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	})
+
+	muxRouter.Methods("PUT").Path("/macs/{mac}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		macs := lookupMacs(w, r)
+		if macs == nil {
+			return
+		}
+		peer := router.Ourself.Peer
+		if peerName := r.FormValue("peer"); peerName != "" {
+			if peer = router.lookupPeer(peerName); peer == nil {
+				http.Error(w, fmt.Sprint("unknown peer ", peerName), http.StatusNotFound)
+				return
+			}
+		}
+		log.Println("Pinning MAC", mac, "to", peer)
+		macs.AddStatic(mac, peer)
+	})
+
+	muxRouter.Methods("DELETE").Path("/macs/{mac}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		macs := lookupMacs(w, r)
+		if macs == nil {
+			return
+		}
+		if !macs.DeleteStatic(mac) {
+			http.Error(w, fmt.Sprint("MAC ", mac, " is not pinned"), http.StatusNotFound)
+			return
+		}
+		log.Println("Unpinned MAC", mac)
+	})
+
+}
+
+// Find a peer by name or nickname
+func (router *NetworkRouter) lookupPeer(nameOrNickName string) *mesh.Peer {
+	if name, err := mesh.PeerNameFromUserInput(nameOrNickName); err == nil {
+		if peer := router.Peers.Fetch(name); peer != nil {
+			return peer
+		}
+	}
+	var found *mesh.Peer
+	router.Peers.ForEach(func(peer *mesh.Peer) {
+		if peer.NickName == nameOrNickName {
+			found = peer
+		}
+	})
+	return found
 }
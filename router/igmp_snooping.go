@@ -0,0 +1,523 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// IGMP snooping: we watch the IGMP membership reports and leaves sent
+// by local hosts, and gossip the set of multicast groups that have
+// local members.  Multicast frames for other than link-local groups
+// are then only sent to the peers which have members, by forwarding a
+// copy to each such peer, rather than being flooded to every peer.
+//
+// Membership is tracked at the granularity of multicast MAC addresses
+// (which is all that the fastdp flows can match on), so groups that
+// map to the same MAC address are not distinguished.  Hosts only
+// report their membership when they join, unless asked, so we act as
+// querier on the local bridge, and forget members that stop
+// answering.
+//
+// A peer doing IGMP snooping sends each multicast frame directly to
+// the peers that should get it, and those peers do not relay it
+// further.  That is the peers with members, once every peer is known
+// to be doing IGMP snooping, and all peers until then.  Frames from
+// peers that are not doing IGMP snooping are flooded as before.
+
+const (
+	IGMPGossipChannel = "igmp"
+
+	igmpQuery    = 0x11
+	igmpV1Report = 0x12
+	igmpV2Report = 0x16
+	igmpV2Leave  = 0x17
+	igmpV3Report = 0x22
+
+	igmpV3ModeIsInclude     = 1
+	igmpV3ModeIsExclude     = 2
+	igmpV3ChangeToInclude   = 3
+	igmpV3ChangeToExclude   = 4
+	igmpV3AllowNewSources   = 5
+	igmpV3BlockOldSources   = 6
+	igmpSenderClassifyAfter = macMaxAge
+
+	// As recommended by RFC 3376
+	igmpQueryInterval     = 125 * time.Second
+	igmpQueryResponseTime = 10 * time.Second
+	igmpMembershipTimeout = 2*igmpQueryInterval + igmpQueryResponseTime
+)
+
+type GroupMembership struct {
+	Version uint64
+	Groups  []MAC
+}
+
+type IGMPSnooper struct {
+	sync.RWMutex
+	router       *NetworkRouter
+	gossip       mesh.Gossip
+	localMembers map[MAC]map[MAC]time.Time          // group MAC -> local member MAC -> when last reported
+	peers        map[mesh.PeerName]*GroupMembership // including ourself
+	senders      map[PacketKey]time.Time            // known non-IGMP multicast senders
+}
+
+func NewIGMPSnooper(router *NetworkRouter) *IGMPSnooper {
+	snooper := &IGMPSnooper{
+		router:       router,
+		localMembers: make(map[MAC]map[MAC]time.Time),
+		peers:        make(map[mesh.PeerName]*GroupMembership),
+		senders:      make(map[PacketKey]time.Time)}
+	// Version numbers must increase across restarts, so that our
+	// new state supersedes any old state still being gossiped.
+	snooper.peers[router.Ourself.Name] = &GroupMembership{Version: uint64(time.Now().UnixNano())}
+	snooper.gossip = router.NewGossip(IGMPGossipChannel, snooper)
+	router.Peers.OnGC(func(peer *mesh.Peer) { snooper.peerGone(peer.Name) })
+	time.AfterFunc(igmpSenderClassifyAfter, snooper.expireSenders)
+	// Give the bridge a moment before the first query, which gets
+	// us the memberships of hosts that joined before we started
+	time.AfterFunc(igmpQueryResponseTime, snooper.queryAndExpire)
+	return snooper
+}
+
+func isIPv4MulticastMAC(mac MAC) bool {
+	return mac[0] == 0x01 && mac[1] == 0x00 && mac[2] == 0x5e
+}
+
+// Groups in 224.0.0.0/24 are link-local, and always flooded.
+func isLinkLocalMulticastMAC(mac MAC) bool {
+	return isIPv4MulticastMAC(mac) && mac[3] == 0 && mac[4] == 0
+}
+
+func multicastMAC(group address.Address) MAC {
+	return MAC{0x01, 0x00, 0x5e, byte(group>>16) & 0x7f, byte(group >> 8), byte(group)}
+}
+
+// Are multicast frames sent to this MAC by the given peer sent
+// directly to every peer that should get them, rather than flooded?
+// Decided by what we know of the originating peer rather than of the
+// cluster, as that is what it decides by.
+func (snooper *IGMPSnooper) sentDirectly(srcPeer mesh.PeerName, mac MAC) bool {
+	if !isIPv4MulticastMAC(mac) || isLinkLocalMulticastMAC(mac) {
+		return false
+	}
+	snooper.RLock()
+	defer snooper.RUnlock()
+	_, snooping := snooper.peers[srcPeer]
+	return snooping
+}
+
+// Do we know which groups every peer is interested in?
+func (snooper *IGMPSnooper) replicating() bool {
+	snooper.RLock()
+	defer snooper.RUnlock()
+	for name := range snooper.router.Peers.Names() {
+		if _, found := snooper.peers[name]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (snooper *IGMPSnooper) interestedPeers(group MAC) []mesh.PeerName {
+	snooper.RLock()
+	defer snooper.RUnlock()
+	var names []mesh.PeerName
+	for name, membership := range snooper.peers {
+		for _, g := range membership.Groups {
+			if g == group {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// The FlowOp for a multicast frame captured from the bridge.
+func (snooper *IGMPSnooper) capturedFlowOp(key PacketKey) FlowOp {
+	router := snooper.router
+	if isLinkLocalMulticastMAC(key.DstMAC) {
+		// IGMPv3 reports and all leaves are sent to
+		// link-local groups.
+		relayFop := router.relayBroadcast(router.Ourself.Peer, DefaultNetwork, key)
+		return inspectingFlowOp{inspect: func(frame []byte, dec *EthernetDecoder) FlowOp {
+			snooper.snoop(key, dec)
+			return relayFop
+		}}
+	}
+
+	snooper.RLock()
+	_, knownSender := snooper.senders[key]
+	snooper.RUnlock()
+	if knownSender {
+		return snooper.relay(key)
+	}
+
+	// IGMPv1 and v2 reports are sent to the group being joined,
+	// so until we know that a host is sending real traffic to the
+	// group, we need to examine its frames (which means they
+	// cannot be handled by fastdp flows).
+	return inspectingFlowOp{inspect: func(frame []byte, dec *EthernetDecoder) FlowOp {
+		if snooper.snoop(key, dec) {
+			return router.relayBroadcast(router.Ourself.Peer, DefaultNetwork, key)
+		}
+		snooper.Lock()
+		// A member's later reports go to the group too, and we
+		// must keep seeing those to keep its membership alive
+		if _, member := snooper.localMembers[key.DstMAC][key.SrcMAC]; !member {
+			snooper.senders[key] = time.Now()
+		}
+		snooper.Unlock()
+		return snooper.relay(key)
+	}}
+}
+
+// Receiving peers don't relay the frame further, so send a copy to
+// every peer that should get it.
+func (snooper *IGMPSnooper) relay(key PacketKey) FlowOp {
+	router := snooper.router
+	if !snooper.replicating() {
+		var all []mesh.PeerName
+		for name := range router.Peers.Names() {
+			all = append(all, name)
+		}
+		return router.relayMulticast(router.Ourself.Peer, key, all)
+	}
+	return router.relayMulticast(router.Ourself.Peer, key, snooper.interestedPeers(key.DstMAC))
+}
+
+// Process an IGMP message, returning false if the frame isn't one.
+func (snooper *IGMPSnooper) snoop(key PacketKey, dec *EthernetDecoder) bool {
+	if !dec.isIPv4() || dec.IP.Protocol != layers.IPProtocolIGMP {
+		return false
+	}
+
+	msg := dec.IP.Payload
+	if len(msg) < 8 {
+		return true
+	}
+	switch msg[0] {
+	case igmpV1Report, igmpV2Report:
+		snooper.update(key.SrcMAC, address.FromIP4(msg[4:8]), true)
+	case igmpV2Leave:
+		snooper.update(key.SrcMAC, address.FromIP4(msg[4:8]), false)
+	case igmpQuery:
+		// Some other querier; hosts' answers will refresh
+		// their memberships just as well
+	case igmpV3Report:
+		numRecords := int(binary.BigEndian.Uint16(msg[6:8]))
+		records := msg[8:]
+		for i := 0; i < numRecords && len(records) >= 8; i++ {
+			recordType := records[0]
+			auxLen := int(records[1]) * 4
+			numSources := int(binary.BigEndian.Uint16(records[2:4]))
+			group := address.FromIP4(records[4:8])
+			switch recordType {
+			case igmpV3ModeIsExclude, igmpV3ChangeToExclude:
+				snooper.update(key.SrcMAC, group, true)
+			case igmpV3ModeIsInclude, igmpV3ChangeToInclude, igmpV3AllowNewSources:
+				// An empty include list means the host has
+				// left the group
+				snooper.update(key.SrcMAC, group, numSources > 0)
+			}
+			recordLen := 8 + numSources*4 + auxLen
+			if recordLen > len(records) {
+				break
+			}
+			records = records[recordLen:]
+		}
+	}
+	return true
+}
+
+func (snooper *IGMPSnooper) update(member MAC, group address.Address, join bool) {
+	groupMAC := multicastMAC(group)
+	if isLinkLocalMulticastMAC(groupMAC) {
+		return
+	}
+
+	snooper.Lock()
+	members := snooper.localMembers[groupMAC]
+	_, isMember := members[member]
+	switch {
+	case join:
+		if members == nil {
+			members = make(map[MAC]time.Time)
+			snooper.localMembers[groupMAC] = members
+		}
+		members[member] = time.Now()
+		if isMember {
+			snooper.Unlock()
+			return
+		}
+		log.Println("Multicast group", group, "joined by", member)
+	case isMember:
+		snooper.removeMember(groupMAC, member)
+		log.Println("Multicast group", group, "left by", member)
+	default:
+		snooper.Unlock()
+		return
+	}
+	snooper.publish()
+}
+
+// Must be called with the lock held.
+func (snooper *IGMPSnooper) removeMember(group MAC, member MAC) {
+	members := snooper.localMembers[group]
+	delete(members, member)
+	if len(members) == 0 {
+		delete(snooper.localMembers, group)
+	}
+}
+
+// Update and gossip our set of groups, if it has changed.  Must be
+// called with the lock held, which it releases.
+func (snooper *IGMPSnooper) publish() {
+	ours := snooper.peers[snooper.router.Ourself.Name]
+	groups := make([]MAC, 0, len(snooper.localMembers))
+	for g := range snooper.localMembers {
+		groups = append(groups, g)
+	}
+	sort.Sort(macSlice(groups))
+	changed := !macsEqual(groups, ours.Groups)
+	if changed {
+		ours = &GroupMembership{Version: ours.Version + 1, Groups: groups}
+		snooper.peers[snooper.router.Ourself.Name] = ours
+	}
+	snooper.Unlock()
+
+	if changed {
+		snooper.invalidateFlows()
+		checkWarn(snooper.gossip.GossipBroadcast(&IGMPGossipData{
+			Peers: map[mesh.PeerName]GroupMembership{snooper.router.Ourself.Name: *ours}}))
+	}
+}
+
+func (snooper *IGMPSnooper) queryAndExpire() {
+	snooper.query()
+	snooper.expireMembers(time.Now())
+	time.AfterFunc(igmpQueryInterval, snooper.queryAndExpire)
+}
+
+// Forget members that haven't reported for a while
+func (snooper *IGMPSnooper) expireMembers(now time.Time) {
+	snooper.Lock()
+	for group, members := range snooper.localMembers {
+		for member, reported := range members {
+			if now.Sub(reported) > igmpMembershipTimeout {
+				log.Println("Multicast group", group, "membership of", member, "timed out")
+				snooper.removeMember(group, member)
+			}
+		}
+	}
+	snooper.publish()
+}
+
+// Ask local hosts which groups they are members of, with an IGMPv3
+// general query, which IGMPv1 and v2 hosts understand too.  The
+// source address is 0.0.0.0, as for a snooping switch (RFC 4541).
+func (snooper *IGMPSnooper) query() {
+	router := snooper.router
+	msg := []byte{igmpQuery, byte(igmpQueryResponseTime / (time.Second / 10)), 0, 0,
+		0, 0, 0, 0, // general query
+		2,                                     // robustness
+		byte(igmpQueryInterval / time.Second), // exact below 128 seconds
+		0, 0}
+	binary.BigEndian.PutUint16(msg[2:4], ipChecksum(msg))
+	mac := makeServiceMAC("igmp", router.Ourself.Name)
+	allHosts := multicastMAC(address.FromIP4(net.IPv4allsys))
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: mac[:], DstMAC: allHosts[:], EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 1, Protocol: layers.IPProtocolIGMP, SrcIP: net.IPv4zero, DstIP: net.IPv4allsys},
+		gopacket.Payload(msg))
+	if err != nil {
+		log.Error("Unable to construct IGMP query: ", err)
+		return
+	}
+	key := PacketKey{SrcMAC: mac, DstMAC: allHosts}
+	router.PacketLogging.LogPacket("IGMP query", key)
+	if fop := router.Bridge.InjectPacket(key); fop != nil {
+		frame := buf.Bytes()
+		dec := NewEthernetDecoder()
+		dec.DecodeLayers(frame)
+		fop.Process(frame, dec, true)
+	}
+}
+
+// The Internet checksum of RFC 1071
+func ipChecksum(data []byte) uint16 {
+	var sum uint32
+	for ; len(data) >= 2; data = data[2:] {
+		sum += uint32(data[0])<<8 | uint32(data[1])
+	}
+	if len(data) > 0 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func (snooper *IGMPSnooper) invalidateFlows() {
+	snooper.router.Overlay.(NetworkOverlay).InvalidateRoutes()
+}
+
+func (snooper *IGMPSnooper) peerGone(name mesh.PeerName) {
+	snooper.Lock()
+	delete(snooper.peers, name)
+	snooper.Unlock()
+	snooper.invalidateFlows()
+}
+
+func (snooper *IGMPSnooper) expireSenders() {
+	now := time.Now()
+	snooper.Lock()
+	for key, seen := range snooper.senders {
+		if now.Sub(seen) > igmpSenderClassifyAfter {
+			delete(snooper.senders, key)
+		}
+	}
+	snooper.Unlock()
+	time.AfterFunc(igmpSenderClassifyAfter, snooper.expireSenders)
+}
+
+// Merge membership received from other peers, returning that which
+// was new to us.
+func (snooper *IGMPSnooper) merge(peers map[mesh.PeerName]GroupMembership) map[mesh.PeerName]GroupMembership {
+	newPeers := make(map[mesh.PeerName]GroupMembership)
+	snooper.Lock()
+	for name, membership := range peers {
+		if name == snooper.router.Ourself.Name || snooper.router.Peers.Fetch(name) == nil {
+			continue
+		}
+		if existing, found := snooper.peers[name]; found && existing.Version >= membership.Version {
+			continue
+		}
+		m := membership
+		snooper.peers[name] = &m
+		newPeers[name] = membership
+	}
+	snooper.Unlock()
+
+	if len(newPeers) > 0 {
+		snooper.invalidateFlows()
+	}
+	return newPeers
+}
+
+// Gossiper methods
+
+func (snooper *IGMPSnooper) Gossip() mesh.GossipData {
+	snooper.RLock()
+	defer snooper.RUnlock()
+	gossip := &IGMPGossipData{Peers: make(map[mesh.PeerName]GroupMembership)}
+	for name, membership := range snooper.peers {
+		gossip.Peers[name] = *membership
+	}
+	return gossip
+}
+
+func (snooper *IGMPSnooper) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+func (snooper *IGMPSnooper) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	_, gossip, err := snooper.receiveGossip(msg)
+	return gossip, err
+}
+
+func (snooper *IGMPSnooper) OnGossip(msg []byte) (mesh.GossipData, error) {
+	newPeers, _, err := snooper.receiveGossip(msg)
+	return newPeers, err
+}
+
+func (snooper *IGMPSnooper) receiveGossip(msg []byte) (mesh.GossipData, mesh.GossipData, error) {
+	var gossip IGMPGossipData
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&gossip); err != nil {
+		return nil, nil, err
+	}
+	if newPeers := snooper.merge(gossip.Peers); len(newPeers) > 0 {
+		return &IGMPGossipData{Peers: newPeers}, &gossip, nil
+	}
+	return nil, &gossip, nil
+}
+
+type IGMPGossipData struct {
+	Peers map[mesh.PeerName]GroupMembership
+}
+
+func (g *IGMPGossipData) Merge(o mesh.GossipData) mesh.GossipData {
+	merged := &IGMPGossipData{Peers: make(map[mesh.PeerName]GroupMembership)}
+	for _, peers := range []map[mesh.PeerName]GroupMembership{g.Peers, o.(*IGMPGossipData).Peers} {
+		for name, membership := range peers {
+			if existing, found := merged.Peers[name]; !found || existing.Version < membership.Version {
+				merged.Peers[name] = membership
+			}
+		}
+	}
+	return merged
+}
+
+func (g *IGMPGossipData) Encode() [][]byte {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(g); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
+
+type MulticastGroupStatus struct {
+	Group string // multicast MAC address
+	Peers []string
+}
+
+func NewMulticastGroupStatusSlice(snooper *IGMPSnooper) []MulticastGroupStatus {
+	if snooper == nil {
+		return nil
+	}
+	snooper.RLock()
+	defer snooper.RUnlock()
+	byGroup := make(map[MAC][]string)
+	for name, membership := range snooper.peers {
+		for _, group := range membership.Groups {
+			byGroup[group] = append(byGroup[group], name.String())
+		}
+	}
+	var slice []MulticastGroupStatus
+	for group, peers := range byGroup {
+		sort.Strings(peers)
+		slice = append(slice, MulticastGroupStatus{group.String(), peers})
+	}
+	return slice
+}
+
+type macSlice []MAC
+
+func (s macSlice) Len() int           { return len(s) }
+func (s macSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s macSlice) Less(i, j int) bool { return bytes.Compare(s[i][:], s[j][:]) < 0 }
+
+func macsEqual(a, b []MAC) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
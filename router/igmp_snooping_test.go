@@ -0,0 +1,171 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+func makeIGMPFrame(t *testing.T, srcMAC MAC, dstIP string, msg []byte) []byte {
+	binary.BigEndian.PutUint16(msg[2:4], 0)
+	binary.BigEndian.PutUint16(msg[2:4], ipChecksum(msg))
+	dst := net.ParseIP(dstIP).To4()
+	dstMAC := multicastMAC(address.FromIP4(dst))
+	return serializeFrame(t,
+		&layers.Ethernet{SrcMAC: srcMAC[:], DstMAC: dstMAC[:], EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 1, Protocol: layers.IPProtocolIGMP, SrcIP: net.IPv4(10, 0, 0, 1).To4(), DstIP: dst},
+		gopacket.Payload(msg))
+}
+
+func igmpV2(msgType byte, group string) []byte {
+	return append([]byte{msgType, 0, 0, 0}, net.ParseIP(group).To4()...)
+}
+
+func makeIGMPv3Report(recordType byte, group string, sources int) []byte {
+	msg := []byte{igmpV3Report, 0, 0, 0, 0, 0, 0, 1, recordType, 0, byte(sources >> 8), byte(sources)}
+	msg = append(msg, net.ParseIP(group).To4()...)
+	for i := 0; i < sources; i++ {
+		msg = append(msg, 10, 0, 0, byte(i+1))
+	}
+	return msg
+}
+
+func ourGroups(snooper *IGMPSnooper) []string {
+	snooper.RLock()
+	defer snooper.RUnlock()
+	var groups []string
+	for _, g := range snooper.peers[snooper.router.Ourself.Name].Groups {
+		groups = append(groups, g.String())
+	}
+	return groups
+}
+
+func TestIGMPMembership(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{IGMPSnooping: true})
+	snooper := router.IGMP
+	host1 := mustParseMAC(t, "02:00:00:00:00:01")
+	host2 := mustParseMAC(t, "02:00:00:00:00:02")
+	snoop := func(frame []byte) {
+		dec := decodeFrame(frame)
+		require.True(t, snooper.snoop(dec.PacketKey(), dec))
+	}
+
+	snoop(makeIGMPFrame(t, host1, "239.1.2.3", igmpV2(igmpV2Report, "239.1.2.3")))
+	snoop(makeIGMPFrame(t, host2, "224.0.0.22", makeIGMPv3Report(igmpV3ChangeToExclude, "239.4.5.6", 0)))
+	snoop(makeIGMPFrame(t, host2, "224.0.0.22", makeIGMPv3Report(igmpV3ChangeToExclude, "224.0.0.251", 0)))
+	require.Equal(t, []string{"01:00:5e:01:02:03", "01:00:5e:04:05:06"}, ourGroups(snooper), "link-local group ignored")
+
+	// Leaving, in v2 and v3 style
+	snoop(makeIGMPFrame(t, host1, "224.0.0.2", igmpV2(igmpV2Leave, "239.1.2.3")))
+	snoop(makeIGMPFrame(t, host2, "224.0.0.22", makeIGMPv3Report(igmpV3ChangeToInclude, "239.4.5.6", 0)))
+	require.Empty(t, ourGroups(snooper))
+
+	// Frames other than IGMP are not snooped
+	frame := makeUDPFrame(t, host1, multicastMAC(address.FromIP4(net.ParseIP("239.1.2.3").To4())), "10.0.0.1", "239.1.2.3", nil)
+	dec := decodeFrame(frame)
+	require.False(t, snooper.snoop(dec.PacketKey(), dec))
+}
+
+func TestIGMPMembershipTimeout(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{IGMPSnooping: true})
+	snooper := router.IGMP
+	host1 := mustParseMAC(t, "02:00:00:00:00:01")
+	host2 := mustParseMAC(t, "02:00:00:00:00:02")
+	group, _ := address.ParseIP("239.1.2.3")
+
+	start := time.Now()
+	snooper.update(host1, group, true)
+	snooper.update(host2, group, true)
+	snooper.expireMembers(start.Add(igmpMembershipTimeout / 2))
+	require.Len(t, ourGroups(snooper), 1)
+
+	// host2 answers a query; host1 doesn't
+	snooper.Lock()
+	snooper.localMembers[multicastMAC(group)][host2] = start.Add(igmpMembershipTimeout)
+	snooper.Unlock()
+	snooper.expireMembers(start.Add(igmpMembershipTimeout + time.Second))
+	require.Len(t, ourGroups(snooper), 1)
+	snooper.RLock()
+	require.Len(t, snooper.localMembers[multicastMAC(group)], 1)
+	snooper.RUnlock()
+
+	snooper.expireMembers(start.Add(2*igmpMembershipTimeout + time.Second))
+	require.Empty(t, ourGroups(snooper))
+}
+
+func TestIGMPQuery(t *testing.T) {
+	router, bridge := newTestRouter(t, NetworkConfig{IGMPSnooping: true})
+	router.IGMP.query()
+	injected := bridge.takeInjected()
+	require.Len(t, injected, 1)
+	dec := decodeFrame(injected[0])
+	require.True(t, dec.isIPv4())
+	require.Equal(t, layers.IPProtocolIGMP, dec.IP.Protocol)
+	require.Equal(t, net.IPv4allsys.To4(), dec.IP.DstIP.To4())
+	require.Equal(t, uint8(1), dec.IP.TTL)
+	msg := dec.IP.Payload
+	require.Len(t, msg, 12)
+	require.Equal(t, byte(igmpQuery), msg[0])
+	require.Equal(t, byte(100), msg[1], "max response time in tenths of a second")
+	require.Equal(t, uint16(0), ipChecksum(msg), "checksum")
+	require.Equal(t, []byte{0, 0, 0, 0}, msg[4:8], "general query")
+}
+
+func TestIGMPSentDirectly(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{IGMPSnooping: true})
+	snooper := router.IGMP
+	peer := addTestPeer(t, router, "00:00:00:00:00:02")
+	group := mustParseMAC(t, "01:00:5e:01:02:03")
+	linkLocal := mustParseMAC(t, "01:00:5e:00:00:fb")
+
+	// Until we know that the sending peer is snooping, it may be
+	// flooding, and we have to relay
+	require.False(t, snooper.sentDirectly(peer.Name, group))
+	require.False(t, snooper.replicating())
+	snooper.merge(map[mesh.PeerName]GroupMembership{peer.Name: {Version: 1, Groups: []MAC{group}}})
+	require.True(t, snooper.sentDirectly(peer.Name, group))
+	require.False(t, snooper.sentDirectly(peer.Name, linkLocal), "link-local groups are flooded")
+	require.False(t, snooper.sentDirectly(peer.Name, broadcastMAC))
+
+	require.True(t, snooper.replicating())
+	require.Equal(t, []mesh.PeerName{peer.Name}, snooper.interestedPeers(group))
+	require.Empty(t, snooper.interestedPeers(mustParseMAC(t, "01:00:5e:04:05:06")))
+
+	// Older news is ignored
+	require.Empty(t, snooper.merge(map[mesh.PeerName]GroupMembership{peer.Name: {Version: 1}}))
+	require.Equal(t, []mesh.PeerName{peer.Name}, snooper.interestedPeers(group))
+}
+
+func TestIGMPMemberSendingToItsGroup(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{IGMPSnooping: true})
+	snooper := router.IGMP
+	host := mustParseMAC(t, "02:00:00:00:00:01")
+	other := mustParseMAC(t, "02:00:00:00:00:02")
+	group, _ := address.ParseIP("239.1.2.3")
+	snooper.update(host, group, true)
+
+	send := func(src MAC) {
+		frame := makeUDPFrame(t, src, multicastMAC(group), "10.0.0.1", "239.1.2.3", nil)
+		dec := decodeFrame(frame)
+		snooper.capturedFlowOp(dec.PacketKey()).Process(frame, dec, true)
+	}
+	// Other senders get classified, so fastdp can take over their
+	// traffic, but a member's frames must keep being inspected for
+	// its reports
+	send(other)
+	send(host)
+	snooper.RLock()
+	defer snooper.RUnlock()
+	_, otherClassified := snooper.senders[PacketKey{SrcMAC: other, DstMAC: multicastMAC(group)}]
+	_, hostClassified := snooper.senders[PacketKey{SrcMAC: host, DstMAC: multicastMAC(group)}]
+	require.True(t, otherClassified)
+	require.False(t, hostClassified)
+}
@@ -0,0 +1,357 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Routed mode: instead of bridging ethernet frames between peers, IP
+// packets are routed to the peer that owns the destination address,
+// according to the IP allocation ring.  Each peer acts as the
+// gateway for its local containers by answering their ARP requests
+// for remote addresses with its own gateway MAC, so containers need
+// no configuration beyond their usual address and subnet.  Nothing
+// is broadcast between peers, and the MAC cache is not used.
+//
+// Only the default network is routed, and only IPv4 is supported.
+//
+// Every routed packet goes through the router in user space, to have
+// its MAC addresses rewritten and its TTL decremented.  fastdp has no
+// flow actions for that, so it carries routed packets between peers
+// like any other overlay, but never installs kernel flows for them.
+
+const (
+	neighbourMaxAge  = macMaxAge
+	solicitInterval  = time.Second
+	maxSolicitQueue  = 3  // packets held for each address being solicited
+	ipv4HeaderOffset = 14 // size of an untagged ethernet header
+)
+
+var broadcastMAC = MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+type IPRoute struct {
+	address.Range
+	Peer mesh.PeerName
+}
+
+type neighbour struct {
+	mac      MAC
+	lastSeen time.Time
+}
+
+// Packets for a local address whose MAC we have asked for are held
+// until it answers, or until we give up on it.
+type solicitation struct {
+	sent   time.Time
+	queued [][]byte
+}
+
+type L3Router struct {
+	sync.RWMutex
+	router     *NetworkRouter
+	gatewayMAC MAC
+	routes     []IPRoute // sorted by start address
+	neighbours map[address.Address]*neighbour
+	solicited  map[address.Address]*solicitation
+}
+
+func NewL3Router(router *NetworkRouter) *L3Router {
+	l3 := &L3Router{
+		router:     router,
+		gatewayMAC: makeServiceMAC("gateway", router.Ourself.Name),
+		neighbours: make(map[address.Address]*neighbour),
+		solicited:  make(map[address.Address]*solicitation)}
+	log.Println("Routed mode: gateway MAC is", l3.gatewayMAC)
+	time.AfterFunc(neighbourMaxAge/10, l3.expire)
+	return l3
+}
+
+// Replace the routing table; called whenever IP address ownership
+// changes.
+func (l3 *L3Router) SetRoutes(routes []IPRoute) {
+	sorted := make([]IPRoute, len(routes))
+	copy(sorted, routes)
+	sort.Sort(ipRoutes(sorted))
+	l3.Lock()
+	l3.routes = sorted
+	l3.Unlock()
+}
+
+func (l3 *L3Router) owner(addr address.Address) (mesh.PeerName, bool) {
+	l3.RLock()
+	defer l3.RUnlock()
+	i := sort.Search(len(l3.routes), func(i int) bool { return l3.routes[i].End > addr })
+	if i == len(l3.routes) || !l3.routes[i].Contains(addr) {
+		return mesh.UnknownPeerName, false
+	}
+	return l3.routes[i].Peer, true
+}
+
+func (l3 *L3Router) learn(ip address.Address, mac MAC) {
+	now := time.Now()
+	l3.Lock()
+	if n, found := l3.neighbours[ip]; found && n.mac == mac {
+		n.lastSeen = now
+		l3.Unlock()
+		return
+	}
+	log.Println("Routed mode: discovered local address", ip, "at", mac)
+	l3.neighbours[ip] = &neighbour{mac: mac, lastSeen: now}
+	var queued [][]byte
+	if s, found := l3.solicited[ip]; found {
+		queued = s.queued
+		delete(l3.solicited, ip)
+	}
+	l3.Unlock()
+
+	for _, frame := range queued {
+		l3.inject(l3.addressFrame(mac, frame), frame)
+	}
+}
+
+func (l3 *L3Router) lookupNeighbour(ip address.Address) (MAC, bool) {
+	l3.RLock()
+	defer l3.RUnlock()
+	if n, found := l3.neighbours[ip]; found {
+		return n.mac, true
+	}
+	return MAC{}, false
+}
+
+func (l3 *L3Router) expire() {
+	now := time.Now()
+	l3.Lock()
+	for ip, n := range l3.neighbours {
+		if now.After(n.lastSeen.Add(neighbourMaxAge)) {
+			delete(l3.neighbours, ip)
+		}
+	}
+	for ip, s := range l3.solicited {
+		if now.After(s.sent.Add(solicitInterval)) {
+			delete(l3.solicited, ip)
+		}
+	}
+	l3.Unlock()
+	time.AfterFunc(neighbourMaxAge/10, l3.expire)
+}
+
+// Frames captured from the local bridge.  Only frames sent to the
+// gateway, and broadcasts (for ARP), concern us; anything else is
+// local traffic which the bridge deals with.  The inspectingFlowOps
+// mean that no fastdp flows are created; see above.
+func (l3 *L3Router) capturedFlowOp(key PacketKey) FlowOp {
+	switch {
+	case key.DstMAC == l3.gatewayMAC:
+		return inspectingFlowOp{inspect: func(frame []byte, dec *EthernetDecoder) FlowOp {
+			return l3.routeCaptured(key, frame, dec)
+		}}
+	case key.DstMAC == broadcastMAC:
+		return inspectingFlowOp{inspect: func(frame []byte, dec *EthernetDecoder) FlowOp {
+			if dec.isARP() {
+				l3.handleARP(dec)
+			}
+			return nil
+		}}
+	default:
+		return DiscardingFlowOp{}
+	}
+}
+
+func (l3 *L3Router) routeCaptured(key PacketKey, frame []byte, dec *EthernetDecoder) FlowOp {
+	if dec.isARP() {
+		// e.g. a unicast reply to one of our solicitations
+		l3.handleARP(dec)
+		return nil
+	}
+	if !dec.isIPv4() {
+		return nil
+	}
+	if srcIP := address.FromIP4(dec.IP.SrcIP); srcIP != 0 {
+		l3.learn(srcIP, key.SrcMAC)
+	}
+
+	dstIP := address.FromIP4(dec.IP.DstIP)
+	owner, found := l3.owner(dstIP)
+	switch {
+	case !found:
+		return nil
+	case owner == l3.router.Ourself.Name:
+		return l3.deliver(dstIP, frame)
+	}
+
+	if !decrementTTL(frame) {
+		return nil
+	}
+	dstPeer := l3.router.Peers.Fetch(owner)
+	if dstPeer == nil {
+		return nil
+	}
+	fwdKey := ForwardPacketKey{SrcPeer: l3.router.Ourself.Peer, DstPeer: dstPeer, PacketKey: key}
+	l3.router.PacketLogging.LogForwardPacket("Routing", fwdKey)
+	return l3.router.relay(fwdKey)
+}
+
+// Packets routed to us by other peers
+func (l3 *L3Router) forwardedFlowOp(key ForwardPacketKey) FlowOp {
+	return inspectingFlowOp{inspect: func(frame []byte, dec *EthernetDecoder) FlowOp {
+		if !dec.isIPv4() {
+			return nil
+		}
+		return l3.deliver(address.FromIP4(dec.IP.DstIP), frame)
+	}}
+}
+
+// Rewrite the frame's addresses for delivery to a local container
+// and inject it into the bridge.  If we don't know the container's
+// MAC yet, the frame is held while we ask for it.
+func (l3 *L3Router) deliver(dstIP address.Address, frame []byte) FlowOp {
+	dstMAC, found := l3.lookupNeighbour(dstIP)
+	if !found {
+		l3.solicit(dstIP, frame)
+		return nil
+	}
+	key := l3.addressFrame(dstMAC, frame)
+	l3.router.PacketLogging.LogPacket("Delivering", key)
+	return l3.router.Bridge.InjectPacket(key)
+}
+
+func (l3 *L3Router) addressFrame(dstMAC MAC, frame []byte) PacketKey {
+	copy(frame[0:6], dstMAC[:])
+	copy(frame[6:12], l3.gatewayMAC[:])
+	return PacketKey{SrcMAC: l3.gatewayMAC, DstMAC: dstMAC}
+}
+
+func (l3 *L3Router) handleARP(dec *EthernetDecoder) {
+	arp := &dec.ARP
+	if arp.AddrType != layers.LinkTypeEthernet || arp.Protocol != layers.EthernetTypeIPv4 ||
+		len(arp.SourceHwAddress) != 6 || len(arp.SourceProtAddress) != 4 || len(arp.DstProtAddress) != 4 {
+		return
+	}
+
+	srcIP := address.FromIP4(arp.SourceProtAddress)
+	if srcIP != 0 {
+		var srcMAC MAC
+		copy(srcMAC[:], arp.SourceHwAddress)
+		l3.learn(srcIP, srcMAC)
+	}
+
+	if arp.Operation != layers.ARPRequest {
+		return
+	}
+	dstIP := address.FromIP4(arp.DstProtAddress)
+	if _, found := l3.lookupNeighbour(dstIP); found || dstIP == srcIP {
+		return
+	}
+	// Addresses that are ours, or unknown, can only be answered
+	// by a local container, if at all.
+	if owner, found := l3.owner(dstIP); !found || owner == l3.router.Ourself.Name {
+		return
+	}
+
+	reply, err := makeARPReply(l3.gatewayMAC, arp)
+	if err != nil {
+		log.Error("Unable to construct ARP reply: ", err)
+		return
+	}
+	var dstMAC MAC
+	copy(dstMAC[:], arp.SourceHwAddress)
+	l3.inject(PacketKey{SrcMAC: l3.gatewayMAC, DstMAC: dstMAC}, reply)
+}
+
+// Ask a local container for its MAC, holding on to a copy of the
+// frame for it, unless too many are held already.  We don't have an
+// address of our own on the bridge, so send an ARP probe (RFC 5227),
+// which hosts answer all the same.
+func (l3 *L3Router) solicit(ip address.Address, frame []byte) {
+	now := time.Now()
+	l3.Lock()
+	s, found := l3.solicited[ip]
+	if !found {
+		s = &solicitation{}
+		l3.solicited[ip] = s
+	}
+	if len(s.queued) < maxSolicitQueue {
+		s.queued = append(s.queued, append([]byte(nil), frame...))
+	}
+	if now.Before(s.sent.Add(solicitInterval)) {
+		l3.Unlock()
+		return
+	}
+	s.sent = now
+	l3.Unlock()
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr(l3.gatewayMAC[:]),
+			DstMAC:       net.HardwareAddr(broadcastMAC[:]),
+			EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   net.HardwareAddr(l3.gatewayMAC[:]),
+			SourceProtAddress: net.IPv4zero.To4(),
+			DstHwAddress:      zeroMAC,
+			DstProtAddress:    ip.IP4()})
+	if err != nil {
+		log.Error("Unable to construct ARP request: ", err)
+		return
+	}
+	l3.inject(PacketKey{SrcMAC: l3.gatewayMAC, DstMAC: broadcastMAC}, buf.Bytes())
+}
+
+func (l3 *L3Router) inject(key PacketKey, frame []byte) {
+	if fop := l3.router.Bridge.InjectPacket(key); fop != nil {
+		dec := NewEthernetDecoder()
+		dec.DecodeLayers(frame)
+		fop.Process(frame, dec, false)
+	}
+}
+
+// Decrement the TTL of the IPv4 packet in a frame, updating the
+// header checksum incrementally (RFC 1624).  Returns false if the
+// packet has expired.
+func decrementTTL(frame []byte) bool {
+	header := frame[ipv4HeaderOffset:]
+	if header[8] <= 1 {
+		return false
+	}
+	header[8]--
+	sum := uint32(binary.BigEndian.Uint16(header[10:])) + 0x0100
+	binary.BigEndian.PutUint16(header[10:], uint16(sum+sum>>16))
+	return true
+}
+
+type ipRoutes []IPRoute
+
+func (rs ipRoutes) Len() int           { return len(rs) }
+func (rs ipRoutes) Less(i, j int) bool { return rs[i].Start < rs[j].Start }
+func (rs ipRoutes) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+
+type L3RoutingStatus struct {
+	GatewayMAC string
+	Routes     int
+	Neighbours int
+}
+
+func newL3RoutingStatus(l3 *L3Router) *L3RoutingStatus {
+	if l3 == nil {
+		return nil
+	}
+	l3.RLock()
+	defer l3.RUnlock()
+	return &L3RoutingStatus{l3.gatewayMAC.String(), len(l3.routes), len(l3.neighbours)}
+}
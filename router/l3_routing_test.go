@@ -0,0 +1,170 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func newTestL3Router(t *testing.T) (*L3Router, *testBridge) {
+	router, bridge := newTestRouter(t, NetworkConfig{Routed: true})
+	remote := addTestPeer(t, router, "00:00:00:00:00:02")
+	router.L3.SetRoutes([]IPRoute{
+		{Range: address.NewRange(ipAddr(t, "10.32.0.128"), 128), Peer: remote.Name},
+		{Range: address.NewRange(ipAddr(t, "10.32.0.0"), 128), Peer: router.Ourself.Name},
+	})
+	return router.L3, bridge
+}
+
+func TestL3GatewayMAC(t *testing.T) {
+	name := peerName(t, "00:00:00:00:00:01")
+	mac := makeServiceMAC("gateway", name)
+	require.Equal(t, mac, makeServiceMAC("gateway", name), "stable")
+	require.Equal(t, byte(0x02), mac[0]&0x03, "unicast and locally administered")
+	require.NotEqual(t, mac, makeServiceMAC("gateway", peerName(t, "00:00:00:00:00:02")))
+	require.NotEqual(t, mac, makeServiceMAC("dhcp", name), "distinct from other services")
+}
+
+func TestL3Routes(t *testing.T) {
+	l3, _ := newTestL3Router(t)
+	for _, test := range []struct {
+		ip    string
+		owner string
+		found bool
+	}{
+		{"10.32.0.0", "00:00:00:00:00:01", true},
+		{"10.32.0.127", "00:00:00:00:00:01", true},
+		{"10.32.0.128", "00:00:00:00:00:02", true},
+		{"10.32.0.255", "00:00:00:00:00:02", true},
+		{"10.32.1.0", "", false},
+		{"10.31.255.255", "", false},
+	} {
+		owner, found := l3.owner(ipAddr(t, test.ip))
+		require.Equal(t, test.found, found, test.ip)
+		if found {
+			require.Equal(t, test.owner, owner.String(), test.ip)
+		}
+	}
+}
+
+func TestL3DecrementTTL(t *testing.T) {
+	frame := makeUDPFrame(t, MAC{}, MAC{}, "10.32.0.1", "10.32.0.200", nil)
+	require.True(t, decrementTTL(frame))
+	dec := decodeFrame(frame)
+	require.Equal(t, uint8(63), dec.IP.TTL)
+	require.Equal(t, uint16(0), ipChecksum(frame[ipv4HeaderOffset:ipv4HeaderOffset+20]), "header checksum")
+
+	frame[ipv4HeaderOffset+8] = 1
+	require.False(t, decrementTTL(frame), "expired")
+}
+
+func TestL3ARP(t *testing.T) {
+	l3, bridge := newTestL3Router(t)
+	container := mustParseMAC(t, "02:00:00:00:00:01")
+	arp := func(dstIP string) {
+		frame := makeARPFrame(t, layers.ARPRequest, container, "10.32.0.1", MAC{}, dstIP)
+		l3.capturedFlowOp(PacketKey{SrcMAC: container, DstMAC: broadcastMAC}).Process(frame, decodeFrame(frame), true)
+	}
+
+	// Requests for remote addresses are answered with the gateway MAC
+	arp("10.32.0.200")
+	injected := bridge.takeInjected()
+	require.Len(t, injected, 1)
+	dec := decodeFrame(injected[0])
+	require.True(t, dec.isARP())
+	require.Equal(t, uint16(layers.ARPReply), dec.ARP.Operation)
+	require.Equal(t, l3.gatewayMAC[:], []byte(dec.ARP.SourceHwAddress))
+	require.Equal(t, []byte{10, 32, 0, 200}, []byte(dec.ARP.SourceProtAddress))
+	require.Equal(t, container[:], []byte(dec.Eth.DstMAC))
+
+	// ... and the sender is learnt
+	mac, found := l3.lookupNeighbour(ipAddr(t, "10.32.0.1"))
+	require.True(t, found)
+	require.Equal(t, container, mac)
+
+	// Local and unknown addresses are left to the containers
+	arp("10.32.0.2")
+	arp("10.40.0.1")
+	require.Empty(t, bridge.takeInjected())
+}
+
+func TestL3Delivery(t *testing.T) {
+	l3, bridge := newTestL3Router(t)
+	remoteContainer := mustParseMAC(t, "02:00:00:00:00:01")
+	container := mustParseMAC(t, "02:00:00:00:00:02")
+	route := func(srcMAC MAC, srcIP, dstIP string) []byte {
+		frame := makeUDPFrame(t, srcMAC, l3.gatewayMAC, srcIP, dstIP, []byte("hello"))
+		l3.capturedFlowOp(PacketKey{SrcMAC: srcMAC, DstMAC: l3.gatewayMAC}).Process(frame, decodeFrame(frame), false)
+		return frame
+	}
+
+	// We don't know the local container's MAC yet, so ask for it
+	route(remoteContainer, "10.32.0.200", "10.32.0.2")
+	injected := bridge.takeInjected()
+	require.Len(t, injected, 1)
+	dec := decodeFrame(injected[0])
+	require.True(t, dec.isARP())
+	require.Equal(t, uint16(layers.ARPRequest), dec.ARP.Operation)
+	require.Equal(t, []byte{0, 0, 0, 0}, []byte(dec.ARP.SourceProtAddress), "ARP probe")
+	require.Equal(t, []byte{10, 32, 0, 2}, []byte(dec.ARP.DstProtAddress))
+
+	// Asking again straight away is suppressed, and only a few
+	// packets are held meanwhile
+	for i := 0; i < maxSolicitQueue; i++ {
+		route(remoteContainer, "10.32.0.200", "10.32.0.2")
+	}
+	require.Empty(t, bridge.takeInjected())
+
+	// Once it has answered, the held packets are delivered, as
+	// are later ones, with their MACs rewritten
+	reply := makeARPFrame(t, layers.ARPReply, container, "10.32.0.2", l3.gatewayMAC, "0.0.0.0")
+	l3.capturedFlowOp(PacketKey{SrcMAC: container, DstMAC: l3.gatewayMAC}).Process(reply, decodeFrame(reply), false)
+	held := bridge.takeInjected()
+	require.Len(t, held, maxSolicitQueue)
+	for _, frame := range held {
+		require.Equal(t, container[:], frame[0:6])
+	}
+	route(remoteContainer, "10.32.0.200", "10.32.0.2")
+	injected = bridge.takeInjected()
+	require.Len(t, injected, 1)
+	dec = decodeFrame(injected[0])
+	require.Equal(t, container[:], []byte(dec.Eth.DstMAC))
+	require.Equal(t, l3.gatewayMAC[:], []byte(dec.Eth.SrcMAC))
+	require.Equal(t, "10.32.0.2", dec.IP.DstIP.String())
+
+	// Packets from other peers are delivered the same way
+	frame := makeUDPFrame(t, remoteContainer, l3.gatewayMAC, "10.32.0.200", "10.32.0.2", nil)
+	l3.forwardedFlowOp(ForwardPacketKey{}).Process(frame, decodeFrame(frame), false)
+	injected = bridge.takeInjected()
+	require.Len(t, injected, 1)
+	require.Equal(t, container[:], injected[0][0:6])
+
+	// Traffic that isn't for the gateway is the bridge's business
+	require.True(t, l3.capturedFlowOp(PacketKey{SrcMAC: container, DstMAC: remoteContainer}).Discards())
+}
+
+func TestL3RoutingToPeer(t *testing.T) {
+	l3, bridge := newTestL3Router(t)
+	container := mustParseMAC(t, "02:00:00:00:00:02")
+	frame := makeUDPFrame(t, container, l3.gatewayMAC, "10.32.0.2", "10.32.0.200", nil)
+	dec := decodeFrame(frame)
+
+	// Without a connection to the owning peer, there is nowhere to
+	// send the packet, but it has been prepared for sending
+	fop := l3.routeCaptured(PacketKey{SrcMAC: container, DstMAC: l3.gatewayMAC}, frame, dec)
+	require.True(t, fop.Discards())
+	require.Equal(t, uint8(63), decodeFrame(frame).IP.TTL)
+	require.Empty(t, bridge.takeInjected())
+
+	// The sender has been learnt
+	mac, found := l3.lookupNeighbour(ipAddr(t, "10.32.0.2"))
+	require.True(t, found)
+	require.Equal(t, container, mac)
+
+	// Nothing is sent to addresses that nobody owns
+	frame = makeUDPFrame(t, container, l3.gatewayMAC, "10.32.0.2", "10.40.0.1", nil)
+	require.Nil(t, l3.routeCaptured(PacketKey{SrcMAC: container, DstMAC: l3.gatewayMAC}, frame, decodeFrame(frame)))
+}
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"container/list"
 	"net"
 	"sync"
 	"time"
@@ -8,37 +9,61 @@ import (
 	"github.com/weaveworks/weave/mesh"
 )
 
+// The MAC cache is bounded, so that a host generating frames from
+// random source MACs cannot make it grow without limit on every peer.
+// When the cache is full, the least recently seen entry is evicted;
+// when a peer has reached its own limit, its least recently seen
+// entry makes way instead.  Static entries are pinned by the user:
+// they never expire, and are neither evicted nor taken over by other
+// peers.  A frame from another peer claiming a MAC pinned elsewhere is
+// a conflict to be dropped, rather than a sign that the MAC has moved.
+
+type MacCacheConfig struct {
+	MaxAge            time.Duration
+	MaxEntries        int // 0 for unlimited
+	MaxEntriesPerPeer int // 0 for unlimited
+}
+
 type MacCacheEntry struct {
+	key      uint64
 	lastSeen time.Time
 	peer     *mesh.Peer
+	static   bool
+	element  *list.Element // in the peer's list, most recently seen first
 }
 
 type MacCache struct {
 	sync.RWMutex
+	config      MacCacheConfig
 	table       map[uint64]*MacCacheEntry
-	maxAge      time.Duration
+	peers       map[*mesh.Peer]*list.List // dynamic entries only
+	dynamic     int
+	evictions   uint64
 	expiryTimer *time.Timer
 	onExpiry    func(net.HardwareAddr, *mesh.Peer)
 }
 
-func NewMacCache(maxAge time.Duration, onExpiry func(net.HardwareAddr, *mesh.Peer)) *MacCache {
+func NewMacCache(config MacCacheConfig, onExpiry func(net.HardwareAddr, *mesh.Peer)) *MacCache {
 	cache := &MacCache{
+		config:   config,
 		table:    make(map[uint64]*MacCacheEntry),
-		maxAge:   maxAge,
+		peers:    make(map[*mesh.Peer]*list.List),
 		onExpiry: onExpiry}
 	cache.setExpiryTimer()
 	return cache
 }
 
-func (cache *MacCache) add(mac net.HardwareAddr, peer *mesh.Peer, force bool) (bool, *mesh.Peer) {
+// Returns whether the entry is new, and the peer it was at if that
+// was another one, along with whether it is pinned there.
+func (cache *MacCache) add(mac net.HardwareAddr, peer *mesh.Peer, force bool) (bool, *mesh.Peer, bool) {
 	key := macint(mac)
 	now := time.Now()
 
 	cache.RLock()
 	entry, found := cache.table[key]
-	if found && entry.peer == peer && now.Before(entry.lastSeen.Add(cache.maxAge/10)) {
+	if found && entry.peer == peer && (entry.static || now.Before(entry.lastSeen.Add(cache.config.MaxAge/10))) {
 		cache.RUnlock()
-		return false, nil
+		return false, nil, false
 	}
 	cache.RUnlock()
 
@@ -47,33 +72,68 @@ func (cache *MacCache) add(mac net.HardwareAddr, peer *mesh.Peer, force bool) (b
 
 	entry, found = cache.table[key]
 	if !found {
-		cache.table[key] = &MacCacheEntry{lastSeen: now, peer: peer}
-		return true, nil
+		cache.insert(&MacCacheEntry{key: key, lastSeen: now, peer: peer})
+		return true, nil, false
 	}
 
 	if entry.peer != peer {
-		if !force {
-			return false, entry.peer
+		if !force || entry.static {
+			return false, entry.peer, entry.static
 		}
 
+		oldPeer := entry.peer
+		cache.unlink(entry)
+		cache.makeRoomAt(peer)
 		entry.peer = peer
+		entry.lastSeen = now
+		cache.link(entry)
+		return false, oldPeer, false
 	}
 
-	if now.After(entry.lastSeen.Add(cache.maxAge / 10)) {
+	if !entry.static && now.After(entry.lastSeen.Add(cache.config.MaxAge/10)) {
 		entry.lastSeen = now
+		cache.peers[peer].MoveToFront(entry.element)
 	}
 
-	return false, nil
+	return false, nil, false
 }
 
 func (cache *MacCache) Add(mac net.HardwareAddr, peer *mesh.Peer) (bool, *mesh.Peer) {
-	return cache.add(mac, peer, false)
+	newEntry, conflictPeer, _ := cache.add(mac, peer, false)
+	return newEntry, conflictPeer
 }
 
-func (cache *MacCache) AddForced(mac net.HardwareAddr, peer *mesh.Peer) (bool, *mesh.Peer) {
+// Like Add, but moves the MAC to the given peer if it was at another
+// one, and returns that peer, unless it is pinned there, in which
+// case the last result is true and the MAC stays put.
+func (cache *MacCache) AddForced(mac net.HardwareAddr, peer *mesh.Peer) (bool, *mesh.Peer, bool) {
 	return cache.add(mac, peer, true)
 }
 
+// Pin a MAC to a peer, replacing any existing entry.
+func (cache *MacCache) AddStatic(mac net.HardwareAddr, peer *mesh.Peer) {
+	key := macint(mac)
+	cache.Lock()
+	defer cache.Unlock()
+	if entry, found := cache.table[key]; found {
+		cache.remove(entry)
+	}
+	cache.table[key] = &MacCacheEntry{key: key, lastSeen: time.Now(), peer: peer, static: true}
+}
+
+// Unpin a MAC, returning false if it wasn't pinned.
+func (cache *MacCache) DeleteStatic(mac net.HardwareAddr) bool {
+	key := macint(mac)
+	cache.Lock()
+	defer cache.Unlock()
+	entry, found := cache.table[key]
+	if !found || !entry.static {
+		return false
+	}
+	delete(cache.table, key)
+	return true
+}
+
 func (cache *MacCache) Lookup(mac net.HardwareAddr) *mesh.Peer {
 	key := macint(mac)
 	cache.RLock()
@@ -89,27 +149,105 @@ func (cache *MacCache) Delete(peer *mesh.Peer) bool {
 	found := false
 	cache.Lock()
 	defer cache.Unlock()
-	for key, entry := range cache.table {
+	for _, entry := range cache.table {
 		if entry.peer == peer {
-			delete(cache.table, key)
+			cache.remove(entry)
 			found = true
 		}
 	}
 	return found
 }
 
+func (cache *MacCache) Len() int {
+	cache.RLock()
+	defer cache.RUnlock()
+	return len(cache.table)
+}
+
+// Add a new dynamic entry, making room for it if necessary.  Must be
+// called with the lock held.
+func (cache *MacCache) insert(entry *MacCacheEntry) {
+	cache.makeRoomAt(entry.peer)
+	if limit := cache.config.MaxEntries; limit > 0 && cache.dynamic >= limit {
+		if oldest := cache.leastRecentlySeen(); oldest != nil {
+			cache.evict(oldest)
+		}
+	}
+	cache.table[entry.key] = entry
+	cache.link(entry)
+}
+
+// Make room for another dynamic entry at the peer, if it has reached
+// its limit.  Must be called with the lock held.
+func (cache *MacCache) makeRoomAt(peer *mesh.Peer) {
+	if limit := cache.config.MaxEntriesPerPeer; limit > 0 {
+		if entries, found := cache.peers[peer]; found && entries.Len() >= limit {
+			cache.evict(entries.Back().Value.(*MacCacheEntry))
+		}
+	}
+}
+
+func (cache *MacCache) leastRecentlySeen() *MacCacheEntry {
+	var oldest *MacCacheEntry
+	for _, entries := range cache.peers {
+		if candidate := entries.Back().Value.(*MacCacheEntry); oldest == nil || candidate.lastSeen.Before(oldest.lastSeen) {
+			oldest = candidate
+		}
+	}
+	return oldest
+}
+
+func (cache *MacCache) evict(entry *MacCacheEntry) {
+	if cache.evictions%1000 == 0 {
+		log.Warning("MAC cache limit reached; evicting ", intmac(entry.key), " at ", entry.peer, " (", cache.evictions+1, " evictions so far)")
+	}
+	cache.evictions++
+	cache.remove(entry)
+}
+
+func (cache *MacCache) link(entry *MacCacheEntry) {
+	entries, found := cache.peers[entry.peer]
+	if !found {
+		entries = list.New()
+		cache.peers[entry.peer] = entries
+	}
+	entry.element = entries.PushFront(entry)
+	cache.dynamic++
+}
+
+func (cache *MacCache) unlink(entry *MacCacheEntry) {
+	entries := cache.peers[entry.peer]
+	entries.Remove(entry.element)
+	if entries.Len() == 0 {
+		delete(cache.peers, entry.peer)
+	}
+	entry.element = nil
+	cache.dynamic--
+}
+
+func (cache *MacCache) remove(entry *MacCacheEntry) {
+	delete(cache.table, entry.key)
+	if !entry.static {
+		cache.unlink(entry)
+	}
+}
+
 func (cache *MacCache) setExpiryTimer() {
-	cache.expiryTimer = time.AfterFunc(cache.maxAge/10, func() { cache.expire() })
+	cache.expiryTimer = time.AfterFunc(cache.config.MaxAge/10, func() { cache.expire() })
 }
 
 func (cache *MacCache) expire() {
 	now := time.Now()
 	cache.Lock()
 	defer cache.Unlock()
-	for key, entry := range cache.table {
-		if now.After(entry.lastSeen.Add(cache.maxAge)) {
-			delete(cache.table, key)
-			cache.onExpiry(intmac(key), entry.peer)
+	for _, entries := range cache.peers {
+		for entries.Len() > 0 {
+			entry := entries.Back().Value.(*MacCacheEntry)
+			if !now.After(entry.lastSeen.Add(cache.config.MaxAge)) {
+				break
+			}
+			cache.remove(entry)
+			cache.onExpiry(intmac(entry.key), entry.peer)
 		}
 	}
 	cache.setExpiryTimer()
@@ -0,0 +1,145 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+func testMacs(t *testing.T, n int) []net.HardwareAddr {
+	macs := make([]net.HardwareAddr, n)
+	for i := range macs {
+		macs[i] = intmac(0x020000000000 + uint64(i))
+	}
+	return macs
+}
+
+func testPeer(t *testing.T, name string) *mesh.Peer {
+	return mesh.NewPeer(peerName(t, name), "", 0, 0, 0)
+}
+
+func newTestMacCache(config MacCacheConfig, onExpiry func(net.HardwareAddr, *mesh.Peer)) *MacCache {
+	config.MaxAge = time.Hour
+	if onExpiry == nil {
+		onExpiry = func(net.HardwareAddr, *mesh.Peer) {}
+	}
+	cache := NewMacCache(config, onExpiry)
+	cache.expiryTimer.Stop()
+	return cache
+}
+
+// Make an entry look as though it was last seen the given time ago
+func age(cache *MacCache, mac net.HardwareAddr, d time.Duration) {
+	cache.Lock()
+	cache.table[macint(mac)].lastSeen = time.Now().Add(-d)
+	cache.Unlock()
+}
+
+func TestMacCacheEviction(t *testing.T) {
+	peer := testPeer(t, "00:00:00:00:00:01")
+	macs := testMacs(t, 5)
+	cache := newTestMacCache(MacCacheConfig{MaxEntries: 3}, nil)
+
+	for _, mac := range macs[:3] {
+		newEntry, _ := cache.Add(mac, peer)
+		require.True(t, newEntry)
+	}
+	// Seeing the first again makes the second the least recently seen
+	for i, mac := range macs[:3] {
+		age(cache, mac, time.Duration(3-i)*10*time.Minute)
+	}
+	cache.Add(macs[0], peer)
+	cache.Add(macs[3], peer)
+	require.Equal(t, 3, cache.Len())
+	require.Nil(t, cache.Lookup(macs[1]), "least recently seen evicted")
+	for _, mac := range []net.HardwareAddr{macs[0], macs[2], macs[3]} {
+		require.Equal(t, peer, cache.Lookup(mac))
+	}
+	require.Equal(t, uint64(1), cache.evictions)
+}
+
+func TestMacCachePerPeerLimit(t *testing.T) {
+	peer1 := testPeer(t, "00:00:00:00:00:01")
+	peer2 := testPeer(t, "00:00:00:00:00:02")
+	macs := testMacs(t, 5)
+	cache := newTestMacCache(MacCacheConfig{MaxEntriesPerPeer: 2}, nil)
+
+	cache.Add(macs[0], peer2)
+	for _, mac := range macs[1:4] {
+		cache.Add(mac, peer1)
+	}
+	// peer1's oldest made way, and peer2's entry is unaffected
+	require.Nil(t, cache.Lookup(macs[1]))
+	require.Equal(t, peer1, cache.Lookup(macs[2]))
+	require.Equal(t, peer1, cache.Lookup(macs[3]))
+	require.Equal(t, peer2, cache.Lookup(macs[0]))
+
+	// Moving a MAC to a peer counts against its limit too
+	_, oldPeer, pinned := cache.AddForced(macs[0], peer1)
+	require.Equal(t, peer2, oldPeer)
+	require.False(t, pinned)
+	require.Equal(t, peer1, cache.Lookup(macs[0]))
+	require.Nil(t, cache.Lookup(macs[2]))
+	require.Equal(t, 2, cache.Len())
+}
+
+func TestMacCacheStatic(t *testing.T) {
+	peer1 := testPeer(t, "00:00:00:00:00:01")
+	peer2 := testPeer(t, "00:00:00:00:00:02")
+	macs := testMacs(t, 5)
+	var expired []string
+	cache := newTestMacCache(MacCacheConfig{MaxEntries: 2}, func(mac net.HardwareAddr, peer *mesh.Peer) {
+		expired = append(expired, mac.String())
+	})
+
+	cache.AddStatic(macs[0], peer1)
+	for _, mac := range macs[1:] {
+		cache.Add(mac, peer2)
+	}
+	require.Equal(t, peer1, cache.Lookup(macs[0]), "static entry not evicted")
+	require.Equal(t, 3, cache.Len())
+
+	// Static entries can't be taken over
+	newEntry, conflictPeer, pinned := cache.AddForced(macs[0], peer2)
+	require.False(t, newEntry)
+	require.Equal(t, peer1, conflictPeer)
+	require.True(t, pinned)
+	require.Equal(t, peer1, cache.Lookup(macs[0]))
+	_, conflictPeer = cache.Add(macs[0], peer2)
+	require.Equal(t, peer1, conflictPeer)
+
+	// ...and don't expire
+	age(cache, macs[0], 2*time.Hour)
+	age(cache, macs[3], 2*time.Hour)
+	cache.expire()
+	cache.expiryTimer.Stop()
+	require.Equal(t, []string{macs[3].String()}, expired)
+	require.Equal(t, peer1, cache.Lookup(macs[0]))
+	require.Equal(t, peer2, cache.Lookup(macs[4]))
+
+	require.True(t, cache.DeleteStatic(macs[0]))
+	require.False(t, cache.DeleteStatic(macs[4]), "not static")
+	require.Nil(t, cache.Lookup(macs[0]))
+}
+
+func TestPinnedMACFromOtherPeer(t *testing.T) {
+	router, bridge := newTestRouter(t, NetworkConfig{})
+	peer1 := addTestPeer(t, router, "00:00:00:00:00:02")
+	peer2 := addTestPeer(t, router, "00:00:00:00:00:03")
+	mac := mustParseMAC(t, "02:00:00:00:00:01")
+	router.Macs.AddStatic(mac[:], peer1)
+
+	key := ForwardPacketKey{
+		PacketKey: PacketKey{SrcMAC: mac, DstMAC: mustParseMAC(t, "02:00:00:00:00:02")},
+		SrcPeer:   peer2,
+		DstPeer:   router.Ourself.Peer,
+		Network:   DefaultNetwork}
+	fop := router.handleForwardedPacket(key)
+	require.Equal(t, FlowOp(DiscardingFlowOp{}), fop, "frame dropped")
+	require.Empty(t, bridge.takeInjected())
+	require.Equal(t, peer1, router.Macs.Lookup(mac[:]))
+}
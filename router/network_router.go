@@ -1,8 +1,10 @@
 package router
 
 import (
+	"hash/fnv"
 	"math"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/weaveworks/weave/common"
@@ -33,6 +35,12 @@ type NetworkConfig struct {
 	BufSz         int
 	PacketLogging PacketLogging
 	Bridge        Bridge
+	ARPProxy      bool
+	IGMPSnooping  bool
+	StormControl  StormControlConfig
+	MacCache      MacCacheConfig
+	Routed        bool
+	AntiSpoofing  SourceGuardMode
 }
 
 type PacketLogging interface {
@@ -43,7 +51,17 @@ type PacketLogging interface {
 type NetworkRouter struct {
 	*mesh.Router
 	NetworkConfig
-	Macs *MacCache
+	Macs        *MacCache // of the default network
+	ARP         *ARPProxy
+	IGMP        *IGMPSnooper
+	L3          *L3Router // only in routed mode
+	DHCP        *DHCPServer
+	SourceGuard *SourceGuard
+	storm       *stormControl
+
+	networksLock sync.RWMutex
+	networks     map[NetworkID]*Network
+	started      bool // whether the networks' bridges are being captured
 }
 
 func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, name mesh.PeerName, nickName string, overlay NetworkOverlay) *NetworkRouter {
@@ -53,32 +71,81 @@ func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, name mesh
 	if networkConfig.Bridge == nil {
 		networkConfig.Bridge = NullBridge{}
 	}
+	if networkConfig.MacCache.MaxAge == 0 {
+		networkConfig.MacCache.MaxAge = macMaxAge
+	}
 
 	router := &NetworkRouter{Router: mesh.NewRouter(config, name, nickName, overlay), NetworkConfig: networkConfig}
 	router.Peers.OnInvalidateShortIDs(overlay.InvalidateShortIDs)
 	router.Routes.OnChange(overlay.InvalidateRoutes)
-	router.Macs = NewMacCache(macMaxAge,
-		func(mac net.HardwareAddr, peer *mesh.Peer) {
-			log.Println("Expired MAC", mac, "at", peer)
-		})
-	router.Peers.OnGC(func(peer *mesh.Peer) { router.Macs.Delete(peer) })
+	defaultNetwork := newNetwork(DefaultNetwork, "default", networkConfig.Bridge, networkConfig.MacCache)
+	router.Macs = defaultNetwork.Macs
+	router.networks = map[NetworkID]*Network{DefaultNetwork: defaultNetwork}
+	router.Peers.OnGC(func(peer *mesh.Peer) {
+		router.networksLock.RLock()
+		defer router.networksLock.RUnlock()
+		for _, network := range router.networks {
+			network.Macs.Delete(peer)
+		}
+	})
+	if networkConfig.AntiSpoofing != SourceGuardOff {
+		router.SourceGuard = NewSourceGuard(router, networkConfig.AntiSpoofing)
+	}
+	if networkConfig.Routed {
+		router.L3 = NewL3Router(router)
+	}
+	if networkConfig.ARPProxy {
+		router.ARP = NewARPProxy(router)
+	}
+	if networkConfig.IGMPSnooping {
+		router.IGMP = NewIGMPSnooper(router)
+	}
+	if networkConfig.StormControl.Enabled() {
+		router.storm = newStormControl(networkConfig.StormControl)
+	}
 	return router
 }
 
 // Start listening for TCP connections, locally captured packets, and
 // forwarded packets.
 func (router *NetworkRouter) Start() {
-	log.Println("Sniffing traffic on", router.Bridge)
-	checkFatal(router.Bridge.StartConsumingPackets(router.handleCapturedPacket))
+	router.networksLock.Lock()
+	for _, network := range router.networks {
+		checkFatal(router.startNetwork(network))
+	}
+	router.started = true
+	router.networksLock.Unlock()
 	checkFatal(router.Overlay.(NetworkOverlay).StartConsumingPackets(router.Ourself.Peer, router.Peers, router.handleForwardedPacket))
 	router.Router.Start()
 }
 
-func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
+func (router *NetworkRouter) startNetwork(network *Network) error {
+	if network.ID == DefaultNetwork {
+		log.Println("Sniffing traffic on", network.Bridge)
+	} else {
+		log.Println("Sniffing traffic for network", network, "on", network.Bridge)
+	}
+	return network.Bridge.StartConsumingPackets(func(key PacketKey) FlowOp {
+		return router.handleCapturedPacket(network, key)
+	})
+}
+
+func (router *NetworkRouter) handleCapturedPacket(network *Network, key PacketKey) FlowOp {
 	router.PacketLogging.LogPacket("Captured", key)
+	fop := router.forwardCapturedPacket(network, key)
+	if router.SourceGuard != nil && network.ID == DefaultNetwork {
+		return router.SourceGuard.capturedFlowOp(key, fop)
+	}
+	return fop
+}
+
+func (router *NetworkRouter) forwardCapturedPacket(network *Network, key PacketKey) FlowOp {
+	if network.ID == DefaultNetwork && router.L3 != nil {
+		return router.L3.capturedFlowOp(key)
+	}
 	srcMac := net.HardwareAddr(key.SrcMAC[:])
 
-	switch newSrcMac, conflictPeer := router.Macs.Add(srcMac, router.Ourself.Peer); {
+	switch newSrcMac, conflictPeer := network.Macs.Add(srcMac, router.Ourself.Peer); {
 	case newSrcMac:
 		log.Println("Discovered local MAC", srcMac)
 
@@ -96,8 +163,12 @@ func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
 		return DiscardingFlowOp{}
 	}
 
+	if router.DHCP != nil && network.ID == DefaultNetwork && key.DstMAC == router.DHCP.mac {
+		return router.DHCP.capturedFlowOp(key, DiscardingFlowOp{})
+	}
+
 	dstMac := net.HardwareAddr(key.DstMAC[:])
-	switch dstPeer := router.Macs.Lookup(dstMac); dstPeer {
+	switch dstPeer := network.Macs.Lookup(dstMac); dstPeer {
 	case router.Ourself.Peer:
 		// The packet is destined for a local MAC.  The bridge
 		// won't normally send us such packets, and if it does
@@ -108,14 +179,35 @@ func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
 	case nil:
 		// If we don't know which peer corresponds to the dest
 		// MAC, broadcast it.
+		if !router.allowBroadcast(key.SrcMAC, router.Ourself.Peer) {
+			return vetoFlowCreationFlowOp{}
+		}
 		router.PacketLogging.LogPacket("Broadcasting", key)
-		return router.relayBroadcast(router.Ourself.Peer, key)
+		if network.ID != DefaultNetwork {
+			return router.stormControlled(router.relayBroadcast(router.Ourself.Peer, network.ID, key))
+		}
+		if router.IGMP != nil && isIPv4MulticastMAC(key.DstMAC) {
+			return router.stormControlled(router.IGMP.capturedFlowOp(key))
+		}
+		relayFop := router.relayBroadcast(router.Ourself.Peer, DefaultNetwork, key)
+		if router.ARP != nil {
+			relayFop = router.ARP.broadcastFlowOp(key, relayFop)
+		}
+		if router.DHCP != nil && key.DstMAC == broadcastMAC {
+			relayFop = router.DHCP.capturedFlowOp(key, relayFop)
+		}
+		return router.stormControlled(relayFop)
 	default:
 		router.PacketLogging.LogPacket("Forwarding", key)
-		return router.relay(ForwardPacketKey{
+		fwdFop := router.relay(ForwardPacketKey{
 			PacketKey: key,
 			SrcPeer:   router.Ourself.Peer,
-			DstPeer:   dstPeer})
+			DstPeer:   dstPeer,
+			Network:   network.ID})
+		if router.ARP != nil && network.ID == DefaultNetwork {
+			return router.ARP.unicastFlowOp(key, fwdFop)
+		}
+		return fwdFop
 	}
 }
 
@@ -130,10 +222,33 @@ func (router *NetworkRouter) handleForwardedPacket(key ForwardPacketKey) FlowOp
 	// (because the DstPeer on a forwarded broadcast packet is
 	// always set to the peer being forwarded to)
 
+	if key.Network == DefaultNetwork && router.L3 != nil {
+		router.PacketLogging.LogForwardPacket("Routed", key)
+		return router.L3.forwardedFlowOp(key)
+	}
+
+	if key.Network == DefaultNetwork && router.SourceGuard != nil && !router.SourceGuard.checkForwarded(key) {
+		return vetoFlowCreationFlowOp{}
+	}
+
+	network := router.lookupNetworkByID(key.Network)
+	if network == nil {
+		// We don't have this network, but other peers might
+		// be relying on us to relay its broadcasts.
+		if !router.allowBroadcast(key.SrcMAC, key.SrcPeer) {
+			return vetoFlowCreationFlowOp{}
+		}
+		router.PacketLogging.LogForwardPacket("Relaying broadcast", key)
+		return router.stormControlled(router.relayBroadcast(key.SrcPeer, key.Network, key.PacketKey))
+	}
+
 	srcMac := net.HardwareAddr(key.SrcMAC[:])
 	dstMac := net.HardwareAddr(key.DstMAC[:])
 
-	switch newSrcMac, conflictPeer := router.Macs.AddForced(srcMac, key.SrcPeer); {
+	switch newSrcMac, conflictPeer, pinned := network.Macs.AddForced(srcMac, key.SrcPeer); {
+	case pinned:
+		log.Debug("Dropping frame from MAC ", srcMac, " at ", key.SrcPeer, ", which is pinned to ", conflictPeer)
+		return DiscardingFlowOp{}
 	case newSrcMac:
 		log.Print("Discovered remote MAC ", srcMac, " at ", key.SrcPeer)
 	case conflictPeer != nil:
@@ -143,28 +258,65 @@ func (router *NetworkRouter) handleForwardedPacket(key ForwardPacketKey) FlowOp
 		router.Overlay.(NetworkOverlay).InvalidateRoutes()
 	}
 
+	dstPeer := network.Macs.Lookup(dstMac)
+	if dstPeer != router.Ourself.Peer && !router.allowBroadcast(key.SrcMAC, key.SrcPeer) {
+		return vetoFlowCreationFlowOp{}
+	}
+
 	router.PacketLogging.LogForwardPacket("Injecting", key)
-	injectFop := router.Bridge.InjectPacket(key.PacketKey)
-	dstPeer := router.Macs.Lookup(dstMac)
+	injectFop := network.Bridge.InjectPacket(key.PacketKey)
 	if dstPeer == router.Ourself.Peer {
 		return injectFop
 	}
 
+	if network.ID == DefaultNetwork && router.IGMP != nil && router.IGMP.sentDirectly(key.SrcPeer.Name, key.DstMAC) {
+		// The originating peer sends a copy to every peer
+		// that should get one, so there is nothing to relay.
+		return router.stormControlled(injectFop)
+	}
+
 	router.PacketLogging.LogForwardPacket("Relaying broadcast", key)
-	relayFop := router.relayBroadcast(key.SrcPeer, key.PacketKey)
+	relayFop := router.relayBroadcast(key.SrcPeer, key.Network, key.PacketKey)
 	switch {
 	case injectFop == nil:
-		return relayFop
+		return router.stormControlled(relayFop)
 	case relayFop == nil:
-		return injectFop
+		return router.stormControlled(injectFop)
 	default:
 		mfop := NewMultiFlowOp(false)
 		mfop.Add(injectFop)
 		mfop.Add(relayFop)
-		return mfop
+		return router.stormControlled(mfop)
 	}
 }
 
+// The MAC from which the router sends frames of its own for a
+// service, such as DHCP, on the local bridge.  It stays the same
+// across restarts, so that hosts' ARP caches don't go stale.
+func makeServiceMAC(service string, name mesh.PeerName) (mac MAC) {
+	hash := fnv.New64a()
+	hash.Write([]byte(service + ":" + name.String()))
+	copy(mac[:], hash.Sum(nil))
+	mac[0] = mac[0]&^0x01 | 0x02 // unicast, locally administered
+	return
+}
+
+// Storm control
+
+func (router *NetworkRouter) allowBroadcast(srcMAC MAC, srcPeer *mesh.Peer) bool {
+	return router.storm == nil || router.storm.allow(srcMAC, srcPeer)
+}
+
+// When storm control is enabled, every broadcast frame must be seen
+// by the router in order to be counted, so we cannot let fastdp
+// create flows for them.
+func (router *NetworkRouter) stormControlled(fop FlowOp) FlowOp {
+	if router.storm == nil {
+		return fop
+	}
+	return NewMultiFlowOp(true, vetoFlowCreationFlowOp{}, fop)
+}
+
 // Routing
 
 func (router *NetworkRouter) relay(key ForwardPacketKey) FlowOp {
@@ -186,7 +338,7 @@ func (router *NetworkRouter) relay(key ForwardPacketKey) FlowOp {
 	return conn.(*mesh.LocalConnection).OverlayConn.(OverlayForwarder).Forward(key)
 }
 
-func (router *NetworkRouter) relayBroadcast(srcPeer *mesh.Peer, key PacketKey) FlowOp {
+func (router *NetworkRouter) relayBroadcast(srcPeer *mesh.Peer, network NetworkID, key PacketKey) FlowOp {
 	nextHops := router.Routes.Broadcast(srcPeer.Name)
 	if len(nextHops) == 0 {
 		return DiscardingFlowOp{}
@@ -198,8 +350,34 @@ func (router *NetworkRouter) relayBroadcast(srcPeer *mesh.Peer, key PacketKey) F
 		op.Add(conn.(*mesh.LocalConnection).OverlayConn.(OverlayForwarder).Forward(ForwardPacketKey{
 			PacketKey: key,
 			SrcPeer:   srcPeer,
-			DstPeer:   conn.Remote()}))
+			DstPeer:   conn.Remote(),
+			Network:   network}))
 	}
 
 	return op
 }
+
+// Send a copy of a multicast frame to each of the given peers.
+func (router *NetworkRouter) relayMulticast(srcPeer *mesh.Peer, key PacketKey, peerNames []mesh.PeerName) FlowOp {
+	op := NewMultiFlowOp(true)
+
+	for _, name := range peerNames {
+		if name == router.Ourself.Name || name == srcPeer.Name {
+			continue
+		}
+		if _, found := router.Routes.Unicast(name); !found {
+			continue
+		}
+		if peer := router.Peers.Fetch(name); peer != nil {
+			op.Add(router.relay(ForwardPacketKey{
+				PacketKey: key,
+				SrcPeer:   srcPeer,
+				DstPeer:   peer}))
+		}
+	}
+
+	if len(op.ops) == 0 {
+		return DiscardingFlowOp{}
+	}
+	return op
+}
@@ -11,6 +11,12 @@ type NetworkRouterStatus struct {
 	Interface    string
 	CaptureStats map[string]int
 	MACs         []MACStatus
+	StormControl *StormControlStatus    `json:"StormControl,omitempty"`
+	Multicast    []MulticastGroupStatus `json:"Multicast,omitempty"`
+	Networks     []NetworkStatus        `json:"Networks,omitempty"`
+	Routing      *L3RoutingStatus       `json:"Routing,omitempty"`
+	DHCP         *DHCPStatus            `json:"DHCP,omitempty"`
+	AntiSpoofing *SourceGuardStatus     `json:"AntiSpoofing,omitempty"`
 }
 
 type MACStatus struct {
@@ -18,6 +24,7 @@ type MACStatus struct {
 	Name     string
 	NickName string
 	LastSeen time.Time
+	Static   bool `json:",omitempty"`
 }
 
 func NewNetworkRouterStatus(router *NetworkRouter) *NetworkRouterStatus {
@@ -25,20 +32,36 @@ func NewNetworkRouterStatus(router *NetworkRouter) *NetworkRouterStatus {
 		mesh.NewStatus(router.Router),
 		router.Bridge.String(),
 		router.Bridge.Stats(),
-		NewMACStatusSlice(router.Macs)}
+		NewMACStatusSlice(router.Macs),
+		newStormControlStatus(router.storm),
+		NewMulticastGroupStatusSlice(router.IGMP),
+		NewNetworkStatusSlice(router),
+		newL3RoutingStatus(router.L3),
+		newDHCPStatus(router.DHCP),
+		newSourceGuardStatus(router.SourceGuard)}
 }
 
 func NewMACStatusSlice(cache *MacCache) []MACStatus {
+	return newMACStatusSliceForPeer(cache, nil)
+}
+
+// As NewMACStatusSlice, but only including entries for the given
+// peer, if that isn't nil.
+func newMACStatusSliceForPeer(cache *MacCache, peer *mesh.Peer) []MACStatus {
 	cache.RLock()
 	defer cache.RUnlock()
 
 	var slice []MACStatus
 	for key, entry := range cache.table {
+		if peer != nil && entry.peer != peer {
+			continue
+		}
 		slice = append(slice, MACStatus{
 			intmac(key).String(),
 			entry.peer.Name.String(),
 			entry.peer.NickName,
-			entry.lastSeen})
+			entry.lastSeen,
+			entry.static})
 	}
 
 	return slice
@@ -0,0 +1,169 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// Isolated networks: a router can carry several virtual networks,
+// each with its own bridge and MAC cache.  Frames never cross from
+// one network to another.  The default network (ID 0) is the one
+// that weave has always provided.
+//
+// Between peers, sleeve marks frames on other networks with an
+// 802.1ad service tag whose VID is the network ID, and fastdp sends
+// them to a separate vxlan port, with the network ID in the VNI.
+// Peers that understand either advertise networksFeature on their
+// connections.  Frames on other networks are never sent to a peer
+// that doesn't, and all frames from such a peer are on the default
+// network, whatever they look like.
+
+type NetworkID uint16
+
+const (
+	DefaultNetwork NetworkID = 0
+	MaxNetworkID   NetworkID = 4094
+
+	networkTagEtherType = layers.EthernetType(0x88a8)
+	networkTagSize      = 4
+
+	networksFeature = "Networks"
+)
+
+func supportsNetworks(features map[string]string) bool {
+	_, present := features[networksFeature]
+	return present
+}
+
+type Network struct {
+	ID     NetworkID
+	Name   string
+	Bridge Bridge
+	Macs   *MacCache
+}
+
+func newNetwork(id NetworkID, name string, bridge Bridge, macConfig MacCacheConfig) *Network {
+	return &Network{
+		ID:     id,
+		Name:   name,
+		Bridge: bridge,
+		Macs: NewMacCache(macConfig,
+			func(mac net.HardwareAddr, peer *mesh.Peer) {
+				if id == DefaultNetwork {
+					log.Println("Expired MAC", mac, "at", peer)
+				} else {
+					log.Println("Expired MAC", mac, "at", peer, "on network", name)
+				}
+			})}
+}
+
+func (network *Network) String() string {
+	return fmt.Sprintf("%s(%d)", network.Name, network.ID)
+}
+
+// Check that a network with the given ID and name could be added, so
+// that callers can find out before setting up its bridge.
+func (router *NetworkRouter) CheckNewNetwork(id NetworkID, name string) error {
+	router.networksLock.RLock()
+	defer router.networksLock.RUnlock()
+	return router.checkNewNetwork(id, name)
+}
+
+func (router *NetworkRouter) checkNewNetwork(id NetworkID, name string) error {
+	if id == DefaultNetwork || id > MaxNetworkID {
+		return fmt.Errorf("network ID must be in the range 1-%d", MaxNetworkID)
+	}
+	for _, network := range router.networks {
+		switch {
+		case network.ID == id:
+			return fmt.Errorf("network ID %d is already used by network %s", id, network.Name)
+		case network.Name == name:
+			return fmt.Errorf("network %s already exists", name)
+		}
+	}
+	return nil
+}
+
+// Add an isolated network, with frames captured from and injected
+// into the given bridge.  If the router has already been started,
+// capture on the bridge starts straight away.
+func (router *NetworkRouter) AddNetwork(id NetworkID, name string, bridge Bridge) (*Network, error) {
+	router.networksLock.Lock()
+	defer router.networksLock.Unlock()
+	if err := router.checkNewNetwork(id, name); err != nil {
+		return nil, err
+	}
+	network := newNetwork(id, name, bridge, router.MacCache)
+	if router.started {
+		if err := router.startNetwork(network); err != nil {
+			return nil, err
+		}
+	}
+	router.networks[id] = network
+	return network, nil
+}
+
+func (router *NetworkRouter) LookupNetwork(name string) *Network {
+	router.networksLock.RLock()
+	defer router.networksLock.RUnlock()
+	for _, network := range router.networks {
+		if network.Name == name {
+			return network
+		}
+	}
+	return nil
+}
+
+func (router *NetworkRouter) lookupNetworkByID(id NetworkID) *Network {
+	router.networksLock.RLock()
+	defer router.networksLock.RUnlock()
+	return router.networks[id]
+}
+
+// Insert the service tag identifying the network into a frame.  The
+// result is built in buf, which is only reallocated if it is too
+// small, so callers can keep hold of it for the next frame.
+func tagFrame(network NetworkID, frame []byte, buf []byte) []byte {
+	size := len(frame) + networkTagSize
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	tagged := buf[:size]
+	copy(tagged, frame[:12])
+	binary.BigEndian.PutUint16(tagged[12:], uint16(networkTagEtherType))
+	binary.BigEndian.PutUint16(tagged[14:], uint16(network))
+	copy(tagged[16:], frame[12:])
+	return tagged
+}
+
+// Remove the service tag from a frame, in place
+func untagFrame(frame []byte) (NetworkID, []byte) {
+	network := NetworkID(binary.BigEndian.Uint16(frame[14:]) & 0xfff)
+	copy(frame[networkTagSize:], frame[:12])
+	return network, frame[networkTagSize:]
+}
+
+type NetworkStatus struct {
+	ID        NetworkID
+	Name      string
+	Interface string
+	MACs      int
+}
+
+func NewNetworkStatusSlice(router *NetworkRouter) []NetworkStatus {
+	router.networksLock.RLock()
+	defer router.networksLock.RUnlock()
+	var slice []NetworkStatus
+	for _, network := range router.networks {
+		if network.ID == DefaultNetwork {
+			continue
+		}
+		slice = append(slice, NetworkStatus{network.ID, network.Name, network.Bridge.String(), network.Macs.Len()})
+	}
+	return slice
+}
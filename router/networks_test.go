@@ -0,0 +1,215 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/go-odp/odp"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+func TestTagFrame(t *testing.T) {
+	mac1 := mustParseMAC(t, "02:00:00:00:00:01")
+	mac2 := mustParseMAC(t, "02:00:00:00:00:02")
+	frame := makeUDPFrame(t, mac1, mac2, "10.0.0.1", "10.0.0.2", []byte("hello"))
+	orig := append([]byte(nil), frame...)
+
+	var buf []byte
+	buf = tagFrame(42, frame, buf)
+	require.Len(t, buf, len(frame)+networkTagSize)
+	require.Equal(t, networkTagEtherType, decodeFrame(buf).Eth.EthernetType)
+	require.Equal(t, orig, frame)
+
+	network, untagged := untagFrame(append([]byte(nil), buf...))
+	require.Equal(t, NetworkID(42), network)
+	require.Equal(t, orig, untagged)
+
+	// Once the buffer is big enough, it is reused
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = tagFrame(42, frame, buf)
+	})
+	require.Equal(t, 0.0, allocs)
+}
+
+// Records the UDP packets a sleeve forwarder sends
+type recordingUDPSender struct {
+	msgs [][]byte
+}
+
+func (sender *recordingUDPSender) send(msg []byte, raddr *net.UDPAddr) error {
+	sender.msgs = append(sender.msgs, append([]byte(nil), msg...))
+	return nil
+}
+
+func (sender *recordingUDPSender) sendBatch(msgs [][]byte, raddr *net.UDPAddr) error {
+	for _, msg := range msgs {
+		sender.send(msg, raddr)
+	}
+	return nil
+}
+
+// Send a frame through a sleeve forwarder to a peer that does or
+// doesn't support networks, and receive it on a sleeve whose
+// forwarder for the sending peer does or doesn't, returning the keys
+// and frames delivered.
+func sleeveNetworkRoundTrip(t *testing.T, sendNetworks, receiveNetworks bool, network NetworkID, frame []byte) []receivedFrame {
+	router, _ := newTestRouter(t, NetworkConfig{})
+	srcPeer := router.Ourself.Peer
+	dstPeer := addTestPeer(t, router, "00:00:00:00:00:02")
+
+	aggChan := make(chan aggregatorFrame, 10)
+	fwd := &sleeveForwarder{
+		sleeve:           &SleeveOverlay{},
+		remotePeer:       dstPeer,
+		networks:         sendNetworks,
+		aggregatorChan:   aggChan,
+		aggregatorDFChan: aggChan,
+		remoteAddr:       &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 6783},
+		mtu:              DefaultMTU,
+		maxPayload:       DefaultMTU - UDPOverhead,
+	}
+	dec := decodeFrame(frame)
+	fop := fwd.Forward(ForwardPacketKey{SrcPeer: srcPeer, DstPeer: dstPeer, Network: network, PacketKey: dec.PacketKey()})
+	fop.Process(frame, dec, false)
+
+	sender := &recordingUDPSender{}
+	for len(aggChan) > 0 {
+		require.NoError(t, fwd.aggregateAndSend(<-aggChan, aggChan, NewNonEncryptor(srcPeer.NameByte), sender, MaxUDPPacketSize-UDPOverhead))
+	}
+
+	var received []receivedFrame
+	sleeve := &SleeveOverlay{
+		peers: router.Peers,
+		consumer: func(key ForwardPacketKey) FlowOp {
+			return &recordingFlowOp{record: func(frame []byte) {
+				received = append(received, receivedFrame{key, frame})
+			}}
+		},
+	}
+	receiver := &sleeveForwarder{sleeve: sleeve, remotePeer: srcPeer, networks: receiveNetworks}
+	for _, msg := range sender.msgs {
+		// Each packet starts with the name of the sending peer
+		require.NoError(t, NewNonDecryptor().IterateFrames(msg[NameSize:], func(src []byte, dst []byte, frame []byte) {
+			sleeve.handleFrame(nil, receiver, src, dst, frame, NewEthernetDecoder())
+		}))
+	}
+	return received
+}
+
+func TestSleeveNetworks(t *testing.T) {
+	mac1 := mustParseMAC(t, "02:00:00:00:00:01")
+	mac2 := mustParseMAC(t, "02:00:00:00:00:02")
+	frame := makeUDPFrame(t, mac1, mac2, "10.0.0.1", "10.0.0.2", []byte("hello"))
+	// A frame on the default network that happens to carry an
+	// 802.1ad tag of its own
+	tagged := tagFrame(7, frame, nil)
+
+	received := sleeveNetworkRoundTrip(t, true, true, 5, frame)
+	require.Len(t, received, 1)
+	require.Equal(t, NetworkID(5), received[0].key.Network)
+	require.Equal(t, frame, received[0].frame)
+
+	received = sleeveNetworkRoundTrip(t, true, true, DefaultNetwork, tagged)
+	require.Len(t, received, 1)
+	require.Equal(t, DefaultNetwork, received[0].key.Network)
+	require.Equal(t, tagged, received[0].frame)
+
+	// Frames on other networks are not sent to peers that don't
+	// support networks, and tagged frames are sent as they are
+	require.Len(t, sleeveNetworkRoundTrip(t, false, false, 5, frame), 0)
+	received = sleeveNetworkRoundTrip(t, false, false, DefaultNetwork, tagged)
+	require.Len(t, received, 1)
+	require.Equal(t, DefaultNetwork, received[0].key.Network)
+	require.Equal(t, tagged, received[0].frame)
+}
+
+func TestFastDatapathNetworks(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{})
+	fastdp := &FastDatapath{peers: router.Peers, localPeer: router.Ourself.Peer}
+	srcPeer := router.Ourself.Peer
+	remotePeer := router.Peers.FetchWithDefault(mesh.NewPeer(peerName(t, "00:00:00:00:00:02"), "", 0, 0, (srcPeer.ShortID+1)&0xfff))
+	otherPeer := router.Peers.FetchWithDefault(mesh.NewPeer(peerName(t, "00:00:00:00:00:03"), "", 0, 0, (srcPeer.ShortID+2)&0xfff))
+
+	key := ForwardPacketKey{SrcPeer: srcPeer, DstPeer: remotePeer, Network: 5}
+	peer, network := fastdp.extractNetworkPeer(networkTunnelIDFor(key))
+	require.Equal(t, srcPeer, peer)
+	require.Equal(t, NetworkID(5), network)
+
+	fwd := &fastDatapathForwarder{
+		fastdp:              fastdp,
+		remotePeer:          remotePeer,
+		vxlanVportID:        1,
+		networks:            true,
+		networkVxlanVportID: 2,
+		remoteAddr:          &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 6784},
+	}
+	tunnelAndVport := func(fop FlowOp) ([8]byte, odp.VportID) {
+		actions := fop.(odpActionsFlowOp).actions
+		return actions[0].(odp.SetTunnelAction).TunnelId, actions[1].(odp.OutputAction).VportID()
+	}
+
+	tunnelID, vport := tunnelAndVport(fwd.Forward(ForwardPacketKey{SrcPeer: srcPeer, DstPeer: remotePeer}))
+	require.Equal(t, tunnelIDFor(ForwardPacketKey{SrcPeer: srcPeer, DstPeer: remotePeer}), tunnelID)
+	require.Equal(t, odp.VportID(1), vport)
+
+	tunnelID, vport = tunnelAndVport(fwd.Forward(key))
+	require.Equal(t, networkTunnelIDFor(key), tunnelID)
+	require.Equal(t, odp.VportID(2), vport)
+
+	// The VNI can't say where frames on other networks are going
+	// beyond the remote peer, so those are left to other overlays
+	require.Nil(t, fwd.Forward(ForwardPacketKey{SrcPeer: srcPeer, DstPeer: otherPeer, Network: 5}))
+
+	fwd.networks = false
+	require.Nil(t, fwd.Forward(key))
+}
+
+// A bridge that remembers the consumer it was started with
+type startableBridge struct {
+	testBridge
+	consumer BridgeConsumer
+}
+
+func (bridge *startableBridge) StartConsumingPackets(consumer BridgeConsumer) error {
+	bridge.consumer = consumer
+	return nil
+}
+
+func TestAddNetwork(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{})
+
+	blue := &startableBridge{}
+	network, err := router.AddNetwork(1, "blue", blue)
+	require.NoError(t, err)
+	require.Equal(t, network, router.LookupNetwork("blue"))
+	require.Nil(t, blue.consumer)
+
+	_, err = router.AddNetwork(1, "green", &startableBridge{})
+	require.Error(t, err)
+	_, err = router.AddNetwork(2, "blue", &startableBridge{})
+	require.Error(t, err)
+	_, err = router.AddNetwork(MaxNetworkID+1, "green", &startableBridge{})
+	require.Error(t, err)
+	require.Error(t, router.CheckNewNetwork(DefaultNetwork, "green"))
+	require.NoError(t, router.CheckNewNetwork(2, "green"))
+
+	// Once the router has started, networks start capturing as
+	// soon as they are added
+	router.Start()
+	require.NotNil(t, blue.consumer)
+	green := &startableBridge{}
+	_, err = router.AddNetwork(2, "green", green)
+	require.NoError(t, err)
+	require.NotNil(t, green.consumer)
+
+	// and frames forwarded for the network reach its bridge
+	mac1 := mustParseMAC(t, "02:00:00:00:00:01")
+	frame := makeUDPFrame(t, mac1, broadcastMAC, "10.0.0.1", "10.0.0.255", nil)
+	peer := addTestPeer(t, router, "00:00:00:00:00:02")
+	dec := decodeFrame(frame)
+	router.handleForwardedPacket(ForwardPacketKey{SrcPeer: peer, DstPeer: router.Ourself.Peer, Network: 2, PacketKey: dec.PacketKey()}).Process(frame, dec, true)
+	require.Len(t, green.takeInjected(), 1)
+	require.Len(t, blue.takeInjected(), 0)
+}
@@ -0,0 +1,172 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/weaveworks/weave/mesh"
+)
+
+// An OverlayPolicy controls which overlays the OverlaySwitch may use
+// for connections to particular peers, and in what order of
+// preference.  The first rule matching a connection applies; where
+// none does, all the overlays may be used, in the order they were
+// added to the switch.
+//
+// Both ends of a connection apply their own policies.  Each only
+// sends over the overlays its policy allows, and refuses to start
+// the others, so an overlay is only used if both ends allow it.
+type OverlayPolicy struct {
+	Rules []OverlayPolicyRule
+}
+
+// A rule matches a connection if the remote peer matches all of the
+// non-empty selectors.
+type OverlayPolicyRule struct {
+	Peer   string `json:",omitempty"` // name or nickname
+	Label  string `json:",omitempty"` // key=value, as given to the remote peer
+	Subnet string `json:",omitempty"` // CIDR containing the remote address
+
+	// The overlays that may be used, most preferred first
+	Overlays []string
+
+	subnet *net.IPNet
+}
+
+func (rule *OverlayPolicyRule) matches(params mesh.OverlayConnectionParams) bool {
+	if rule.Peer != "" && rule.Peer != params.RemotePeer.Name.String() && rule.Peer != params.RemotePeer.NickName {
+		return false
+	}
+	if rule.Label != "" && !hasLabel(params.Features["Labels"], rule.Label) {
+		return false
+	}
+	if rule.subnet != nil && (params.RemoteAddr == nil || !rule.subnet.Contains(params.RemoteAddr.IP)) {
+		return false
+	}
+	return true
+}
+
+func hasLabel(labels string, label string) bool {
+	for _, l := range strings.Split(labels, ",") {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func (osw *OverlaySwitch) checkPolicy(policy *OverlayPolicy) error {
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.Label != "" && !strings.Contains(rule.Label, "=") {
+			return fmt.Errorf("invalid label %q; expected key=value", rule.Label)
+		}
+		rule.subnet = nil
+		if rule.Subnet != "" {
+			_, subnet, err := net.ParseCIDR(rule.Subnet)
+			if err != nil {
+				return err
+			}
+			rule.subnet = subnet
+		}
+		for _, name := range rule.Overlays {
+			if _, present := osw.overlays[name]; !present {
+				return fmt.Errorf("unknown overlay %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// SetPolicy replaces the overlay policy.  It applies to existing
+// connections as well as new ones: they stop using overlays that are
+// no longer allowed, and may take up newly allowed ones when they
+// next probe for them.
+func (osw *OverlaySwitch) SetPolicy(policy OverlayPolicy) error {
+	if err := osw.checkPolicy(&policy); err != nil {
+		return err
+	}
+
+	osw.lock.Lock()
+	osw.policy = policy
+	var forwarders []*overlaySwitchForwarder
+	for fwd := range osw.forwarders {
+		forwarders = append(forwarders, fwd)
+	}
+	osw.lock.Unlock()
+
+	for _, fwd := range forwarders {
+		fwd.setPreferences(osw.preferences(fwd.params, fwd.overlayNames()))
+	}
+	return nil
+}
+
+func (osw *OverlaySwitch) Policy() OverlayPolicy {
+	osw.lock.Lock()
+	defer osw.lock.Unlock()
+	return osw.policy
+}
+
+// SetLabels sets the labels of this peer, which are passed to remote
+// peers for matching against their policies.
+func (osw *OverlaySwitch) SetLabels(labels []string) {
+	osw.labels = strings.Join(labels, ",")
+}
+
+// Work out the order of preference of the given overlays for a
+// connection.  The result holds indices into overlays, with those
+// that may not be used left out.
+func (osw *OverlaySwitch) preferences(params mesh.OverlayConnectionParams, overlays []string) []int {
+	osw.lock.Lock()
+	defer osw.lock.Unlock()
+
+	var allowed []string
+	for _, rule := range osw.policy.Rules {
+		if rule.matches(params) {
+			allowed = rule.Overlays
+			break
+		}
+	}
+	if allowed == nil {
+		allowed = osw.overlayNames
+	}
+
+	var order []int
+	for _, name := range allowed {
+		for i, overlay := range overlays {
+			if overlay == name {
+				order = append(order, i)
+			}
+		}
+	}
+	return order
+}
+
+func (osw *OverlaySwitch) HandleHTTP(muxRouter *mux.Router) {
+	muxRouter.Methods("GET").Path("/overlay-policy").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json, err := json.MarshalIndent(osw.Policy(), "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	})
+
+	muxRouter.Methods("PUT").Path("/overlay-policy").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var policy OverlayPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, fmt.Sprint("unable to parse policy: ", err), http.StatusBadRequest)
+			return
+		}
+		if err := osw.SetPolicy(policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("Overlay policy set to", policy.Rules)
+	})
+}
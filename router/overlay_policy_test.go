@@ -0,0 +1,53 @@
+package router
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+func TestOverlayPolicyPreferences(t *testing.T) {
+	osw := NewOverlaySwitch()
+	for _, name := range []string{"fastdp", "sleeve", "tcp"} {
+		osw.Add(name, NewTCPOverlay())
+	}
+	err := osw.SetPolicy(OverlayPolicy{Rules: []OverlayPolicyRule{
+		{Peer: "host2", Overlays: []string{"sleeve"}},
+		{Label: "zone=dmz", Overlays: []string{"tcp", "sleeve"}},
+		{Subnet: "10.1.0.0/16", Overlays: []string{}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, _ := mesh.PeerNameFromString("00:00:00:00:00:01")
+	params := func(nickName string, labels string, ip string) mesh.OverlayConnectionParams {
+		return mesh.OverlayConnectionParams{
+			RemotePeer: mesh.NewPeer(name, nickName, 0, 0, 0),
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: mesh.Port},
+			Features:   map[string]string{"Labels": labels},
+		}
+	}
+	// as the connectee, the remote peer's ordering applies
+	overlays := []string{"tcp", "sleeve", "fastdp"}
+
+	for _, c := range []struct {
+		params mesh.OverlayConnectionParams
+		order  []int
+	}{
+		{params("host1", "", "192.168.0.1"), []int{2, 1, 0}},
+		{params("host2", "zone=dmz", "10.1.0.1"), []int{1}},
+		{params("host3", "rack=1,zone=dmz", "10.1.0.1"), []int{0, 1}},
+		{params("host3", "", "10.1.0.1"), nil},
+	} {
+		if order := osw.preferences(c.params, overlays); !reflect.DeepEqual(order, c.order) {
+			t.Errorf("%s: expected %v, got %v", c.params.RemotePeer.NickName, c.order, order)
+		}
+	}
+
+	if err := osw.SetPolicy(OverlayPolicy{Rules: []OverlayPolicyRule{{Overlays: []string{"vxlan"}}}}); err == nil {
+		t.Error("expected policy with an unknown overlay to be rejected")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/weaveworks/weave/mesh"
 )
@@ -18,10 +19,18 @@ type OverlaySwitch struct {
 	overlays      map[string]NetworkOverlay
 	overlayNames  []string
 	compatOverlay NetworkOverlay
+	labels        string
+
+	lock       sync.Mutex
+	policy     OverlayPolicy
+	forwarders map[*overlaySwitchForwarder]struct{}
 }
 
 func NewOverlaySwitch() *OverlaySwitch {
-	return &OverlaySwitch{overlays: make(map[string]NetworkOverlay)}
+	return &OverlaySwitch{
+		overlays:   make(map[string]NetworkOverlay),
+		forwarders: make(map[*overlaySwitchForwarder]struct{}),
+	}
 }
 
 func (osw *OverlaySwitch) Add(name string, overlay NetworkOverlay) {
@@ -40,6 +49,11 @@ func (osw *OverlaySwitch) SetCompatOverlay(overlay NetworkOverlay) {
 
 func (osw *OverlaySwitch) AddFeaturesTo(features map[string]string) {
 	features["Overlays"] = strings.Join(osw.overlayNames, " ")
+	features["OverlayProbing"] = "1"
+	features[networksFeature] = "1"
+	if osw.labels != "" {
+		features["Labels"] = osw.labels
+	}
 }
 
 func (osw *OverlaySwitch) Diagnostics() interface{} {
@@ -111,27 +125,78 @@ func (osw *OverlaySwitch) commonOverlays(params mesh.OverlayConnectionParams) ([
 	}
 
 	// we use bytes to represent forwarder indices in control
-	// messages, so just in case:
-	if len(res) > 256 {
-		res = res[:256]
+	// messages, with one reserved, so just in case:
+	if len(res) > switchControlIndex {
+		res = res[:switchControlIndex]
 	}
 
 	return res, nil
 }
 
+// Once a connection has fallen back from a preferred overlay, the
+// connecting end periodically asks the other end to start afresh
+// with that overlay, so that the connection can switch back to it
+// when it works again.  This takes a pair of control messages, which
+// are sent with the reserved forwarder index switchControlIndex:
+//
+//     switchProbe:    index, generation
+//     switchProbeAck: index, generation (or switchProbeNack)
+//
+// The connecting end prepares its new subsidiary forwarder before
+// sending switchProbe.  The other end replaces its forwarder for that
+// index, confirms it, and acknowledges.  Then the connecting end
+// confirms its new forwarder too, as when the connection started.
+
+const switchControlIndex = 255
+
+// Control messages for subforwarders are prefixed by their index and
+// tag
+const switchControlPrefixSize = 2
+
+const (
+	switchProbe = iota
+	switchProbeAck
+	switchProbeNack
+)
+
+const (
+	overlayProbeTick        = 10 * time.Second
+	overlayProbeInitialWait = 30 * time.Second
+	overlayProbeMaxWait     = 10 * time.Minute
+
+	maxSwitchEvents = 10
+)
+
 type overlaySwitchForwarder struct {
+	osw        *OverlaySwitch
 	remotePeer *mesh.Peer
+	params     mesh.OverlayConnectionParams
+
+	// should we probe for failed overlays?
+	probing bool
 
 	lock sync.Mutex
 
 	// the index of the forwarder to send on
 	best int
 
+	// the indices of the forwarders the overlay policy allows, most
+	// preferred first
+	order []int
+
 	// the subsidiary forwarders
 	forwarders []subForwarder
 
+	// channel to carry events from the subforwarder monitors to
+	// the main goroutine
+	eventsChan chan subForwarderEvent
+
 	// closed to tell the main goroutine to stop
 	stopChan chan<- struct{}
+	stopped  bool
+
+	// recent changes of the forwarder in use
+	events []switchEvent
 
 	alreadyEstablished bool
 	establishedChan    chan struct{}
@@ -141,6 +206,7 @@ type overlaySwitchForwarder struct {
 // A subsidiary forwarder
 type subForwarder struct {
 	fwd         OverlayForwarder
+	overlay     NetworkOverlay
 	overlayName string
 
 	// Has the forwarder signalled that it is established?
@@ -148,6 +214,18 @@ type subForwarder struct {
 
 	// closed to tell the forwarder monitor goroutine to stop
 	stopChan chan<- struct{}
+
+	// why the forwarder is not working
+	lastErr error
+
+	// A new forwarder, awaiting the other end's response to a
+	// probe
+	probeFwd OverlayForwarder
+	probeGen byte
+
+	// when to probe next, and how long to wait after that
+	probeAt   time.Time
+	probeWait time.Duration
 }
 
 // An event from a subsidiary forwarder
@@ -155,6 +233,9 @@ type subForwarderEvent struct {
 	// the index of the forwarder
 	index int
 
+	// the forwarder itself, since it may have been replaced
+	fwd OverlayForwarder
+
 	// is this an "established" event?
 	established bool
 
@@ -162,6 +243,13 @@ type subForwarderEvent struct {
 	err error
 }
 
+// A change of the forwarder in use
+type switchEvent struct {
+	Time    time.Time
+	Overlay string
+	Reason  string
+}
+
 func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
 	if _, present := params.Features["Overlays"]; !present && osw.compatOverlay != nil {
 		return osw.compatOverlay.PrepareConnection(params)
@@ -172,70 +260,159 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 		return nil, err
 	}
 
-	// channel to carry events from the subforwarder monitors to
-	// the main goroutine
-	eventsChan := make(chan subForwarderEvent)
-
 	// channel to stop the main goroutine
 	stopChan := make(chan struct{})
 
+	_, remoteProbes := params.Features["OverlayProbing"]
 	fwd := &overlaySwitchForwarder{
+		osw:        osw,
 		remotePeer: params.RemotePeer,
+		params:     params,
+		// only the connecting end probes, so that the two ends
+		// don't probe the same overlay at once
+		probing: remoteProbes && params.Outbound,
 
 		best:       -1,
 		forwarders: make([]subForwarder, len(overlays)),
+		eventsChan: make(chan subForwarderEvent),
 		stopChan:   stopChan,
 
 		establishedChan: make(chan struct{}),
 		errorChan:       make(chan error, 1),
 	}
 
-	origSendControlMessage := params.SendControlMessage
 	for i, overlay := range overlays {
-		// Prefix control messages to indicate the relevant forwarder
-		index := i
-		params.SendControlMessage = func(tag byte, msg []byte) error {
-			xmsg := make([]byte, len(msg)+2)
-			xmsg[0] = byte(index)
-			xmsg[1] = tag
-			copy(xmsg[2:], msg)
-			return origSendControlMessage(mesh.ProtocolOverlayControlMsg, xmsg)
+		fwd.forwarders[i] = subForwarder{
+			overlay:     overlay.NetworkOverlay,
+			overlayName: overlay.name,
+			probeWait:   overlayProbeInitialWait,
 		}
+	}
+	fwd.order = osw.preferences(params, fwd.overlayNames())
 
-		subConn, err := overlay.PrepareConnection(params)
+	for i, overlay := range overlays {
+		if !fwd.allowed(i) {
+			fwd.forwarders[i].lastErr = errOverlayNotAllowed
+			continue
+		}
+		subFwd, err := fwd.prepareSubForwarder(i)
 		if err != nil {
 			log.Infof("Unable to use %s for connection to %s(%s): %s",
 				overlay.name,
 				params.RemotePeer.Name,
 				params.RemotePeer.NickName,
 				err)
-			// failed to start subforwarder - record overlay name and continue
-			fwd.forwarders[i] = subForwarder{
-				overlayName: overlay.name,
-			}
+			// failed to start subforwarder - record the error and
+			// continue
+			fwd.forwarders[i].lastErr = err
+			fwd.forwarders[i].probeAt = time.Now().Add(overlayProbeInitialWait)
 			continue
 		}
-		subFwd := subConn.(OverlayForwarder)
+		fwd.startSubForwarder(i, subFwd)
+	}
 
-		subStopChan := make(chan struct{})
-		go monitorForwarder(i, eventsChan, subStopChan, subFwd)
-		fwd.forwarders[i] = subForwarder{
-			fwd:         subFwd,
-			overlayName: overlay.name,
-			stopChan:    subStopChan,
+	fwd.chooseBest("connection started")
+	osw.lock.Lock()
+	osw.forwarders[fwd] = struct{}{}
+	osw.lock.Unlock()
+	go fwd.run(stopChan)
+	return fwd, nil
+}
+
+var errOverlayNotAllowed = fmt.Errorf("not allowed by overlay policy")
+
+func (fwd *overlaySwitchForwarder) overlayNames() []string {
+	names := make([]string, len(fwd.forwarders))
+	for i, sub := range fwd.forwarders {
+		names[i] = sub.overlayName
+	}
+	return names
+}
+
+// Does the overlay policy allow the forwarder with the given index?
+// Must be called with the lock held, or before the forwarder is
+// shared
+func (fwd *overlaySwitchForwarder) allowed(index int) bool {
+	for _, i := range fwd.order {
+		if i == index {
+			return true
 		}
 	}
+	return false
+}
 
-	fwd.chooseBest()
-	go fwd.run(eventsChan, stopChan)
-	return fwd, nil
+// Apply a new order of preference, from a change of overlay policy
+func (fwd *overlaySwitchForwarder) setPreferences(order []int) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	if fwd.stopped {
+		return
+	}
+	fwd.order = order
+	now := time.Now()
+	for i := range fwd.forwarders {
+		sub := &fwd.forwarders[i]
+		switch {
+		case !fwd.allowed(i):
+			if sub.fwd != nil {
+				sub.fwd = nil
+				close(sub.stopChan)
+			}
+			if sub.probeFwd != nil {
+				sub.probeFwd.Stop()
+				sub.probeFwd = nil
+			}
+			sub.lastErr = errOverlayNotAllowed
+		case sub.lastErr == errOverlayNotAllowed:
+			// probe for it straight away
+			sub.lastErr = nil
+			sub.probeAt = now
+			sub.probeWait = overlayProbeInitialWait
+		}
+	}
+	fwd.chooseBest("overlay policy changed")
+}
+
+func (fwd *overlaySwitchForwarder) prepareSubForwarder(index int) (OverlayForwarder, error) {
+	params := fwd.params
+	// Prefix control messages to indicate the relevant forwarder
+	params.SendControlMessage = func(tag byte, msg []byte) error {
+		return fwd.sendControlMessage(byte(index), tag, msg)
+	}
+
+	subConn, err := fwd.forwarders[index].overlay.PrepareConnection(params)
+	if err != nil {
+		return nil, err
+	}
+	return subConn.(OverlayForwarder), nil
+}
+
+func (fwd *overlaySwitchForwarder) sendControlMessage(index byte, tag byte, msg []byte) error {
+	xmsg := make([]byte, len(msg)+switchControlPrefixSize)
+	xmsg[0] = index
+	xmsg[1] = tag
+	copy(xmsg[2:], msg)
+	return fwd.params.SendControlMessage(mesh.ProtocolOverlayControlMsg, xmsg)
+}
+
+// Must be called with the lock held, or before the forwarder is
+// shared
+func (fwd *overlaySwitchForwarder) startSubForwarder(index int, subFwd OverlayForwarder) {
+	subStopChan := make(chan struct{})
+	go monitorForwarder(index, fwd.eventsChan, subStopChan, subFwd)
+	sub := &fwd.forwarders[index]
+	sub.fwd = subFwd
+	sub.stopChan = subStopChan
+	sub.established = false
+	sub.lastErr = nil
 }
 
 func monitorForwarder(index int, eventsChan chan<- subForwarderEvent, stopChan <-chan struct{}, fwd OverlayForwarder) {
 	establishedChan := fwd.EstablishedChannel()
 loop:
 	for {
-		e := subForwarderEvent{index: index}
+		e := subForwarderEvent{index: index, fwd: fwd}
 
 		select {
 		case <-establishedChan:
@@ -263,20 +440,30 @@ loop:
 	fwd.Stop()
 }
 
-func (fwd *overlaySwitchForwarder) run(eventsChan <-chan subForwarderEvent, stopChan <-chan struct{}) {
+func (fwd *overlaySwitchForwarder) run(stopChan <-chan struct{}) {
+	var probeChan <-chan time.Time
+	if fwd.probing {
+		ticker := time.NewTicker(overlayProbeTick)
+		defer ticker.Stop()
+		probeChan = ticker.C
+	}
+
 loop:
 	for {
 		select {
 		case <-stopChan:
 			break loop
 
-		case e := <-eventsChan:
+		case e := <-fwd.eventsChan:
 			switch {
 			case e.established:
-				fwd.established(e.index)
+				fwd.established(e.index, e.fwd)
 			case e.err != nil:
-				fwd.error(e.index, e.err)
+				fwd.error(e.index, e.fwd, e.err)
 			}
+
+		case now := <-probeChan:
+			fwd.probe(now)
 		}
 	}
 
@@ -285,31 +472,44 @@ loop:
 	fwd.stopFrom(0)
 }
 
-func (fwd *overlaySwitchForwarder) established(index int) {
+func (fwd *overlaySwitchForwarder) established(index int, subFwd OverlayForwarder) {
 	fwd.lock.Lock()
 	defer fwd.lock.Unlock()
 
-	fwd.forwarders[index].established = true
+	sub := &fwd.forwarders[index]
+	if sub.fwd != subFwd {
+		// it has been replaced
+		return
+	}
+	sub.established = true
+	sub.probeWait = overlayProbeInitialWait
 
 	if !fwd.alreadyEstablished {
 		fwd.alreadyEstablished = true
 		close(fwd.establishedChan)
 	}
 
-	fwd.chooseBest()
+	fwd.chooseBest(sub.overlayName + " established")
 }
 
 func (fwd *overlaySwitchForwarder) logPrefix() string {
 	return fmt.Sprintf("overlay_switch ->[%s] ", fwd.remotePeer)
 }
 
-func (fwd *overlaySwitchForwarder) error(index int, err error) {
+func (fwd *overlaySwitchForwarder) error(index int, subFwd OverlayForwarder, err error) {
 	fwd.lock.Lock()
 	defer fwd.lock.Unlock()
 
-	log.Info(fwd.logPrefix(), fwd.forwarders[index].overlayName, " ", err)
-	fwd.forwarders[index].fwd = nil
-	fwd.chooseBest()
+	sub := &fwd.forwarders[index]
+	if sub.fwd != subFwd {
+		// it has been replaced
+		return
+	}
+	log.Info(fwd.logPrefix(), sub.overlayName, " ", err)
+	sub.fwd = nil
+	sub.lastErr = err
+	sub.probeAt = time.Now().Add(sub.probeWait)
+	fwd.chooseBest(fmt.Sprint(sub.overlayName, " failed: ", err))
 }
 
 func (fwd *overlaySwitchForwarder) stopFrom(index int) {
@@ -319,17 +519,21 @@ func (fwd *overlaySwitchForwarder) stopFrom(index int) {
 			subFwd.fwd = nil
 			close(subFwd.stopChan)
 		}
+		if subFwd.probeFwd != nil {
+			subFwd.probeFwd.Stop()
+			subFwd.probeFwd = nil
+		}
 		index++
 	}
 }
 
-func (fwd *overlaySwitchForwarder) chooseBest() {
+func (fwd *overlaySwitchForwarder) chooseBest(reason string) {
 	// the most preferred established forwarder is the best
 	// otherwise, the most preferred working forwarder is the best
 	bestEstablished := -1
 	bestWorking := -1
 
-	for i := range fwd.forwarders {
+	for _, i := range fwd.order {
 		subFwd := &fwd.forwarders[i]
 		if subFwd.fwd == nil {
 			continue
@@ -360,10 +564,141 @@ func (fwd *overlaySwitchForwarder) chooseBest() {
 
 	if fwd.best != best {
 		fwd.best = best
-		log.Info(fwd.logPrefix(), "using ", fwd.forwarders[best].overlayName)
+		overlayName := fwd.forwarders[best].overlayName
+		log.Info(fwd.logPrefix(), "using ", overlayName, " (", reason, ")")
+		if len(fwd.events) == maxSwitchEvents {
+			fwd.events = fwd.events[1:]
+		}
+		fwd.events = append(fwd.events, switchEvent{time.Now(), overlayName, reason})
+	}
+}
+
+// Probe any overlays more preferred than the one in use that have
+// failed, and are due another try.
+func (fwd *overlaySwitchForwarder) probe(now time.Time) {
+	fwd.lock.Lock()
+	var due []int
+	for _, i := range fwd.order {
+		if i == fwd.best {
+			break
+		}
+		sub := &fwd.forwarders[i]
+		if sub.fwd != nil || now.Before(sub.probeAt) {
+			continue
+		}
+		if sub.probeFwd != nil {
+			// The other end never answered; give up on it
+			sub.probeFwd.Stop()
+			sub.probeFwd = nil
+			sub.lastErr = fmt.Errorf("no response to probe")
+			fwd.backOff(sub, now)
+			continue
+		}
+		due = append(due, i)
+	}
+	fwd.lock.Unlock()
+
+	for _, i := range due {
+		subFwd, err := fwd.prepareSubForwarder(i)
+
+		fwd.lock.Lock()
+		sub := &fwd.forwarders[i]
+		if err != nil {
+			sub.lastErr = err
+			fwd.backOff(sub, now)
+			fwd.lock.Unlock()
+			continue
+		}
+		sub.probeGen++
+		sub.probeFwd = subFwd
+		gen := sub.probeGen
+		// give the other end until the next probe to answer
+		sub.probeAt = now.Add(sub.probeWait)
+		fwd.lock.Unlock()
+
+		log.Info(fwd.logPrefix(), "probing ", sub.overlayName)
+		if err := fwd.sendControlMessage(switchControlIndex, switchProbe, []byte{byte(i), gen}); err != nil {
+			return
+		}
+	}
+}
+
+// Must be called with the lock held
+func (fwd *overlaySwitchForwarder) backOff(sub *subForwarder, now time.Time) {
+	sub.probeAt = now.Add(sub.probeWait)
+	if sub.probeWait *= 2; sub.probeWait > overlayProbeMaxWait {
+		sub.probeWait = overlayProbeMaxWait
+	}
+}
+
+// Handle a control message addressed to the switch itself
+func (fwd *overlaySwitchForwarder) switchControlMessage(tag byte, msg []byte) {
+	if len(msg) != 2 || int(msg[0]) >= len(fwd.forwarders) {
+		log.Warning(fwd.logPrefix(), "ignoring malformed control message")
+		return
+	}
+	index, gen := int(msg[0]), msg[1]
+
+	switch tag {
+	case switchProbe:
+		fwd.probed(index, gen)
+
+	case switchProbeAck, switchProbeNack:
+		fwd.lock.Lock()
+		sub := &fwd.forwarders[index]
+		subFwd := sub.probeFwd
+		if subFwd == nil || gen != sub.probeGen {
+			// stale response
+			fwd.lock.Unlock()
+			return
+		}
+		sub.probeFwd = nil
+		if tag == switchProbeNack {
+			sub.lastErr = fmt.Errorf("peer unable to use %s", sub.overlayName)
+			fwd.backOff(sub, time.Now())
+			fwd.lock.Unlock()
+			subFwd.Stop()
+			return
+		}
+		fwd.startSubForwarder(index, subFwd)
+		fwd.lock.Unlock()
+		subFwd.Confirm()
+
+	default:
+		log.Warning(fwd.logPrefix(), "ignoring unknown control message tag: ", tag)
 	}
 }
 
+// The other end wants to try an overlay afresh
+func (fwd *overlaySwitchForwarder) probed(index int, gen byte) {
+	fwd.lock.Lock()
+	allowed := fwd.allowed(index)
+	fwd.lock.Unlock()
+	if !allowed {
+		fwd.sendControlMessage(switchControlIndex, switchProbeNack, []byte{byte(index), gen})
+		return
+	}
+
+	subFwd, err := fwd.prepareSubForwarder(index)
+	if err != nil {
+		log.Info(fwd.logPrefix(), "unable to use ", fwd.forwarders[index].overlayName, " when probed: ", err)
+		fwd.sendControlMessage(switchControlIndex, switchProbeNack, []byte{byte(index), gen})
+		return
+	}
+
+	fwd.lock.Lock()
+	sub := &fwd.forwarders[index]
+	if sub.fwd != nil {
+		close(sub.stopChan)
+	}
+	fwd.startSubForwarder(index, subFwd)
+	fwd.chooseBest(sub.overlayName + " restarted by peer")
+	fwd.lock.Unlock()
+
+	fwd.sendControlMessage(switchControlIndex, switchProbeAck, []byte{byte(index), gen})
+	subFwd.Confirm()
+}
+
 func (fwd *overlaySwitchForwarder) Confirm() {
 	var forwarders []OverlayForwarder
 
@@ -384,7 +719,12 @@ func (fwd *overlaySwitchForwarder) Forward(pk ForwardPacketKey) FlowOp {
 	fwd.lock.Lock()
 
 	if fwd.best >= 0 {
-		for i := fwd.best; i < len(fwd.forwarders); i++ {
+		// try the best forwarder, then the less preferred ones
+		order := fwd.order
+		for len(order) > 0 && order[0] != fwd.best {
+			order = order[1:]
+		}
+		for _, i := range order {
 			best := fwd.forwarders[i].fwd
 			if best != nil {
 				fwd.lock.Unlock()
@@ -410,14 +750,39 @@ func (fwd *overlaySwitchForwarder) ErrorChannel() <-chan error {
 }
 
 func (fwd *overlaySwitchForwarder) Stop() {
+	fwd.osw.lock.Lock()
+	delete(fwd.osw.forwarders, fwd)
+	fwd.osw.lock.Unlock()
+
 	fwd.lock.Lock()
 	defer fwd.lock.Unlock()
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
 	fwd.stopFrom(0)
 }
 
 func (fwd *overlaySwitchForwarder) ControlMessage(tag byte, msg []byte) {
+	if len(msg) < 2 {
+		return
+	}
+	if msg[0] == switchControlIndex {
+		fwd.switchControlMessage(msg[1], msg[2:])
+		return
+	}
+	if int(msg[0]) >= len(fwd.forwarders) {
+		return
+	}
+
 	fwd.lock.Lock()
-	subFwd := fwd.forwarders[msg[0]].fwd
+	sub := &fwd.forwarders[msg[0]]
+	subFwd := sub.fwd
+	if subFwd == nil {
+		// the other end may already be using the forwarder we are
+		// probing with
+		subFwd = sub.probeFwd
+	}
 	fwd.lock.Unlock()
 	if subFwd != nil {
 		subFwd.ControlMessage(msg[1], msg[2:])
@@ -439,3 +804,36 @@ func (fwd *overlaySwitchForwarder) DisplayName() string {
 
 	return "none"
 }
+
+func (fwd *overlaySwitchForwarder) Attrs() map[string]interface{} {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	overlays := make(map[string]string)
+	for _, sub := range fwd.forwarders {
+		state := "pending"
+		switch {
+		case sub.fwd != nil && sub.established:
+			state = "established"
+		case sub.probeFwd != nil:
+			state = "probing"
+		case sub.lastErr == errOverlayNotAllowed:
+			state = "not allowed"
+		case sub.fwd == nil && sub.lastErr != nil:
+			state = "failed: " + sub.lastErr.Error()
+		case sub.fwd == nil:
+			state = "failed"
+		}
+		overlays[sub.overlayName] = state
+	}
+
+	attrs := map[string]interface{}{
+		"overlays": overlays,
+		"events":   append([]switchEvent(nil), fwd.events...),
+	}
+	// Explain why we aren't using the most preferred overlay
+	if fwd.best >= 0 && len(fwd.order) > 0 && fwd.best != fwd.order[0] && len(fwd.events) > 0 {
+		attrs["fallback"] = fwd.events[len(fwd.events)-1].Reason
+	}
+	return attrs
+}
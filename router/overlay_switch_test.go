@@ -0,0 +1,182 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// An overlay whose forwarders are established as soon as they are
+// confirmed, and which can be made to refuse new connections
+type stubOverlay struct {
+	NullNetworkOverlay
+	sync.Mutex
+	name string
+	fail bool
+	fwds []*stubForwarder
+}
+
+func (overlay *stubOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if overlay.fail {
+		return nil, fmt.Errorf("%s unavailable", overlay.name)
+	}
+	fwd := &stubForwarder{name: overlay.name, establishedChan: make(chan struct{}), errorChan: make(chan error, 1)}
+	overlay.fwds = append(overlay.fwds, fwd)
+	return fwd, nil
+}
+
+func (overlay *stubOverlay) setFail(fail bool) {
+	overlay.Lock()
+	overlay.fail = fail
+	overlay.Unlock()
+}
+
+func (overlay *stubOverlay) prepared() []*stubForwarder {
+	overlay.Lock()
+	defer overlay.Unlock()
+	return append([]*stubForwarder(nil), overlay.fwds...)
+}
+
+type stubForwarder struct {
+	name            string
+	confirmOnce     sync.Once
+	establishedChan chan struct{}
+	errorChan       chan error
+}
+
+// Identifies the forwarder a frame was given to
+type stubFlowOp struct {
+	DiscardingFlowOp
+	overlay string
+}
+
+func (fwd *stubForwarder) Confirm() {
+	fwd.confirmOnce.Do(func() { close(fwd.establishedChan) })
+}
+
+func (fwd *stubForwarder) EstablishedChannel() <-chan struct{} { return fwd.establishedChan }
+func (fwd *stubForwarder) ErrorChannel() <-chan error          { return fwd.errorChan }
+func (fwd *stubForwarder) Stop()                               {}
+func (fwd *stubForwarder) ControlMessage(byte, []byte)         {}
+func (fwd *stubForwarder) DisplayName() string                 { return fwd.name }
+
+func (fwd *stubForwarder) Forward(ForwardPacketKey) FlowOp {
+	return stubFlowOp{overlay: fwd.name}
+}
+
+func newStubOverlaySwitch(names ...string) (*OverlaySwitch, map[string]*stubOverlay) {
+	osw := NewOverlaySwitch()
+	stubs := make(map[string]*stubOverlay)
+	for _, name := range names {
+		stubs[name] = &stubOverlay{name: name}
+		osw.Add(name, stubs[name])
+	}
+	return osw, stubs
+}
+
+// Connect two overlay switches, with control messages delivered
+// straight to the other end.  The first end is the connecting one.
+func connectOverlaySwitches(t *testing.T, osw, remoteOsw *OverlaySwitch) (*overlaySwitchForwarder, *overlaySwitchForwarder) {
+	peer := mesh.NewPeer(peerName(t, "00:00:00:00:00:01"), "", 0, 0, 0)
+	remotePeer := mesh.NewPeer(peerName(t, "00:00:00:00:00:02"), "", 0, 0, 0)
+	var fwd, remoteFwd *overlaySwitchForwarder
+	features := func(osw *OverlaySwitch) map[string]string {
+		features := make(map[string]string)
+		osw.AddFeaturesTo(features)
+		return features
+	}
+
+	conn, err := osw.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer:         remotePeer,
+		RemoteAddr:         &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: mesh.Port},
+		Outbound:           true,
+		Features:           features(remoteOsw),
+		SendControlMessage: func(tag byte, msg []byte) error { remoteFwd.ControlMessage(tag, msg); return nil },
+	})
+	require.NoError(t, err)
+	fwd = conn.(*overlaySwitchForwarder)
+	conn, err = remoteOsw.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer:         peer,
+		Features:           features(osw),
+		SendControlMessage: func(tag byte, msg []byte) error { fwd.ControlMessage(tag, msg); return nil },
+	})
+	require.NoError(t, err)
+	remoteFwd = conn.(*overlaySwitchForwarder)
+
+	fwd.Confirm()
+	remoteFwd.Confirm()
+	return fwd, remoteFwd
+}
+
+func waitForOverlay(t *testing.T, fwd *overlaySwitchForwarder, name string) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if op, ok := fwd.Forward(ForwardPacketKey{}).(stubFlowOp); ok && op.overlay == name {
+			return
+		}
+	}
+	require.FailNow(t, "switch not using "+name)
+}
+
+func TestOverlaySwitchOrdering(t *testing.T) {
+	osw, _ := newStubOverlaySwitch("fast", "slow")
+	remoteOsw, _ := newStubOverlaySwitch("slow", "fast")
+	fwd, remoteFwd := connectOverlaySwitches(t, osw, remoteOsw)
+	defer fwd.Stop()
+	defer remoteFwd.Stop()
+
+	// Both ends number their forwarders in the connecting end's
+	// order, so that the indices in control messages agree
+	require.Equal(t, []string{"fast", "slow"}, fwd.overlayNames())
+	require.Equal(t, []string{"fast", "slow"}, remoteFwd.overlayNames())
+}
+
+func TestOverlaySwitchFallbackAndProbe(t *testing.T) {
+	osw, stubs := newStubOverlaySwitch("fast", "slow")
+	remoteOsw, remoteStubs := newStubOverlaySwitch("fast", "slow")
+	fwd, remoteFwd := connectOverlaySwitches(t, osw, remoteOsw)
+	defer fwd.Stop()
+	defer remoteFwd.Stop()
+	require.True(t, fwd.probing, "connecting end probes")
+	require.False(t, remoteFwd.probing)
+	waitForOverlay(t, fwd, "fast")
+
+	// When the preferred overlay fails, we fall back
+	stubs["fast"].setFail(true)
+	stubs["fast"].prepared()[0].errorChan <- fmt.Errorf("stopped working")
+	waitForOverlay(t, fwd, "slow")
+
+	fast := func() subForwarder {
+		fwd.lock.Lock()
+		defer fwd.lock.Unlock()
+		return fwd.forwarders[0]
+	}
+	failedAt := fast().probeAt
+
+	// It isn't probed until it is due, and while it still fails,
+	// we back off
+	fwd.probe(failedAt.Add(-time.Second))
+	require.Len(t, stubs["fast"].prepared(), 1)
+	fwd.probe(failedAt)
+	require.Equal(t, failedAt.Add(overlayProbeInitialWait), fast().probeAt)
+	require.Equal(t, 2*overlayProbeInitialWait, fast().probeWait)
+	waitForOverlay(t, fwd, "slow")
+
+	// Once it works again, a probe restarts it at both ends, and
+	// we switch back
+	stubs["fast"].setFail(false)
+	fwd.probe(fast().probeAt)
+	require.Len(t, stubs["fast"].prepared(), 2)
+	require.Len(t, remoteStubs["fast"].prepared(), 2)
+	waitForOverlay(t, fwd, "fast")
+	waitForOverlay(t, remoteFwd, "fast")
+	require.Nil(t, fast().probeFwd)
+	require.Equal(t, overlayProbeInitialWait, fast().probeWait)
+}
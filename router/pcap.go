@@ -1,3 +1,8 @@
+// libpcap support is only built in with "-tags pcap", since it needs
+// cgo; otherwise AFPacket is the only Bridge.
+
+// +build pcap
+
 package router
 
 import (
@@ -36,6 +41,15 @@ func NewPcap(iface *net.Interface, bufSz int) (Bridge, error) {
 	return &Pcap{iface: iface, bufSz: bufSz, writeHandle: wh}, nil
 }
 
+// Release a bridge that was never started.  Once consuming packets,
+// a bridge stays open for the life of the router.
+func (p *Pcap) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.writeHandle.Close()
+	return nil
+}
+
 func (p *Pcap) StartConsumingPackets(consumer BridgeConsumer) error {
 	rh, err := newPcapHandle(p.iface.Name, true, 65535, p.bufSz)
 	if err != nil {
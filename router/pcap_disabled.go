@@ -0,0 +1,12 @@
+// +build !pcap
+
+package router
+
+import (
+	"fmt"
+	"net"
+)
+
+func NewPcap(iface *net.Interface, bufSz int) (Bridge, error) {
+	return nil, fmt.Errorf("built without libpcap support (build with -tags pcap); capture from %s with AF_PACKET instead", iface.Name)
+}
@@ -64,6 +64,8 @@ const (
 
 type SleeveOverlay struct {
 	localPort int
+	sockets   int
+	crypto    *cryptoWorkers
 
 	// These fields are set in StartConsumingPackets, and not
 	// subsequently modified
@@ -71,38 +73,21 @@ type SleeveOverlay struct {
 	localPeerBin []byte
 	consumer     OverlayConsumer
 	peers        *mesh.Peers
-	conn         *net.UDPConn
+	socks        []*sleeveSocket
 
 	lock       sync.Mutex
 	forwarders map[mesh.PeerName]*sleeveForwarder
 }
 
-func NewSleeveOverlay(localPort int) NetworkOverlay {
-	return &SleeveOverlay{localPort: localPort}
+// sockets is the number of UDP sockets to spread traffic across, and
+// cryptoWorkers the number of goroutines encrypting and decrypting
+// packets.
+func NewSleeveOverlay(localPort int, sockets int, cryptoWorkers int) NetworkOverlay {
+	return &SleeveOverlay{localPort: localPort, sockets: sockets, crypto: newCryptoWorkers(cryptoWorkers)}
 }
 
 func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
-	localAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", sleeve.localPort))
-	if err != nil {
-		return err
-	}
-
-	conn, err := net.ListenUDP("udp4", localAddr)
-	if err != nil {
-		return err
-	}
-
-	f, err := conn.File()
-	if err != nil {
-		return err
-	}
-
-	defer f.Close()
-	fd := int(f.Fd())
-
-	// This makes sure all packets we send out do not have DF set
-	// on them.
-	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
+	socks, err := openSleeveSockets(sleeve.localPort, sleeve.sockets)
 	if err != nil {
 		return err
 	}
@@ -111,7 +96,9 @@ func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *
 	defer sleeve.lock.Unlock()
 
 	if sleeve.localPeer != nil {
-		conn.Close()
+		for _, sock := range socks {
+			sock.close()
+		}
 		return fmt.Errorf("StartConsumingPackets already called")
 	}
 
@@ -119,9 +106,11 @@ func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *
 	sleeve.localPeerBin = localPeer.NameByte
 	sleeve.consumer = consumer
 	sleeve.peers = peers
-	sleeve.conn = conn
+	sleeve.socks = socks
 	sleeve.forwarders = make(map[mesh.PeerName]*sleeveForwarder)
-	go sleeve.readUDP()
+	for _, sock := range socks {
+		go sleeve.readUDP(sock)
+	}
 	return nil
 }
 
@@ -161,56 +150,110 @@ func (sleeve *SleeveOverlay) removeForwarder(peer mesh.PeerName, fwd *sleeveForw
 	}
 }
 
-func (sleeve *SleeveOverlay) readUDP() {
-	defer sleeve.conn.Close()
+// A received packet, on its way through decryption
+type receivedPacket struct {
+	sender *net.UDPAddr
+	fwd    *sleeveForwarder
+	packet []byte
+	nacl   *NaClDecryptor // if the packet is encrypted
+	opened openedPacket
+}
+
+func (sleeve *SleeveOverlay) readUDP(sock *sleeveSocket) {
+	defer sock.close()
 	dec := NewEthernetDecoder()
-	buf := make([]byte, MaxUDPPacketSize)
+	packets := make([]receivedPacket, sleeveBatchSize)
 
 	for {
-		n, sender, err := sleeve.conn.ReadFromUDP(buf)
-		if err == io.EOF {
+		count, err := sock.recvBatch()
+		switch {
+		case err == io.EOF || err == syscall.EBADF:
 			return
-		} else if err != nil {
-			log.Print("ignoring UDP read error ", err)
+		case err == syscall.EINTR:
 			continue
-		} else if n < NameSize {
-			log.Print("ignoring too short UDP packet from ", sender)
+		case err != nil:
+			log.Print("ignoring UDP read error ", err)
 			continue
 		}
 
-		fwdName := mesh.PeerNameFromBin(buf[:NameSize])
-		fwd := sleeve.lookupForwarder(fwdName)
-		if fwd == nil {
-			continue
+		batch := packets[:0]
+		for i := 0; i < count; i++ {
+			buf, sender := sock.received(i)
+			if p, ok := sleeve.receivePacket(buf, sender); ok {
+				batch = append(batch, p)
+			}
 		}
 
-		packet := make([]byte, n-NameSize)
-		copy(packet, buf[NameSize:n])
-
-		err = fwd.crypto.Dec.IterateFrames(packet,
-			func(src []byte, dst []byte, frame []byte) {
-				sleeve.handleFrame(sender, fwd, src, dst, frame, dec)
-			})
-		if err != nil {
-			// Errors during UDP packet decoding /
-			// processing are non-fatal. One common cause
-			// is that we receive and attempt to decrypt a
-			// "stray" packet. This can actually happen
-			// quite easily if there is some connection
-			// churn between two peers. After all, UDP
-			// isn't a connection-oriented protocol, yet
-			// we pretend it is.
-			//
-			// If anything really is seriously,
-			// unrecoverably amiss with a connection, that
-			// will typically result in missed heartbeats
-			// and the connection getting shut down
-			// because of that.
-			log.Print(fwd.logPrefixFor(sender), err)
+		// Decrypt the whole batch in parallel, then process the
+		// packets in order.
+		sleeve.crypto.parallel(len(batch), func(i int) {
+			if p := &batch[i]; p.nacl != nil {
+				p.opened = p.nacl.open(p.packet)
+			}
+		})
+		for i := range batch {
+			sleeve.handlePacket(&batch[i], dec)
+			batch[i] = receivedPacket{}
 		}
 	}
 }
 
+func (sleeve *SleeveOverlay) receivePacket(buf []byte, sender *net.UDPAddr) (receivedPacket, bool) {
+	if len(buf) < NameSize {
+		log.Print("ignoring too short UDP packet from ", sender)
+		return receivedPacket{}, false
+	}
+
+	fwdName := mesh.PeerNameFromBin(buf[:NameSize])
+	fwd := sleeve.lookupForwarder(fwdName)
+	if fwd == nil {
+		return receivedPacket{}, false
+	}
+
+	packet := make([]byte, len(buf)-NameSize)
+	copy(packet, buf[NameSize:])
+
+	p := receivedPacket{sender: sender, fwd: fwd, packet: packet}
+	p.nacl, _ = fwd.crypto.Dec.(*NaClDecryptor)
+	return p, true
+}
+
+func (sleeve *SleeveOverlay) handlePacket(p *receivedPacket, dec *EthernetDecoder) {
+	fwd, sender := p.fwd, p.sender
+	consumer := func(src []byte, dst []byte, frame []byte) {
+		sleeve.handleFrame(sender, fwd, src, dst, frame, dec)
+	}
+
+	// All of a peer's packets normally arrive on the same
+	// socket, but the decryptor must not be used concurrently
+	// regardless.
+	var err error
+	fwd.decLock.Lock()
+	if p.nacl != nil {
+		err = p.nacl.iterateOpened(p.opened, consumer)
+	} else {
+		err = fwd.crypto.Dec.IterateFrames(p.packet, consumer)
+	}
+	fwd.decLock.Unlock()
+	if err != nil {
+		// Errors during UDP packet decoding /
+		// processing are non-fatal. One common cause
+		// is that we receive and attempt to decrypt a
+		// "stray" packet. This can actually happen
+		// quite easily if there is some connection
+		// churn between two peers. After all, UDP
+		// isn't a connection-oriented protocol, yet
+		// we pretend it is.
+		//
+		// If anything really is seriously,
+		// unrecoverably amiss with a connection, that
+		// will typically result in missed heartbeats
+		// and the connection getting shut down
+		// because of that.
+		log.Print(fwd.logPrefixFor(sender), err)
+	}
+}
+
 func (sleeve *SleeveOverlay) handleFrame(sender *net.UDPAddr, fwd *sleeveForwarder, src []byte, dst []byte, frame []byte, dec *EthernetDecoder) {
 	dec.DecodeLayers(frame)
 	decodedLen := len(dec.decoded)
@@ -243,10 +286,16 @@ func (sleeve *SleeveOverlay) handleFrame(sender *net.UDPAddr, fwd *sleeveForward
 		return
 	}
 
-	sleeve.sendToConsumer(srcPeer, dstPeer, frame, dec)
+	network := DefaultNetwork
+	if fwd.networks && dec.Eth.EthernetType == networkTagEtherType && len(frame) >= EthernetOverhead+networkTagSize {
+		network, frame = untagFrame(frame)
+		dec.DecodeLayers(frame)
+	}
+
+	sleeve.sendToConsumer(srcPeer, dstPeer, network, frame, dec)
 }
 
-func (sleeve *SleeveOverlay) sendToConsumer(srcPeer, dstPeer *mesh.Peer, frame []byte, dec *EthernetDecoder) {
+func (sleeve *SleeveOverlay) sendToConsumer(srcPeer, dstPeer *mesh.Peer, network NetworkID, frame []byte, dec *EthernetDecoder) {
 	if sleeve.consumer == nil {
 		return
 	}
@@ -254,6 +303,7 @@ func (sleeve *SleeveOverlay) sendToConsumer(srcPeer, dstPeer *mesh.Peer, frame [
 	fop := sleeve.consumer(ForwardPacketKey{
 		SrcPeer:   srcPeer,
 		DstPeer:   dstPeer,
+		Network:   network,
 		PacketKey: dec.PacketKey(),
 	})
 	if fop != nil {
@@ -263,20 +313,7 @@ func (sleeve *SleeveOverlay) sendToConsumer(srcPeer, dstPeer *mesh.Peer, frame [
 
 type udpSender interface {
 	send([]byte, *net.UDPAddr) error
-}
-
-func (sleeve *SleeveOverlay) send(msg []byte, raddr *net.UDPAddr) error {
-	sleeve.lock.Lock()
-	conn := sleeve.conn
-	sleeve.lock.Unlock()
-
-	if conn == nil {
-		// Consume wasn't called yet
-		return nil
-	}
-
-	_, err := conn.WriteToUDP(msg, raddr)
-	return err
+	sendBatch([][]byte, *net.UDPAddr) error
 }
 
 type sleeveCrypto struct {
@@ -311,6 +348,7 @@ type sleeveForwarder struct {
 	remotePeerBin  []byte
 	sendControlMsg func(byte, []byte) error
 	connUID        uint64
+	networks       bool // whether the remote peer understands network tags
 
 	// Channels to communicate with the aggregator goroutine
 	aggregatorChan   chan<- aggregatorFrame
@@ -327,6 +365,7 @@ type sleeveForwarder struct {
 	// Explicitly locked state
 	lock       sync.RWMutex
 	remoteAddr *net.UDPAddr
+	decLock    sync.Mutex // held while decrypting
 
 	// These fields are accessed and updated independently, so no
 	// locking needed.
@@ -335,8 +374,11 @@ type sleeveForwarder struct {
 
 	// State only used within the forwarder goroutine
 	crypto     sleeveCrypto
+	sock       *sleeveSocket
 	senderDF   *udpSenderDF
+	batch      udpBatch
 	maxPayload int
+	tagBuf     []byte // for inserting network tags into frames
 
 	// How many bytes of overhead it takes to turn an IP packet on
 	// the overlay network into an encapsulated packet on the underlay
@@ -357,9 +399,18 @@ type sleeveForwarder struct {
 }
 
 type aggregatorFrame struct {
-	src   []byte
-	dst   []byte
-	frame []byte
+	src     []byte
+	dst     []byte
+	frame   []byte
+	tagged  bool // whether to insert a tag for network when sending
+	network NetworkID
+}
+
+func (frame aggregatorFrame) len() int {
+	if frame.tagged {
+		return len(frame.frame) + networkTagSize
+	}
+	return len(frame.frame)
 }
 
 // A "special" frame over UDP
@@ -395,6 +446,7 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		remotePeerBin:    params.RemotePeer.NameByte,
 		sendControlMsg:   params.SendControlMessage,
 		connUID:          params.ConnUID,
+		networks:         supportsNetworks(params.Features),
 		aggregatorChan:   aggChan,
 		aggregatorDFChan: aggDFChan,
 		specialChan:      specialChan,
@@ -406,6 +458,7 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		remoteAddr:       remoteAddr,
 		mtu:              DefaultMTU,
 		crypto:           crypto,
+		sock:             sleeve.socketFor(params.RemotePeer.Name),
 		maxPayload:       DefaultMTU - UDPOverhead,
 		overheadDF:       crypto.Overhead(),
 		senderDF:         newUDPSenderDF(params.LocalAddr.IP, sleeve.localPort),
@@ -449,6 +502,10 @@ type curriedForward struct {
 }
 
 func (fwd *sleeveForwarder) Forward(key ForwardPacketKey) FlowOp {
+	if key.Network != DefaultNetwork && !fwd.networks {
+		log.Debug(fwd.logPrefix(), "dropping frame for network ", key.Network, ", which the remote peer does not support")
+		return DiscardingFlowOp{}
+	}
 	return curriedForward{fwd: fwd, key: key}
 }
 
@@ -468,6 +525,19 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 	srcName := f.key.SrcPeer.NameByte
 	dstName := f.key.DstPeer.NameByte
 
+	// Frames on networks other than the default one carry a tag
+	// identifying the network.  Frames on the default network that
+	// happen to look like they have such a tag get tagged too, so
+	// that the receiver strips the right one.  The tag is inserted
+	// by the forwarder goroutine as it aggregates the frame.
+	tagged := f.key.Network != DefaultNetwork || (fwd.networks && dec.Eth.EthernetType == networkTagEtherType)
+	if tagged {
+		mtu -= networkTagSize
+	}
+	aggregate := func(ch chan<- aggregatorFrame, frame []byte) {
+		fwd.aggregate(ch, aggregatorFrame{srcName, dstName, frame, tagged, f.key.Network})
+	}
+
 	// We could use non-blocking channel sends here, i.e. drop frames
 	// on the floor when the forwarder is busy. This would allow our
 	// caller - the capturing loop in the router - to read frames more
@@ -480,7 +550,7 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 	// of our pipeline.
 	if dec.DF() {
 		if !frameTooBig(frame, mtu) {
-			fwd.aggregate(fwd.aggregatorDFChan, srcName, dstName, frame)
+			aggregate(fwd.aggregatorDFChan, frame)
 			return
 		}
 
@@ -505,19 +575,43 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 
 		// The frag-needed packet does not have DF set, so the
 		// potential recursion here is bounded.
-		fwd.sleeve.sendToConsumer(f.key.DstPeer, f.key.SrcPeer, fragNeededPacket, dec)
+		fwd.sleeve.sendToConsumer(f.key.DstPeer, f.key.SrcPeer, f.key.Network, fragNeededPacket, dec)
 		return
 	}
 
-	if stackFrag || len(dec.decoded) < 2 {
-		fwd.aggregate(fwd.aggregatorChan, srcName, dstName, frame)
+	// IPv6 packets are never fragmented on the way, so senders
+	// have to be told to send smaller ones.  Unless the MTU is below
+	// the IPv6 minimum, which they can't go under; then we leave it
+	// to the UDP stack to fragment.
+	if dec.isIPv6() && frameTooBig(frame, mtu) && mtu >= ipv6MinMTU {
+		if broadcast {
+			log.Print(fwd.logPrefix(), "dropping too big IPv6 broadcast frame (", dec.IPv6.SrcIP, " -> ", dec.IPv6.DstIP, "): MTU=", mtu)
+			return
+		}
+
+		packetTooBig, err := dec.makeICMPv6PacketTooBig(mtu)
+		if err != nil {
+			log.Print(fwd.logPrefix(), err)
+			return
+		}
+
+		dec.DecodeLayers(packetTooBig)
+
+		// The Packet Too Big message fits within the minimum
+		// IPv6 MTU, so the potential recursion here is bounded.
+		fwd.sleeve.sendToConsumer(f.key.DstPeer, f.key.SrcPeer, f.key.Network, packetTooBig, dec)
+		return
+	}
+
+	if stackFrag || !dec.isIPv4() {
+		aggregate(fwd.aggregatorChan, frame)
 		return
 	}
 
 	// Don't have trustworthy stack, so we're going to have to
 	// send it DF in any case.
 	if !frameTooBig(frame, mtu) {
-		fwd.aggregate(fwd.aggregatorDFChan, srcName, dstName, frame)
+		aggregate(fwd.aggregatorDFChan, frame)
 		return
 	}
 
@@ -526,13 +620,13 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 	// fragment it ourself.
 	checkWarn(fragment(dec.Eth, dec.IP, mtu,
 		func(segFrame []byte) {
-			fwd.aggregate(fwd.aggregatorDFChan, srcName, dstName, segFrame)
+			aggregate(fwd.aggregatorDFChan, segFrame)
 		}))
 }
 
-func (fwd *sleeveForwarder) aggregate(ch chan<- aggregatorFrame, src []byte, dst []byte, frame []byte) {
+func (fwd *sleeveForwarder) aggregate(ch chan<- aggregatorFrame, frame aggregatorFrame) {
 	select {
-	case ch <- aggregatorFrame{src, dst, frame}:
+	case ch <- frame:
 	case <-fwd.finishedChan:
 	}
 }
@@ -631,7 +725,7 @@ loop:
 	for err == nil {
 		select {
 		case frame := <-aggChan:
-			err = fwd.aggregateAndSend(frame, aggChan, fwd.crypto.Enc, fwd.sleeve, MaxUDPPacketSize-UDPOverhead)
+			err = fwd.aggregateAndSend(frame, aggChan, fwd.crypto.Enc, fwd.sock, MaxUDPPacketSize-UDPOverhead)
 
 		case frame := <-aggDFChan:
 			err = fwd.aggregateAndSend(frame, aggDFChan, fwd.crypto.EncDF, fwd.senderDF, fwd.maxPayload)
@@ -688,6 +782,16 @@ loop:
 }
 
 func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-chan aggregatorFrame, enc Encryptor, sender udpSender, limit int) error {
+	err := fwd.aggregateBatch(frame, aggChan, enc, sender, limit)
+	if flushErr := fwd.flushBatch(sender); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// Encrypt frames into UDP packets, and those into a batch to be sent
+// by the caller.
+func (fwd *sleeveForwarder) aggregateBatch(frame aggregatorFrame, aggChan <-chan aggregatorFrame, enc Encryptor, sender udpSender, limit int) error {
 	// Give up after processing N frames, to avoid starving the
 	// other activities of the forwarder goroutine.
 	i := 0
@@ -695,12 +799,17 @@ func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-ch
 	for {
 		// Adding the first frame to an empty buffer
 		if !fits(frame, enc, limit) {
-			log.Print(fwd.logPrefix(), "Dropping too big frame during forwarding: frame len ", len(frame.frame), ", limit ", limit)
+			log.Print(fwd.logPrefix(), "Dropping too big frame during forwarding: frame len ", frame.len(), ", limit ", limit)
 			return nil
 		}
 
 		for {
-			enc.AppendFrame(frame.src, frame.dst, frame.frame)
+			if frame.tagged {
+				fwd.tagBuf = tagFrame(frame.network, frame.frame, fwd.tagBuf)
+				enc.AppendFrame(frame.src, frame.dst, fwd.tagBuf)
+			} else {
+				enc.AppendFrame(frame.src, frame.dst, frame.frame)
+			}
 			i++
 
 			gotOne := false
@@ -713,7 +822,7 @@ func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-ch
 			}
 
 			if !gotOne {
-				return fwd.flushEncryptor(enc, sender)
+				return fwd.batchEncryptor(enc, sender)
 			}
 
 			// Accumulate frames until doing so would
@@ -727,28 +836,47 @@ func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-ch
 			}
 		}
 
-		if err := fwd.flushEncryptor(enc, sender); err != nil {
+		if err := fwd.batchEncryptor(enc, sender); err != nil {
 			return err
 		}
 	}
 }
 
 func fits(frame aggregatorFrame, enc Encryptor, limit int) bool {
-	return enc.TotalLen()+enc.FrameOverhead()+len(frame.frame) <= limit
+	return enc.TotalLen()+enc.FrameOverhead()+frame.len() <= limit
 }
 
-func (fwd *sleeveForwarder) flushEncryptor(enc Encryptor, sender udpSender) error {
-	msg, err := enc.Bytes()
-	if err != nil {
-		return err
+func (fwd *sleeveForwarder) batchEncryptor(enc Encryptor, sender udpSender) error {
+	if nacl, ok := enc.(*NaClEncryptor); ok && fwd.sleeve.crypto != nil {
+		if err := fwd.batch.addDeferred(nacl); err != nil {
+			return err
+		}
+	} else {
+		msg, err := enc.Bytes()
+		if err != nil {
+			return err
+		}
+		fwd.batch.add(msg)
 	}
 
-	return fwd.processSendError(sender.send(msg, fwd.remoteAddr))
+	if fwd.batch.full() {
+		return fwd.flushBatch(sender)
+	}
+	return nil
+}
+
+func (fwd *sleeveForwarder) flushBatch(sender udpSender) error {
+	return fwd.processSendError(fwd.batch.flush(sender, fwd.remoteAddr, fwd.sleeve.crypto))
 }
 
 func (fwd *sleeveForwarder) sendSpecial(enc Encryptor, sender udpSender, data []byte) error {
 	enc.AppendFrame(fwd.sleeve.localPeerBin, fwd.remotePeerBin, data)
-	return fwd.flushEncryptor(enc, sender)
+	msg, err := enc.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return fwd.processSendError(sender.send(msg, fwd.remoteAddr))
 }
 
 func (fwd *sleeveForwarder) handleSpecialFrame(special specialFrame) error {
@@ -893,7 +1021,7 @@ func (fwd *sleeveForwarder) handleHeartbeatAck() error {
 func (fwd *sleeveForwarder) sendFragTest() error {
 	log.Debug(fwd.logPrefix(), "sendFragTest")
 	fwd.stackFrag = false
-	return fwd.sendSpecial(fwd.crypto.Enc, fwd.sleeve, make([]byte, FragTestSize))
+	return fwd.sendSpecial(fwd.crypto.Enc, fwd.sock, make([]byte, FragTestSize))
 }
 
 func (fwd *sleeveForwarder) handleFragTest(frame []byte) error {
@@ -1004,6 +1132,8 @@ type udpSenderDF struct {
 	localIP   net.IP
 	remoteIP  net.IP
 	socket    *net.IPConn
+	file      *os.File // for the socket's fd
+	batch     udpBatch // of serialized IP payloads
 }
 
 func newUDPSenderDF(localIP net.IP, localPort int) *udpSenderDF {
@@ -1024,36 +1154,41 @@ func newUDPSenderDF(localIP net.IP, localPort int) *udpSenderDF {
 }
 
 func (sender *udpSenderDF) dial() error {
-	if sender.socket != nil {
-		if err := sender.socket.Close(); err != nil {
-			return err
-		}
-
-		sender.socket = nil
+	if err := sender.close(); err != nil {
+		return err
 	}
 
 	laddr := &net.IPAddr{IP: sender.localIP}
 	raddr := &net.IPAddr{IP: sender.remoteIP}
 	s, err := net.DialIP("ip4:UDP", laddr, raddr)
+	if err != nil {
+		return err
+	}
 
 	f, err := s.File()
 	if err != nil {
+		s.Close()
 		return err
 	}
 
-	defer f.Close()
-
 	// This makes sure all packets we send out have DF set on them.
 	err = syscall.SetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
 	if err != nil {
+		f.Close()
+		s.Close()
 		return err
 	}
 
 	sender.socket = s
+	sender.file = f
 	return nil
 }
 
 func (sender *udpSenderDF) send(msg []byte, raddr *net.UDPAddr) error {
+	return sender.sendBatch([][]byte{msg}, raddr)
+}
+
+func (sender *udpSenderDF) sendBatch(msgs [][]byte, raddr *net.UDPAddr) error {
 	// Ensure we have a socket sending to the right IP address
 	if sender.socket == nil || !bytes.Equal(sender.remoteIP, raddr.IP) {
 		sender.remoteIP = raddr.IP
@@ -1063,26 +1198,34 @@ func (sender *udpSenderDF) send(msg []byte, raddr *net.UDPAddr) error {
 	}
 
 	sender.udpHeader.DstPort = layers.UDPPort(raddr.Port)
-	payload := gopacket.Payload(msg)
-	err := gopacket.SerializeLayers(sender.ipBuf, sender.opts, sender.udpHeader, &payload)
-	if err != nil {
-		return err
+	for _, msg := range msgs {
+		payload := gopacket.Payload(msg)
+		err := gopacket.SerializeLayers(sender.ipBuf, sender.opts, sender.udpHeader, &payload)
+		if err != nil {
+			sender.batch.msgs = sender.batch.msgs[:0]
+			return err
+		}
+		sender.batch.add(sender.ipBuf.Bytes())
 	}
 
-	packet := sender.ipBuf.Bytes()
-	_, err = sender.socket.Write(packet)
-	if err == nil || PosixError(err) != syscall.EMSGSIZE {
-		return err
+	var err error
+	packets := sender.batch.msgs
+	sender.batch.msgs = sender.batch.msgs[:0]
+	if mmsgSupported && len(packets) > 1 {
+		err = sendmmsg(int(sender.file.Fd()), packets, nil, 0)
+	} else {
+		for _, packet := range packets {
+			if _, err = sender.socket.Write(packet); err != nil {
+				break
+			}
+		}
 	}
-
-	f, err := sender.socket.File()
-	if err != nil {
+	if err == nil || PosixError(err) != syscall.EMSGSIZE {
 		return err
 	}
-	defer f.Close()
 
-	log.Print("EMSGSIZE on send, expecting PMTU update (IP packet was ", len(packet), " bytes, payload was ", len(msg), " bytes)")
-	pmtu, err := syscall.GetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU)
+	log.Print("EMSGSIZE on send, expecting PMTU update")
+	pmtu, err := syscall.GetsockoptInt(int(sender.file.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU)
 	if err != nil {
 		return err
 	}
@@ -1103,7 +1246,11 @@ func (sender *udpSenderDF) close() error {
 		return nil
 	}
 
-	return sender.socket.Close()
+	sender.file.Close()
+	err := sender.socket.Close()
+	sender.socket = nil
+	sender.file = nil
+	return err
 }
 
 func udpAddrsEqual(a *net.UDPAddr, b *net.UDPAddr) bool {
@@ -0,0 +1,317 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// Sleeve moves its UDP traffic through several sockets bound to the
+// same port with SO_REUSEPORT, each read by its own goroutine, and
+// reads and writes batches of datagrams with recvmmsg and sendmmsg.
+//
+// Ordering matters to the encrypted sleeve protocol (the decryptors
+// only accept sequence numbers within a sliding window), and to the
+// frames it carries.  So each forwarder sends everything through the
+// one socket, from its own goroutine.  On the receiving side, the
+// kernel spreads datagrams across the sockets by hashing their
+// addresses and ports, and all the datagrams from a remote peer have
+// the same ones, so they are all read by the same goroutine.
+
+const (
+	sleeveBatchSize = 32 // datagrams per recvmmsg/sendmmsg
+	soReusePort     = 15 // SO_REUSEPORT
+	msgWaitForOne   = 0x10000
+)
+
+// struct mmsghdr.  Go pads it out to the alignment of Msghdr, just as
+// C does, so it has the right size on 32-bit and 64-bit platforms
+// alike.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+type sleeveSocket struct {
+	fd   int
+	file *os.File // keeps fd open
+	shut int32    // set atomically by shutdown
+
+	// State used only by the socket's reader goroutine
+	bufs   [][]byte
+	addrs  []syscall.RawSockaddrInet4
+	iovecs []syscall.Iovec
+	msgs   []mmsghdr
+}
+
+func openSleeveSockets(port int, count int) ([]*sleeveSocket, error) {
+	if count < 1 {
+		count = 1
+	}
+	var socks []*sleeveSocket
+	for i := 0; i < count; i++ {
+		sock, err := openSleeveSocket(port, count > 1)
+		if err != nil && i == 0 && count > 1 {
+			log.Warning("Unable to use several sleeve sockets (", err, "); using just one")
+			sock, err = openSleeveSocket(port, false)
+			count = 1
+		}
+		if err != nil {
+			for _, sock := range socks {
+				sock.close()
+			}
+			return nil, err
+		}
+		socks = append(socks, sock)
+	}
+	return socks, nil
+}
+
+func openSleeveSocket(port int, reusePort bool) (*sleeveSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	sock := &sleeveSocket{fd: fd, file: os.NewFile(uintptr(fd), fmt.Sprint("sleeve:", port))}
+	if reusePort {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			sock.close()
+			return nil, err
+		}
+	}
+	// This makes sure all packets we send out do not have DF set
+	// on them.
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT); err != nil {
+		sock.close()
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: port}); err != nil {
+		sock.close()
+		return nil, err
+	}
+
+	sock.bufs = make([][]byte, sleeveBatchSize)
+	sock.addrs = make([]syscall.RawSockaddrInet4, sleeveBatchSize)
+	sock.iovecs = make([]syscall.Iovec, sleeveBatchSize)
+	sock.msgs = make([]mmsghdr, sleeveBatchSize)
+	for i := range sock.msgs {
+		sock.bufs[i] = make([]byte, MaxUDPPacketSize)
+		sock.iovecs[i].Base = &sock.bufs[i][0]
+		sock.iovecs[i].SetLen(MaxUDPPacketSize)
+		sock.msgs[i].hdr.Iov = &sock.iovecs[i]
+		sock.msgs[i].hdr.Iovlen = 1
+		sock.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&sock.addrs[i]))
+	}
+	return sock, nil
+}
+
+// Closing the socket doesn't wake up a goroutine blocked in
+// recvBatch, and could let the fd be reused under its feet, so the
+// goroutine reading the socket should close it, once this has made
+// recvBatch return io.EOF.
+func (sock *sleeveSocket) shutdown() error {
+	atomic.StoreInt32(&sock.shut, 1)
+	// An unconnected UDP socket reports ENOTCONN, but its readers
+	// are woken up all the same.
+	if err := syscall.Shutdown(sock.fd, syscall.SHUT_RD); err != nil && err != syscall.ENOTCONN {
+		return err
+	}
+	return nil
+}
+
+func (sock *sleeveSocket) close() error {
+	return sock.file.Close()
+}
+
+// Block until at least one datagram arrives, then return as many as
+// are available, up to the batch size.  The datagrams remain valid
+// until the next call.
+func (sock *sleeveSocket) recvBatch() (int, error) {
+	if atomic.LoadInt32(&sock.shut) != 0 {
+		return 0, io.EOF
+	}
+	for i := range sock.msgs {
+		sock.msgs[i].hdr.Namelen = syscall.SizeofSockaddrInet4
+	}
+	if !mmsgSupported {
+		n, _, errno := syscall.Syscall6(syscall.SYS_RECVFROM, uintptr(sock.fd),
+			uintptr(unsafe.Pointer(&sock.bufs[0][0])), MaxUDPPacketSize, 0,
+			uintptr(unsafe.Pointer(&sock.addrs[0])), uintptr(unsafe.Pointer(&sock.msgs[0].hdr.Namelen)))
+		// A shut down socket reads as an empty datagram
+		if atomic.LoadInt32(&sock.shut) != 0 {
+			return 0, io.EOF
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		sock.msgs[0].len = uint32(n)
+		return 1, nil
+	}
+	n, _, errno := syscall.Syscall6(sysRecvmmsg, uintptr(sock.fd),
+		uintptr(unsafe.Pointer(&sock.msgs[0])), sleeveBatchSize, msgWaitForOne, 0, 0)
+	if atomic.LoadInt32(&sock.shut) != 0 {
+		return 0, io.EOF
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// The i'th datagram of the last batch received, and its sender
+func (sock *sleeveSocket) received(i int) ([]byte, *net.UDPAddr) {
+	addr := &sock.addrs[i]
+	port := (*[2]byte)(unsafe.Pointer(&addr.Port))
+	sender := &net.UDPAddr{
+		IP:   net.IPv4(addr.Addr[0], addr.Addr[1], addr.Addr[2], addr.Addr[3]),
+		Port: int(port[0])<<8 | int(port[1])}
+	return sock.bufs[i][:sock.msgs[i].len], sender
+}
+
+func (sock *sleeveSocket) send(msg []byte, raddr *net.UDPAddr) error {
+	if sock == nil {
+		// Consume wasn't called yet
+		return nil
+	}
+	return syscall.Sendto(sock.fd, msg, 0, udpSockaddr(raddr))
+}
+
+func (sock *sleeveSocket) sendBatch(msgs [][]byte, raddr *net.UDPAddr) error {
+	if sock == nil {
+		// Consume wasn't called yet
+		return nil
+	}
+	if !mmsgSupported || len(msgs) == 1 {
+		for _, msg := range msgs {
+			if err := sock.send(msg, raddr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var addr syscall.RawSockaddrInet4
+	addr.Family = syscall.AF_INET
+	port := (*[2]byte)(unsafe.Pointer(&addr.Port))
+	port[0], port[1] = byte(raddr.Port>>8), byte(raddr.Port)
+	copy(addr.Addr[:], raddr.IP.To4())
+	return sendmmsg(sock.fd, msgs, (*byte)(unsafe.Pointer(&addr)), syscall.SizeofSockaddrInet4)
+}
+
+// Send all of msgs on fd, stopping at the first error.  name may be
+// nil for connected sockets.
+func sendmmsg(fd int, msgs [][]byte, name *byte, namelen uint32) error {
+	iovecs := make([]syscall.Iovec, len(msgs))
+	hdrs := make([]mmsghdr, len(msgs))
+	for i, msg := range msgs {
+		iovecs[i].Base = &msg[0]
+		iovecs[i].SetLen(len(msg))
+		hdrs[i].hdr.Iov = &iovecs[i]
+		hdrs[i].hdr.Iovlen = 1
+		hdrs[i].hdr.Name = name
+		hdrs[i].hdr.Namelen = namelen
+	}
+	for sent := 0; sent < len(hdrs); {
+		n, _, errno := syscall.Syscall6(sysSendmmsg, uintptr(fd),
+			uintptr(unsafe.Pointer(&hdrs[sent])), uintptr(len(hdrs)-sent), 0, 0, 0)
+		switch {
+		case errno == syscall.EINTR:
+			continue
+		case errno != 0:
+			return errno
+		}
+		sent += int(n)
+	}
+	return nil
+}
+
+func udpSockaddr(addr *net.UDPAddr) syscall.Sockaddr {
+	sa := &syscall.SockaddrInet4{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To4())
+	return sa
+}
+
+// Each forwarder sticks to one socket, so that its datagrams go out
+// in order.  Before StartConsumingPackets there are no sockets, and
+// the nil socket returned drops everything sent to it.
+func (sleeve *SleeveOverlay) socketFor(peer mesh.PeerName) *sleeveSocket {
+	sleeve.lock.Lock()
+	socks := sleeve.socks
+	sleeve.lock.Unlock()
+
+	switch len(socks) {
+	case 0:
+		return nil
+	case 1:
+		return socks[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(peer.String()))
+	return socks[hash.Sum32()%uint32(len(socks))]
+}
+
+// Datagrams accumulated by a forwarder so they can be sent with a
+// single system call.  The encryptors reuse their buffers, so
+// messages are copied in.  Encryption can be deferred until the
+// batch is sent, so that it can be done in parallel.
+type udpBatch struct {
+	bufs     [][]byte
+	msgs     [][]byte // nil where sealing is deferred
+	seals    []deferredSeal
+	deferred bool
+}
+
+func (batch *udpBatch) add(msg []byte) {
+	i := len(batch.msgs)
+	for len(batch.bufs) <= i {
+		batch.bufs = append(batch.bufs, nil)
+	}
+	batch.bufs[i] = append(batch.bufs[i][:0], msg...)
+	batch.msgs = append(batch.msgs, batch.bufs[i])
+}
+
+func (batch *udpBatch) addDeferred(enc *NaClEncryptor) error {
+	i := len(batch.msgs)
+	for len(batch.seals) <= i {
+		batch.seals = append(batch.seals, deferredSeal{})
+	}
+	if err := enc.BytesDeferred(&batch.seals[i]); err != nil {
+		return err
+	}
+	batch.msgs = append(batch.msgs, nil)
+	batch.deferred = true
+	return nil
+}
+
+func (batch *udpBatch) full() bool {
+	return len(batch.msgs) >= sleeveBatchSize
+}
+
+func (batch *udpBatch) flush(sender udpSender, raddr *net.UDPAddr, workers *cryptoWorkers) error {
+	if len(batch.msgs) == 0 {
+		return nil
+	}
+	if batch.deferred {
+		msgs := batch.msgs
+		workers.parallel(len(msgs), func(i int) {
+			if msgs[i] == nil {
+				batch.seals[i].seal()
+			}
+		})
+		for i, msg := range msgs {
+			if msg == nil {
+				msgs[i] = batch.seals[i].msg
+			}
+		}
+		batch.deferred = false
+	}
+	err := sender.sendBatch(batch.msgs, raddr)
+	batch.msgs = batch.msgs[:0]
+	return err
+}
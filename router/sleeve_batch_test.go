@@ -0,0 +1,193 @@
+package router
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+const benchmarkDatagramSize = 1400
+
+func openTestSockets(t *testing.T) (*sleeveSocket, *sleeveSocket, *net.UDPAddr) {
+	recv, err := openSleeveSocket(0, false)
+	require.NoError(t, err)
+	send, err := openSleeveSocket(0, false)
+	require.NoError(t, err)
+	sa, err := syscall.Getsockname(recv.fd)
+	require.NoError(t, err)
+	return recv, send, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*syscall.SockaddrInet4).Port}
+}
+
+func TestMmsghdrSize(t *testing.T) {
+	// As the kernel lays out struct mmsghdr
+	align := unsafe.Alignof(syscall.Msghdr{})
+	size := (unsafe.Sizeof(syscall.Msghdr{}) + 4 + align - 1) &^ (align - 1)
+	require.Equal(t, size, unsafe.Sizeof(mmsghdr{}))
+}
+
+func TestSleeveBatchLoopback(t *testing.T) {
+	recv, send, raddr := openTestSockets(t)
+	defer recv.close()
+	defer send.close()
+	sa, err := syscall.Getsockname(send.fd)
+	require.NoError(t, err)
+	sendPort := sa.(*syscall.SockaddrInet4).Port
+
+	// Datagrams of different sizes and contents
+	msgs := make([][]byte, sleeveBatchSize)
+	for i := range msgs {
+		msgs[i] = bytes.Repeat([]byte{byte(i)}, 1+i*40)
+	}
+	require.NoError(t, send.sendBatch(msgs, raddr))
+
+	var received [][]byte
+	for len(received) < len(msgs) {
+		n, err := recv.recvBatch()
+		require.NoError(t, err)
+		for i := 0; i < n; i++ {
+			buf, sender := recv.received(i)
+			require.Equal(t, "127.0.0.1", sender.IP.String())
+			require.Equal(t, sendPort, sender.Port)
+			received = append(received, append([]byte{}, buf...))
+		}
+	}
+	require.Equal(t, msgs, received)
+}
+
+func TestSleeveSocketShutdown(t *testing.T) {
+	recv, send, _ := openTestSockets(t)
+	send.close()
+
+	done := make(chan error)
+	go func() {
+		defer recv.close()
+		_, err := recv.recvBatch()
+		done <- err
+	}()
+	// Give the reader a chance to block
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, recv.shutdown())
+	select {
+	case err := <-done:
+		require.Equal(t, io.EOF, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "reader not woken by shutdown")
+	}
+}
+
+func TestSleeveSocketBeforeStart(t *testing.T) {
+	sleeve := &SleeveOverlay{}
+	sock := sleeve.socketFor(peerName(t, "00:00:00:00:00:02"))
+	require.Nil(t, sock)
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6783}
+	require.NoError(t, sock.send([]byte("hello"), raddr), "dropped")
+	require.NoError(t, sock.sendBatch(makeBenchmarkBatch(2), raddr), "dropped")
+}
+
+func openBenchmarkSockets(b *testing.B) (*sleeveSocket, *sleeveSocket, *net.UDPAddr) {
+	recv, err := openSleeveSocket(0, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	send, err := openSleeveSocket(0, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(recv.fd)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return recv, send, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*syscall.SockaddrInet4).Port}
+}
+
+func makeBenchmarkBatch(size int) [][]byte {
+	msgs := make([][]byte, size)
+	for i := range msgs {
+		msgs[i] = make([]byte, benchmarkDatagramSize)
+	}
+	return msgs
+}
+
+// Keep reading from sock until it is shut down, then close it
+func drain(sock *sleeveSocket) {
+	defer sock.close()
+	for {
+		if _, err := sock.recvBatch(); err != nil && err != syscall.EINTR {
+			return
+		}
+	}
+}
+
+func benchmarkSend(b *testing.B, batchSize int) {
+	recv, send, raddr := openBenchmarkSockets(b)
+	defer send.close()
+	go drain(recv)
+	defer recv.shutdown()
+
+	msgs := makeBenchmarkBatch(batchSize)
+	b.SetBytes(benchmarkDatagramSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		n := batchSize
+		if b.N-i < n {
+			n = b.N - i
+		}
+		if err := send.sendBatch(msgs[:n], raddr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSleeveSendSingle(b *testing.B) {
+	benchmarkSend(b, 1)
+}
+
+func BenchmarkSleeveSendBatch(b *testing.B) {
+	benchmarkSend(b, sleeveBatchSize)
+}
+
+func benchmarkRecv(b *testing.B, recvBatch func(*sleeveSocket) (int, error)) {
+	recv, send, raddr := openBenchmarkSockets(b)
+	defer recv.close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer send.close()
+		msgs := makeBenchmarkBatch(sleeveBatchSize)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				send.sendBatch(msgs, raddr)
+			}
+		}
+	}()
+
+	b.SetBytes(benchmarkDatagramSize)
+	b.ResetTimer()
+	for received := 0; received < b.N; {
+		n, err := recvBatch(recv)
+		if err != nil {
+			b.Fatal(err)
+		}
+		received += n
+	}
+}
+
+func BenchmarkSleeveRecvSingle(b *testing.B) {
+	benchmarkRecv(b, func(sock *sleeveSocket) (int, error) {
+		_, _, err := syscall.Recvfrom(sock.fd, sock.bufs[0], 0)
+		return 1, err
+	})
+}
+
+func BenchmarkSleeveRecvBatch(b *testing.B) {
+	benchmarkRecv(b, (*sleeveSocket).recvBatch)
+}
@@ -0,0 +1,7 @@
+package router
+
+const (
+	mmsgSupported = true
+	sysRecvmmsg   = 243
+	sysSendmmsg   = 269
+)
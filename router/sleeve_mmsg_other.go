@@ -0,0 +1,11 @@
+// +build !amd64,!arm64
+
+package router
+
+// recvmmsg and sendmmsg aren't used on other platforms; sleeve
+// sends and receives one datagram per system call instead.
+const (
+	mmsgSupported = false
+	sysRecvmmsg   = 0
+	sysSendmmsg   = 0
+)
@@ -0,0 +1,311 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Source address anti-spoofing: local containers may only send from
+// the IP addresses that IPAM has allocated to them.  Each container
+// is bound to the MAC of its weave interface, which we look up rather
+// than take from its traffic, so that the first frame seen can't
+// claim it.  Frames from a container's addresses must carry its MAC,
+// and frames from its MAC must carry its addresses.  ARP packets are
+// held to the same rules, so containers cannot claim addresses that
+// aren't theirs, and other peers cannot take over the MACs of local
+// containers.
+//
+// IPAM only allocates IPv4 addresses, so the sources of IPv6 frames
+// are not checked.  Only frames which reach the router are checked,
+// which excludes traffic between containers on the same host.
+
+type SourceGuardMode int
+
+const (
+	SourceGuardOff     SourceGuardMode = iota
+	SourceGuardLog                     // report violations, but let the frames through
+	SourceGuardEnforce                 // report violations and drop the frames
+
+	sourceGuardRecentViolations = 20
+	sourceGuardLogInterval      = time.Minute
+	sourceGuardLookupInterval   = time.Second // between lookups of one container's MAC
+)
+
+// Finds the MAC that a container (or anything else IPAM allocates
+// to) sends from, given one of its addresses.  Containers that get
+// their address by DHCP are known to IPAM by their MAC, and need no
+// lookup.
+type SourceMACLookup func(ident string, addr address.Address) (MAC, error)
+
+func ParseSourceGuardMode(s string) (SourceGuardMode, error) {
+	switch s {
+	case "off", "":
+		return SourceGuardOff, nil
+	case "log":
+		return SourceGuardLog, nil
+	case "enforce":
+		return SourceGuardEnforce, nil
+	}
+	return SourceGuardOff, fmt.Errorf("invalid anti-spoofing mode %q; expected off, log or enforce", s)
+}
+
+func (mode SourceGuardMode) String() string {
+	switch mode {
+	case SourceGuardLog:
+		return "log"
+	case SourceGuardEnforce:
+		return "enforce"
+	}
+	return "off"
+}
+
+type SourceViolation struct {
+	Time   time.Time
+	MAC    string
+	IP     string `json:",omitempty"`
+	Peer   string `json:",omitempty"` // for frames forwarded by other peers
+	Reason string
+}
+
+type SourceGuard struct {
+	sync.Mutex
+	router     *NetworkRouter
+	mode       SourceGuardMode
+	allocated  map[address.Address]string // allocated address -> container
+	macs       map[MAC]string             // bound MAC -> container
+	containers map[string]MAC             // container -> bound MAC
+	lookup     SourceMACLookup
+	lookups    map[string]time.Time // container -> when its MAC was last looked up
+	lastLogged map[MAC]time.Time
+	violations uint64
+	recent     []SourceViolation
+}
+
+func NewSourceGuard(router *NetworkRouter, mode SourceGuardMode) *SourceGuard {
+	guard := &SourceGuard{
+		router:     router,
+		mode:       mode,
+		allocated:  make(map[address.Address]string),
+		macs:       make(map[MAC]string),
+		containers: make(map[string]MAC),
+		lookups:    make(map[string]time.Time),
+		lastLogged: make(map[MAC]time.Time)}
+	time.AfterFunc(sourceGuardLogInterval, guard.expire)
+	return guard
+}
+
+// Forget when we last logged violations from MACs that have been
+// quiet for a while.
+func (guard *SourceGuard) expire() {
+	now := time.Now()
+	guard.Lock()
+	for mac, when := range guard.lastLogged {
+		if now.After(when.Add(sourceGuardLogInterval)) {
+			delete(guard.lastLogged, mac)
+		}
+	}
+	guard.Unlock()
+	time.AfterFunc(sourceGuardLogInterval, guard.expire)
+}
+
+// Without a lookup, only DHCP clients can be bound.
+func (guard *SourceGuard) SetMACLookup(lookup SourceMACLookup) {
+	guard.Lock()
+	guard.lookup = lookup
+	guard.Unlock()
+}
+
+// Replace the set of locally allocated addresses; called whenever
+// that changes.  Containers which no longer have any addresses lose
+// their MAC bindings.
+func (guard *SourceGuard) SetAllocations(allocated map[address.Address]string) {
+	guard.Lock()
+	defer guard.Unlock()
+	guard.allocated = allocated
+	remaining := make(map[string]struct{})
+	for addr, container := range allocated {
+		remaining[container] = struct{}{}
+		if _, found := guard.containers[container]; !found {
+			guard.lookUp(container, addr)
+		}
+	}
+	for container, mac := range guard.containers {
+		if _, found := remaining[container]; !found {
+			delete(guard.containers, container)
+			delete(guard.macs, mac)
+		}
+	}
+	for container := range guard.lookups {
+		if _, found := remaining[container]; !found {
+			delete(guard.lookups, container)
+		}
+	}
+}
+
+// Find out the MAC of a container, in the background as it may take
+// a while.  Must be called with the lock held.
+func (guard *SourceGuard) lookUp(container string, addr address.Address) {
+	if hw, err := net.ParseMAC(container); err == nil && len(hw) == len(MAC{}) {
+		var mac MAC
+		copy(mac[:], hw)
+		guard.bind(container, mac)
+		return
+	}
+	now := time.Now()
+	if guard.lookup == nil || now.Before(guard.lookups[container].Add(sourceGuardLookupInterval)) {
+		return
+	}
+	guard.lookups[container] = now
+	lookup := guard.lookup
+	go func() {
+		mac, err := lookup(container, addr)
+		guard.Lock()
+		defer guard.Unlock()
+		switch {
+		case err != nil:
+			log.Debug("Anti-spoofing: unable to find MAC of ", container, ": ", err)
+		case guard.allocated[addr] == container:
+			guard.bind(container, mac)
+		}
+	}()
+}
+
+// Must be called with the lock held.
+func (guard *SourceGuard) bind(container string, mac MAC) {
+	if old, found := guard.containers[container]; found {
+		if old == mac {
+			return
+		}
+		delete(guard.macs, old)
+	}
+	log.Println("Anti-spoofing: bound MAC", mac, "to container", container)
+	guard.containers[container] = mac
+	guard.macs[mac] = container
+}
+
+// Wrap the FlowOp for a locally captured frame so that the frame is
+// only passed on if its source addresses check out.
+func (guard *SourceGuard) capturedFlowOp(key PacketKey, fop FlowOp) FlowOp {
+	return inspectingFlowOp{inspect: func(frame []byte, dec *EthernetDecoder) FlowOp {
+		if guard.checkCaptured(key, dec) {
+			return fop
+		}
+		return nil
+	}}
+}
+
+// Returns false if the frame should be dropped.
+func (guard *SourceGuard) checkCaptured(key PacketKey, dec *EthernetDecoder) bool {
+	guard.Lock()
+	defer guard.Unlock()
+
+	switch {
+	case dec.isIPv4():
+		return guard.checkBinding(key.SrcMAC, address.FromIP4(dec.IP.SrcIP))
+	case dec.isARP():
+		arp := &dec.ARP
+		if len(arp.SourceHwAddress) != 6 || len(arp.SourceProtAddress) != 4 {
+			return guard.violation(key.SrcMAC, 0, "", "malformed ARP packet")
+		}
+		var arpMAC MAC
+		copy(arpMAC[:], arp.SourceHwAddress)
+		if arpMAC != key.SrcMAC {
+			return guard.violation(key.SrcMAC, 0, "", "ARP sender MAC "+arpMAC.String()+" differs from frame source")
+		}
+		return guard.checkBinding(key.SrcMAC, address.FromIP4(arp.SourceProtAddress))
+	case dec.isIPv6():
+		// Not allocated by IPAM, so there's nothing to check
+		return true
+	default:
+		// Other protocols carry no addresses we know about, so
+		// all we can do is insist on a known source.
+		if _, found := guard.macs[key.SrcMAC]; !found {
+			return guard.violation(key.SrcMAC, 0, "", "source MAC not bound to any container")
+		}
+		return true
+	}
+}
+
+func (guard *SourceGuard) checkBinding(mac MAC, ip address.Address) bool {
+	if ip == 0 {
+		// e.g. DHCP, or ARP probes
+		return true
+	}
+	container, allocated := guard.allocated[ip]
+	if !allocated {
+		return guard.violation(mac, ip, "", "source IP not allocated")
+	}
+	switch boundMAC, bound := guard.containers[container]; {
+	case !bound:
+		guard.lookUp(container, ip)
+		return guard.violation(mac, ip, "", "MAC of the container the source IP belongs to is not yet known")
+	case boundMAC != mac:
+		// The container may have been recreated, with a new MAC
+		guard.lookUp(container, ip)
+		return guard.violation(mac, ip, "", "source IP belongs to "+boundMAC.String())
+	}
+	return true
+}
+
+// Returns false if a frame from another peer claims the MAC of a
+// local container.
+func (guard *SourceGuard) checkForwarded(key ForwardPacketKey) bool {
+	guard.Lock()
+	defer guard.Unlock()
+	if _, found := guard.macs[key.SrcMAC]; found {
+		return guard.violation(key.SrcMAC, 0, key.SrcPeer.String(), "MAC belongs to a local container")
+	}
+	return true
+}
+
+// Record a violation, returning whether the frame should be allowed
+// through regardless.  Must be called with the lock held.
+func (guard *SourceGuard) violation(mac MAC, ip address.Address, peer string, reason string) bool {
+	now := time.Now()
+	guard.violations++
+	v := SourceViolation{Time: now, MAC: mac.String(), Peer: peer, Reason: reason}
+	if ip != 0 {
+		v.IP = ip.String()
+	}
+	if len(guard.recent) == sourceGuardRecentViolations {
+		guard.recent = append(guard.recent[:0], guard.recent[1:]...)
+	}
+	guard.recent = append(guard.recent, v)
+
+	if now.After(guard.lastLogged[mac].Add(sourceGuardLogInterval)) {
+		guard.lastLogged[mac] = now
+		msg := fmt.Sprint("Anti-spoofing: frame from ", mac)
+		if ip != 0 {
+			msg += fmt.Sprint(" with source IP ", ip)
+		}
+		if peer != "" {
+			msg += fmt.Sprint(" via peer ", peer)
+		}
+		log.Warning(msg, ": ", reason)
+	}
+	return guard.mode != SourceGuardEnforce
+}
+
+type SourceGuardStatus struct {
+	Mode       string
+	Bindings   int
+	Violations uint64
+	Recent     []SourceViolation
+}
+
+func newSourceGuardStatus(guard *SourceGuard) *SourceGuardStatus {
+	if guard == nil {
+		return nil
+	}
+	guard.Lock()
+	defer guard.Unlock()
+	return &SourceGuardStatus{
+		Mode:       guard.mode.String(),
+		Bindings:   len(guard.macs),
+		Violations: guard.violations,
+		Recent:     append([]SourceViolation(nil), guard.recent...)}
+}
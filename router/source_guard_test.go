@@ -0,0 +1,125 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func waitForBindings(t *testing.T, guard *SourceGuard, n int) {
+	for deadline := time.Now().Add(time.Second); newSourceGuardStatus(guard).Bindings != n; time.Sleep(time.Millisecond) {
+		require.True(t, time.Now().Before(deadline), "waiting for %d bindings", n)
+	}
+}
+
+func TestSourceGuard(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{AntiSpoofing: SourceGuardEnforce})
+	guard := router.SourceGuard
+	macs := map[string]MAC{
+		"c1": mustParseMAC(t, "02:00:00:00:00:01"),
+		"c2": mustParseMAC(t, "02:00:00:00:00:02"),
+		"c4": mustParseMAC(t, "02:00:00:00:00:04"),
+	}
+	dhcpMAC := mustParseMAC(t, "02:00:00:00:00:03")
+	attacker := mustParseMAC(t, "02:00:00:00:00:66")
+	release := make(chan struct{})
+	guard.SetMACLookup(func(ident string, addr address.Address) (MAC, error) {
+		if ident == "c4" {
+			<-release
+		}
+		if mac, found := macs[ident]; found {
+			return mac, nil
+		}
+		return MAC{}, fmt.Errorf("unknown container %s", ident)
+	})
+	guard.SetAllocations(map[address.Address]string{
+		ipAddr(t, "10.0.0.1"): "c1",
+		ipAddr(t, "10.0.0.2"): "c2",
+		ipAddr(t, "10.0.0.3"): dhcpMAC.String(),
+		ipAddr(t, "10.0.0.4"): "c4",
+	})
+	waitForBindings(t, guard, 3)
+
+	passes := func(frame []byte) bool {
+		return len(passFrame(frame, false, guard.capturedFlowOp)) == 1
+	}
+	udp := func(mac MAC, srcIP string) []byte {
+		return makeUDPFrame(t, mac, broadcastMAC, srcIP, "10.0.0.254", []byte("hello"))
+	}
+	arp := func(mac MAC, srcIP string) []byte {
+		return makeARPFrame(t, layers.ARPRequest, mac, srcIP, MAC{}, "10.0.0.254")
+	}
+
+	require.True(t, passes(udp(macs["c1"], "10.0.0.1")))
+	require.True(t, passes(arp(macs["c2"], "10.0.0.2")))
+	require.True(t, passes(udp(dhcpMAC, "10.0.0.3")), "DHCP client bound by its MAC")
+	require.True(t, passes(udp(macs["c1"], "0.0.0.0")), "unconfigured source")
+
+	require.False(t, passes(udp(attacker, "10.0.0.1")), "someone else's IP")
+	require.False(t, passes(udp(macs["c1"], "10.0.0.2")), "another container's IP")
+	require.False(t, passes(udp(macs["c1"], "10.0.0.9")), "unallocated IP")
+	require.False(t, passes(arp(attacker, "10.0.0.1")), "ARP claiming someone else's IP")
+	spoofedARP := arp(attacker, "10.0.0.1")
+	c1MAC := macs["c1"]
+	copy(spoofedARP[6:12], c1MAC[:]) // frame source differs from ARP sender
+	require.False(t, passes(spoofedARP), "ARP sender differing from frame source")
+
+	// Sending first doesn't get a MAC bound to a container: only
+	// the lookup does
+	require.False(t, passes(udp(attacker, "10.0.0.4")), "MAC not known yet")
+	close(release)
+	waitForBindings(t, guard, 4)
+	require.False(t, passes(udp(attacker, "10.0.0.4")), "after lookup")
+	require.True(t, passes(udp(macs["c4"], "10.0.0.4")))
+
+	// IPv6 isn't allocated by IPAM, so isn't checked
+	require.True(t, passes(makeUDPFrame(t, attacker, broadcastMAC, "fe80::1", "ff02::1", nil)))
+
+	// Other peers can't send from local containers' MACs
+	peer := addTestPeer(t, router, "00:00:00:00:00:02")
+	require.False(t, guard.checkForwarded(ForwardPacketKey{PacketKey: PacketKey{SrcMAC: macs["c1"]}, SrcPeer: peer}))
+	require.True(t, guard.checkForwarded(ForwardPacketKey{PacketKey: PacketKey{SrcMAC: attacker}, SrcPeer: peer}))
+
+	// Containers that lose their addresses lose their bindings
+	guard.SetAllocations(map[address.Address]string{ipAddr(t, "10.0.0.1"): "c1"})
+	waitForBindings(t, guard, 1)
+	require.False(t, passes(udp(macs["c2"], "10.0.0.2")))
+
+	status := newSourceGuardStatus(guard)
+	require.Equal(t, uint64(9), status.Violations)
+	require.Len(t, status.Recent, 9)
+}
+
+func TestSourceGuardLogOnly(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{AntiSpoofing: SourceGuardLog})
+	guard := router.SourceGuard
+	guard.SetAllocations(map[address.Address]string{ipAddr(t, "10.0.0.1"): "c1"})
+
+	frame := makeUDPFrame(t, mustParseMAC(t, "02:00:00:00:00:66"), broadcastMAC, "10.0.0.9", "10.0.0.254", nil)
+	require.Len(t, passFrame(frame, false, guard.capturedFlowOp), 1, "violations let through")
+	require.Equal(t, uint64(1), newSourceGuardStatus(guard).Violations)
+}
+
+func TestSourceGuardExpiry(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{AntiSpoofing: SourceGuardEnforce})
+	guard := router.SourceGuard
+	spoofer := mustParseMAC(t, "02:00:00:00:00:66")
+	frame := makeUDPFrame(t, spoofer, broadcastMAC, "10.0.0.9", "10.0.0.254", nil)
+	for i := 0; i < 10; i++ {
+		require.Empty(t, passFrame(frame, false, guard.capturedFlowOp))
+	}
+	guard.Lock()
+	require.Len(t, guard.lastLogged, 1, "logged once")
+	guard.lastLogged[spoofer] = time.Now().Add(-2 * sourceGuardLogInterval)
+	guard.Unlock()
+
+	guard.expire()
+	guard.Lock()
+	defer guard.Unlock()
+	require.Empty(t, guard.lastLogged)
+}
@@ -0,0 +1,173 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// Storm control: limit the rate at which broadcast, multicast and
+// unknown-unicast frames are relayed, both per source MAC and per
+// originating peer, so that a single misbehaving container cannot
+// flood the whole network.
+
+const (
+	// Token buckets refill at whole nanosecond intervals, so much
+	// higher rates could not be enforced
+	MaxStormControlRate = 1000000
+
+	stormControlIdleTimeout = time.Minute
+)
+
+type StormControlConfig struct {
+	MACRate  int // frames per second from any one source MAC; 0 for unlimited
+	PeerRate int // frames per second originating from any one peer; 0 for unlimited
+	Burst    int // number of frames allowed in a burst
+}
+
+func (config StormControlConfig) Enabled() bool {
+	return config.MACRate > 0 || config.PeerRate > 0
+}
+
+type stormBucket struct {
+	*mesh.TokenBucket
+	lastUsed time.Time
+	dropped  uint64 // since the bucket last ran dry
+	total    uint64
+}
+
+type stormControl struct {
+	sync.Mutex
+	config      StormControlConfig
+	macs        map[MAC]*stormBucket
+	peers       map[mesh.PeerName]*stormBucket
+	droppedMACs uint64
+	droppedPeer uint64
+}
+
+func newStormControl(config StormControlConfig) *stormControl {
+	if config.Burst <= 0 {
+		config.Burst = 1
+	}
+	sc := &stormControl{
+		config: config,
+		macs:   make(map[MAC]*stormBucket),
+		peers:  make(map[mesh.PeerName]*stormBucket)}
+	time.AfterFunc(stormControlIdleTimeout, sc.expire)
+	return sc
+}
+
+func (sc *stormControl) newBucket(rate int) *stormBucket {
+	return &stormBucket{TokenBucket: mesh.NewTokenBucket(int64(sc.config.Burst), time.Second/time.Duration(rate))}
+}
+
+// Returns false if a frame from the given MAC and peer should be
+// dropped.
+func (sc *stormControl) allow(mac MAC, peer *mesh.Peer) bool {
+	now := time.Now()
+	sc.Lock()
+	defer sc.Unlock()
+
+	if sc.config.MACRate > 0 {
+		bucket, found := sc.macs[mac]
+		if !found {
+			bucket = sc.newBucket(sc.config.MACRate)
+			sc.macs[mac] = bucket
+		}
+		if !bucket.take(now, "MAC "+mac.String()) {
+			sc.droppedMACs++
+			return false
+		}
+	}
+
+	if sc.config.PeerRate > 0 {
+		bucket, found := sc.peers[peer.Name]
+		if !found {
+			bucket = sc.newBucket(sc.config.PeerRate)
+			sc.peers[peer.Name] = bucket
+		}
+		if !bucket.take(now, "peer "+peer.String()) {
+			sc.droppedPeer++
+			return false
+		}
+	}
+
+	return true
+}
+
+func (bucket *stormBucket) take(now time.Time, source string) bool {
+	bucket.lastUsed = now
+	if !bucket.TryTake() {
+		if bucket.dropped == 0 {
+			log.Warning("Storm control: rate-limiting broadcast and unknown-unicast frames from ", source)
+		}
+		bucket.dropped++
+		bucket.total++
+		return false
+	}
+	if bucket.dropped > 0 {
+		log.Warning("Storm control: ", source, " back within limits after ", bucket.dropped, " frames dropped")
+		bucket.dropped = 0
+	}
+	return true
+}
+
+// Forget about sources that have been quiet for a while, so that the
+// tables don't grow without bound.
+func (sc *stormControl) expire() {
+	now := time.Now()
+	sc.Lock()
+	for mac, bucket := range sc.macs {
+		if now.Sub(bucket.lastUsed) > stormControlIdleTimeout {
+			delete(sc.macs, mac)
+		}
+	}
+	for name, bucket := range sc.peers {
+		if now.Sub(bucket.lastUsed) > stormControlIdleTimeout {
+			delete(sc.peers, name)
+		}
+	}
+	sc.Unlock()
+	time.AfterFunc(stormControlIdleTimeout, sc.expire)
+}
+
+type StormControlStatus struct {
+	MACRate        int
+	PeerRate       int
+	Burst          int
+	DroppedByMAC   uint64
+	DroppedByPeer  uint64
+	LimitedSources []StormSourceStatus
+}
+
+type StormSourceStatus struct {
+	Source   string
+	Dropped  uint64
+	LastSeen time.Time
+}
+
+func newStormControlStatus(sc *stormControl) *StormControlStatus {
+	if sc == nil {
+		return nil
+	}
+	sc.Lock()
+	defer sc.Unlock()
+	status := &StormControlStatus{
+		MACRate:       sc.config.MACRate,
+		PeerRate:      sc.config.PeerRate,
+		Burst:         sc.config.Burst,
+		DroppedByMAC:  sc.droppedMACs,
+		DroppedByPeer: sc.droppedPeer}
+	for mac, bucket := range sc.macs {
+		if bucket.total > 0 {
+			status.LimitedSources = append(status.LimitedSources, StormSourceStatus{mac.String(), bucket.total, bucket.lastUsed})
+		}
+	}
+	for name, bucket := range sc.peers {
+		if bucket.total > 0 {
+			status.LimitedSources = append(status.LimitedSources, StormSourceStatus{name.String(), bucket.total, bucket.lastUsed})
+		}
+	}
+	return status
+}
@@ -0,0 +1,127 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func broadcastFrame(t *testing.T, mac MAC) []byte {
+	return makeUDPFrame(t, mac, broadcastMAC, "10.0.0.1", "10.0.0.255", nil)
+}
+
+// The initial fill of a token bucket is rounded to a whole token
+// interval, so it may let one more frame through than the burst size.
+func requireBurst(t *testing.T, passed int, burst int) {
+	require.True(t, passed >= burst && passed <= burst+1, "%d frames let through a burst of %d", passed, burst)
+}
+
+func TestStormControlPerMAC(t *testing.T) {
+	router, bridge := newTestRouter(t, NetworkConfig{StormControl: StormControlConfig{MACRate: 1, Burst: 3}})
+	peer := addTestPeer(t, router, "00:00:00:00:00:02")
+	mac1 := mustParseMAC(t, "02:00:00:00:00:01")
+	mac2 := mustParseMAC(t, "02:00:00:00:00:02")
+
+	for i := 0; i < 10; i++ {
+		forwardFrame(router, peer, broadcastFrame(t, mac1))
+	}
+	passed := len(bridge.takeInjected())
+	requireBurst(t, passed, 3)
+
+	// Other MACs have limits of their own
+	forwardFrame(router, peer, broadcastFrame(t, mac2))
+	require.Len(t, bridge.takeInjected(), 1)
+
+	status := newStormControlStatus(router.storm)
+	require.Equal(t, uint64(10-passed), status.DroppedByMAC)
+	require.Equal(t, uint64(0), status.DroppedByPeer)
+	require.Len(t, status.LimitedSources, 1)
+	require.Equal(t, mac1.String(), status.LimitedSources[0].Source)
+}
+
+func TestStormControlPerPeer(t *testing.T) {
+	router, bridge := newTestRouter(t, NetworkConfig{StormControl: StormControlConfig{PeerRate: 1, Burst: 3}})
+	peer1 := addTestPeer(t, router, "00:00:00:00:00:02")
+	peer2 := addTestPeer(t, router, "00:00:00:00:00:03")
+
+	for i := 0; i < 10; i++ {
+		forwardFrame(router, peer1, broadcastFrame(t, MAC{0x02, 0, 0, 0, 0, byte(i + 1)}))
+	}
+	passed := len(bridge.takeInjected())
+	requireBurst(t, passed, 3)
+
+	// Other peers have limits of their own
+	forwardFrame(router, peer2, broadcastFrame(t, MAC{0x02, 0, 0, 0, 1, 1}))
+	require.Len(t, bridge.takeInjected(), 1)
+
+	status := newStormControlStatus(router.storm)
+	require.Equal(t, uint64(0), status.DroppedByMAC)
+	require.Equal(t, uint64(10-passed), status.DroppedByPeer)
+}
+
+func TestStormControlVetoesFlows(t *testing.T) {
+	router, bridge := newTestRouter(t, NetworkConfig{StormControl: StormControlConfig{MACRate: 1, Burst: 2}})
+	peer := addTestPeer(t, router, "00:00:00:00:00:02")
+	localMAC := mustParseMAC(t, "02:00:00:00:00:01")
+	remoteMAC := mustParseMAC(t, "02:00:00:00:00:02")
+
+	// Broadcasts that are let through must still come to us, so
+	// fastdp can't be allowed to create flows for them
+	passed := 0
+	for ; passed < 10; passed++ {
+		fop := captureFrame(router, broadcastFrame(t, localMAC))
+		if fop == FlowOp(vetoFlowCreationFlowOp{}) {
+			break // dropped
+		}
+		require.IsType(t, &MultiFlowOp{}, fop)
+		require.Equal(t, FlowOp(vetoFlowCreationFlowOp{}), fop.(*MultiFlowOp).ops[0])
+	}
+	requireBurst(t, passed, 2)
+
+	// Unicast frames for local MACs aren't limited, so flows for
+	// them are allowed
+	for i := 0; i < 3; i++ {
+		fop := forwardFrame(router, peer, makeUDPFrame(t, remoteMAC, localMAC, "10.0.0.2", "10.0.0.1", nil))
+		require.IsType(t, &recordingFlowOp{}, fop)
+	}
+	require.Len(t, bridge.takeInjected(), 3)
+}
+
+func TestStormControlExpiry(t *testing.T) {
+	router, bridge := newTestRouter(t, NetworkConfig{StormControl: StormControlConfig{MACRate: 1, PeerRate: 1, Burst: 1}})
+	peer := addTestPeer(t, router, "00:00:00:00:00:02")
+	mac := mustParseMAC(t, "02:00:00:00:00:01")
+
+	for i := 0; i < 3; i++ {
+		forwardFrame(router, peer, broadcastFrame(t, mac))
+	}
+	requireBurst(t, len(bridge.takeInjected()), 1)
+
+	sc := router.storm
+	sc.Lock()
+	require.Len(t, sc.macs, 1)
+	require.Len(t, sc.peers, 1)
+	for _, bucket := range sc.macs {
+		bucket.lastUsed = bucket.lastUsed.Add(-2 * stormControlIdleTimeout)
+	}
+	sc.Unlock()
+
+	// Only idle sources are forgotten
+	sc.expire()
+	sc.Lock()
+	require.Empty(t, sc.macs)
+	require.Len(t, sc.peers, 1)
+	for _, bucket := range sc.peers {
+		bucket.lastUsed = time.Now().Add(-2 * stormControlIdleTimeout)
+	}
+	sc.Unlock()
+	sc.expire()
+	sc.Lock()
+	require.Empty(t, sc.peers)
+	sc.Unlock()
+
+	// and start afresh, with a full bucket
+	forwardFrame(router, peer, broadcastFrame(t, mac))
+	require.Len(t, bridge.takeInjected(), 1)
+}
@@ -0,0 +1,264 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// The TCP overlay tunnels frames through the mesh's own TCP
+// connection between two peers, as control messages, so that weave
+// still works where UDP is blocked.  It gives up the batching, and
+// the freedom from head-of-line blocking, that the UDP based overlays
+// enjoy, so the OverlaySwitch should be given it last, and then it
+// is only used once the others have failed.  It needs no crypto of
+// its own, since the TCP connection is encrypted if so configured.
+//
+// Frames are queued for a per-connection goroutine to send, and when
+// the connection cannot keep up they are dropped, as they would be on
+// a congested link, rather than holding up the router.
+
+const (
+	tcpOverlayHello = iota // sent when the connection is confirmed
+	tcpOverlayFrame        // src peer, dst peer, network, frame
+
+	tcpOverlayFrameHeaderSize = NameSize + NameSize + 2
+
+	tcpOverlayQueueSize = 64
+
+	// The largest frame that fits into a mesh message, alongside
+	// the message tag, the OverlaySwitch's prefix, our header and
+	// the encryption overhead
+	tcpOverlayMaxFrameSize = mesh.MaxTCPMsgSize - 1 - switchControlPrefixSize - secretbox.Overhead - tcpOverlayFrameHeaderSize
+)
+
+// Buffers for queued messages, so that we don't allocate for every
+// frame
+var tcpOverlayBuffers = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+type TCPOverlay struct {
+	// These fields are set in StartConsumingPackets, and not
+	// subsequently modified
+	localPeer *mesh.Peer
+	peers     *mesh.Peers
+	consumer  OverlayConsumer
+}
+
+func NewTCPOverlay() NetworkOverlay {
+	return &TCPOverlay{}
+}
+
+func (overlay *TCPOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
+	overlay.localPeer = localPeer
+	overlay.peers = peers
+	overlay.consumer = consumer
+	return nil
+}
+
+func (*TCPOverlay) InvalidateRoutes() {
+	// no cached information, so nothing to do
+}
+
+func (*TCPOverlay) InvalidateShortIDs() {
+	// no cached information, so nothing to do
+}
+
+func (*TCPOverlay) AddFeaturesTo(map[string]string) {
+	// OverlaySwitch advertises us
+}
+
+func (*TCPOverlay) Diagnostics() interface{} {
+	return nil
+}
+
+func (overlay *TCPOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	fwd := &tcpForwarder{
+		overlay:         overlay,
+		remotePeer:      params.RemotePeer,
+		sendControlMsg:  params.SendControlMessage,
+		queue:           make(chan *[]byte, tcpOverlayQueueSize),
+		stopChan:        make(chan struct{}),
+		establishedChan: make(chan struct{}),
+		errorChan:       make(chan error, 1),
+	}
+	go fwd.run()
+	return fwd, nil
+}
+
+type tcpForwarder struct {
+	overlay         *TCPOverlay
+	remotePeer      *mesh.Peer
+	sendControlMsg  func(byte, []byte) error
+	queue           chan *[]byte
+	stopChan        chan struct{}
+	establishedChan chan struct{}
+	errorChan       chan error
+
+	lock        sync.Mutex
+	confirmed   bool
+	helloed     bool // have we heard from the other end?
+	established bool
+	stopped     bool
+}
+
+func (fwd *tcpForwarder) logPrefix() string {
+	return fmt.Sprintf("tcp ->[%s]: ", fwd.remotePeer)
+}
+
+func (fwd *tcpForwarder) Confirm() {
+	fwd.lock.Lock()
+	fwd.confirmed = true
+	fwd.checkEstablished()
+	fwd.lock.Unlock()
+	fwd.send(tcpOverlayHello, nil)
+}
+
+// Must be called with the lock held
+func (fwd *tcpForwarder) checkEstablished() {
+	if fwd.confirmed && fwd.helloed && !fwd.established && !fwd.stopped {
+		fwd.established = true
+		close(fwd.establishedChan)
+	}
+}
+
+func (fwd *tcpForwarder) EstablishedChannel() <-chan struct{} {
+	return fwd.establishedChan
+}
+
+func (fwd *tcpForwarder) ErrorChannel() <-chan error {
+	return fwd.errorChan
+}
+
+func (fwd *tcpForwarder) Stop() {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
+}
+
+func (fwd *tcpForwarder) DisplayName() string {
+	return "tcp"
+}
+
+func (fwd *tcpForwarder) send(tag byte, msg []byte) error {
+	err := fwd.sendControlMsg(tag, msg)
+	if err != nil {
+		select {
+		case fwd.errorChan <- err:
+		default:
+		}
+	}
+	return err
+}
+
+func (fwd *tcpForwarder) run() {
+	for {
+		select {
+		case buf := <-fwd.queue:
+			err := fwd.send(tcpOverlayFrame, *buf)
+			tcpOverlayBuffers.Put(buf)
+			if err != nil {
+				return
+			}
+
+		case <-fwd.stopChan:
+			return
+		}
+	}
+}
+
+func (fwd *tcpForwarder) Forward(key ForwardPacketKey) FlowOp {
+	fwd.lock.Lock()
+	usable := fwd.established && !fwd.stopped
+	fwd.lock.Unlock()
+	if !usable {
+		return nil
+	}
+	return tcpForwardOp{fwd: fwd, key: key}
+}
+
+type tcpForwardOp struct {
+	NonDiscardingFlowOp
+	fwd *tcpForwarder
+	key ForwardPacketKey
+}
+
+func (op tcpForwardOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	fwd := op.fwd
+	// Sending it would fail, and take the connection down with it
+	if len(frame) > tcpOverlayMaxFrameSize {
+		log.Print(fwd.logPrefix(), "Dropping too big frame during forwarding: frame len ", len(frame), ", limit ", tcpOverlayMaxFrameSize)
+		return
+	}
+
+	buf := tcpOverlayBuffers.Get().(*[]byte)
+	msg := append((*buf)[:0], op.key.SrcPeer.NameByte...)
+	msg = append(msg, op.key.DstPeer.NameByte...)
+	msg = append(msg, 0, 0)
+	binary.BigEndian.PutUint16(msg[2*NameSize:], uint16(op.key.Network))
+	*buf = append(msg, frame...)
+
+	select {
+	case fwd.queue <- buf:
+	default:
+		log.Debug(fwd.logPrefix(), "Dropping frame: send queue full")
+		tcpOverlayBuffers.Put(buf)
+	}
+}
+
+func (fwd *tcpForwarder) ControlMessage(tag byte, msg []byte) {
+	switch tag {
+	case tcpOverlayHello:
+		fwd.lock.Lock()
+		fwd.helloed = true
+		fwd.checkEstablished()
+		fwd.lock.Unlock()
+
+	case tcpOverlayFrame:
+		if len(msg) < tcpOverlayFrameHeaderSize {
+			log.Print(fwd.logPrefix(), "ignoring truncated frame")
+			return
+		}
+		fwd.handleFrame(msg)
+
+	default:
+		log.Print(fwd.logPrefix(), "Ignoring unknown control message tag: ", tag)
+	}
+}
+
+func (fwd *tcpForwarder) handleFrame(msg []byte) {
+	overlay := fwd.overlay
+	if overlay.consumer == nil {
+		return
+	}
+	srcPeer := overlay.peers.Fetch(mesh.PeerNameFromBin(msg[:NameSize]))
+	dstPeer := overlay.peers.Fetch(mesh.PeerNameFromBin(msg[NameSize : 2*NameSize]))
+	if srcPeer == nil || dstPeer == nil {
+		return
+	}
+	network := NetworkID(binary.BigEndian.Uint16(msg[2*NameSize:]))
+	frame := msg[tcpOverlayFrameHeaderSize:]
+
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	if len(dec.decoded) == 0 {
+		return
+	}
+	fop := overlay.consumer(ForwardPacketKey{
+		SrcPeer:   srcPeer,
+		DstPeer:   dstPeer,
+		Network:   network,
+		PacketKey: dec.PacketKey(),
+	})
+	if fop != nil {
+		fop.Process(frame, dec, false)
+	}
+}
@@ -0,0 +1,208 @@
+package router
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+type receivedFrame struct {
+	key   ForwardPacketKey
+	frame []byte
+}
+
+// A pair of TCP overlay forwarders between two peers, with the control
+// messages from the first delivered to the second through send
+type tcpOverlayPair struct {
+	sync.Mutex
+	fwd, remoteFwd *tcpForwarder
+	srcPeer        *mesh.Peer
+	dstPeer        *mesh.Peer
+	received       []receivedFrame
+}
+
+func newTCPOverlayPair(t *testing.T, send func(tag byte, deliver func())) *tcpOverlayPair {
+	router, _ := newTestRouter(t, NetworkConfig{})
+	pair := &tcpOverlayPair{srcPeer: router.Ourself.Peer, dstPeer: addTestPeer(t, router, "00:00:00:00:00:02")}
+
+	remoteOverlay := NewTCPOverlay()
+	remoteOverlay.StartConsumingPackets(pair.dstPeer, router.Peers, func(key ForwardPacketKey) FlowOp {
+		return &recordingFlowOp{record: func(frame []byte) {
+			pair.Lock()
+			pair.received = append(pair.received, receivedFrame{key, frame})
+			pair.Unlock()
+		}}
+	})
+	remoteConn, err := remoteOverlay.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer:         pair.srcPeer,
+		SendControlMessage: func(tag byte, msg []byte) error { return nil },
+	})
+	require.NoError(t, err)
+	pair.remoteFwd = remoteConn.(*tcpForwarder)
+
+	overlay := NewTCPOverlay()
+	overlay.StartConsumingPackets(pair.srcPeer, router.Peers, nil)
+	conn, err := overlay.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer: pair.dstPeer,
+		SendControlMessage: func(tag byte, msg []byte) error {
+			msg = append([]byte(nil), msg...)
+			send(tag, func() { pair.remoteFwd.ControlMessage(tag, msg) })
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	pair.fwd = conn.(*tcpForwarder)
+
+	pair.fwd.Confirm()
+	pair.fwd.ControlMessage(tcpOverlayHello, nil)
+	select {
+	case <-pair.fwd.EstablishedChannel():
+	case <-time.After(time.Second):
+		require.FailNow(t, "connection not established")
+	}
+	return pair
+}
+
+func (pair *tcpOverlayPair) forward(t *testing.T, network NetworkID, frame []byte) {
+	dec := decodeFrame(frame)
+	fop := pair.fwd.Forward(ForwardPacketKey{SrcPeer: pair.srcPeer, DstPeer: pair.dstPeer, Network: network, PacketKey: dec.PacketKey()})
+	require.NotNil(t, fop)
+	fop.Process(frame, dec, false)
+}
+
+func (pair *tcpOverlayPair) waitForFrames(t *testing.T, n int) []receivedFrame {
+	for i := 0; i < 100; i++ {
+		pair.Lock()
+		received := pair.received
+		pair.Unlock()
+		if len(received) >= n {
+			return received
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "frames not received")
+	return nil
+}
+
+func TestTCPOverlayForwarding(t *testing.T) {
+	pair := newTCPOverlayPair(t, func(tag byte, deliver func()) { deliver() })
+	defer pair.fwd.Stop()
+	mac1 := mustParseMAC(t, "02:00:00:00:00:01")
+	mac2 := mustParseMAC(t, "02:00:00:00:00:02")
+
+	frame1 := makeUDPFrame(t, mac1, mac2, "10.0.0.1", "10.0.0.2", []byte("one"))
+	frame2 := makeUDPFrame(t, mac2, mac1, "10.0.0.2", "10.0.0.1", []byte("two"))
+	pair.forward(t, DefaultNetwork, frame1)
+	pair.forward(t, NetworkID(3), frame2)
+
+	received := pair.waitForFrames(t, 2)
+	require.Len(t, received, 2)
+	require.Equal(t, frame1, received[0].frame)
+	require.Equal(t, DefaultNetwork, received[0].key.Network)
+	require.Equal(t, pair.srcPeer, received[0].key.SrcPeer)
+	require.Equal(t, pair.dstPeer, received[0].key.DstPeer)
+	require.Equal(t, PacketKey{SrcMAC: mac1, DstMAC: mac2}, received[0].key.PacketKey)
+	require.Equal(t, frame2, received[1].frame)
+	require.Equal(t, NetworkID(3), received[1].key.Network)
+
+	// Once stopped, the forwarder no longer accepts frames
+	pair.fwd.Stop()
+	require.Nil(t, pair.fwd.Forward(ForwardPacketKey{SrcPeer: pair.srcPeer, DstPeer: pair.dstPeer}))
+}
+
+func TestTCPOverlayQueueOverflow(t *testing.T) {
+	unblock := make(chan struct{})
+	pair := newTCPOverlayPair(t, func(tag byte, deliver func()) {
+		if tag == tcpOverlayFrame {
+			<-unblock
+		}
+		deliver()
+	})
+	defer pair.fwd.Stop()
+	mac1 := mustParseMAC(t, "02:00:00:00:00:01")
+	mac2 := mustParseMAC(t, "02:00:00:00:00:02")
+
+	// Sending the first frame blocks; frames beyond the queue
+	// size are dropped rather than holding us up
+	frame := makeUDPFrame(t, mac1, mac2, "10.0.0.1", "10.0.0.2", nil)
+	pair.forward(t, DefaultNetwork, frame)
+	for len(pair.fwd.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < tcpOverlayQueueSize+10; i++ {
+		pair.forward(t, DefaultNetwork, frame)
+	}
+	require.Len(t, pair.fwd.queue, tcpOverlayQueueSize)
+	close(unblock)
+	require.Len(t, pair.waitForFrames(t, tcpOverlayQueueSize+1), tcpOverlayQueueSize+1)
+	time.Sleep(50 * time.Millisecond)
+	pair.Lock()
+	require.Len(t, pair.received, tcpOverlayQueueSize+1)
+	pair.Unlock()
+}
+
+func TestTCPOverlayTooBigFrame(t *testing.T) {
+	pair := newTCPOverlayPair(t, func(tag byte, deliver func()) { deliver() })
+	defer pair.fwd.Stop()
+	mac1 := mustParseMAC(t, "02:00:00:00:00:01")
+	mac2 := mustParseMAC(t, "02:00:00:00:00:02")
+
+	frame := makeUDPFrame(t, mac1, mac2, "10.0.0.1", "10.0.0.2", nil)
+	frame = append(frame, make([]byte, tcpOverlayMaxFrameSize+1-len(frame))...)
+	pair.forward(t, DefaultNetwork, frame)
+	require.Len(t, pair.fwd.queue, 0)
+	select {
+	case err := <-pair.fwd.ErrorChannel():
+		require.FailNow(t, "unexpected error", "%v", err)
+	default:
+	}
+}
+
+func TestTCPOverlayMaxFrameSize(t *testing.T) {
+	router, _ := newTestRouter(t, NetworkConfig{})
+	srcPeer, dstPeer := router.Ourself.Peer, addTestPeer(t, router, "00:00:00:00:00:02")
+
+	// Frames go through the same layers as on a real connection:
+	// the OverlaySwitch's prefix, then the mesh's message tag,
+	// encryption and size check
+	tcpSender := mesh.NewEncryptedTCPSender(mesh.NewLengthPrefixTCPSender(ioutil.Discard), new([32]byte), true)
+	switchFwd := &overlaySwitchForwarder{params: mesh.OverlayConnectionParams{
+		SendControlMessage: func(tag byte, msg []byte) error {
+			return tcpSender.Send(append([]byte{tag}, msg...))
+		},
+	}}
+	sent := make(chan error, 1)
+	overlay := NewTCPOverlay()
+	overlay.StartConsumingPackets(srcPeer, router.Peers, nil)
+	conn, err := overlay.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer: dstPeer,
+		SendControlMessage: func(tag byte, msg []byte) error {
+			err := switchFwd.sendControlMessage(0, tag, msg)
+			if tag == tcpOverlayFrame {
+				sent <- err
+			}
+			return err
+		},
+	})
+	require.NoError(t, err)
+	fwd := conn.(*tcpForwarder)
+	defer fwd.Stop()
+	fwd.Confirm()
+	fwd.ControlMessage(tcpOverlayHello, nil)
+
+	frame := makeUDPFrame(t, mustParseMAC(t, "02:00:00:00:00:01"), mustParseMAC(t, "02:00:00:00:00:02"), "10.0.0.1", "10.0.0.2", nil)
+	frame = append(frame, make([]byte, tcpOverlayMaxFrameSize-len(frame))...)
+	dec := decodeFrame(frame)
+	fwd.Forward(ForwardPacketKey{SrcPeer: srcPeer, DstPeer: dstPeer, PacketKey: dec.PacketKey()}).Process(frame, dec, false)
+	select {
+	case err := <-sent:
+		require.NoError(t, err, "frame at the limit")
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "frame at the limit not sent")
+	}
+}
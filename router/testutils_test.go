@@ -0,0 +1,162 @@
+package router
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// Helpers for exercising a NetworkRouter's handling of frames without
+// a real bridge or overlay
+
+type nopPacketLogging struct{}
+
+func (nopPacketLogging) LogPacket(string, PacketKey)               {}
+func (nopPacketLogging) LogForwardPacket(string, ForwardPacketKey) {}
+
+// A bridge that records the frames injected into it
+type testBridge struct {
+	NullBridge
+	sync.Mutex
+	injected [][]byte
+}
+
+func (bridge *testBridge) InjectPacket(PacketKey) FlowOp {
+	return &recordingFlowOp{record: func(frame []byte) {
+		bridge.Lock()
+		bridge.injected = append(bridge.injected, frame)
+		bridge.Unlock()
+	}}
+}
+
+func (bridge *testBridge) takeInjected() [][]byte {
+	bridge.Lock()
+	defer bridge.Unlock()
+	injected := bridge.injected
+	bridge.injected = nil
+	return injected
+}
+
+// A FlowOp that keeps a copy of every frame it processes
+type recordingFlowOp struct {
+	NonDiscardingFlowOp
+	frames [][]byte
+	record func([]byte)
+}
+
+func (fop *recordingFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	frame = append([]byte(nil), frame...)
+	fop.frames = append(fop.frames, frame)
+	if fop.record != nil {
+		fop.record(frame)
+	}
+}
+
+// Pass a frame through the FlowOp that wrap puts in front of another,
+// as a feature does in front of the router's own forwarding, returning
+// the frames that got through to the latter
+func passFrame(frame []byte, broadcast bool, wrap func(PacketKey, FlowOp) FlowOp) [][]byte {
+	dec := decodeFrame(frame)
+	next := &recordingFlowOp{}
+	wrap(dec.PacketKey(), next).Process(frame, dec, broadcast)
+	return next.frames
+}
+
+// Feed a frame to the router as though captured on the bridge of the
+// default network, returning the FlowOp it chose
+func captureFrame(router *NetworkRouter, frame []byte) FlowOp {
+	dec := decodeFrame(frame)
+	fop := router.handleCapturedPacket(router.lookupNetworkByID(DefaultNetwork), dec.PacketKey())
+	fop.Process(frame, dec, false)
+	return fop
+}
+
+// Feed a frame to the router as though srcPeer had forwarded it to
+// us, returning the FlowOp it chose
+func forwardFrame(router *NetworkRouter, srcPeer *mesh.Peer, frame []byte) FlowOp {
+	dec := decodeFrame(frame)
+	fop := router.handleForwardedPacket(ForwardPacketKey{SrcPeer: srcPeer, DstPeer: router.Ourself.Peer, Network: DefaultNetwork, PacketKey: dec.PacketKey()})
+	fop.Process(frame, dec, true)
+	return fop
+}
+
+func peerName(t *testing.T, s string) mesh.PeerName {
+	name, err := mesh.PeerNameFromString(s)
+	require.NoError(t, err)
+	return name
+}
+
+func newTestRouter(t *testing.T, config NetworkConfig) (*NetworkRouter, *testBridge) {
+	bridge := &testBridge{}
+	config.Bridge = bridge
+	config.PacketLogging = nopPacketLogging{}
+	return NewNetworkRouter(mesh.Config{}, config, peerName(t, "00:00:00:00:00:01"), "test", nil), bridge
+}
+
+// Make a remote peer known to the router
+func addTestPeer(t *testing.T, router *NetworkRouter, name string) *mesh.Peer {
+	return router.Peers.FetchWithDefault(mesh.NewPeer(peerName(t, name), "", 0, 0, 0))
+}
+
+func mustParseMAC(t *testing.T, s string) MAC {
+	hw, err := net.ParseMAC(s)
+	require.NoError(t, err)
+	var mac MAC
+	copy(mac[:], hw)
+	return mac
+}
+
+func serializeFrame(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...))
+	return buf.Bytes()
+}
+
+func decodeFrame(frame []byte) *EthernetDecoder {
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	return dec
+}
+
+func makeARPFrame(t *testing.T, op uint16, srcMAC MAC, srcIP string, dstMAC MAC, dstIP string) []byte {
+	ethDst := dstMAC
+	if op == layers.ARPRequest {
+		ethDst = broadcastMAC
+	}
+	return serializeFrame(t,
+		&layers.Ethernet{SrcMAC: srcMAC[:], DstMAC: ethDst[:], EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         op,
+			SourceHwAddress:   srcMAC[:],
+			SourceProtAddress: net.ParseIP(srcIP).To4(),
+			DstHwAddress:      dstMAC[:],
+			DstProtAddress:    net.ParseIP(dstIP).To4()})
+}
+
+func makeUDPFrame(t *testing.T, srcMAC MAC, dstMAC MAC, srcIP, dstIP string, payload []byte) []byte {
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 5678}
+	var ip gopacket.SerializableLayer
+	ethType := layers.EthernetTypeIPv4
+	if src := net.ParseIP(srcIP); src.To4() != nil {
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src.To4(), DstIP: net.ParseIP(dstIP).To4()}
+		udp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	} else {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: src, DstIP: net.ParseIP(dstIP)}
+		udp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+		ethType = layers.EthernetTypeIPv6
+	}
+	return serializeFrame(t, &layers.Ethernet{SrcMAC: srcMAC[:], DstMAC: dstMAC[:], EthernetType: ethType},
+		ip, udp, gopacket.Payload(payload))
+}